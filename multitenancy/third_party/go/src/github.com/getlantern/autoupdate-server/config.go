@@ -5,6 +5,8 @@ import (
 )
 
 const (
-	githubRefreshTime     = time.Minute * 30
-	localPatchesDirectory = "./patches/"
+	githubRefreshTime = time.Minute * 30
+
+	// Polling interval when releases are refreshed on webhooks.
+	githubWebhookRefreshTime = time.Hour * 6
 )
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
+	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/getlantern/autoupdate-server/server"
@@ -13,10 +17,25 @@ import (
 
 var (
 	flagPrivateKey         = flag.String("k", "", "Path to private key.")
-	flagLocalAddr          = flag.String("l", ":6868", "Local bind address.")
+	flagKeyID              = flag.String("kid", "", "ID of the private key, sent along signatures so clients know which public key to verify them with.")
+	flagLocalAddr          = flag.String("l", ":6868", "Local bind address, use unix:///path/to/socket for a Unix socket.")
 	flagPublicAddr         = flag.String("p", "http://127.0.0.1:6868/", "Public address.")
 	flagGithubOrganization = flag.String("o", "getlantern", "Github organization.")
 	flagGithubProject      = flag.String("n", "lantern", "Github project name.")
+	flagGithubToken        = flag.String("t", os.Getenv("GITHUB_TOKEN"), "Github access token.")
+	flagGithubAPI          = flag.String("a", "", "Github API base URL (for Github Enterprise).")
+	flagGitLabURL          = flag.String("g", "", "GitLab base URL, releases of the -o/-n project are listed from there instead of Github.")
+	flagGitLabToken        = flag.String("gt", os.Getenv("GITLAB_TOKEN"), "GitLab access token.")
+	flagWebhookSecret      = flag.String("w", os.Getenv("GITHUB_WEBHOOK_SECRET"), "Github webhook secret, releases are refreshed on /webhook and polled less often.")
+	flagStorageDir         = flag.String("s", "", "Directory to keep assets and patches in across restarts, so updates are served while Github is down.")
+	flagS3Bucket           = flag.String("s3", "", "S3 bucket clients download patches from, also keeping assets and patches across restarts unless -s is given. Credentials are read from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN.")
+	flagS3Endpoint         = flag.String("s3-endpoint", "https://s3.amazonaws.com", "S3 endpoint, for S3 compatible services.")
+	flagS3Region           = flag.String("s3-region", "us-east-1", "S3 region.")
+	flagS3Prefix           = flag.String("s3-prefix", "", "Key prefix of the objects in the S3 bucket.")
+	flagS3PathStyle        = flag.Bool("s3-path-style", false, "Address the S3 bucket in the request path, as most S3 compatible services want.")
+	flagS3PublicURL        = flag.String("s3-url", "", "Public URL of the S3 bucket, patch URLs are presigned otherwise.")
+	flagValidate           = flag.String("validate", "", "Tag of a release to validate rather than serve, a JSON report is printed and the exit status is 1 if it fails.")
+	flagValidateAll        = flag.Bool("validate-all", false, "Patch every platform with -validate, rather than one.")
 	flagHelp               = flag.Bool("h", false, "Shows help.")
 )
 
@@ -25,7 +44,28 @@ var (
 	releaseManager *server.ReleaseManager
 )
 
-type updateHandler struct {
+// validateRelease prints the JSON report of ValidateRelease for the release of
+// the given tag, returning the exit status.
+func validateRelease(tag string, all bool) int {
+	patches := server.ValidatePatchSample
+	if all {
+		patches = server.ValidatePatchAll
+	}
+	report, err := releaseManager.ValidateReleaseContext(context.Background(), tag, patches)
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+	content, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+	os.Stdout.Write(append(content, '\n'))
+	if !report.Passed {
+		return 1
+	}
+	return 0
 }
 
 // updateAssets checks for new assets released on the github releases page.
@@ -37,104 +77,142 @@ func updateAssets() error {
 	return nil
 }
 
-// backgroundUpdate periodically looks for releases.
-func backgroundUpdate() {
-	for {
-		time.Sleep(githubRefreshTime)
-		// Updating assets...
-		if err := updateAssets(); err != nil {
-			log.Debugf("updateAssets: %s", err)
-		}
-	}
-}
-
-func (u *updateHandler) closeWithStatus(w http.ResponseWriter, status int) {
-	w.WriteHeader(status)
-	w.Write([]byte(http.StatusText(status)))
-}
-
-func (u *updateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	var err error
-	var res *server.Result
-
-	if r.Method == "POST" {
-		defer r.Body.Close()
-
-		var params server.Params
-		decoder := json.NewDecoder(r.Body)
-
-		if err = decoder.Decode(&params); err != nil {
-			u.closeWithStatus(w, http.StatusBadRequest)
-			return
-		}
-
-		if res, err = releaseManager.CheckForUpdate(&params); err != nil {
-			log.Debugf("CheckForUpdate failed with error: %q", err)
-			if err == server.ErrNoUpdateAvailable {
-				u.closeWithStatus(w, http.StatusNoContent)
-			}
-			u.closeWithStatus(w, http.StatusExpectationFailed)
-			return
-		}
-
-		if res.PatchURL != "" {
-			res.PatchURL = *flagPublicAddr + res.PatchURL
-		}
-
-		var content []byte
-
-		if content, err = json.Marshal(res); err != nil {
-			u.closeWithStatus(w, http.StatusInternalServerError)
-			return
-		}
-
-		w.WriteHeader(http.StatusOK)
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(content)
-		return
-	}
-	u.closeWithStatus(w, http.StatusNotFound)
-	return
-}
-
 func main() {
 
 	// Parsing flags
 	flag.Parse()
 
-	if *flagHelp || *flagPrivateKey == "" {
+	if *flagHelp {
 		flag.Usage()
 		os.Exit(0)
 	}
+	if *flagPrivateKey == "" {
+		fmt.Fprintln(os.Stderr, "Missing -k, the path to the private key.")
+		flag.Usage()
+		os.Exit(2)
+	}
 
 	server.SetPrivateKey(*flagPrivateKey)
 
+	// A bad key must stop us now rather than at the first signature.
+	key, err := server.LoadSigningKey(*flagKeyID, *flagPrivateKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// Creating release manager.
 	log.Debug("Starting release manager.")
-	releaseManager = server.NewReleaseManager(*flagGithubOrganization, *flagGithubProject)
+	opts := []server.Option{
+		server.WithWebhookSecret(*flagWebhookSecret),
+		server.WithSigningKeys(key),
+	}
+	if *flagGitLabURL != "" {
+		provider, err := server.NewGitLabProvider(*flagGitLabURL, *flagGithubOrganization+"/"+*flagGithubProject, server.WithGitLabToken(*flagGitLabToken))
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, server.WithReleaseProvider(provider))
+	} else {
+		opts = append(opts, server.WithToken(*flagGithubToken), server.WithBaseURL(*flagGithubAPI))
+	}
+	if *flagStorageDir != "" {
+		storage, err := server.NewFileStorage(*flagStorageDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, server.WithStorage(storage))
+	}
+	if *flagS3Bucket != "" {
+		s3opts := []server.S3Option{
+			server.WithS3Credentials(os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"), os.Getenv("AWS_SESSION_TOKEN")),
+			server.WithS3Prefix(*flagS3Prefix),
+		}
+		if *flagS3PathStyle {
+			s3opts = append(s3opts, server.WithS3PathStyle())
+		}
+		if *flagS3PublicURL != "" {
+			s3opts = append(s3opts, server.WithS3PublicURL(*flagS3PublicURL))
+		}
+		store, err := server.NewS3Store(*flagS3Endpoint, *flagS3Region, *flagS3Bucket, s3opts...)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, server.WithAssetStore(store))
+		if *flagStorageDir == "" {
+			opts = append(opts, server.WithStorage(store))
+		}
+	}
+	releaseManager = server.NewReleaseManager(*flagGithubOrganization, *flagGithubProject, opts...)
 	// Getting assets...
 	if err := updateAssets(); err != nil {
-		// In this case we will not be able to continue.
-		log.Fatal(err)
+		if since := releaseManager.StaleSince(); !since.IsZero() {
+			log.Errorf("Could not update assets, serving the ones stored at %v: %q", since, err)
+		} else {
+			// In this case we will not be able to continue.
+			log.Fatal(err)
+		}
+	}
+
+	if *flagValidate != "" {
+		os.Exit(validateRelease(*flagValidate, *flagValidateAll))
 	}
 
-	// Setting a goroutine for pulling updates periodically
-	go backgroundUpdate()
+	// Pulling updates periodically, webhooks make polling a mere fallback.
+	refreshTime := githubRefreshTime
+	if *flagWebhookSecret != "" {
+		refreshTime = githubWebhookRefreshTime
+	}
+	releaseManager.StartAutoUpdate(refreshTime, func(err error) {
+		log.Debugf("updateAssets: %s", err)
+	})
 
 	mux := http.NewServeMux()
 
-	mux.Handle("/update", new(updateHandler))
-	mux.Handle("/patches/", http.StripPrefix("/patches/", http.FileServer(http.Dir(localPatchesDirectory))))
+	updates := server.NewHandler(releaseManager, *flagPublicAddr)
+	mux.Handle("/update", updates)
+	mux.Handle("/patches/", updates)
+	mux.Handle("/manifest/", updates)
+	mux.Handle("/assets/", updates)
+	mux.Handle("/aux/", http.StripPrefix("/aux/", server.NewAuxHandler(releaseManager)))
+	mux.Handle("/releases/", http.StripPrefix("/releases/", server.NewReleasesHandler(releaseManager)))
+	mux.Handle("/admin/rollout", server.NewRolloutHandler(releaseManager))
+	mux.Handle("/admin/pins", server.NewPinsHandler(releaseManager))
+	mux.Handle("/admin/inventory", server.NewInventoryHandler(releaseManager))
+	mux.Handle("/health", server.NewHealthHandler(releaseManager))
+	if *flagWebhookSecret != "" {
+		mux.HandleFunc("/webhook", releaseManager.RefreshOnWebhook)
+	}
 
-	srv := http.Server{
+	srv := &server.Server{
 		Addr:    *flagLocalAddr,
 		Handler: mux,
 	}
 
+	// Shutting down on signals so the socket file is cleaned up.
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-sig
+		log.Debug("Shutting down HTTP server.")
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Errorf("Shutdown: %q", err)
+		}
+		// Patches still being generated are left unfinished past the
+		// deadline, rather than truncated.
+		if err := releaseManager.Close(ctx); err != nil {
+			log.Errorf("Close: %q", err)
+		}
+	}()
+
 	log.Debugf("Starting up HTTP server at %s.", *flagLocalAddr)
 
 	if err := srv.ListenAndServe(); err != nil {
-		log.Fatalf("ListenAndServe: ", err)
+		log.Fatalf("ListenAndServe: %q", err)
 	}
+	<-stopped
 
 }
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/getlantern/autoupdate-server/server"
+)
+
+const testMigrationURL = "https://example.com/macos-32bit"
+
+func TestUpdateHandlerPlatformEOL(t *testing.T) {
+	releaseManager = server.NewReleaseManager("getlantern", "autoupdate-server")
+	releaseManager.SetPlatformEOL("darwin", "386", testMigrationURL)
+
+	params := &server.Params{
+		AppVersion: "1.0.0",
+		OS:         "darwin",
+		Arch:       "386",
+		Checksum:   "abc",
+	}
+	_, err := releaseManager.CheckForUpdate(params)
+	if _, ok := err.(*server.PlatformEOLError); !ok {
+		t.Fatalf("Expecting a *PlatformEOLError, got %q", err)
+	}
+	if !errors.Is(err, server.ErrPlatformEOL) {
+		t.Fatal("Expecting the error to match ErrPlatformEOL.")
+	}
+
+	body := `{"app_version": "1.0.0", "checksum": "abc", "tags": {"os": "darwin", "arch": "386"}}`
+	req := httptest.NewRequest("POST", "/update", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	server.NewUpdateHandler(releaseManager, *flagPublicAddr).ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusUpgradeRequired {
+		t.Fatalf("Expecting status %d, got %d", http.StatusUpgradeRequired, rec.Code)
+	}
+	content, _ := ioutil.ReadAll(rec.Body)
+	if !strings.Contains(string(content), testMigrationURL) {
+		t.Fatalf("Expecting the migration URL in the body, got %q", content)
+	}
+}
+
+func TestUpdateHandlerOverUnixSocket(t *testing.T) {
+	releaseManager = server.NewReleaseManager("getlantern", "autoupdate-server")
+	releaseManager.SetPlatformEOL("darwin", "386", testMigrationURL)
+
+	dir, err := ioutil.TempDir("", "autoupdate-socket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "autoupdate.sock")
+	srv := &server.Server{Addr: "unix://" + socket, Handler: server.NewUpdateHandler(releaseManager, *flagPublicAddr)}
+	l, err := srv.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- srv.Serve(l) }()
+
+	fi, err := os.Stat(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0660 {
+		t.Fatalf("Expecting socket mode 0660, got %v", fi.Mode().Perm())
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return new(net.Dialer).DialContext(ctx, "unix", socket)
+		},
+	}}
+	body := `{"app_version": "1.0.0", "checksum": "abc", "tags": {"os": "darwin", "arch": "386"}}`
+	res, err := client.Post("http://autoupdate/update", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusUpgradeRequired {
+		t.Fatalf("Expecting status %d, got %d", http.StatusUpgradeRequired, res.StatusCode)
+	}
+
+	if err = srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(socket); !os.IsNotExist(err) {
+		t.Fatal("Expecting the socket file to be removed on shutdown.")
+	}
+}
@@ -0,0 +1,266 @@
+package server
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Hours of the sliding window adoption is counted over.
+	adoptionBuckets = 24
+
+	// Number of shards of the adoption counters, spreading the locks taken
+	// by update checks of versions seen for the first time.
+	adoptionShards = 16
+
+	// Versions and platforms tracked by WithAdoption when given no limit.
+	defaultAdoptionVersions = 256
+
+	// An adoption bucket holds the hour it counts, modulo 2^24, in its high
+	// bits and the count in the others.
+	adoptionCountBits = 40
+	adoptionCountMask = 1<<adoptionCountBits - 1
+)
+
+// AdoptionOther is the version the checks of versions past the limit of
+// WithAdoption are counted under, along with those that are not semantic
+// versions.
+const AdoptionOther = "other"
+
+// WithAdoption counts the update checks by app version and platform over the
+// last 24 hours, see ReleaseManager.Adoption. At most maxVersions versions and
+// platforms are tracked, the checks of the others go to AdoptionOther until
+// tracked ones go a whole window without any. Zero or less tracks 256. Without
+// it, the default, nothing is counted.
+func WithAdoption(maxVersions int) Option {
+	return func(g *ReleaseManager) {
+		g.adoption = newAdoption(maxVersions)
+	}
+}
+
+// Adoption counts update checks by app version and platform over a sliding
+// window of 24 hours, hour by hour. It is safe for concurrent use, checks from
+// versions already tracked only take the read lock of their shard.
+type Adoption struct {
+	shards      [adoptionShards]adoptionShard
+	other       adoptionCounter
+	maxVersions int64
+	tracked     int64 // keys in the shards
+	pruned      int64 // hour of the last prune
+	now         func() time.Time
+}
+
+type adoptionShard struct {
+	mu       sync.RWMutex
+	counters map[adoptionKey]*adoptionCounter
+}
+
+type adoptionKey struct {
+	version string
+	os      string
+	arch    string
+}
+
+// adoptionCounter counts checks by hour of the window. Moving a bucket to the
+// hour it counts for and counting are a single compare and swap.
+type adoptionCounter struct {
+	buckets [adoptionBuckets]uint64
+}
+
+// AdoptionCount is the number of update checks from a version and platform.
+type AdoptionCount struct {
+	Version string `json:"version"`
+	OS      string `json:"os,omitempty"`
+	Arch    string `json:"arch,omitempty"`
+	Checks  int64  `json:"checks"` // over the window
+	// Hourly holds the checks of each hour of the window, the current one
+	// last.
+	Hourly []int64 `json:"hourly"`
+}
+
+// AdoptionSnapshot is a copy of the counts of an Adoption.
+type AdoptionSnapshot struct {
+	Window   time.Duration   `json:"window"`
+	Versions []AdoptionCount `json:"versions"` // by decreasing checks
+	Other    AdoptionCount   `json:"other"`
+}
+
+func newAdoption(maxVersions int) *Adoption {
+	if maxVersions <= 0 {
+		maxVersions = defaultAdoptionVersions
+	}
+	a := &Adoption{maxVersions: int64(maxVersions), now: time.Now}
+	for i := range a.shards {
+		a.shards[i].counters = make(map[adoptionKey]*adoptionCounter)
+	}
+	return a
+}
+
+// Adoption returns the counts of update checks by version and platform, nil
+// without WithAdoption.
+func (g *ReleaseManager) Adoption() *Adoption {
+	return g.adoption
+}
+
+// hour returns the current hour since the epoch.
+func (a *Adoption) hour() int64 {
+	return a.now().Unix() / int64(time.Hour/time.Second)
+}
+
+// record counts a check from the given version and platform.
+func (a *Adoption) record(version string, os string, arch string) {
+	hour := a.hour()
+	if version == AdoptionOther {
+		a.other.add(hour)
+		return
+	}
+
+	key := adoptionKey{version: version, os: os, arch: arch}
+	shard := &a.shards[adoptionHash(key)%adoptionShards]
+	shard.mu.RLock()
+	c := shard.counters[key]
+	shard.mu.RUnlock()
+	if c == nil {
+		if c = a.track(shard, key, hour); c == nil {
+			a.other.add(hour)
+			return
+		}
+	}
+	c.add(hour)
+}
+
+// track returns the counter of key, nil if there is no room left for it.
+func (a *Adoption) track(shard *adoptionShard, key adoptionKey, hour int64) *adoptionCounter {
+	if atomic.LoadInt64(&a.tracked) >= a.maxVersions {
+		a.prune(hour)
+	}
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if c := shard.counters[key]; c != nil {
+		return c
+	}
+	if atomic.AddInt64(&a.tracked, 1) > a.maxVersions {
+		atomic.AddInt64(&a.tracked, -1)
+		return nil
+	}
+	c := new(adoptionCounter)
+	shard.counters[key] = c
+	return c
+}
+
+// prune stops tracking the versions and platforms with no check over the
+// window, at most once an hour.
+func (a *Adoption) prune(hour int64) {
+	last := atomic.LoadInt64(&a.pruned)
+	if last == hour || !atomic.CompareAndSwapInt64(&a.pruned, last, hour) {
+		return
+	}
+	for i := range a.shards {
+		shard := &a.shards[i]
+		shard.mu.Lock()
+		for key, c := range shard.counters {
+			if c.count(hour) == 0 {
+				delete(shard.counters, key)
+				atomic.AddInt64(&a.tracked, -1)
+			}
+		}
+		shard.mu.Unlock()
+	}
+}
+
+// Snapshot returns the counts of the versions and platforms checked over the
+// window, along with those counted as AdoptionOther.
+func (a *Adoption) Snapshot() AdoptionSnapshot {
+	hour := a.hour()
+	snapshot := AdoptionSnapshot{
+		Window:   adoptionBuckets * time.Hour,
+		Versions: []AdoptionCount{},
+		Other:    a.other.snapshot(AdoptionOther, "", "", hour),
+	}
+	for i := range a.shards {
+		shard := &a.shards[i]
+		shard.mu.RLock()
+		for key, c := range shard.counters {
+			if count := c.snapshot(key.version, key.os, key.arch, hour); count.Checks > 0 {
+				snapshot.Versions = append(snapshot.Versions, count)
+			}
+		}
+		shard.mu.RUnlock()
+	}
+	sort.Slice(snapshot.Versions, func(i, j int) bool {
+		x, y := snapshot.Versions[i], snapshot.Versions[j]
+		if x.Checks != y.Checks {
+			return x.Checks > y.Checks
+		}
+		if x.Version != y.Version {
+			return x.Version < y.Version
+		}
+		if x.OS != y.OS {
+			return x.OS < y.OS
+		}
+		return x.Arch < y.Arch
+	})
+	return snapshot
+}
+
+// add counts a check in the given hour.
+func (c *adoptionCounter) add(hour int64) {
+	b := &c.buckets[hour%adoptionBuckets]
+	tag := uint64(hour) << adoptionCountBits
+	for {
+		old := atomic.LoadUint64(b)
+		next := tag | 1
+		if old&^adoptionCountMask == tag {
+			next = old + 1
+		}
+		if atomic.CompareAndSwapUint64(b, old, next) {
+			return
+		}
+	}
+}
+
+// hourly returns the checks counted in each hour of the window ending at
+// hour, oldest first.
+func (c *adoptionCounter) hourly(hour int64) []int64 {
+	counts := make([]int64, adoptionBuckets)
+	for i := range counts {
+		h := hour - adoptionBuckets + 1 + int64(i)
+		v := atomic.LoadUint64(&c.buckets[h%adoptionBuckets])
+		if v&^adoptionCountMask == uint64(h)<<adoptionCountBits {
+			counts[i] = int64(v & adoptionCountMask)
+		}
+	}
+	return counts
+}
+
+// count returns the checks counted over the window ending at hour.
+func (c *adoptionCounter) count(hour int64) int64 {
+	var n int64
+	for _, count := range c.hourly(hour) {
+		n += count
+	}
+	return n
+}
+
+func (c *adoptionCounter) snapshot(version string, os string, arch string, hour int64) AdoptionCount {
+	count := AdoptionCount{Version: version, OS: os, Arch: arch, Hourly: c.hourly(hour)}
+	for _, n := range count.Hourly {
+		count.Checks += n
+	}
+	return count
+}
+
+// adoptionHash is the FNV-1a hash of key, picking its shard.
+func adoptionHash(key adoptionKey) uint32 {
+	h := uint32(2166136261)
+	for _, s := range [...]string{key.version, key.os, key.arch} {
+		for i := 0; i < len(s); i++ {
+			h ^= uint32(s[i])
+			h *= 16777619
+		}
+	}
+	return h
+}
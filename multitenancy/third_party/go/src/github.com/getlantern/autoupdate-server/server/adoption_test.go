@@ -0,0 +1,86 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/blang/semver"
+)
+
+func TestAdoption(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+	a := newAdoption(2)
+	a.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		a.record("1.0.0", OS.Linux, Arch.X64)
+	}
+	a.record("1.1.0", OS.Windows, Arch.X86)
+	// Past the limit.
+	a.record("1.2.0", OS.Linux, Arch.X64)
+	a.record(AdoptionOther, OS.Linux, Arch.X64)
+
+	s := a.Snapshot()
+	if len(s.Versions) != 2 || s.Versions[0].Version != "1.0.0" || s.Versions[0].Checks != 3 || s.Versions[1].Version != "1.1.0" || s.Versions[1].Checks != 1 {
+		t.Fatalf("Expecting 1.0.0 and 1.1.0 to be counted, got %+v", s.Versions)
+	}
+	if s.Other.Checks != 2 {
+		t.Fatalf("Expecting 2 other checks, got %d", s.Other.Checks)
+	}
+
+	now = now.Add(time.Hour)
+	a.record("1.0.0", OS.Linux, Arch.X64)
+	hourly := a.Snapshot().Versions[0].Hourly
+	if len(hourly) != adoptionBuckets || hourly[adoptionBuckets-2] != 3 || hourly[adoptionBuckets-1] != 1 {
+		t.Fatalf("Expecting 3 checks an hour ago and 1 now, got %v", hourly)
+	}
+
+	// Counts leave the window, making room for other versions.
+	now = now.Add(adoptionBuckets * time.Hour)
+	a.record("1.2.0", OS.Linux, Arch.X64)
+	s = a.Snapshot()
+	if len(s.Versions) != 1 || s.Versions[0].Version != "1.2.0" || s.Versions[0].Checks != 1 || s.Other.Checks != 0 {
+		t.Fatalf("Expecting only the check of 1.2.0 in the window, got %+v", s)
+	}
+
+	if allocs := testing.AllocsPerRun(100, func() { a.record("1.2.0", OS.Linux, Arch.X64) }); allocs != 0 {
+		t.Fatalf("Expecting counting a tracked version not to allocate, got %v allocations", allocs)
+	}
+}
+
+func TestAdoptionHandler(t *testing.T) {
+	g, _ := newTestMemoryManager(t)
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	NewAdoptionHandler(g).ServeHTTP(rec, httptest.NewRequest("GET", "/admin/adoption", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("Expecting 404 without WithAdoption, got %d", rec.Code)
+	}
+
+	WithAdoption(0)(g)
+	for _, version := range []string{"1.0.0", "1.0.0", "1.1.0"} {
+		if _, err := g.CheckForUpdate(&Params{
+			AppVersion: version,
+			OS:         OS.Linux,
+			Arch:       Arch.X64,
+			Checksum:   g.assetOfVersion(OS.Linux, Arch.X64, semver.MustParse(version)).Checksum,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	NewAdoptionHandler(g).ServeHTTP(rec, httptest.NewRequest("GET", "/admin/adoption", nil))
+	var s AdoptionSnapshot
+	if err := json.NewDecoder(rec.Body).Decode(&s); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Versions) != 2 || s.Versions[0].Version != "1.0.0" || s.Versions[0].Checks != 2 || s.Versions[0].OS != OS.Linux || s.Versions[1].Checks != 1 {
+		t.Fatalf("Expecting the checks of 1.0.0 and 1.1.0 to be counted, got %+v", s.Versions)
+	}
+}
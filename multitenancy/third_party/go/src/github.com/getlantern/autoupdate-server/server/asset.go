@@ -1,12 +1,21 @@
 package server
 
 import (
+	"context"
 	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 )
 
 const (
@@ -16,13 +25,105 @@ const (
 func init() {
 	err := os.MkdirAll(assetsDirectory, os.ModeDir|0700)
 	if err != nil {
-		log.Fatalf("Could not create directory for storing assets: %q", err)
+		// Read-only working directories are fine with SetDownloadDir.
+		log.Errorf("Could not create directory for storing assets: %q", err)
 	}
 }
 
+// fileSize returns the size in bytes of the given file.
+func fileSize(file string) (int64, error) {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// RetryPolicy tells how downloads and releases requests are retried after a
+// network error or an overloaded server, waiting longer if a Retry-After header
+// asks to. A partially downloaded asset is resumed with a range request.
+type RetryPolicy struct {
+	// Attempts is the number of tries, at least one.
+	Attempts int
+	// Backoff is the wait before the first retry, doubling after each one.
+	Backoff time.Duration
+	// MaxElapsed bounds the time spent retrying, zero means unbounded.
+	MaxElapsed time.Duration
+	// Jitter is the fraction of each wait taken off at random, so servers
+	// don't all retry at once.
+	Jitter float64
+}
+
+var defaultRetryPolicy = RetryPolicy{
+	Attempts:   3,
+	Backoff:    time.Second,
+	MaxElapsed: time.Minute,
+	Jitter:     0.2,
+}
+
+const (
+	// defaultDownloadTimeout caps each download attempt unless
+	// SetDownloadTimeout says otherwise.
+	defaultDownloadTimeout = 10 * time.Minute
+	// A download attempt has downloadTimeoutBase plus the time to receive
+	// the asset at downloadMinRate bytes per second, up to the cap.
+	downloadTimeoutBase = 30 * time.Second
+	downloadMinRate     = 64 << 10
+)
+
+// downloadTransport connects to asset hosts, giving up on those that don't
+// answer rather than hanging on them.
+var downloadTransport = &http.Transport{
+	Proxy: http.ProxyFromEnvironment,
+	DialContext: (&net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).DialContext,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ResponseHeaderTimeout: 30 * time.Second,
+	ExpectContinueTimeout: time.Second,
+	IdleConnTimeout:       90 * time.Second,
+	MaxIdleConns:          100,
+}
+
+var defaultDownloadClient = &http.Client{Transport: downloadTransport}
+
+// attemptTimeout returns the time a download attempt of size bytes has,
+// up to max. Attempts of unknown size have max.
+func attemptTimeout(size int64, max time.Duration) time.Duration {
+	if size < 0 {
+		return max
+	}
+	if d := downloadTimeoutBase + time.Duration(size/downloadMinRate)*time.Second; d < max {
+		return d
+	}
+	return max
+}
+
 // downloadAsset grabs the contents of the body of the given URL and stores
 // then into $ASSETS_DIRECTORY/$BASENAME.SHA256_SUM($URL)
 func downloadAsset(uri string) (localfile string, err error) {
+	return downloadAssetContext(context.Background(), uri)
+}
+
+// downloadAssetContext is like downloadAsset, cancelling ctx aborts the
+// transfer.
+func downloadAssetContext(ctx context.Context, uri string) (localfile string, err error) {
+	return downloadAssetRetry(ctx, defaultDownloadClient, uri, "", defaultRetryPolicy)
+}
+
+// downloadAssetRetry is like downloadAssetContext, retrying as told by policy.
+// When checksum is not empty the file must match it, a file that doesn't is
+// downloaded again and ErrCorruptDownload is returned if it never does, as it
+// is for transfers shorter than their Content-Length. When every other try
+// fails the error matches ErrAssetUnreachable.
+func downloadAssetRetry(ctx context.Context, client *http.Client, uri string, checksum string, policy RetryPolicy) (localfile string, err error) {
+	return downloadAssetTo(ctx, client, assetsDirectory, uri, checksum, policy, defaultDownloadTimeout, noopLogger{})
+}
+
+// assetBasename returns the beginning of the local file name of the asset at
+// uri.
+func assetBasename(uri string) string {
 	basename := path.Base(uri)
 
 	// We'll be appending 65 chars to create a local file name for the asset,
@@ -32,33 +133,344 @@ func downloadAsset(uri string) (localfile string, err error) {
 	if len(basename) > 60 {
 		basename = basename[:60]
 	}
+	return basename
+}
 
-	localfile = assetsDirectory + fmt.Sprintf("%s.%x", basename, sha256.Sum256([]byte(uri)))
+// assetFile returns the file the asset at uri is downloaded to in dir.
+func assetFile(dir string, uri string) string {
+	return filepath.Join(dir, fmt.Sprintf("%s.%x", assetBasename(uri), sha256.Sum256([]byte(uri))))
+}
 
-	if !fileExists(localfile) {
-		var res *http.Response
+// downloadAssetTo is like downloadAssetRetry, storing the asset in dir and
+// telling logger about retries. Each attempt is bounded as told by
+// attemptTimeout, up to timeout unless zero.
+func downloadAssetTo(ctx context.Context, client *http.Client, dir string, uri string, checksum string, policy RetryPolicy, timeout time.Duration, logger Logger) (localfile string, err error) {
+	localfile = assetFile(dir, uri)
 
-		if res, err = http.Get(uri); err != nil {
-			return "", err
+	if fileExists(localfile) {
+		if checksum == "" || matchesChecksum(localfile, checksum) {
+			return localfile, nil
 		}
+		logger.Warn("Cached asset does not match its checksum, downloading it again", "asset", uri, "file", localfile, "checksum", checksum)
+	}
+
+	// Download into a temporary file first, a truncated download must not
+	// be mistaken for the asset later on.
+	var fp *os.File
 
-		if res.StatusCode != http.StatusOK {
-			return "", fmt.Errorf("Expecting 200 OK, got: %s", res.Status)
+	defer writing.add(localfile)()
+	if fp, err = ioutil.TempFile(dir, filepath.Base(localfile)+".*.tmp"); err != nil {
+		return "", err
+	}
+	defer func() {
+		if err != nil {
+			fp.Close()
+			os.Remove(fp.Name())
+		}
+	}()
+
+	err = retry(ctx, policy, func() (bool, time.Duration, error) {
+		temporary, err := fetchAsset(ctx, client, uri, fp, timeout)
+		if errors.Is(err, ErrCorruptDownload) {
+			return temporary, 0, err
+		}
+		if err != nil {
+			_, after := temporaryError(err)
+			return temporary, after, fmt.Errorf("%w: %w", ErrAssetUnreachable, err)
 		}
+		if checksum != "" && !matchesChecksum(fp.Name(), checksum) {
+			// Start over, there is no telling which part is wrong.
+			if err = fp.Truncate(0); err != nil {
+				return false, 0, err
+			}
+			return true, 0, ErrCorruptDownload
+		}
+		return false, 0, nil
+	}, func(attempt int, wait time.Duration, err error) {
+		logger.Warn("Retrying download", "asset", uri, "attempt", attempt, "backoff", wait, "err", err)
+	})
+	if err != nil {
+		return "", err
+	}
 
-		var fp *os.File
+	if err = fp.Close(); err != nil {
+		return "", err
+	}
+	if err = os.Rename(fp.Name(), localfile); err != nil {
+		return "", err
+	}
+	return localfile, nil
+}
+
+// fetchAsset downloads uri into fp with the given client, resuming from the end of fp if it already
+// holds part of it. retry tells whether a failure is worth trying again. A
+// transfer past its attempt timeout is given up on, keeping what was received.
+func fetchAsset(ctx context.Context, client *http.Client, uri string, fp *os.File, timeout time.Duration) (retry bool, err error) {
+	offset, err := fp.Seek(0, io.SeekEnd)
+	if err != nil {
+		return false, err
+	}
 
-		if fp, err = os.Create(localfile); err != nil {
-			return "", err
+	parent := ctx
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	start := time.Now()
+	var timer *time.Timer
+	if timeout > 0 {
+		timer = time.AfterFunc(timeout, func() {
+			cancel(fmt.Errorf("Download timed out after %v", time.Since(start).Round(time.Millisecond)))
+		})
+		defer timer.Stop()
+	}
+	defer func() {
+		if err != nil && parent.Err() == nil && context.Cause(ctx) != nil {
+			retry, err = true, context.Cause(ctx)
 		}
+	}()
 
-		defer fp.Close()
+	var req *http.Request
+	if req, err = http.NewRequest("GET", uri, nil); err != nil {
+		return false, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
 
-		if _, err = io.Copy(fp, res.Body); err != nil {
-			return "", err
+	var res *http.Response
+	if res, err = client.Do(req.WithContext(ctx)); err != nil {
+		return true, err
+	}
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusPartialContent && offset > 0:
+	case res.StatusCode == http.StatusOK:
+		// The server ignored the range, start over.
+		if err = fp.Truncate(0); err != nil {
+			return false, err
+		}
+		if _, err = fp.Seek(0, io.SeekStart); err != nil {
+			return false, err
 		}
+	case res.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// Nothing left past what we have.
+		return false, nil
+	default:
+		err = newStatusError(res, fmt.Sprintf("Expecting 200 OK, got: %s", res.Status))
+		return temporaryStatus(res.StatusCode), err
+	}
 
+	// Now the size is known, so is the time the attempt has.
+	if timer != nil && res.ContentLength >= 0 && timer.Stop() {
+		timer.Reset(attemptTimeout(res.ContentLength, timeout) - time.Since(start))
 	}
 
-	return localfile, nil
+	var n int64
+	if n, err = io.Copy(fp, res.Body); err != nil {
+		return true, err
+	}
+	// Truncated transfers are caught here rather than by hashing, what was
+	// received is kept and resumed from.
+	if res.ContentLength >= 0 && n != res.ContentLength {
+		return true, fmt.Errorf("%w: got %d of %d bytes", ErrCorruptDownload, n, res.ContentLength)
+	}
+
+	return false, nil
+}
+
+// matchesChecksum tells whether the given file has the given hex encoded
+// sha256 sum.
+func matchesChecksum(file string, checksum string) bool {
+	sum, err := checksumForFile(file)
+	return err == nil && sum == strings.ToLower(checksum)
+}
+
+// SetDownloadRetryPolicy sets how asset downloads made by the manager are
+// retried, three tries over at most a minute by default.
+func (g *ReleaseManager) SetDownloadRetryPolicy(policy RetryPolicy) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.retryPolicy = policy
+}
+
+// SetDownloadTimeout caps each download attempt, which otherwise has 30
+// seconds plus the time to receive the asset at 64 KiB/s. Attempts running
+// out of time are retried as told by the retry policy, resuming the
+// transfer. Defaults to 10 minutes, zero leaves attempts unbounded.
+func (g *ReleaseManager) SetDownloadTimeout(max time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.downloadTimeout = max
+}
+
+// SetDownloadDir sets the directory assets are downloaded to and patches are
+// verified in, it is created if it does not exist. Defaults to assets/ in the
+// working directory.
+func (g *ReleaseManager) SetDownloadDir(dir string) error {
+	if err := os.MkdirAll(dir, os.ModeDir|0700); err != nil {
+		return fmt.Errorf("Could not create download directory: %q", err)
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.downloadDir = dir
+	return nil
+}
+
+// DownloadDir returns the directory assets are downloaded to.
+func (g *ReleaseManager) DownloadDir() string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	if g.downloadDir == "" {
+		return assetsDirectory
+	}
+	return g.downloadDir
+}
+
+// clientURL returns the URL clients download a from, the server's /assets/
+// route, relative like patch URLs, for private assets.
+func (a *Asset) clientURL() string {
+	if !a.Private {
+		return a.URL
+	}
+	return "assets/" + a.v.String() + "/" + url.PathEscape(a.Name)
+}
+
+// privateAsset returns the private update asset named name of version, nil
+// if there's none.
+func (g *ReleaseManager) privateAsset(version string, name string) *Asset {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	for os := range g.updateAssetsMap {
+		for arch := range g.updateAssetsMap[os] {
+			if a := g.updateAssetsMap[os][arch][version]; a != nil && a.Private && a.Name == name {
+				return a
+			}
+		}
+	}
+	return nil
+}
+
+// downloadAsset downloads uri with the manager's retry policy and timeout,
+// checking the result against checksum if not empty, through the client set
+// with WithDownloadClient or else the release provider's.
+func (g *ReleaseManager) downloadAsset(ctx context.Context, uri string, checksum string) (string, error) {
+	ctx, done, err := g.begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer done()
+
+	g.mu.RLock()
+	policy, timeout, client := g.retryPolicy, g.downloadTimeout, g.downloadClient
+	g.mu.RUnlock()
+	if client == nil {
+		client = g.provider.Client()
+	}
+
+	dir := g.DownloadDir()
+	cached := fileExists(assetFile(dir, uri))
+	localfile, err := downloadAssetTo(ctx, client, dir, uri, checksum, policy, timeout, g.logger)
+	if err != nil && ctx.Err() == nil {
+		g.metrics.DownloadError(err)
+	}
+	if err == nil && !cached {
+		if size, err := fileSize(localfile); err == nil {
+			g.extendedMetrics().AssetDownloaded(size)
+		}
+		g.cacheWritten(localfile)
+	} else if err == nil {
+		// Marks it as recently used.
+		now := time.Now()
+		os.Chtimes(localfile, now, now)
+	}
+	return localfile, err
+}
+
+// downloadKnownAsset is like downloadAsset, checking the result against the
+// checksum of the indexed asset with the same URL, if any. The file is only
+// needed until release is called: it's then deleted unless it's the local
+// file of an asset or still used by someone else.
+func (g *ReleaseManager) downloadKnownAsset(ctx context.Context, uri string) (localfile string, release func(), err error) {
+	var checksum string
+	if a := g.assetByURL(uri); a != nil {
+		checksum = a.Checksum
+	}
+
+	file := assetFile(g.DownloadDir(), uri)
+	g.downloads.acquire(file)
+	release = func() { g.downloads.release(file) }
+
+	if localfile, err = g.downloadAsset(ctx, uri, checksum); err != nil {
+		release()
+		return "", nil, err
+	}
+	return localfile, release, nil
+}
+
+// downloadRefs keeps track of the downloaded files patch generation and
+// verification are using, so they are only deleted once nobody needs them.
+type downloadRefs struct {
+	mu   sync.Mutex
+	refs map[string]int
+	keep map[string]bool // local files of assets, never deleted
+}
+
+// acquire marks file as being used.
+func (d *downloadRefs) acquire(file string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.refs == nil {
+		d.refs = make(map[string]int)
+	}
+	d.refs[file]++
+}
+
+// release gives back a file taken with acquire, deleting it if it's no
+// longer used.
+func (d *downloadRefs) release(file string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.refs[file]--; d.refs[file] > 0 {
+		return
+	}
+	delete(d.refs, file)
+	if !d.keep[file] {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			log.Errorf("Could not remove downloaded file %s: %q", file, err)
+		}
+	}
+}
+
+// drop deletes file unless it's in use or kept, for it to be downloaded again.
+func (d *downloadRefs) drop(file string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.refs[file] > 0 || d.keep[file] {
+		return
+	}
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		log.Errorf("Could not remove downloaded file %s: %q", file, err)
+	}
+}
+
+// forget lets file go unless it's in use, telling whether it can be deleted.
+func (d *downloadRefs) forget(file string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.refs[file] > 0 {
+		return false
+	}
+	delete(d.keep, file)
+	return true
+}
+
+// hold keeps file around for good, as the local file of an asset.
+func (d *downloadRefs) hold(file string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.keep == nil {
+		d.keep = make(map[string]bool)
+	}
+	d.keep[file] = true
 }
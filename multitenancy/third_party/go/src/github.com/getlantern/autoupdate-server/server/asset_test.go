@@ -1,8 +1,20 @@
 package server
 
 import (
+	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 const (
@@ -10,7 +22,353 @@ const (
 )
 
 func TestDownloadAsset(t *testing.T) {
-	if _, err := downloadAsset(testAssetURL); err != nil {
+	g, p := newTestMemoryManager(t)
+	rs, err := p.Releases(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	localfile, err := g.downloadAsset(context.Background(), rs[0].Assets[0].URL, "")
+	if err != nil {
 		t.Fatal(fmt.Errorf("Failed to download asset: %q", err))
 	}
+	if b, err := ioutil.ReadFile(localfile); err != nil || !strings.HasSuffix(string(b), " 1.2.0") {
+		t.Fatalf("Expecting the asset of 1.2.0, got %q %v", b, err)
+	}
+
+	if _, err = g.downloadAsset(context.Background(), rs[0].URL+"/missing", ""); err == nil {
+		t.Fatal("Expecting an asset that is not published to be missing.")
+	}
+}
+
+// newStalledServer returns a server that starts sending a body and then hangs
+// until the client goes away.
+func newStalledServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1048576")
+		w.Write([]byte("the first few bytes"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+}
+
+func TestDownloadAssetContextCancel(t *testing.T) {
+	srv := newStalledServer()
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := downloadAssetContext(ctx, srv.URL+"/stalled")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expecting a deadline error, got %q", err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Fatal("Expecting the download to be aborted promptly.")
+	}
+}
+
+func TestDownloadAssetCancelCleansUp(t *testing.T) {
+	srv := newStalledServer()
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	dir := t.TempDir()
+	_, err := downloadAssetTo(ctx, http.DefaultClient, dir, srv.URL+"/stalled", "", defaultRetryPolicy, defaultDownloadTimeout, noopLogger{})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expecting a cancellation error, got %q", err)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("Expecting the partial download to be deleted, got %s", files[0].Name())
+	}
+}
+
+// countingTransport counts the requests going through it.
+type countingTransport struct {
+	n int32
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&t.n, 1)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestDownloadAssetTimeout(t *testing.T) {
+	srv := newStalledServer()
+	defer srv.Close()
+
+	transport := &countingTransport{}
+	g := NewReleaseManager("getlantern", "autoupdate-server", WithDownloadClient(&http.Client{Transport: transport}))
+	if err := g.SetDownloadDir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	g.SetDownloadRetryPolicy(RetryPolicy{Attempts: 2, Backoff: time.Millisecond})
+	g.SetDownloadTimeout(100 * time.Millisecond)
+
+	start := time.Now()
+	_, err := g.downloadAsset(context.Background(), srv.URL+"/stalled", "")
+	if !errors.Is(err, ErrAssetUnreachable) || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("Expecting the stalled download to time out, got %q", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("Expecting the download to be aborted within its deadline, took %v", elapsed)
+	}
+	if n := atomic.LoadInt32(&transport.n); n != 2 {
+		t.Fatalf("Expecting both attempts to go through the given client, got %d", n)
+	}
+
+	// Attempts have the time to get the asset at a minimum rate, up to the
+	// cap.
+	if d := attemptTimeout(640<<10, time.Hour); d != downloadTimeoutBase+10*time.Second {
+		t.Fatalf("Expecting 40s for 640 KiB, got %v", d)
+	}
+	if d := attemptTimeout(1<<40, time.Hour); d != time.Hour {
+		t.Fatalf("Expecting the cap for huge assets, got %v", d)
+	}
+	if d := attemptTimeout(-1, time.Minute); d != time.Minute {
+		t.Fatalf("Expecting the cap for assets of unknown size, got %v", d)
+	}
+}
+
+func TestUpdateAssetsMapContextCancel(t *testing.T) {
+	setTestPrivateKey(t)
+
+	srv := newStalledServer()
+	defer srv.Close()
+
+	api := newTestReleasesAPI(fmt.Sprintf(`[{"id": 1, "tag_name": "1.0.0", "zipball_url": "%s/1.0.0.zip", "assets": [
+		{"id": 10, "name": "autoupdate-binary-linux-amd64", "browser_download_url": "%s/autoupdate-binary-linux-amd64"}
+	]}]`, srv.URL, srv.URL))
+	defer api.Close()
+
+	g := NewReleaseManager("getlantern", "autoupdate-server")
+	useTestGitHub(t, g, api)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	if err := g.UpdateAssetsMapContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expecting a cancellation error, got %q", err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Fatal("Expecting the refresh to be aborted promptly.")
+	}
+	if !g.LastRefresh().IsZero() {
+		t.Fatal("Expecting a cancelled refresh not to count.")
+	}
+
+	// Cancelled before the releases list is even fetched.
+	if _, err := g.GetReleasesContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expecting a cancellation error, got %q", err)
+	}
+}
+
+func TestCheckForUpdateContextDeadline(t *testing.T) {
+	g, current, _ := newTestUpdatePair(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1048576")
+		w.Write([]byte("the first few bytes"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	res, err := g.CheckForUpdateContext(ctx, &Params{
+		AppVersion: "1.0.0",
+		OS:         OS.Linux,
+		Arch:       Arch.X64,
+		Checksum:   current.Checksum,
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expecting a deadline error, got %v, %q", res, err)
+	}
+	if !strings.Contains(err.Error(), "Downloading old asset") {
+		t.Fatalf("Expecting the error to tell the stage that timed out, got %q", err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Fatal("Expecting the check to be aborted promptly.")
+	}
+}
+
+func TestDownloadAssetRetry(t *testing.T) {
+	content := strings.Repeat("resumable asset ", 1024)
+	checksum := fmt.Sprintf("%x", sha256.Sum256([]byte(content)))
+	policy := RetryPolicy{Attempts: 3, Backoff: time.Millisecond}
+
+	// The first request is cut halfway, the second one must resume from there.
+	var ranges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		if len(ranges) == 1 {
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			w.Write([]byte(content[:len(content)/2]))
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		http.ServeContent(w, r, "asset", time.Time{}, strings.NewReader(content))
+	}))
+	defer srv.Close()
+
+	localfile, err := downloadAssetRetry(context.Background(), http.DefaultClient, srv.URL+"/"+t.Name(), checksum, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(localfile); string(b) != content {
+		t.Fatal("Expecting the resumed download to be complete.")
+	}
+	if len(ranges) != 2 || ranges[1] != fmt.Sprintf("bytes=%d-", len(content)/2) {
+		t.Fatalf("Expecting the second request to resume the first one, got %q", ranges)
+	}
+
+	// Bytes that never match the checksum are a corrupt download.
+	corrupt := newTestAssetServer(map[string]string{"/corrupt": "not the asset"})
+	defer corrupt.Close()
+	if _, err = downloadAssetRetry(context.Background(), http.DefaultClient, corrupt.URL+"/corrupt", checksum, policy); err != ErrCorruptDownload {
+		t.Fatalf("Expecting ErrCorruptDownload, got %q", err)
+	}
+	if leftovers, _ := filepath.Glob(assetsDirectory + "corrupt.*"); len(leftovers) != 0 {
+		t.Fatalf("Expecting the corrupt download to be deleted, got %q", leftovers)
+	}
+
+	// Servers that keep failing are unreachable.
+	var tries int
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tries++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	if _, err = downloadAssetRetry(context.Background(), http.DefaultClient, failing.URL+"/failing", "", policy); !errors.Is(err, ErrAssetUnreachable) {
+		t.Fatalf("Expecting ErrAssetUnreachable, got %q", err)
+	}
+	if tries != policy.Attempts {
+		t.Fatalf("Expecting %d tries, got %d", policy.Attempts, tries)
+	}
+
+	// Missing assets are unreachable too.
+	if _, err = downloadAssetRetry(context.Background(), http.DefaultClient, corrupt.URL+"/missing", "", policy); !errors.Is(err, ErrAssetUnreachable) {
+		t.Fatalf("Expecting ErrAssetUnreachable, got %q", err)
+	}
+}
+
+// shortTransport answers every request with a body shorter than its
+// Content-Length, like a proxy cutting transfers without an error.
+type shortTransport struct {
+	content string
+}
+
+func (t shortTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Status:        "200 OK",
+		ContentLength: int64(len(t.content)),
+		Body:          ioutil.NopCloser(strings.NewReader(t.content[:len(t.content)/2])),
+		Request:       req,
+	}, nil
+}
+
+func TestDownloadAssetTruncated(t *testing.T) {
+	client := &http.Client{Transport: shortTransport{"truncated asset"}}
+	policy := RetryPolicy{Attempts: 2, Backoff: time.Millisecond}
+
+	// Caught without a checksum to compare with.
+	dir := t.TempDir()
+	_, err := downloadAssetTo(context.Background(), client, dir, "http://example.com/truncated", "", policy, defaultDownloadTimeout, noopLogger{})
+	if !errors.Is(err, ErrCorruptDownload) {
+		t.Fatalf("Expecting ErrCorruptDownload, got %q", err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("Expecting the truncated download to be deleted, got %s", files[0].Name())
+	}
+}
+
+func TestDownloadDirCleanup(t *testing.T) {
+	requireBsdiff(t)
+
+	srv := newTestAssetServer(map[string]string{
+		"/old": "in a gadda da vida, honey, don't you know that I'm loving you.",
+		"/new": "in a gadda da vida, baby, don't you know that I'll always be true.",
+	})
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "downloads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	patchDir, err := ioutil.TempDir("", "patch-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(patchDir)
+
+	g := NewReleaseManager("getlantern", "autoupdate-server")
+	if err = g.SetDownloadDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err = g.SetPatchCacheDir(patchDir); err != nil {
+		t.Fatal(err)
+	}
+
+	leftovers := func() []string {
+		files, err := filepath.Glob(filepath.Join(dir, "*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return files
+	}
+
+	p, err := g.GeneratePatch(srv.URL+"/old", srv.URL+"/new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fileExists(p.File) {
+		t.Fatal("Expecting the patch to be cached.")
+	}
+	if files := leftovers(); len(files) != 0 {
+		t.Fatalf("Expecting no leftovers after generating a patch, got %v", files)
+	}
+
+	if _, err = g.GeneratePatch(srv.URL+"/old", srv.URL+"/missing"); err == nil {
+		t.Fatal("Expecting the generation to fail.")
+	}
+	if files := leftovers(); len(files) != 0 {
+		t.Fatalf("Expecting no leftovers after a failed generation, got %v", files)
+	}
+
+	// A file stays as long as someone is using it.
+	localfile, release, err := g.downloadKnownAsset(context.Background(), srv.URL+"/old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, releaseAgain, err := g.downloadKnownAsset(context.Background(), srv.URL+"/old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if !fileExists(localfile) {
+		t.Fatal("Expecting the download to be kept while still in use.")
+	}
+	releaseAgain()
+	if fileExists(localfile) {
+		t.Fatal("Expecting the download to be deleted once released.")
+	}
+
+	// Local files of assets are never deleted.
+	g.downloads.hold(assetFile(dir, srv.URL+"/new"))
+	if localfile, release, err = g.downloadKnownAsset(context.Background(), srv.URL+"/new"); err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if !fileExists(localfile) {
+		t.Fatal("Expecting the asset's local file to be kept.")
+	}
 }
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// AssetStore is where clients download patches from, like an S3 or GCS
+// bucket, so they don't go through the update server. Keys are slash
+// separated relative paths.
+type AssetStore interface {
+	// Put stores what r yields under key, replacing any previous value, and
+	// returns the public or presigned URL clients download it from.
+	Put(key string, r io.Reader) (url string, err error)
+}
+
+// AssetLocator is an AssetStore that can tell the URL of what it already
+// stores. The manager otherwise uploads every patch once after it starts,
+// even those a previous run uploaded.
+type AssetLocator interface {
+	AssetStore
+	// Lookup returns the URL of the value stored under key, ErrNotStored if
+	// there is none.
+	Lookup(key string) (url string, err error)
+}
+
+// WithAssetStore has clients download patches from the given store: patches
+// are uploaded once, the first time they are handed out, and results point
+// at their store URL. Patches are served by NewPatchHandler otherwise.
+func WithAssetStore(s AssetStore) Option {
+	return func(g *ReleaseManager) {
+		g.assetStore = s
+	}
+}
+
+// FileAssetStore is an AssetLocator copying values to files under Dir, for a
+// web server or CDN to serve at BaseURL.
+type FileAssetStore struct {
+	Dir     string
+	BaseURL string
+}
+
+// NewFileAssetStore returns a FileAssetStore in the given directory, served
+// at baseURL. The directory is created if it does not exist.
+func NewFileAssetStore(dir string, baseURL string) (*FileAssetStore, error) {
+	if _, err := url.Parse(baseURL); err != nil {
+		return nil, fmt.Errorf("Bad asset store URL: %v", err)
+	}
+	if err := os.MkdirAll(dir, os.ModeDir|0700); err != nil {
+		return nil, fmt.Errorf("Could not create asset store directory: %q", err)
+	}
+	return &FileAssetStore{Dir: dir, BaseURL: baseURL}, nil
+}
+
+// Put copies r to the key's file.
+func (s *FileAssetStore) Put(key string, r io.Reader) (string, error) {
+	if err := (&FileStorage{Dir: s.Dir}).SaveFrom(key, r); err != nil {
+		return "", err
+	}
+	return s.url(key), nil
+}
+
+// Lookup tells whether the key's file exists.
+func (s *FileAssetStore) Lookup(key string) (string, error) {
+	file, err := (&FileStorage{Dir: s.Dir}).file(key)
+	if err != nil {
+		return "", err
+	}
+	if !fileExists(file) {
+		return "", ErrNotStored
+	}
+	return s.url(key), nil
+}
+
+func (s *FileAssetStore) url(key string) string {
+	return strings.TrimSuffix(s.BaseURL, "/") + "/" + key
+}
+
+// patchUploads remembers the store URLs of uploaded patches, and has checks
+// handing out a patch being uploaded wait for that upload.
+type patchUploads struct {
+	mu      sync.Mutex
+	urls    map[string]string        // key -> URL
+	pending map[string]chan struct{} // key -> closed once uploaded
+}
+
+// patchURL returns the URL clients download patch from, relative to the
+// public address unless it's in the asset store. An upload failure is logged
+// and the patch is served by the update server instead.
+func (g *ReleaseManager) patchURL(patch *Patch) string {
+	name := filepath.Base(patch.File)
+	local := "patches/" + name
+
+	g.mu.RLock()
+	store := g.assetStore
+	g.mu.RUnlock()
+	if store == nil {
+		return local
+	}
+
+	u, err := g.uploadPatch(store, patchStoragePrefix+name, patch.File)
+	if err != nil {
+		g.logger.Error("Could not upload patch", "patch", name, "err", err)
+		return local
+	}
+	return u
+}
+
+// uploadPatch puts file in store under key unless it's already there,
+// returning its URL.
+func (g *ReleaseManager) uploadPatch(store AssetStore, key string, file string) (string, error) {
+	up := &g.uploads
+	for {
+		up.mu.Lock()
+		if u, ok := up.urls[key]; ok {
+			up.mu.Unlock()
+			return u, nil
+		}
+		wait, busy := up.pending[key]
+		if !busy {
+			break
+		}
+		up.mu.Unlock()
+		<-wait
+	}
+	if up.pending == nil {
+		up.urls = make(map[string]string)
+		up.pending = make(map[string]chan struct{})
+	}
+	done := make(chan struct{})
+	up.pending[key] = done
+	up.mu.Unlock()
+
+	u, err := putPatch(store, key, file)
+
+	up.mu.Lock()
+	if err == nil {
+		up.urls[key] = u
+	}
+	delete(up.pending, key)
+	close(done)
+	up.mu.Unlock()
+
+	return u, err
+}
+
+// putPatch uploads file to store under key, unless the store can tell it
+// already has it.
+func putPatch(store AssetStore, key string, file string) (string, error) {
+	if l, ok := store.(AssetLocator); ok {
+		u, err := l.Lookup(key)
+		if err == nil {
+			return u, nil
+		}
+		if err != ErrNotStored {
+			return "", err
+		}
+	}
+
+	fp, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer fp.Close()
+
+	log.Debugf("Uploading patch %s to the asset store", key)
+	return store.Put(key, fp)
+}
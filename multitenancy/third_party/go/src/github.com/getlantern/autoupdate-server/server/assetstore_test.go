@@ -0,0 +1,153 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// testAssetStore keeps uploads in memory, failing them while broken.
+type testAssetStore struct {
+	mu      sync.Mutex
+	objects map[string]string
+	puts    int32
+	broken  bool
+}
+
+func (s *testAssetStore) Put(key string, r io.Reader) (string, error) {
+	atomic.AddInt32(&s.puts, 1)
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.broken {
+		return "", errors.New("bucket is on fire")
+	}
+	if s.objects == nil {
+		s.objects = make(map[string]string)
+	}
+	s.objects[key] = string(b)
+	return "https://bucket.example.com/" + key + "?signature=abc", nil
+}
+
+func TestAssetStore(t *testing.T) {
+	requireBsdiff(t)
+	g, current, _ := newTestUpdatePair(t, nil)
+	g.SetMaxPatchRatio(0)
+	if err := g.SetPatchCacheDir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	store := &testAssetStore{}
+	WithAssetStore(store)(g)
+
+	check := func() *Result {
+		rec := httptest.NewRecorder()
+		NewHandler(g, "http://updates.example.com/").ServeHTTP(rec, httptest.NewRequest("GET", "/update?os=linux&arch=amd64&app_version=1.0.0&checksum="+current.Checksum, nil))
+		var res Result
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+			t.Fatalf("Expecting a JSON result, got %d %q", rec.Code, rec.Body.String())
+		}
+		return &res
+	}
+
+	// Checks handing out the same patch upload it once.
+	urls := []string{check().PatchURL, check().PatchURL}
+	for _, u := range urls {
+		if !strings.HasPrefix(u, "https://bucket.example.com/patches/") {
+			t.Fatalf("Expecting the store URL, got %q", u)
+		}
+	}
+	if store.puts != 1 {
+		t.Fatalf("Expecting a single upload, got %d", store.puts)
+	}
+	key := strings.TrimSuffix(strings.TrimPrefix(urls[0], "https://bucket.example.com/"), "?signature=abc")
+	if b, _ := ioutil.ReadFile(g.PatchCacheDir() + "/" + strings.TrimPrefix(key, "patches/")); store.objects[key] != string(b) || len(b) == 0 {
+		t.Fatal("Expecting the patch to be uploaded whole.")
+	}
+
+	// Concurrent uploads of a patch are one upload.
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := g.uploadPatch(store, "patches/concurrent", g.PatchCacheDir()+"/"+strings.TrimPrefix(key, "patches/")); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if store.puts != 2 {
+		t.Fatalf("Expecting concurrent uploads to coalesce, got %d uploads", store.puts)
+	}
+
+	// Failed uploads fall back to the patch handler.
+	g2, current2, _ := newTestUpdatePair(t, nil)
+	g2.SetMaxPatchRatio(0)
+	if err := g2.SetPatchCacheDir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	WithAssetStore(&testAssetStore{broken: true})(g2)
+	res, err := g2.CheckForUpdate(&Params{AppVersion: "1.0.0", OS: OS.Linux, Arch: Arch.X64, Checksum: current2.Checksum})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(res.PatchURL, "patches/") {
+		t.Fatalf("Expecting the patch to be served by the update server, got %q", res.PatchURL)
+	}
+}
+
+func TestFileAssetStore(t *testing.T) {
+	requireBsdiff(t)
+	dir := t.TempDir()
+	store, err := NewFileAssetStore(dir, "https://cdn.example.com/updates/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.Lookup("patches/abc"); err != ErrNotStored {
+		t.Fatalf("Expecting ErrNotStored, got %v", err)
+	}
+
+	g, current, _ := newTestUpdatePair(t, nil)
+	g.SetMaxPatchRatio(0)
+	if err := g.SetPatchCacheDir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	WithAssetStore(store)(g)
+	res, err := g.CheckForUpdate(&Params{AppVersion: "1.0.0", OS: OS.Linux, Arch: Arch.X64, Checksum: current.Checksum})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(res.PatchURL, "https://cdn.example.com/updates/patches/") {
+		t.Fatalf("Expecting the CDN URL, got %q", res.PatchURL)
+	}
+	key := strings.TrimPrefix(res.PatchURL, "https://cdn.example.com/updates/")
+	if u, err := store.Lookup(key); err != nil || u != res.PatchURL {
+		t.Fatalf("Expecting the patch to be stored, got %q, %v", u, err)
+	}
+
+	// Patches a previous run uploaded are not uploaded again.
+	counting := &countingAssetStore{FileAssetStore: store}
+	if u, err := g.uploadPatch(counting, key, "/nonexistent"); err != nil || u != res.PatchURL || counting.puts != 0 {
+		t.Fatalf("Expecting the stored patch to be found, got %q, %v after %d uploads", u, err, counting.puts)
+	}
+}
+
+// countingAssetStore counts the uploads to a FileAssetStore.
+type countingAssetStore struct {
+	*FileAssetStore
+	puts int
+}
+
+func (s *countingAssetStore) Put(key string, r io.Reader) (string, error) {
+	s.puts++
+	return s.FileAssetStore.Put(key, r)
+}
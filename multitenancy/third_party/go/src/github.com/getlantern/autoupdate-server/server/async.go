@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	// asyncPatchTimeout bounds a patch generated in the background, for
+	// clients not to wait on a stuck one forever.
+	asyncPatchTimeout = 30 * time.Minute
+
+	// asyncFailureCooldown is how long clients get the full update after a
+	// patch failed to generate in the background, before it is tried again.
+	asyncFailureCooldown = 15 * time.Minute
+)
+
+// asyncPatches tracks the patches generated in the background, see
+// SetAsyncPatches.
+type asyncPatches struct {
+	retryAfter time.Duration // zero generates patches while clients wait
+	running    map[string]bool
+	failed     map[string]asyncFailure
+}
+
+// asyncFailure is a patch that failed to generate in the background.
+type asyncFailure struct {
+	err   error
+	until time.Time
+}
+
+// SetAsyncPatches makes CheckForUpdate generate the patches it doesn't have
+// yet in the background. Until a patch is ready, checks needing it fail with
+// a *PatchPendingError telling clients to check again after retryAfter, and
+// should generating it fail they get the full update instead. Zero, the
+// default, generates patches while clients wait.
+func (g *ReleaseManager) SetAsyncPatches(retryAfter time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.async.retryAfter = retryAfter
+}
+
+// asyncPatch is like CachedPatchContext for patches of type t, unless patches
+// are generated in the background. It then returns a *PatchPendingError after
+// starting to generate a patch that isn't ready, and the error it failed with
+// for a while after.
+func (g *ReleaseManager) asyncPatch(ctx context.Context, t PatchType, oldAsset *Asset, newAsset *Asset) (*Patch, error) {
+	patchfile := g.typedPatchFile(t, oldAsset, newAsset)
+	if _, ok := cachedPatchFile(patchfile); ok {
+		return g.cachedTypedPatch(ctx, t, oldAsset, newAsset)
+	}
+
+	g.mu.Lock()
+	a := &g.async
+	if a.retryAfter <= 0 {
+		g.mu.Unlock()
+		return g.cachedTypedPatch(ctx, t, oldAsset, newAsset)
+	}
+	if f, ok := a.failed[patchfile]; ok {
+		if time.Now().Before(f.until) {
+			g.mu.Unlock()
+			return nil, f.err
+		}
+		delete(a.failed, patchfile)
+	}
+	pending := &PatchPendingError{RetryAfter: a.retryAfter}
+	if a.running[patchfile] {
+		g.mu.Unlock()
+		return nil, pending
+	}
+	if a.running == nil {
+		a.running = make(map[string]bool)
+	}
+	a.running[patchfile] = true
+	g.mu.Unlock()
+
+	// Tracked from now on, for Close to wait for it.
+	bg, done, err := g.begin(context.Background())
+	if err != nil {
+		g.mu.Lock()
+		delete(a.running, patchfile)
+		g.mu.Unlock()
+		return nil, err
+	}
+	g.logger.Debug("Generating patch in the background", "old", oldAsset.URL, "new", newAsset.URL)
+	go func() {
+		defer done()
+		g.generateAsync(bg, t, patchfile, oldAsset, newAsset)
+	}()
+	return nil, pending
+}
+
+// generateAsync generates the patch of type t between the two assets into
+// patchfile, remembering whether it failed.
+func (g *ReleaseManager) generateAsync(ctx context.Context, t PatchType, patchfile string, oldAsset *Asset, newAsset *Asset) {
+	ctx, cancel := context.WithTimeout(ctx, asyncPatchTimeout)
+	defer cancel()
+	_, err := g.cachedTypedPatch(ctx, t, oldAsset, newAsset)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.async.running, patchfile)
+	if err == nil {
+		return
+	}
+	if g.async.failed == nil {
+		g.async.failed = make(map[string]asyncFailure)
+	}
+	g.async.failed[patchfile] = asyncFailure{err: err, until: time.Now().Add(asyncFailureCooldown)}
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitForPatch checks for an update until it's no longer pending.
+func waitForPatch(t *testing.T, g *ReleaseManager, p Params) *Result {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		q := p
+		res, err := g.CheckForUpdate(&q)
+		if !errors.Is(err, ErrPatchPending) {
+			if err != nil && !errors.Is(err, ErrPatchUnavailable) {
+				t.Fatal(err)
+			}
+			return res
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expecting the patch to be generated in the background.")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAsyncPatches(t *testing.T) {
+	requireBsdiff(t)
+
+	// The old asset takes as long to download as a large diff would take to
+	// generate.
+	var requests int32
+	slow := make(chan struct{})
+	g, current, _ := newTestUpdatePair(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		<-slow
+		w.Write([]byte("full fallback 1.0.0"))
+	})
+	g.SetMaxPatchRatio(0)
+	g.SetAsyncPatches(5 * time.Second)
+	p := Params{AppVersion: "1.0.0", OS: OS.Linux, Arch: Arch.X64, Checksum: current.Checksum}
+
+	for i := 0; i < 2; i++ {
+		q := p
+		_, err := g.CheckForUpdate(&q)
+		var pending *PatchPendingError
+		if !errors.As(err, &pending) || pending.RetryAfter != 5*time.Second {
+			t.Fatalf("Expecting the check to pend while the patch is generated, got %v", err)
+		}
+	}
+	close(slow)
+
+	if res := waitForPatch(t, g, p); res.UpdateType != UPDATETYPE_PATCH || res.PatchURL == "" {
+		t.Fatalf("Expecting the patch once generated, got %+v", res)
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Fatalf("Expecting the patch to be generated once, got %d downloads", n)
+	}
+}
+
+func TestAsyncPatchFailure(t *testing.T) {
+	slow := make(chan struct{})
+	g, current, update := newTestUpdatePair(t, func(w http.ResponseWriter, r *http.Request) {
+		<-slow
+		http.Error(w, "unavailable", http.StatusInternalServerError)
+	})
+	g.SetAsyncPatches(5 * time.Second)
+	p := Params{AppVersion: "1.0.0", OS: OS.Linux, Arch: Arch.X64, Checksum: current.Checksum}
+
+	rec := httptest.NewRecorder()
+	NewUpdateHandler(g, "https://update.example.com/").ServeHTTP(rec,
+		httptest.NewRequest("GET", "/update?os=linux&arch=amd64&app_version=1.0.0&checksum="+current.Checksum, nil))
+	if rec.Code != http.StatusAccepted || rec.Header().Get("Retry-After") != "5" {
+		t.Fatalf("Expecting 202 and when to check again, got %d %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	close(slow)
+
+	res := waitForPatch(t, g, p)
+	if res.UpdateType != UPDATETYPE_FULL || !res.PatchUnavailable || res.URL != update.URL {
+		t.Fatalf("Expecting the full update once generating the patch failed, got %+v", res)
+	}
+	if res, err := g.CheckForUpdate(&Params{AppVersion: "1.0.0", OS: OS.Linux, Arch: Arch.X64, Checksum: current.Checksum}); res == nil || !errors.Is(err, ErrPatchUnavailable) {
+		t.Fatalf("Expecting the failure to be remembered, got %v", err)
+	}
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// Fraction of the interval taken off each wait between refreshes at random,
+// so servers started together don't all query Github at once.
+const autoUpdateJitter = 0.1
+
+// autoUpdater is the background refresh started by StartAutoUpdate.
+type autoUpdater struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// StartAutoUpdate calls UpdateAssetsMap about every interval in a goroutine
+// until StopAutoUpdate is called, the previous maps are served until a refresh
+// succeeds. The error of every failed refresh is passed to onError, if not
+// nil. A refresh running into the rate limit is tried again
+// once it resets, if that's later than the next interval. Calling it again
+// replaces the running refresh.
+func (g *ReleaseManager) StartAutoUpdate(interval time.Duration, onError func(error)) {
+	g.StopAutoUpdate()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	au := &autoUpdater{cancel: cancel, done: make(chan struct{})}
+
+	g.mu.Lock()
+	g.autoUpdate = au
+	g.mu.Unlock()
+
+	go func() {
+		defer close(au.done)
+		t := time.NewTimer(jittered(interval))
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				return
+			}
+			if err := g.UpdateAssetsMapContext(ctx); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				if onError != nil {
+					onError(err)
+				}
+			}
+			wait := jittered(interval)
+			if until := time.Until(g.RateLimitedUntil()); until > wait {
+				log.Debugf("Rate limited, refreshing again in %v", until)
+				wait = until
+			}
+			t.Reset(wait)
+		}
+	}()
+}
+
+// StopAutoUpdate stops the refresh started by StartAutoUpdate, aborting any
+// refresh in progress, and waits for it to return.
+func (g *ReleaseManager) StopAutoUpdate() {
+	g.mu.Lock()
+	au := g.autoUpdate
+	g.autoUpdate = nil
+	g.mu.Unlock()
+
+	if au == nil {
+		return
+	}
+	au.cancel()
+	<-au.done
+}
+
+// jittered returns interval with up to autoUpdateJitter of it taken off at
+// random.
+func jittered(interval time.Duration) time.Duration {
+	return interval - time.Duration(rand.Float64()*autoUpdateJitter*float64(interval))
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAutoUpdateRateLimited(t *testing.T) {
+	var requests int32
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("X-RateLimit-Limit", "60")
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.Header().Set("X-RateLimit-Reset", fmt.Sprint(time.Now().Add(time.Hour).Unix()))
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"message": "API rate limit exceeded"}`))
+	}))
+	defer api.Close()
+
+	g := NewReleaseManager("getlantern", "autoupdate-server")
+	useTestGitHub(t, g, api)
+
+	errs := make(chan error, 10)
+	g.StartAutoUpdate(5*time.Millisecond, func(err error) { errs <- err })
+	defer g.StopAutoUpdate()
+
+	if err := <-errs; !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("Expecting the refresh to be rate limited, got %q", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if r := atomic.LoadInt32(&requests); r != 1 {
+		t.Fatalf("Expecting no refresh before the rate limit resets, got %d requests", r)
+	}
+	if until := g.RateLimitedUntil(); time.Until(until) < 50*time.Minute {
+		t.Fatalf("Expecting the reset an hour from now, got %v", until)
+	}
+
+	// Registry refreshes wait as well.
+	r := NewReleaseManagerRegistry(1)
+	useTestGitHub(t, r.AddApp("lantern", "getlantern", "autoupdate-server"), api)
+	if err := r.Refresh(); err == nil {
+		t.Fatal("Expecting the first registry refresh to be rate limited")
+	}
+	if err := r.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if r := atomic.LoadInt32(&requests); r != 2 {
+		t.Fatalf("Expecting the registry not to refresh before the reset, got %d requests", r)
+	}
+}
+
+func TestAutoUpdate(t *testing.T) {
+	var inflight, maxInflight, requests int32
+	var failing atomic.Value
+	failing.Store(false)
+
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inflight, 1)
+		defer atomic.AddInt32(&inflight, -1)
+		for {
+			max := atomic.LoadInt32(&maxInflight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInflight, max, n) {
+				break
+			}
+		}
+		atomic.AddInt32(&requests, 1)
+		time.Sleep(20 * time.Millisecond)
+		if failing.Load().(bool) {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`[]`))
+	}))
+	defer api.Close()
+
+	g := NewReleaseManager("getlantern", "autoupdate-server")
+	useTestGitHub(t, g, api)
+
+	var mu sync.Mutex
+	var errs []error
+	g.StartAutoUpdate(5*time.Millisecond, func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		errs = append(errs, err)
+	})
+
+	// Manual refreshes never overlap with the background ones.
+	for i := 0; i < 3; i++ {
+		if err := g.UpdateAssetsMap(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	failing.Store(true)
+	time.Sleep(100 * time.Millisecond)
+	g.StopAutoUpdate()
+
+	if atomic.LoadInt32(&maxInflight) != 1 {
+		t.Fatalf("Expecting refreshes not to overlap, got %d at once", maxInflight)
+	}
+	if r := atomic.LoadInt32(&requests); r < 5 {
+		t.Fatalf("Expecting the assets to be refreshed in the background, got %d requests", r)
+	}
+	mu.Lock()
+	if len(errs) == 0 {
+		t.Fatal("Expecting refresh errors to be passed along.")
+	}
+	mu.Unlock()
+
+	// Nothing runs once stopped.
+	stopped := atomic.LoadInt32(&requests)
+	time.Sleep(30 * time.Millisecond)
+	if r := atomic.LoadInt32(&requests); r != stopped {
+		t.Fatalf("Expecting no refresh after StopAutoUpdate, got %d more", r-stopped)
+	}
+	g.StopAutoUpdate()
+}
+
+func TestAutoUpdateJitter(t *testing.T) {
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		d := jittered(time.Minute)
+		if d > time.Minute || d < time.Minute-time.Duration(autoUpdateJitter*float64(time.Minute)) {
+			t.Fatalf("Expecting at most %v taken off a minute, got %v", autoUpdateJitter, d)
+		}
+		seen[d] = true
+	}
+	if len(seen) < 2 {
+		t.Fatal("Expecting refreshes to be spread out")
+	}
+}
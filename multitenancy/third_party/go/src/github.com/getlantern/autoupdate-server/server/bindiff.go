@@ -1,33 +1,56 @@
 package server
 
 import (
+	"context"
 	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"runtime"
 	"sync"
+	"time"
 )
 
 var (
-	generatePatchMu sync.Mutex
+	generations = &generationLimiter{sem: make(chan struct{}, defaultMaxGenerations()), wait: -1}
 )
 
-// Patch struct is a representation of a patch generated by bsdiff.
+// defaultMaxGenerations is how many patches are generated at once unless told
+// otherwise, one per usable CPU.
+func defaultMaxGenerations() int {
+	return runtime.GOMAXPROCS(0)
+}
+
+// Patch struct is a representation of a patch generated by a Differ.
 type Patch struct {
 	oldfile string
 	newfile string
+	fresh   bool // just generated by the differ, see diffTo
 	File    string
+	// size in bytes of File, zero if unknown
+	Size int64
+	// how File is encoded, like Compression.Zstd, empty for the differ
+	// output as it is
+	Compression string
 }
 
 const (
 	patchesDirectory = "patches/"
+
+	// Patches larger than this fraction of the new asset are not worth
+	// downloading over the full binary.
+	defaultMaxPatchRatio = 0.8
 )
 
 func init() {
 	err := os.MkdirAll(patchesDirectory, os.ModeDir|0700)
 	if err != nil {
-		log.Fatalf("Could not create directory for storing patches: %q", err)
+		// Read-only working directories are fine with SetPatchCacheDir.
+		log.Errorf("Could not create directory for storing patches: %q", err)
 	}
 }
 
@@ -79,58 +102,442 @@ func bspatch(oldfile string, newfile string, patchfile string) (err error) {
 	return nil
 }
 
+// patchFileName returns the name of the patch between two files given their
+// hex encoded sha256 sums.
+func patchFileName(oldfileHash string, newfileHash string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(oldfileHash+"|"+newfileHash)))
+}
+
+// typedPatchFileName is patchFileName for patches of type t, bsdiff patches
+// keep their name.
+func typedPatchFileName(t PatchType, oldfileHash string, newfileHash string) string {
+	if t == PATCHTYPE_BSDIFF {
+		return patchFileName(oldfileHash, newfileHash)
+	}
+	return patchFileName(oldfileHash, newfileHash+"|"+string(t))
+}
+
 func bsdiff(oldfile string, newfile string) (patchfile string, err error) {
+	patchfile, _, err = diffTo(context.Background(), PATCHTYPE_BSDIFF, BsdiffDiffer{}, patchesDirectory, oldfile, newfile)
+	return patchfile, err
+}
+
+// diffTo generates a patch of type t between oldfile and newfile with d into
+// the given directory, cancelling ctx aborts d if it's a ContextDiffer. fresh
+// is false when the patch was already there, it may have been post processed.
+func diffTo(ctx context.Context, t PatchType, d Differ, dir string, oldfile string, newfile string) (patchfile string, fresh bool, err error) {
 
 	if !fileExists(oldfile) {
-		return "", fmt.Errorf("File %s does not exist.", oldfile)
+		return "", false, fmt.Errorf("File %s does not exist.", oldfile)
 	}
 
 	if !fileExists(newfile) {
-		return "", fmt.Errorf("File %s does not exist.", oldfile)
+		return "", false, fmt.Errorf("File %s does not exist.", oldfile)
 	}
 
 	oldfileHash := fileHash(oldfile)
 	newfileHash := fileHash(newfile)
 
-	patchfile = patchesDirectory + fmt.Sprintf("%x", sha256.Sum256([]byte(oldfileHash+"|"+newfileHash)))
+	patchfile = filepath.Join(dir, typedPatchFileName(t, oldfileHash, newfileHash))
+	defer writing.add(patchfile)()
 
 	if fileExists(patchfile) {
 		// Patch already exists, no need to compute it again.
-		return patchfile, nil
+		return patchfile, false, nil
 	}
 
-	cmd := exec.Command(
-		"bsdiff",
-		oldfile,
-		newfile,
-		patchfile,
-	)
+	// Write to a temporary file first so a half written patch is never
+	// mistaken for a complete one.
+	fp, err := ioutil.TempFile(dir, filepath.Base(patchfile)+".*.tmp")
+	if err != nil {
+		return "", false, err
+	}
+	fp.Close()
+	tmpfile := fp.Name()
 
-	if err := cmd.Run(); err != nil {
-		return "", fmt.Errorf("Failed to generate patch with bsdiff: %q", err)
+	if err := diff(ctx, d, oldfile, newfile, tmpfile); err != nil {
+		os.Remove(tmpfile)
+		if ctx.Err() != nil {
+			return "", false, ctx.Err()
+		}
+		return "", false, err
+	}
+
+	if err := os.Rename(tmpfile, patchfile); err != nil {
+		os.Remove(tmpfile)
+		return "", false, err
+	}
+
+	return patchfile, true, nil
+}
+
+// stageError tells which stage of patch generation ran out of time or was
+// cancelled, other errors are returned as they are.
+func stageError(stage string, err error) error {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%s: %w", stage, err)
 	}
+	return err
+}
 
-	return patchfile, nil
+// generationLimiter bounds the number of bsdiff processes running at once.
+type generationLimiter struct {
+	mu   sync.Mutex
+	sem  chan struct{}
+	wait time.Duration
+}
+
+// acquire takes a generation slot, waiting for one to be released for at most
+// l.wait, forever if negative, or until ctx is done. The returned func gives
+// the slot back.
+func (l *generationLimiter) acquire(ctx context.Context) (release func(), err error) {
+	l.mu.Lock()
+	sem, wait := l.sem, l.wait
+	l.mu.Unlock()
+
+	release = func() { <-sem }
+
+	select {
+	case sem <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	if wait == 0 {
+		return nil, ErrGenerationBusy
+	}
+
+	var timeout <-chan time.Time
+	if wait > 0 {
+		t := time.NewTimer(wait)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	select {
+	case sem <- struct{}{}:
+		return release, nil
+	case <-timeout:
+		return nil, ErrGenerationBusy
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// SetMaxConcurrentGenerations limits how many patches are generated at once
+// across the process, GOMAXPROCS by default. When every slot is taken new
+// generations wait for at most the given duration, forever if negative, and
+// then fail with ErrGenerationBusy. CheckForUpdate then does as told by
+// SetGenerationOverflow.
+func SetMaxConcurrentGenerations(max int, wait time.Duration) {
+	generations.set(max, wait)
+}
+
+// set changes the number of slots and how long to wait for one, generations
+// holding a slot keep it until they're done.
+func (l *generationLimiter) set(max int, wait time.Duration) {
+	if max < 1 {
+		max = 1
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sem = make(chan struct{}, max)
+	l.wait = wait
+}
+
+// SetMaxConcurrentGenerations is like the package level
+// SetMaxConcurrentGenerations for the patches of this manager alone, which
+// stop sharing the process wide slots. Managers of large assets can bound
+// their bsdiff memory use this way without holding back the others.
+func (g *ReleaseManager) SetMaxConcurrentGenerations(max int, wait time.Duration) {
+	l := new(generationLimiter)
+	l.set(max, wait)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.generations = l
+}
+
+// GenerationOverflow tells CheckForUpdate what to do when no generation slot
+// frees up in time for a client's patch.
+type GenerationOverflow int
+
+const (
+	// GenerationOverflowServeFull offers the complete new binary instead, the
+	// default.
+	GenerationOverflowServeFull GenerationOverflow = iota
+	// GenerationOverflowFailBusy fails the check with ErrPatchBusy, for
+	// clients to check again later rather than download the whole binary.
+	GenerationOverflowFailBusy
+)
+
+// SetGenerationOverflow sets how clients are answered when too many patches
+// are being generated for theirs.
+func (g *ReleaseManager) SetGenerationOverflow(overflow GenerationOverflow) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.overflow = overflow
+}
+
+// failsBusy tells whether a check whose patch couldn't be generated because
+// of err must fail with ErrPatchBusy.
+func (g *ReleaseManager) failsBusy(err error) bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.overflow == GenerationOverflowFailBusy && errors.Is(err, ErrGenerationBusy)
+}
+
+// limiter returns the generation slots the manager's patches take.
+func (g *ReleaseManager) limiter() *generationLimiter {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	if g.generations == nil {
+		return generations
+	}
+	return g.generations
 }
 
 // GeneratePatch compares the contents of two URLs and generates a patch.
 func GeneratePatch(oldfileURL string, newfileURL string) (p *Patch, err error) {
-	generatePatchMu.Lock()
-	defer generatePatchMu.Unlock()
+	return GeneratePatchContext(context.Background(), oldfileURL, newfileURL)
+}
 
+// GeneratePatchContext is like GeneratePatch, cancelling ctx aborts the
+// downloads.
+func GeneratePatchContext(ctx context.Context, oldfileURL string, newfileURL string) (p *Patch, err error) {
+	return generatePatch(ctx, patchesDirectory, keepDownload(downloadAssetContext), generations, PATCHTYPE_BSDIFF, BsdiffDiffer{}, oldfileURL, newfileURL)
+}
+
+// downloadFunc downloads uri, the returned func is called once the file is no
+// longer needed.
+type downloadFunc func(ctx context.Context, uri string) (localfile string, release func(), err error)
+
+// keepDownload returns a downloadFunc keeping the files download makes.
+func keepDownload(download func(context.Context, string) (string, error)) downloadFunc {
+	return func(ctx context.Context, uri string) (string, func(), error) {
+		localfile, err := download(ctx, uri)
+		return localfile, func() {}, err
+	}
+}
+
+// generatePatch downloads both files with the given func and generates a patch
+// of type t between them with d into dir once limiter has a slot. The
+// downloads are released when it returns.
+func generatePatch(ctx context.Context, dir string, download downloadFunc, limiter *generationLimiter, t PatchType, d Differ, oldfileURL string, newfileURL string) (p *Patch, err error) {
 	p = new(Patch)
 
-	if p.oldfile, err = downloadAsset(oldfileURL); err != nil {
-		return nil, err
+	var done func()
+	if p.oldfile, done, err = download(ctx, oldfileURL); err != nil {
+		if assetGone(err) {
+			return nil, fmt.Errorf("%w: %w", ErrOldAssetGone, err)
+		}
+		return nil, stageError("Downloading old asset", err)
+	}
+	defer done()
+
+	if p.newfile, done, err = download(ctx, newfileURL); err != nil {
+		return nil, stageError("Downloading new asset", err)
+	}
+	defer done()
+
+	release, err := limiter.acquire(ctx)
+	if err != nil {
+		return nil, stageError("Waiting for a generation slot", err)
 	}
+	defer release()
 
-	if p.newfile, err = downloadAsset(newfileURL); err != nil {
+	if p.File, p.fresh, err = diffTo(ctx, t, d, dir, p.oldfile, p.newfile); err != nil {
+		return nil, stageError("Generating patch", err)
+	}
+	if p.Size, err = fileSize(p.File); err != nil {
 		return nil, err
 	}
 
-	if p.File, err = bsdiff(p.oldfile, p.newfile); err != nil {
+	return p, nil
+}
+
+// GeneratePatch returns a patch between the two given URLs, patches are
+// computed once and kept in the manager's cache for subsequent requests.
+// Patches between indexed assets are also looked up in the patch cache
+// directory by their checksums, so they survive restarts. With storage,
+// patches are also looked up in and saved to it.
+func (g *ReleaseManager) GeneratePatch(oldfileURL string, newfileURL string) (*Patch, error) {
+	return g.GeneratePatchContext(context.Background(), oldfileURL, newfileURL)
+}
+
+// GeneratePatchContext is like GeneratePatch, cancelling ctx aborts the
+// downloads. Concurrent calls for the same URLs share a single generation.
+func (g *ReleaseManager) GeneratePatchContext(ctx context.Context, oldfileURL string, newfileURL string) (*Patch, error) {
+	return g.typedPatch(ctx, PATCHTYPE_BSDIFF, oldfileURL, newfileURL)
+}
+
+// typedPatch is GeneratePatchContext for patches of type t.
+func (g *ReleaseManager) typedPatch(ctx context.Context, t PatchType, oldfileURL string, newfileURL string) (*Patch, error) {
+	key := typedPatchCacheKey(t, oldfileURL, newfileURL, Compression.None)
+
+	if p, ok := g.patches.get(key); ok && fileExists(p.File) {
+		g.metrics.PatchCacheLookup(true)
+		g.logger.Debug("Patch cache hit", "old", oldfileURL, "new", newfileURL)
+		return p, nil
+	}
+
+	if p, ok := g.diskPatch(t, oldfileURL, newfileURL); ok {
+		g.metrics.PatchCacheLookup(true)
+		g.logger.Debug("Patch found in cache directory", "old", oldfileURL, "new", newfileURL, "patch", p.File)
+		g.patches.put(key, p)
+		return p, nil
+	}
+
+	if p, ok := g.loadPatch(t, oldfileURL, newfileURL); ok {
+		g.metrics.PatchCacheLookup(true)
+		g.logger.Debug("Patch loaded from storage", "old", oldfileURL, "new", newfileURL)
+		g.patches.put(key, p)
+		return p, nil
+	}
+
+	g.metrics.PatchCacheLookup(false)
+
+	return g.patchFlight.do(ctx, key, func() (*Patch, error) {
+		// Someone may have just finished generating it.
+		if p, ok := g.patches.get(key); ok && fileExists(p.File) {
+			return p, nil
+		}
+		return g.generateCachedPatch(ctx, t, key, oldfileURL, newfileURL)
+	})
+}
+
+// generateCachedPatch generates the patch of type t between the two URLs,
+// stores it and caches it under key.
+func (g *ReleaseManager) generateCachedPatch(ctx context.Context, t PatchType, key string, oldfileURL string, newfileURL string) (*Patch, error) {
+	d := g.differ(t)
+	if d == nil {
+		return nil, fmt.Errorf("No differ for %s patches", t)
+	}
+	ctx, done, err := g.begin(ctx)
+	if err != nil {
 		return nil, err
 	}
+	defer done()
+	g.logger.Debug("Generating patch", "old", oldfileURL, "new", newfileURL)
+	start := time.Now()
+	p, err := generatePatch(ctx, g.PatchCacheDir(), g.downloadKnownAsset, g.limiter(), t, d, oldfileURL, newfileURL)
+	g.metrics.PatchGeneration(time.Since(start), err)
+	if err != nil {
+		g.logger.Error("Could not generate patch", "old", oldfileURL, "new", newfileURL, "err", err)
+		return nil, err
+	}
+	g.logger.Info("Generated patch", "old", oldfileURL, "new", newfileURL, "patch", p.File, "size", p.Size, "duration", time.Since(start))
+	// Post processing rewrites it.
+	defer writing.add(p.File)()
+
+	// A patch found in the directory already went through post processing.
+	if p.fresh {
+		if err = g.postProcessPatch(p); err != nil {
+			removePatchFile(p.File)
+			return nil, err
+		}
+	}
+
+	if p.Size, err = fileSize(p.File); err == nil {
+		g.extendedMetrics().PatchSize(p.Size)
+	}
+
+	g.savePatch(t, oldfileURL, newfileURL, p)
+
+	g.patches.put(key, p)
+	g.evictPatchFiles(p.File)
+	g.cacheWritten(p.File)
 
 	return p, nil
 }
+
+// PatchPostProcess transforms the bytes of a generated patch, e.g. to wrap it
+// in an envelope some clients expect. Clients are given the transformed bytes
+// and must reverse the transform before applying the patch.
+type PatchPostProcess func([]byte) ([]byte, error)
+
+// SetPatchPostProcess sets the transform applied to every patch generated from
+// now on, before it is cached and served. Patches generated before keep their
+// bytes, so the transform is best set before serving any. nil, the default,
+// leaves patches untouched. Transformed patches can't be verified by
+// WarmPatchCache.
+func (g *ReleaseManager) SetPatchPostProcess(fn PatchPostProcess) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.patchPostProcess = fn
+}
+
+// postProcessPatch rewrites the patch file with the manager's transform, if
+// any.
+func (g *ReleaseManager) postProcessPatch(p *Patch) error {
+	g.mu.RLock()
+	fn := g.patchPostProcess
+	g.mu.RUnlock()
+
+	if fn == nil {
+		return nil
+	}
+
+	content, err := ioutil.ReadFile(p.File)
+	if err != nil {
+		return err
+	}
+	if content, err = fn(content); err != nil {
+		return fmt.Errorf("Could not post-process patch: %v", err)
+	}
+	return writeFileAtomic(p.File, content)
+}
+
+// SetPatchCacheSize sets the maximum number of generated patches kept in
+// memory, least recently used patches are dropped first. A size of zero or
+// less means unbounded.
+func (g *ReleaseManager) SetPatchCacheSize(size int) {
+	g.patches.resize(size)
+}
+
+// SetMaxPatchRatio sets the largest patch size, as a fraction of the new
+// asset's size, CheckForUpdate serves. Clients get the full binary when the
+// patch is bigger. Zero or less disables the check.
+func (g *ReleaseManager) SetMaxPatchRatio(ratio float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.maxPatchRatio = ratio
+}
+
+// patchWorthwhile tells whether downloading the patch is cheaper enough than
+// downloading the new asset.
+func (g *ReleaseManager) patchWorthwhile(patch *Patch, newAsset *Asset) bool {
+	return g.patchesWorthwhile([]*Patch{patch}, newAsset)
+}
+
+// patchesWorthwhile is like patchWorthwhile for the total size of the given
+// patches.
+func (g *ReleaseManager) patchesWorthwhile(patches []*Patch, newAsset *Asset) bool {
+	g.mu.RLock()
+	ratio := g.maxPatchRatio
+	g.mu.RUnlock()
+
+	if ratio <= 0 || newAsset.LocalFile == "" {
+		return true
+	}
+
+	var total int64
+	for _, patch := range patches {
+		pfi, err := os.Stat(patch.File)
+		if err != nil {
+			return false
+		}
+		total += pfi.Size()
+	}
+	afi, err := os.Stat(newAsset.LocalFile)
+	if err != nil {
+		return true
+	}
+
+	return float64(total) <= ratio*float64(afi.Size())
+}
+
+// ClearPatchCache drops every cached patch. UpdateAssetsMap calls it when new
+// releases are discovered.
+func (g *ReleaseManager) ClearPatchCache() {
+	g.patches.clear()
+}
@@ -1,10 +1,21 @@
 package server
 
 import (
+	"context"
+	"crypto/rand"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func writeFile(file string, content []byte) (err error) {
@@ -49,3 +60,339 @@ func TestBinaryDiff(t *testing.T) {
 		t.Fatal("File hashes after patch must be equal.")
 	}
 }
+
+func TestMaxConcurrentGenerations(t *testing.T) {
+	requireBsdiff(t)
+	defer SetMaxConcurrentGenerations(defaultMaxGenerations(), -1)
+
+	g, current, update := newTestUpdatePair(t, nil)
+	g.SetMaxPatchRatio(0)
+
+	check := func() *Result {
+		res, err := g.CheckForUpdate(&Params{
+			AppVersion: "1.0.0",
+			OS:         OS.Linux,
+			Arch:       Arch.X64,
+			Checksum:   current.Checksum,
+		})
+		if err != nil && !errors.Is(err, ErrPatchUnavailable) {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	// Saturate generation with the only slot taken.
+	SetMaxConcurrentGenerations(1, 0)
+	release, err := generations.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = g.GeneratePatch(current.URL, update.URL); err != ErrGenerationBusy {
+		t.Fatalf("Expecting ErrGenerationBusy, got %q", err)
+	}
+	if res := check(); res.PatchType != PATCHTYPE_NONE {
+		t.Fatalf("Expecting a full update while saturated, got %+v", res)
+	}
+
+	// Or for clients to come back later.
+	g.SetGenerationOverflow(GenerationOverflowFailBusy)
+	_, err = g.CheckForUpdate(&Params{AppVersion: "1.0.0", OS: OS.Linux, Arch: Arch.X64, Checksum: current.Checksum})
+	if !errors.Is(err, ErrPatchBusy) || !errors.Is(err, ErrGenerationBusy) {
+		t.Fatalf("Expecting ErrPatchBusy while saturated, got %v", err)
+	}
+	if errors.Is(ErrGenerationBusy, ErrPatchBusy) {
+		t.Fatal("Expecting ErrGenerationBusy not to be ErrPatchBusy.")
+	}
+	g.SetGenerationOverflow(GenerationOverflowServeFull)
+
+	// Queued generations give up after the deadline.
+	SetMaxConcurrentGenerations(1, 50*time.Millisecond)
+	release()
+	if release, err = generations.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err = g.GeneratePatch(current.URL, update.URL); err != ErrGenerationBusy {
+		t.Fatalf("Expecting ErrGenerationBusy, got %q", err)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Fatal("Expecting the generation to wait for a slot.")
+	}
+
+	// And go through when a slot is released within the deadline.
+	SetMaxConcurrentGenerations(1, time.Second)
+	release()
+	if release, err = generations.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(20*time.Millisecond, release)
+	if res := check(); res.PatchType != PATCHTYPE_BSDIFF {
+		t.Fatalf("Expecting a patch once a slot is free, got %+v", res)
+	}
+}
+
+func TestManagerMaxConcurrentGenerations(t *testing.T) {
+	requireBsdiff(t)
+
+	g, current, update := newTestUpdatePair(t, nil)
+	g.SetMaxConcurrentGenerations(1, 0)
+
+	// Taking the manager's only slot leaves the process wide ones alone.
+	release, err := g.limiter().acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = g.GeneratePatch(current.URL, update.URL); err != ErrGenerationBusy {
+		t.Fatalf("Expecting ErrGenerationBusy, got %q", err)
+	}
+	if _, err = GeneratePatch(current.URL, update.URL); err != nil {
+		t.Fatalf("Expecting other generations to go through, got %q", err)
+	}
+
+	release()
+	if _, err = g.GeneratePatch(current.URL, update.URL); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGeneratePatchCoalesces(t *testing.T) {
+	requireBsdiff(t)
+
+	// Slow downloads keep the first generation in flight while the others
+	// come in.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte("coalesced " + r.URL.Path))
+	}))
+	defer srv.Close()
+
+	m := newTestMetrics()
+	g := NewReleaseManager("getlantern", "autoupdate-server", WithMetrics(m))
+	if err := g.SetPatchCacheDir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.SetDownloadDir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	patches := make([]*Patch, 10)
+	for i := range patches {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			p, err := g.GeneratePatch(srv.URL+"/old", srv.URL+"/new")
+			if err != nil {
+				t.Error(err)
+			}
+			patches[i] = p
+		}(i)
+	}
+	wg.Wait()
+
+	if m.generations != 1 {
+		t.Fatalf("Expecting a single bsdiff run for the same pair, got %d", m.generations)
+	}
+	for _, p := range patches {
+		if p == nil || p.File != patches[0].File {
+			t.Fatalf("Expecting every caller to get the same patch, got %+v", patches)
+		}
+	}
+}
+
+// BenchmarkGeneratePatch reports the memory allocated to download two large
+// assets and diff them, which must not grow with their size.
+func BenchmarkGeneratePatch(b *testing.B) {
+	requireBsdiff(b)
+
+	const size = 100 << 20
+	dir := b.TempDir()
+	for _, name := range []string{"old", "new"} {
+		fp, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err = io.CopyN(fp, rand.Reader, size); err != nil {
+			b.Fatal(err)
+		}
+		fp.Close()
+	}
+	srv := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	defer srv.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Fresh directories so nothing is reused between runs.
+		work := b.TempDir()
+		download := keepDownload(func(ctx context.Context, uri string) (string, error) {
+			return downloadAssetTo(ctx, http.DefaultClient, work, uri, "", defaultRetryPolicy, defaultDownloadTimeout, noopLogger{})
+		})
+		if _, err := generatePatch(context.Background(), work, download, generations, PATCHTYPE_BSDIFF, BsdiffDiffer{}, srv.URL+"/old", srv.URL+"/new"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestPatchPostProcess(t *testing.T) {
+	requireBsdiff(t)
+
+	g, current, update := newTestUpdatePair(t, nil)
+	g.SetMaxPatchRatio(0)
+
+	xor := func(b []byte) []byte {
+		out := make([]byte, len(b))
+		for i := range b {
+			out[i] = b[i] ^ 0x5a
+		}
+		return out
+	}
+	g.SetPatchPostProcess(func(b []byte) ([]byte, error) {
+		return xor(b), nil
+	})
+
+	res, err := g.CheckForUpdate(&Params{
+		AppVersion: "1.0.0",
+		OS:         OS.Linux,
+		Arch:       Arch.X64,
+		Checksum:   current.Checksum,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.PatchType != PATCHTYPE_BSDIFF {
+		t.Fatalf("Expecting a patch, got %+v", res)
+	}
+
+	rec := httptest.NewRecorder()
+	http.StripPrefix("/patches/", NewPatchHandler(g)).ServeHTTP(rec, httptest.NewRequest("GET", "/"+res.PatchURL, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expecting status %d, got %d", http.StatusOK, rec.Code)
+	}
+	served := rec.Body.Bytes()
+
+	dir, err := ioutil.TempDir("", "autoupdate-postprocess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The served bytes are transformed, they don't patch as they are.
+	patchfile := filepath.Join(dir, "patch")
+	if err = ioutil.WriteFile(patchfile, served, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = bspatch(current.LocalFile, filepath.Join(dir, "bad"), patchfile); err == nil {
+		if checksum, _ := checksumForFile(filepath.Join(dir, "bad")); checksum == update.Checksum {
+			t.Fatal("Expecting the served patch to be transformed.")
+		}
+	}
+
+	// Reversing the transform gets the client the update.
+	if err = ioutil.WriteFile(patchfile, xor(served), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = bspatch(current.LocalFile, filepath.Join(dir, "new"), patchfile); err != nil {
+		t.Fatal(err)
+	}
+	if checksum, _ := checksumForFile(filepath.Join(dir, "new")); checksum != update.Checksum {
+		t.Fatalf("Expecting the reversed patch to produce %s, got %s", update.Checksum, checksum)
+	}
+}
+
+func TestPatchPostProcessOnce(t *testing.T) {
+	requireBsdiff(t)
+
+	srv := newTestAssetServer(map[string]string{
+		"/old": "unindexed old binary",
+		"/new": "unindexed new binary",
+	})
+	defer srv.Close()
+
+	g := NewReleaseManager("getlantern", "autoupdate-server")
+	if err := g.SetPatchCacheDir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	g.SetPatchPostProcess(func(b []byte) ([]byte, error) {
+		return append([]byte("envelope:"), b...), nil
+	})
+
+	// The assets aren't indexed, only the patch cache directory has the
+	// patch once the cache is cleared.
+	var patches [2][]byte
+	for i := range patches {
+		p, err := g.GeneratePatch(srv.URL+"/old", srv.URL+"/new")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if patches[i], err = ioutil.ReadFile(p.File); err != nil {
+			t.Fatal(err)
+		}
+		g.ClearPatchCache()
+	}
+	if strings.Count(string(patches[1]), "envelope:") != 1 || string(patches[0]) != string(patches[1]) {
+		t.Fatalf("Expecting the patch to be transformed once, got %q", patches[1])
+	}
+}
+
+func TestPatchesShareDownloads(t *testing.T) {
+	requireBsdiff(t)
+	setTestPrivateKey(t)
+
+	tags := []string{"1.0.0", "1.1.0", "1.2.0", "1.3.0"}
+	var mu sync.Mutex
+	fetched := make(map[string]int)
+	files := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetched[r.URL.Path]++
+		mu.Unlock()
+		// Large enough for a patch to be worth it over the full binary.
+		for i := 0; i < 200; i++ {
+			fmt.Fprintf(w, "shared downloads %s line %d\n", r.URL.Path, i%10)
+		}
+	}))
+	defer files.Close()
+
+	var releases []string
+	for i, tag := range tags {
+		releases = append(releases, fmt.Sprintf(`{"id": %d, "tag_name": "%s", "zipball_url": "%s/%s.zip", "assets": [
+			{"id": %d, "name": "autoupdate-binary-linux-amd64", "browser_download_url": "%s/%s"}
+		]}`, i+1, tag, files.URL, tag, 10*(i+1), files.URL, tag))
+	}
+	api := newTestReleasesAPI("[" + strings.Join(releases, ",") + "]")
+	defer api.Close()
+
+	g := NewReleaseManager("getlantern", "autoupdate-server")
+	useTestGitHub(t, g, api)
+	g.SetMaxPatchRatio(0)
+	if err := g.SetPatchCacheDir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every old version is patched to the latest one, which is downloaded
+	// once for all of them, along with each old one.
+	for _, tag := range tags[:3] {
+		current := g.updateAssetsMap[OS.Linux][Arch.X64][tag]
+		res, err := g.CheckForUpdate(&Params{AppVersion: tag, OS: OS.Linux, Arch: Arch.X64, Checksum: current.Checksum})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.UpdateType != UPDATETYPE_PATCH || res.Version != "1.3.0" {
+			t.Fatalf("Expecting a patch from %s to 1.3.0, got %+v", tag, res)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for _, tag := range tags {
+		if n := fetched["/"+tag]; n != 1 {
+			t.Fatalf("Expecting %s to be fetched once, got %d", tag, n)
+		}
+	}
+	if n := g.patches.len(); n != 3 {
+		t.Fatalf("Expecting 3 patches, got %d", n)
+	}
+}
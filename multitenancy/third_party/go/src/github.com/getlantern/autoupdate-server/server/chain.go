@@ -0,0 +1,147 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sort"
+)
+
+// PatchStep is one patch of a chain, taking the binary to the next version.
+type PatchStep struct {
+	// version the step updates to
+	Version string `json:"version"`
+	// a URL to the patch to apply
+	PatchURL string `json:"patch_url"`
+	// the patch format
+	PatchType PatchType `json:"patch_type"`
+	// size in bytes of the patch
+	Size int64 `json:"size"`
+	// expected checksum of the binary once the step is applied
+	Checksum string `json:"checksum"`
+	// how the patch is encoded, for clients sending AcceptedCompression
+	Compression string `json:"compression,omitempty"`
+	// SHA-256 of the patch as downloaded
+	PatchChecksum string `json:"patch_checksum,omitempty"`
+	// signature of PatchChecksum
+	PatchSignature string `json:"patch_signature,omitempty"`
+}
+
+// SetMaxChainSteps bounds the number of patches in a chain, clients that would
+// need more are offered the full binary. Zero or less means unbounded, the
+// default.
+func (g *ReleaseManager) SetMaxChainSteps(steps int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.maxChainSteps = steps
+}
+
+// chainAssets returns the assets a client running current goes through to
+// reach update, in order: the good versions of update's channel in between,
+// in update's format, and update itself.
+func (g *ReleaseManager) chainAssets(current *Asset, update *Asset) []*Asset {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	channel := assetChannel(update)
+	chain := []*Asset{update}
+	for _, a := range g.updateAssetsMap[update.OS][update.Arch] {
+		if a.v.GT(current.v) && a.v.LT(update.v) && a.Ext == update.Ext && assetChannel(a) == channel && !g.yanked[a.v.String()] {
+			chain = append(chain, a)
+		}
+	}
+	sort.Slice(chain, func(i, j int) bool { return chain[i].v.LT(chain[j].v) })
+	return chain
+}
+
+// chainUpdate returns a result with the chain of patches of type t from
+// current to update through every version in between. It falls back to a
+// single patch when there is nothing in between or a step can't be generated,
+// and to the full binary when the chain is longer than allowed, no cheaper
+// than it while that fits in the client's space, or larger in total than it
+// takes. Every step is in the smallest encoding the client accepts. It only
+// fails when ctx is done before the patches are ready, with ErrPatchBusy, or
+// with a *PatchPendingError while any of them is generated in the background.
+func (g *ReleaseManager) chainUpdate(ctx context.Context, t PatchType, accepted []string, limits patchLimits, current *Asset, update *Asset) (*Result, error) {
+	chain := g.chainAssets(current, update)
+	if len(chain) == 1 {
+		return g.patchUpdate(ctx, t, accepted, limits, current, update)
+	}
+
+	g.mu.RLock()
+	maxSteps := g.maxChainSteps
+	g.mu.RUnlock()
+
+	if maxSteps > 0 && len(chain) > maxSteps {
+		g.logger.Debug("Chain takes too many steps, serving full update", "old", current.URL, "new", update.URL, "steps", len(chain))
+		return fullUpdate(update), nil
+	}
+
+	steps := make([]PatchStep, 0, len(chain))
+	patches := make([]*Patch, 0, len(chain))
+	var total int64
+	from := current
+	for _, to := range chain {
+		patch, err := g.asyncPatch(ctx, t, from, to)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, ErrPatchPending) {
+				return nil, err
+			}
+			if g.failsBusy(err) {
+				return nil, ErrPatchBusy
+			}
+			g.logger.Warn("Could not generate chained patch, serving a single patch", "old", from.URL, "new", to.URL, "err", err)
+			return g.patchUpdate(ctx, t, accepted, limits, current, update)
+		}
+		patch, ok := g.servedPatch(ctx, t, accepted, from, to, patch)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if !ok {
+			g.logger.Debug("Client takes no encoding of chained patch, serving full update", "old", from.URL, "new", to.URL)
+			return fullUpdate(update), nil
+		}
+		size, err := fileSize(patch.File)
+		if err != nil {
+			g.logger.Warn("Chained patch is gone, serving a single patch", "patch", patch.File, "err", err)
+			return g.patchUpdate(ctx, t, accepted, limits, current, update)
+		}
+		step := PatchStep{
+			Version:   to.v.String(),
+			PatchType: t,
+			Size:      size,
+			Checksum:  to.Checksum,
+		}
+		if len(accepted) > 0 {
+			if step.Compression, step.PatchChecksum, step.PatchSignature, err = g.patchArtifact(patch); err != nil {
+				g.logger.Error("Could not sign chained patch, serving full update", "patch", patch.File, "err", err)
+				return fullUpdate(update), nil
+			}
+		}
+		patches = append(patches, patch)
+		steps = append(steps, step)
+		total += size
+		from = to
+	}
+
+	if limits.tooLarge(total) {
+		g.logger.Debug("Chain is larger than the client takes, serving full update", "old", current.URL, "new", update.URL, "size", total)
+		return fullUpdate(update), nil
+	}
+
+	if !g.patchesWorthwhile(patches, update) && limits.fullFits(update) {
+		g.logger.Debug("Chain is too large, serving full update", "old", current.URL, "new", update.URL, "size", total)
+		return fullUpdate(update), nil
+	}
+
+	for i, patch := range patches {
+		g.markPatchServed(filepath.Base(patch.File))
+		steps[i].PatchURL = g.patchURL(patch)
+	}
+
+	res := fullUpdate(update)
+	res.UpdateType = UPDATETYPE_CHAIN
+	res.Patches = steps
+	res.PatchSize = total
+	return res, nil
+}
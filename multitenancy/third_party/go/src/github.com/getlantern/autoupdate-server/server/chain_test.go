@@ -0,0 +1,144 @@
+package server
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+)
+
+// newTestChain returns a manager with several linux/amd64 versions of the same
+// binary, each one a small change over the previous one.
+func newTestChain(t *testing.T, versions ...string) *ReleaseManager {
+	setTestPrivateKey(t)
+
+	random := make([]byte, 8192)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	for _, tag := range versions {
+		files["/"+tag] = string(random) + "chain " + tag
+	}
+	srv := newTestAssetServer(files)
+	t.Cleanup(srv.Close)
+
+	g := NewReleaseManager("getlantern", "autoupdate-server")
+	for _, tag := range versions {
+		asset := &Asset{Name: "autoupdate-binary-linux-amd64", URL: srv.URL + "/" + tag}
+		asset.v, _ = parseVersion(tag)
+		if err := g.pushAsset(OS.Linux, Arch.X64, asset); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "autoupdate-chain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	if err = g.SetPatchCacheDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	g.SetMaxPatchRatio(0)
+	return g
+}
+
+func TestPatchChain(t *testing.T) {
+	requireBsdiff(t)
+
+	g := newTestChain(t, "1.0.0", "1.1.0", "1.2.0", "1.3.0")
+	current := g.updateAssetsMap[OS.Linux][Arch.X64]["1.0.0"]
+
+	check := func(chain bool) *Result {
+		res, err := g.CheckForUpdate(&Params{
+			AppVersion: "1.0.0",
+			OS:         OS.Linux,
+			Arch:       Arch.X64,
+			Checksum:   current.Checksum,
+			PatchChain: chain,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Version != "1.3.0" {
+			t.Fatalf("Expecting an update to 1.3.0, got %+v", res)
+		}
+		return res
+	}
+
+	// A single patch unless asked for a chain.
+	if res := check(false); res.PatchType != PATCHTYPE_BSDIFF || len(res.Patches) != 0 {
+		t.Fatalf("Expecting a single patch by default, got %+v", res)
+	}
+
+	res := check(true)
+	if len(res.Patches) != 3 || res.UpdateType != UPDATETYPE_CHAIN {
+		t.Fatalf("Expecting a chain of 3 patches, got %+v", res.Patches)
+	}
+	var total int64
+	for _, step := range res.Patches {
+		total += step.Size
+	}
+	if total == 0 || res.PatchSize != total {
+		t.Fatalf("Expecting the chain size to add up its steps, got %d", res.PatchSize)
+	}
+
+	// Applying every step in order gets the client to the latest version.
+	binary := current.LocalFile
+	for i, step := range res.Patches {
+		if want := []string{"1.1.0", "1.2.0", "1.3.0"}[i]; step.Version != want {
+			t.Fatalf("Expecting step %d to update to %s, got %s", i, want, step.Version)
+		}
+		next := filepath.Join(g.PatchCacheDir(), "applied-"+step.Version)
+		if err := bspatch(binary, next, filepath.Join(g.PatchCacheDir(), path.Base(step.PatchURL))); err != nil {
+			t.Fatal(err)
+		}
+		if checksum, _ := checksumForFile(next); checksum != step.Checksum {
+			t.Fatalf("Expecting checksum %s after step %d, got %s", step.Checksum, i, checksum)
+		}
+		binary = next
+	}
+	if res.Patches[2].Checksum != res.Checksum {
+		t.Fatal("Expecting the last step to produce the update.")
+	}
+
+	// Yanked versions are skipped.
+	if err := g.SetYanked("1.2.0", true); err != nil {
+		t.Fatal(err)
+	}
+	if res = check(true); len(res.Patches) != 2 || res.Patches[0].Version != "1.1.0" || res.Patches[1].Version != "1.3.0" {
+		t.Fatalf("Expecting the chain to skip 1.2.0, got %+v", res.Patches)
+	}
+}
+
+func TestMaxChainSteps(t *testing.T) {
+	requireBsdiff(t)
+
+	g := newTestChain(t, "1.0.0", "1.1.0", "1.2.0", "1.3.0", "1.4.0", "1.5.0", "1.6.0")
+	g.SetMaxChainSteps(3)
+
+	check := func(version string) *Result {
+		res, err := g.CheckForUpdate(&Params{
+			AppVersion: version,
+			OS:         OS.Linux,
+			Arch:       Arch.X64,
+			Checksum:   g.updateAssetsMap[OS.Linux][Arch.X64][version].Checksum,
+			PatchChain: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	// Too old clients download the whole binary.
+	if res := check("1.0.0"); res.PatchType != PATCHTYPE_NONE || len(res.Patches) != 0 {
+		t.Fatalf("Expecting a full update for a 6 step chain, got %+v", res)
+	}
+	if res := check("1.3.0"); len(res.Patches) != 3 {
+		t.Fatalf("Expecting a chain of 3 patches, got %+v", res.Patches)
+	}
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+)
+
+// Differ generates binary patches between two files and applies them, see
+// SetDiffer.
+type Differ interface {
+	// Diff writes the patch from the file at oldPath to the one at newPath
+	// into patchPath.
+	Diff(oldPath string, newPath string, patchPath string) error
+	// Patch applies the patch at patchPath to the file at oldPath, writing
+	// the result to newPath.
+	Patch(oldPath string, newPath string, patchPath string) error
+}
+
+// ContextDiffer is a Differ whose diffs can be cancelled, the manager aborts
+// them when the update check they are for is.
+type ContextDiffer interface {
+	Differ
+	// DiffContext is like Diff, cancelling ctx aborts it.
+	DiffContext(ctx context.Context, oldPath string, newPath string, patchPath string) error
+}
+
+// BsdiffDiffer runs the bsdiff and bspatch binaries, it generates the
+// PATCHTYPE_BSDIFF patches by default.
+type BsdiffDiffer struct{}
+
+// Diff implements Differ.
+func (d BsdiffDiffer) Diff(oldPath string, newPath string, patchPath string) error {
+	return d.DiffContext(context.Background(), oldPath, newPath, patchPath)
+}
+
+// DiffContext implements ContextDiffer, cancelling ctx kills bsdiff.
+func (BsdiffDiffer) DiffContext(ctx context.Context, oldPath string, newPath string, patchPath string) error {
+	if err := exec.CommandContext(ctx, "bsdiff", oldPath, newPath, patchPath).Run(); err != nil {
+		return fmt.Errorf("Failed to generate patch with bsdiff: %q", err)
+	}
+	return nil
+}
+
+// Patch implements Differ.
+func (BsdiffDiffer) Patch(oldPath string, newPath string, patchPath string) error {
+	return bspatch(oldPath, newPath, patchPath)
+}
+
+// Xdelta3Differ runs the xdelta3 binary for PATCHTYPE_XDELTA3 patches, a bit
+// larger than bsdiff ones but generated in a fraction of the time and memory.
+type Xdelta3Differ struct {
+	bin string
+}
+
+// NewXdelta3Differ returns an Xdelta3Differ, failing if xdelta3 is not
+// installed.
+func NewXdelta3Differ() (*Xdelta3Differ, error) {
+	bin, err := exec.LookPath("xdelta3")
+	if err != nil {
+		return nil, fmt.Errorf("Could not find xdelta3: %v", err)
+	}
+	return &Xdelta3Differ{bin: bin}, nil
+}
+
+// Diff implements Differ.
+func (d *Xdelta3Differ) Diff(oldPath string, newPath string, patchPath string) error {
+	return d.DiffContext(context.Background(), oldPath, newPath, patchPath)
+}
+
+// DiffContext implements ContextDiffer, cancelling ctx kills xdelta3.
+func (d *Xdelta3Differ) DiffContext(ctx context.Context, oldPath string, newPath string, patchPath string) error {
+	if err := exec.CommandContext(ctx, d.bin, "-e", "-f", "-s", oldPath, newPath, patchPath).Run(); err != nil {
+		return fmt.Errorf("Failed to generate patch with xdelta3: %q", err)
+	}
+	return nil
+}
+
+// Patch implements Differ.
+func (d *Xdelta3Differ) Patch(oldPath string, newPath string, patchPath string) error {
+	if err := exec.Command(d.bin, "-d", "-f", "-s", oldPath, patchPath, newPath).Run(); err != nil {
+		return fmt.Errorf("Failed to apply patch with xdelta3: %q", err)
+	}
+	return nil
+}
+
+// diff runs d, cancelling ctx aborts it if d is a ContextDiffer.
+func diff(ctx context.Context, d Differ, oldPath string, newPath string, patchPath string) error {
+	if cd, ok := d.(ContextDiffer); ok {
+		return cd.DiffContext(ctx, oldPath, newPath, patchPath)
+	}
+	return d.Diff(oldPath, newPath, patchPath)
+}
+
+// SetDiffer generates the patches of type t with d, nil stops offering them.
+// CheckForUpdate offers clients the first of their Params.PatchTypes there is
+// a differ for, bsdiff patches if they list none, and the full binary if
+// there is none. Only BsdiffDiffer is set by default, for PATCHTYPE_BSDIFF.
+func (g *ReleaseManager) SetDiffer(t PatchType, d Differ) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if d == nil {
+		delete(g.differs, t)
+		return
+	}
+	g.differs[t] = d
+}
+
+// WithDiffer generates the patches of type t with d, see SetDiffer.
+func WithDiffer(t PatchType, d Differ) Option {
+	return func(g *ReleaseManager) {
+		g.SetDiffer(t, d)
+	}
+}
+
+// differ returns the Differ of the patches of type t, nil if there is none.
+func (g *ReleaseManager) differ(t PatchType) Differ {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.differs[t]
+}
+
+// patchTypeFor returns the type of the patches offered to a client applying
+// the given types, in order of preference. ok is false if there is a differ
+// for none of them.
+func (g *ReleaseManager) patchTypeFor(types []PatchType) (t PatchType, ok bool) {
+	if len(types) == 0 {
+		types = []PatchType{PATCHTYPE_BSDIFF}
+	}
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	for _, t := range types {
+		if g.differs[t] != nil {
+			return t, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+// copyDiffer is a Differ whose patches are the new file itself.
+type copyDiffer struct {
+	diffs int32
+}
+
+func (d *copyDiffer) Diff(oldPath string, newPath string, patchPath string) error {
+	atomic.AddInt32(&d.diffs, 1)
+	return copyFile(newPath, patchPath)
+}
+
+func (d *copyDiffer) Patch(oldPath string, newPath string, patchPath string) error {
+	return copyFile(patchPath, newPath)
+}
+
+func copyFile(src string, dst string) error {
+	content, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dst, content, 0600)
+}
+
+func TestNewXdelta3Differ(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+	if _, err := NewXdelta3Differ(); err == nil {
+		t.Fatal("Expecting a missing xdelta3 to fail the differ.")
+	}
+}
+
+func TestCheckForUpdatePatchTypes(t *testing.T) {
+	requireBsdiff(t)
+
+	g, current, update := newTestUpdatePair(t, nil)
+	g.SetMaxPatchRatio(0)
+	check := func(types ...PatchType) *Result {
+		res, err := g.CheckForUpdate(&Params{AppVersion: "1.0.0", OS: OS.Linux, Arch: Arch.X64, Checksum: current.Checksum, PatchTypes: types})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	// Nothing generates xdelta3 patches yet.
+	if res := check(PATCHTYPE_XDELTA3); res.UpdateType != UPDATETYPE_FULL || res.PatchType != PATCHTYPE_NONE {
+		t.Fatalf("Expecting a full update without a differ for the client, got %+v", res)
+	}
+
+	d := new(copyDiffer)
+	g.SetDiffer(PATCHTYPE_XDELTA3, d)
+	xdelta := check(PATCHTYPE_XDELTA3, PATCHTYPE_BSDIFF)
+	if xdelta.UpdateType != UPDATETYPE_PATCH || xdelta.PatchType != PATCHTYPE_XDELTA3 {
+		t.Fatalf("Expecting the patch type the client prefers, got %+v", xdelta)
+	}
+	check(PATCHTYPE_XDELTA3)
+	if n := atomic.LoadInt32(&d.diffs); n != 1 {
+		t.Fatalf("Expecting the patch to be cached, got %d diffs", n)
+	}
+
+	// Clients that don't say get bsdiff patches, cached apart.
+	bsdiff := check()
+	if bsdiff.PatchType != PATCHTYPE_BSDIFF || bsdiff.PatchURL == xdelta.PatchURL {
+		t.Fatalf("Expecting a bsdiff patch of its own, got %+v", bsdiff)
+	}
+
+	patched := filepath.Join(t.TempDir(), "patched")
+	if err := d.Patch(current.LocalFile, patched, filepath.Join(g.PatchCacheDir(), path.Base(xdelta.PatchURL))); err != nil {
+		t.Fatal(err)
+	}
+	if checksum, err := checksumForFile(patched); err != nil || checksum != update.Checksum {
+		t.Fatalf("Expecting the patch to apply to the new asset, got %q", err)
+	}
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"fmt"
+)
+
+// Conflict is a release, or an asset of a release, left out of the assets
+// maps because another one has the same version, or platform and format.
+type Conflict struct {
+	Version string `json:"version"`
+	// Platform is the os/arch of conflicting assets and their extension,
+	// empty for releases.
+	Platform string `json:"platform,omitempty"`
+	// Kept and Dropped are the tags of conflicting releases, or the names
+	// of conflicting assets.
+	Kept    string `json:"kept"`
+	Dropped string `json:"dropped"`
+}
+
+// DuplicatePolicy tells UpdateAssetsMap what to do when several releases
+// have the same version, like a re-tagged release.
+type DuplicatePolicy int
+
+const (
+	// DuplicateNewest keeps the most recently created release, the default.
+	// Ties go to the one with the highest id, then to the first listed.
+	DuplicateNewest DuplicatePolicy = iota
+	// DuplicateError fails the refresh with ErrDuplicateVersion, keeping the
+	// current assets.
+	DuplicateError
+)
+
+// SetDuplicatePolicy sets how releases sharing a version are resolved.
+func (g *ReleaseManager) SetDuplicatePolicy(policy DuplicatePolicy) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.duplicatePolicy = policy
+}
+
+// Conflicts returns the releases and assets the last refresh left out for
+// conflicting with others, see SetDuplicatePolicy and UpdateAssetsMap.
+func (g *ReleaseManager) Conflicts() []Conflict {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return append([]Conflict(nil), g.conflicts...)
+}
+
+// dedupeReleases returns the releases with a single one per version, chosen
+// by policy, and the releases it dropped. Their order is kept otherwise.
+func dedupeReleases(rs []Release, policy DuplicatePolicy) ([]Release, []Conflict, error) {
+	chosen := make(map[string]int, len(rs))
+	for i := range rs {
+		version := rs[i].Version.String()
+		j, ok := chosen[version]
+		if !ok {
+			chosen[version] = i
+			continue
+		}
+		if policy == DuplicateError {
+			return nil, nil, fmt.Errorf("%w: %v", ErrDuplicateVersion, version)
+		}
+		log.Debugf("Release %v is listed more than once", version)
+		if newerRelease(&rs[i], &rs[j]) {
+			chosen[version] = i
+		}
+	}
+
+	if len(chosen) == len(rs) {
+		return rs, nil, nil
+	}
+
+	deduped := make([]Release, 0, len(chosen))
+	var conflicts []Conflict
+	for i := range rs {
+		version := rs[i].Version.String()
+		if j := chosen[version]; j != i {
+			conflicts = append(conflicts, Conflict{Version: version, Kept: rs[j].Tag, Dropped: rs[i].Tag})
+			continue
+		}
+		deduped = append(deduped, rs[i])
+	}
+	return deduped, conflicts, nil
+}
+
+// preferredAsset tells whether a is indexed rather than b, both update assets
+// of the same release for the same platform and format. An asset naming the
+// release version wins over one that doesn't, then the one uploaded last,
+// then the one with the highest id, so that every server picks the same one.
+func preferredAsset(a *assetJob, b *assetJob) bool {
+	if a.named != b.named {
+		return a.named
+	}
+	if !a.asset.uploaded.Equal(b.asset.uploaded) {
+		return a.asset.uploaded.After(b.asset.uploaded)
+	}
+	return a.asset.id > b.asset.id
+}
+
+// newerRelease tells whether a was created after b, by id if the creation
+// times don't tell.
+func newerRelease(a *Release, b *Release) bool {
+	if !a.created.Equal(b.created) {
+		return a.created.After(b.created)
+	}
+	return a.id > b.id
+}
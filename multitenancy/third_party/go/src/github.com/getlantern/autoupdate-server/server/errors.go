@@ -2,10 +2,271 @@ package server
 
 import (
 	"errors"
+	"fmt"
+	"time"
 )
 
 // Public errors
 var (
 	ErrNoSuchAsset       = errors.New(`No such asset with the given checksum`)
 	ErrNoUpdateAvailable = errors.New(`No update available`)
+	ErrUnauthorized      = errors.New(`Github rejected the credentials, check the access token`)
+	ErrPlatformEOL       = errors.New(`Platform is no longer supported`)
+	ErrDigestMismatch    = errors.New(`Asset checksum does not match the digest reported by Github`)
+	ErrRateLimited       = errors.New(`Github API rate limit exceeded`)
+	ErrPatchVerification = errors.New(`Patch failed verification`)
+	ErrNotModified       = errors.New(`Releases did not change`)
+	ErrNoSuchAuxAsset    = errors.New(`No such auxiliary asset`)
+	ErrGenerationBusy    = errors.New(`Too many patches being generated`)
+	ErrPatchBusy         = fmt.Errorf("%w, check again later", ErrGenerationBusy)
+	ErrInvalidParams     = errors.New(`Invalid update check params`)
+	ErrNoSuchApp         = errors.New(`No such application`)
+	ErrNoSuchVersion     = errors.New(`No such version`)
+	ErrBadSignature      = errors.New(`Asset signature does not verify`)
+	ErrNotStored         = errors.New(`No value stored under the given key`)
+	ErrSnapshotVersion   = errors.New(`Unsupported assets snapshot version`)
+	ErrSnapshotStale     = errors.New(`Assets snapshot is too old`)
+	ErrCorruptDownload   = errors.New(`Downloaded asset does not match its checksum`)
+	ErrAssetUnreachable  = errors.New(`Could not download asset`)
+	ErrBadAppVersion     = errors.New(`App version is not a semantic version`)
+	ErrDuplicateVersion  = errors.New(`Several releases have the same version`)
+	ErrVersionMismatch   = errors.New(`App version does not match the checksum`)
+	ErrChecksumMismatch  = errors.New(`Checksum matches no asset of the app version`)
+	ErrUnverifiedAsset   = errors.New(`Asset provenance could not be verified`)
+	ErrMaintenance       = errors.New(`Updates are paused for maintenance`)
+	ErrNoSuchPlatform    = errors.New(`No asset for the given platform`)
+	ErrOldAssetGone      = errors.New(`Asset to patch from is gone`)
+	ErrPatchPending      = errors.New(`Patch is being generated`)
+	ErrUnknownPlatform   = errors.New(`Could not tell the client platform`)
+	ErrShuttingDown      = errors.New(`Release manager is shutting down`)
+	ErrInsufficientSpace = errors.New(`Update does not fit in the space available`)
+	ErrUnknownVersion    = errors.New(`Client version is not recognized`)
+	ErrPatchUnavailable  = errors.New(`No patch could be made, full update served`)
+
+	// ErrUnsupportedPlatform is returned by CheckForUpdate for platforms the
+	// manager has no asset of, it matches ErrNoSuchPlatform too.
+	// ErrUnknownPlatform is for clients that didn't tell their platform in
+	// the first place.
+	ErrUnsupportedPlatform = fmt.Errorf("Unsupported platform: %w", ErrNoSuchPlatform)
 )
+
+// RateLimitError is returned when the Github API rate limit is exhausted,
+// callers should back off until Reset. It matches ErrRateLimited when using
+// errors.Is.
+type RateLimitError struct {
+	Reset time.Time
+	// RetryAfter is how long Github asked to wait before trying again, zero
+	// when the limit only frees up at Reset.
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("%v, resets at %v", ErrRateLimited, e.Reset)
+}
+
+// until returns when trying again may succeed, the later of Reset and
+// RetryAfter from now if Github asked to wait.
+func (e *RateLimitError) until() time.Time {
+	if after := time.Now().Add(e.RetryAfter); e.RetryAfter > 0 && after.After(e.Reset) {
+		return after
+	}
+	return e.Reset
+}
+
+// Is makes errors.Is(err, ErrRateLimited) hold for any *RateLimitError.
+func (e *RateLimitError) Is(target error) bool {
+	return target == ErrRateLimited
+}
+
+// PlatformEOLError is returned when a client checks for updates from a
+// platform that reached its end of life. It matches ErrPlatformEOL when using
+// errors.Is.
+type PlatformEOLError struct {
+	OS           string
+	Arch         string
+	MigrationURL string
+}
+
+func (e *PlatformEOLError) Error() string {
+	msg := fmt.Sprintf("Platform %s/%s is no longer supported", e.OS, e.Arch)
+	if e.MigrationURL != "" {
+		msg += ", please visit " + e.MigrationURL
+	}
+	return msg
+}
+
+// Is makes errors.Is(err, ErrPlatformEOL) hold for any *PlatformEOLError.
+func (e *PlatformEOLError) Is(target error) bool {
+	return target == ErrPlatformEOL
+}
+
+// UnknownAppError is returned by a ReleaseManagerRegistry for an application
+// ID it does not serve.
+type UnknownAppError struct {
+	AppID string
+}
+
+func (e *UnknownAppError) Error() string {
+	return fmt.Sprintf("No such application: %q", e.AppID)
+}
+
+// Is makes errors.Is(err, ErrNoSuchApp) hold for any *UnknownAppError.
+func (e *UnknownAppError) Is(target error) bool {
+	return target == ErrNoSuchApp
+}
+
+// ChannelChangeError is returned by CheckForUpdate when the client already
+// runs the latest binary but got it from another channel, like a beta that was
+// promoted to stable. The client should move to Channel, there is nothing to
+// download. It matches ErrNoUpdateAvailable when using errors.Is.
+type ChannelChangeError struct {
+	Channel string
+}
+
+func (e *ChannelChangeError) Error() string {
+	return fmt.Sprintf("%v, switch to the %s channel", ErrNoUpdateAvailable, e.Channel)
+}
+
+// Is makes errors.Is(err, ErrNoUpdateAvailable) hold for any
+// *ChannelChangeError.
+func (e *ChannelChangeError) Is(target error) bool {
+	return target == ErrNoUpdateAvailable
+}
+
+// ParamsError is returned by CheckForUpdate when the client sent malformed
+// params. It matches ErrInvalidParams when using errors.Is.
+type ParamsError struct {
+	Reason string
+}
+
+func (e *ParamsError) Error() string {
+	return e.Reason
+}
+
+// Is makes errors.Is(err, ErrInvalidParams) hold for any *ParamsError.
+func (e *ParamsError) Is(target error) bool {
+	return target == ErrInvalidParams
+}
+
+// AppVersionError is returned by CheckForUpdate when the client's AppVersion
+// can't be parsed. It matches both ErrBadAppVersion and ErrInvalidParams when
+// using errors.Is.
+type AppVersionError struct {
+	AppVersion string
+	Err        error
+}
+
+func (e *AppVersionError) Error() string {
+	return fmt.Sprintf("Bad version string %q: %v", e.AppVersion, e.Err)
+}
+
+// Is makes errors.Is(err, ErrBadAppVersion) and errors.Is(err,
+// ErrInvalidParams) hold for any *AppVersionError.
+func (e *AppVersionError) Is(target error) bool {
+	return target == ErrBadAppVersion || target == ErrInvalidParams
+}
+
+// VersionMismatchError is returned by CheckForUpdate, under the
+// VersionMismatchReject policy, when the client's checksum contradicts its
+// AppVersion. It matches both ErrVersionMismatch and ErrInvalidParams when
+// using errors.Is, and ErrChecksumMismatch too when the checksum matches no
+// asset at all, like for a corrupted install.
+type VersionMismatchError struct {
+	AppVersion string
+	// ChecksumVersion is the version of the asset the checksum matches,
+	// empty if it matches none.
+	ChecksumVersion string
+}
+
+func (e *VersionMismatchError) Error() string {
+	if e.ChecksumVersion == "" {
+		return fmt.Sprintf("%v: no asset of version %s has it", ErrVersionMismatch, e.AppVersion)
+	}
+	return fmt.Sprintf("%v: version %s, checksum of version %s", ErrVersionMismatch, e.AppVersion, e.ChecksumVersion)
+}
+
+// Is makes errors.Is(err, ErrVersionMismatch) and errors.Is(err,
+// ErrInvalidParams) hold for any *VersionMismatchError, and errors.Is(err,
+// ErrChecksumMismatch) and errors.Is(err, ErrUnknownVersion) for those
+// without a ChecksumVersion.
+func (e *VersionMismatchError) Is(target error) bool {
+	if target == ErrChecksumMismatch || target == ErrUnknownVersion {
+		return e.ChecksumVersion == ""
+	}
+	return target == ErrVersionMismatch || target == ErrInvalidParams
+}
+
+// MaintenanceError is returned while updates are paused with SetMaintenance.
+// Clients should check again after RetryAfter. It matches ErrMaintenance when
+// using errors.Is.
+type MaintenanceError struct {
+	Message    string
+	RetryAfter time.Duration
+}
+
+func (e *MaintenanceError) Error() string {
+	if e.Message == "" {
+		return ErrMaintenance.Error()
+	}
+	return e.Message
+}
+
+// Is makes errors.Is(err, ErrMaintenance) hold for any *MaintenanceError.
+func (e *MaintenanceError) Is(target error) bool {
+	return target == ErrMaintenance
+}
+
+// PatchPendingError is returned by CheckForUpdate, with SetAsyncPatches, while
+// the patch the client needs is generated in the background. Clients should
+// check again after RetryAfter. It matches ErrPatchPending when using
+// errors.Is.
+type PatchPendingError struct {
+	RetryAfter time.Duration
+}
+
+func (e *PatchPendingError) Error() string {
+	return fmt.Sprintf("%v, check again in %v", ErrPatchPending, e.RetryAfter)
+}
+
+// Is makes errors.Is(err, ErrPatchPending) hold for any *PatchPendingError.
+func (e *PatchPendingError) Is(target error) bool {
+	return target == ErrPatchPending
+}
+
+// InsufficientSpaceError is returned by CheckForUpdate when neither the patch
+// nor the full binary fit in the AvailableBytes of the client. It matches
+// ErrInsufficientSpace when using errors.Is.
+type InsufficientSpaceError struct {
+	// Required is the size in bytes of the smallest download offered.
+	Required  int64
+	Available int64
+}
+
+func (e *InsufficientSpaceError) Error() string {
+	return fmt.Sprintf("%v, %d bytes required and %d available", ErrInsufficientSpace, e.Required, e.Available)
+}
+
+// Is makes errors.Is(err, ErrInsufficientSpace) hold for any
+// *InsufficientSpaceError.
+func (e *InsufficientSpaceError) Is(target error) bool {
+	return target == ErrInsufficientSpace
+}
+
+// AssetsError is returned by UpdateAssetsMap when some assets could not be
+// prepared, the others were indexed regardless. errors.Is and errors.As look
+// through every failure.
+type AssetsError struct {
+	Errs []error
+}
+
+func (e *AssetsError) Error() string {
+	if len(e.Errs) == 1 {
+		return e.Errs[0].Error()
+	}
+	return fmt.Sprintf("%d assets failed, first: %v", len(e.Errs), e.Errs[0])
+}
+
+// Unwrap returns the error of every failed asset.
+func (e *AssetsError) Unwrap() []error {
+	return e.Errs
+}
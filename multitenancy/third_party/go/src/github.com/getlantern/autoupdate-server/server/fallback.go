@@ -0,0 +1,73 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// defaultGoneAssetCooldown is how long patches from an asset found gone
+// aren't tried again.
+const defaultGoneAssetCooldown = 15 * time.Minute
+
+// SetGoneAssetCooldown sets how long clients running a version whose asset
+// was found gone, like one pruned from github, are served full updates
+// without trying to download it again to patch from. 15 minutes by default,
+// zero tries every time.
+func (g *ReleaseManager) SetGoneAssetCooldown(d time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.goneCooldown = d
+}
+
+// assetGone tells whether a download failed with err because the asset is
+// no longer there.
+func assetGone(err error) bool {
+	var se *statusError
+	return errors.As(err, &se) && (se.code == http.StatusNotFound || se.code == http.StatusGone)
+}
+
+// goneAssetKey is the key of the cohort of clients running a.
+func goneAssetKey(a *Asset) string {
+	return a.OS + "/" + a.Arch + "/" + assetKey(a)
+}
+
+// markAssetGone remembers a can't be patched from for the cooldown.
+func (g *ReleaseManager) markAssetGone(a *Asset) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.goneCooldown <= 0 {
+		return
+	}
+	if g.goneAssets == nil {
+		g.goneAssets = make(map[string]time.Time)
+	}
+	now := time.Now()
+	for key, until := range g.goneAssets {
+		if !now.Before(until) {
+			delete(g.goneAssets, key)
+		}
+	}
+	g.goneAssets[goneAssetKey(a)] = now.Add(g.goneCooldown)
+}
+
+// assetKnownGone tells whether a has no URL or was found gone lately.
+func (g *ReleaseManager) assetKnownGone(a *Asset) bool {
+	if a.URL == "" {
+		return true
+	}
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	until, ok := g.goneAssets[goneAssetKey(a)]
+	return ok && time.Now().Before(until)
+}
+
+// patchUnavailable returns a full update to update for a client whose patch
+// couldn't be made because of cause, along with an error matching
+// ErrPatchUnavailable.
+func patchUnavailable(update *Asset, cause error) (*Result, error) {
+	res := fullUpdate(update)
+	res.PatchUnavailable = true
+	return res, fmt.Errorf("%w: %v", ErrPatchUnavailable, cause)
+}
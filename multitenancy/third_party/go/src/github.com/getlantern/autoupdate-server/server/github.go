@@ -1,30 +1,129 @@
 package server
 
 import (
+	"context"
+	"crypto"
+	"crypto/sha1"
+	"errors"
 	"fmt"
+	"net/http"
 	"regexp"
 	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/blang/semver"
-	"github.com/google/go-github/github"
 )
 
+// Number of assets UpdateAssetsMap prepares at once by default.
+const defaultAssetWorkers = 4
+
+// Names of update assets following the default naming start with this.
+const updateAssetPrefix = "autoupdate-binary-"
+
+// Extension of an asset name telling its format, a single one like ".msix" or
+// a compressed tarball like ".tar.gz". It has a letter, so the last number of
+// a version like 3.1.0-rc.2 is not taken for one.
+const assetExtPattern = `(?P<ext>\.tar\.(?:gz|xz|bz2|zst)|\.[0-9]*[A-Za-z][0-9A-Za-z]*)?`
+
+// A semantic version in an asset name, with its prerelease and build
+// metadata if any. They match as little as they can, leaving a following
+// extension out.
+const assetVersionPattern = `[0-9]+\.[0-9]+\.[0-9]+(?:-[0-9A-Za-z-]+(?:\.[0-9A-Za-z-]+)*?)?(?:\+[0-9A-Za-z-]+(?:\.[0-9A-Za-z-]+)*?)?`
+
 var (
-	updateAssetRe = regexp.MustCompile(`^autoupdate-binary-(darwin|windows|linux)-(arm|386|amd64)\.?.*$`)
+	// Update assets may carry the version they belong to and a trailing
+	// extension telling their format, like
+	// autoupdate-binary-windows-arm64.v3.1.0-rc.2.msix.
+	updateAssetRe = regexp.MustCompile(`^autoupdate-binary-(?P<os>darwin|windows|linux)-(?P<arch>arm64|arm(?:v?[5-7])?|386|amd64)(?:\.(?P<version>v` + assetVersionPattern + `))?` + assetExtPattern + `$`)
+
+	// A release notes line raising the minimum version, like
+	// "Minimum-Version: 2.1.0".
+	minVersionRe = regexp.MustCompile(`(?mi)^minimum-version:[ \t]*(\S+)[ \t\r]*$`)
+
+	// A release notes line staging the rollout of the release, like
+	// "Rollout: 10%".
+	rolloutRe = regexp.MustCompile(`(?mi)^rollout:[ \t]*(\S+?)%?[ \t\r]*$`)
+
+	// Placeholders of an asset name template and what they match.
+	assetTemplateRe     = regexp.MustCompile(`\{(os|arch|version|variant|ext)\}`)
+	assetTemplateGroups = map[string]string{
+		"os":      `(?P<os>[a-z0-9]+)`,
+		"arch":    `(?P<arch>[a-z0-9]+)`,
+		"version": `(?P<version>v?` + assetVersionPattern + `)`,
+		"variant": `(?P<variant>v?[5-7])`,
+		"ext":     assetExtPattern,
+	}
+
+	// An ARM variant in an asset name, like arm6 or armv7.
+	armVariantRe = regexp.MustCompile(`^armv?([5-7])$`)
+
+	// An ARM variant as uname -m reports it, like armv6l or armv5tejl.
+	// 32-bit userlands on ARMv8 report armv8l and run armv7 binaries.
+	unameArmRe = regexp.MustCompile(`^armv([5-8])[a-z]*$`)
 
 	emptyVersion semver.Version
 )
 
-// Arch holds architecture names.
+// Arch holds architecture names. Assets built for an ARM variant are
+// published apart from the plain ARM ones, which are offered to the clients
+// of a variant without assets of its own.
 var Arch = struct {
-	X64 string
-	X86 string
-	ARM string
+	X64   string
+	X86   string
+	ARM   string
+	ARMv5 string
+	ARMv6 string
+	ARMv7 string
+	ARM64 string
 }{
 	"amd64",
 	"386",
 	"arm",
+	"armv5",
+	"armv6",
+	"armv7",
+	"arm64",
+}
+
+// archAliases maps the names some clients report their architecture by, like
+// uname -m on Linux, to the Arch name.
+var archAliases = map[string]string{
+	"aarch64": Arch.ARM64,
+}
+
+// normalizeArch returns the Arch name of arch.
+func normalizeArch(arch string) string {
+	if a, ok := archAliases[arch]; ok {
+		return a
+	}
+	if m := unameArmRe.FindStringSubmatch(arch); m != nil {
+		if m[1] == "8" {
+			return Arch.ARMv7
+		}
+		return Arch.ARM + "v" + m[1]
+	}
+	return arch
+}
+
+// isArmVariant tells whether arch is one of the ARM variants.
+func isArmVariant(arch string) bool {
+	return arch == Arch.ARMv5 || arch == Arch.ARMv6 || arch == Arch.ARMv7
+}
+
+// platformArch returns the arch whose assets are offered to clients of the
+// given platform: plain ARM for an ARM variant without assets of its own.
+func (g *ReleaseManager) platformArch(os string, arch string) string {
+	if !isArmVariant(arch) {
+		return arch
+	}
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	if len(g.updateAssetsMap[os][arch]) == 0 && len(g.updateAssetsMap[os][Arch.ARM]) > 0 {
+		return Arch.ARM
+	}
+	return arch
 }
 
 // OS holds operating system names.
@@ -38,12 +137,49 @@ var OS = struct {
 	"darwin",
 }
 
+// Channel holds release channel names. Stable releases carry no semver
+// prerelease tag, any other channel is named after the first prerelease
+// identifier (e.g. 2.3.0-beta.1 belongs to "beta").
+var Channel = struct {
+	Stable string
+	Beta   string
+}{
+	"stable",
+	"beta",
+}
+
 // Release struct represents a single github release.
 type Release struct {
-	id      int
-	URL     string
-	Version semver.Version
-	Assets  []Asset
+	id         int
+	URL        string
+	Tag        string // git tag, empty if the provider has none
+	Version    semver.Version
+	Prerelease bool
+	Assets     []Asset
+	minVersion semver.Version // from the release notes, if any
+	rollout    float64        // same, if staged
+	staged     bool
+	created    time.Time // zero if unknown
+	notes      string    // release notes, if any
+	latest     bool      // marked as the latest release by github
+}
+
+// parseNotes picks the settings out of the release notes.
+func (rel *Release) parseNotes(notes string) {
+	var err error
+	rel.notes = notes
+	if m := minVersionRe.FindStringSubmatch(notes); m != nil {
+		if rel.minVersion, err = parseVersion(m[1]); err != nil {
+			log.Debugf("Release %v has a bad minimum version, ignoring: %v", rel.Version, err)
+		}
+	}
+	if m := rolloutRe.FindStringSubmatch(notes); m != nil {
+		if rel.rollout, err = parseRollout(m[1]); err != nil {
+			log.Debugf("Release %v has a bad rollout, ignoring: %v", rel.Version, err)
+		} else {
+			rel.staged = true
+		}
+	}
 }
 
 type releasesByID []Release
@@ -55,25 +191,138 @@ type Asset struct {
 	Name      string
 	URL       string
 	LocalFile string
+	Size      int64
 	Checksum  string
+	SHA256    string
+	// SHA1 is the legacy digest some older clients still identify the
+	// asset with.
+	SHA1      string
 	Signature string
+	// SignatureKeyID is the ID of the signing key Signature was made with,
+	// empty for the PRIVATE_KEY file.
+	SignatureKeyID string
+	// Uploader is the login of who uploaded the asset, empty if unknown.
+	Uploader string
+	// Private is set for assets of private repositories, URL needs the
+	// token and clients download them through the server instead.
+	Private bool
+	// Signatures holds a signature per signing key, keyed by key ID.
+	Signatures map[string]string
+	digest     string // as reported by github, e.g. "sha256:..."
+	channel    string
+	uploaded   time.Time // zero if the release provider doesn't tell
 	AssetInfo
 }
 
-// AssetInfo struct holds OS and Arch information of an asset.
+// AssetInfo struct holds OS and Arch information of an asset, along with the
+// extension telling its format.
 type AssetInfo struct {
 	OS   string
 	Arch string
+	// Ext is the extension of the asset name with its dot, like ".msix" or
+	// ".tar.gz", empty for bare binaries.
+	Ext string
+	// Variant is the ARM variant the asset is built for, like "v6", empty for
+	// plain ARM and other architectures. Arch names it as well, like "armv6".
+	Variant string
 }
 
 // ReleaseManager struct defines a repository to pull releases from.
 type ReleaseManager struct {
-	client          *github.Client
-	owner           string
-	repo            string
-	updateAssetsMap map[string]map[string]map[string]*Asset
-	latestAssetsMap map[string]map[string]*Asset
-	mu              *sync.RWMutex
+	httpClient       *http.Client
+	token            string
+	baseURL          string
+	assetPages       *int      // asset pagination threshold, nil keeps the provider default
+	privateAssets    *bool     // nil asks github whether the repository is private
+	etag             string    // of the releases list behind the current maps
+	lastModified     string    // same, for when github sends no ETag
+	lastRefresh      time.Time // last successful UpdateAssetsMap
+	staleSince       time.Time // of the stored assets served until then
+	limitedUntil     time.Time // reset of the last exhausted rate limit
+	refreshInterval  time.Duration
+	updateAssetsMap  map[string]map[string]map[string]*Asset
+	latestAssetsMap  map[string]map[string]map[string]*Asset // channel -> os -> arch
+	eolPlatforms     map[string]map[string]string            // os -> arch -> migration URL
+	minVersions      map[string]map[string]semver.Version    // os -> arch -> floor
+	pins             map[string]map[string]semver.Version    // os -> arch -> served as latest
+	markedLatest     map[string]semver.Version               // channel -> marked latest by github
+	overrides        map[string]semver.Version               // device ID -> served as latest
+	releaseFloor     semver.Version                          // from release notes
+	auxAssetsMap     map[string]map[string]*Asset            // version -> name
+	auxAssetRe       *regexp.Regexp
+	assetNameRes     []*regexp.Regexp   // nil means updateAssetRe
+	skippedAssets    int                // as of the last refresh
+	yanked           map[string]bool    // versions pulled from distribution
+	withdrawn        map[string]string  // asset checksum -> version of a release taken down
+	rollouts         map[string]float64 // version -> percentage, set at runtime
+	stableLag        StableLag
+	stableHeld       map[string]time.Time // version -> held from stable until, see holdStable
+	firstSeen        map[string]time.Time // version -> first listed
+	releaseSettle    time.Duration
+	incomplete       map[string]incompleteRelease // version -> missing platforms, see SetReleaseSettle
+	releaseRollouts  map[string]float64           // same, from release notes
+	releaseNotes     map[string]string            // version -> notes, truncated
+	releaseDates     map[string]time.Time         // version -> creation time, if known
+	releaseTags      map[string]string            // version -> git tag, if any
+	notesLimit       int
+	changelogLimit   int
+	signingKeys      []*SigningKey
+	verifyKeys       []crypto.PublicKey
+	signatures       signatureCache
+	patches          *patchCache
+	patchFlight      flightGroup
+	generations      *generationLimiter // nil shares the process wide one
+	overflow         GenerationOverflow
+	patchDir         string
+	downloadDir      string
+	downloads        downloadRefs
+	patchMaxBytes    int64
+	verifyWorkers    int
+	assetWorkers     int
+	maxPatchRatio    float64
+	maxChainSteps    int
+	duplicatePolicy  DuplicatePolicy
+	conflicts        []Conflict // left out by the last refresh
+	releaseLimit     int        // newest releases kept, zero keeps them all
+	versionMismatch  VersionMismatchPolicy
+	rejectSHA1       bool // SetAcceptSHA1(false)
+	githubLatest     bool // WithGithubLatest
+	latestPin        latestOverride
+	maintenance      maintenance
+	patchPostProcess PatchPostProcess
+	brokenPatches    map[string]bool      // patch file -> failed verification
+	goneAssets       map[string]time.Time // goneAssetKey -> until when it's not tried
+	goneCooldown     time.Duration
+	differs          map[PatchType]Differ
+	async            asyncPatches
+	servedPatches    map[string]bool            // patch file names handed out to clients
+	manifests        map[string]*SignedManifest // by channel/os/arch
+	provider         ReleaseProvider
+	storage          Storage
+	assetStore       AssetStore // nil serves patches with NewPatchHandler
+	uploads          patchUploads
+	channelPromotion bool // move clients to the channel their binary was promoted to
+	state            StateStore
+	metrics          Metrics
+	adoption         *Adoption
+	logger           Logger
+	autoDisable      autoDisable
+	provenance       provenance
+	unverified       map[string]bool // os/arch with assets left out by provenance checks
+	retryPolicy      RetryPolicy     // downloads
+	listRetry        RetryPolicy     // releases requests
+	downloadClient   *http.Client    // nil downloads with the provider's client
+	downloadTimeout  time.Duration   // cap of a download attempt, zero means none
+	autoUpdate       *autoUpdater
+	janitor          *janitor
+	cacheMaxBytes    int64         // of downloads and patches together, see SetCacheMaxBytes
+	cacheMu          sync.Mutex    // serializes cache evictions
+	janitorEvery     time.Duration // from WithJanitor, zero means none
+	janitorAge       time.Duration
+	webhook          webhookRefresh
+	drain            drain
+	refreshMu        sync.Mutex // one UpdateAssetsMap at a time
+	mu               *sync.RWMutex
 }
 
 func (a releasesByID) Len() int {
@@ -88,109 +337,1234 @@ func (a releasesByID) Less(i, j int) bool {
 	return a[i].id < a[j].id
 }
 
-// NewReleaseManager creates a wrapper of github.Client.
-func NewReleaseManager(owner string, repo string) *ReleaseManager {
+// Option configures a ReleaseManager when it's created.
+type Option func(*ReleaseManager)
+
+// WithToken authenticates every API request with the given personal access
+// token or Github App installation token, this raises the rate limit and
+// allows listing releases of private repositories.
+func WithToken(token string) Option {
+	return func(g *ReleaseManager) {
+		g.token = token
+	}
+}
+
+// WithBaseURL points the manager at a different API endpoint, such as a
+// Github Enterprise installation (https://github.example.com/api/v3/).
+func WithBaseURL(baseURL string) Option {
+	return func(g *ReleaseManager) {
+		g.baseURL = baseURL
+	}
+}
+
+// WithAssetPagination lists the assets of releases having at least threshold
+// of them in the releases list page by page, from the release assets
+// endpoint. github embeds only part of the assets of releases with many of
+// them. Defaults to 30, zero lists the assets of every release and a negative
+// threshold never does.
+func WithAssetPagination(threshold int) Option {
+	return func(g *ReleaseManager) {
+		g.assetPages = &threshold
+	}
+}
+
+// WithPrivateAssets tells whether the repository is private, its assets are
+// then downloaded from the API with the token, and clients are pointed at
+// the server's /assets/ route for them, see NewAssetHandler. By default
+// github is asked once a token is set.
+func WithPrivateAssets(private bool) Option {
+	return func(g *ReleaseManager) {
+		g.privateAssets = &private
+	}
+}
+
+// WithHTTPClient sets the HTTP client used to talk to the Github API.
+func WithHTTPClient(c *http.Client) Option {
+	return func(g *ReleaseManager) {
+		g.httpClient = c
+	}
+}
+
+// WithDownloadClient downloads assets with the given client instead of the
+// one of the release provider, to go through a proxy or trust another CA.
+// It is used as is: it needs the credentials of private repositories and
+// its own dial and TLS handshake timeouts.
+func WithDownloadClient(c *http.Client) Option {
+	return func(g *ReleaseManager) {
+		g.downloadClient = c
+	}
+}
+
+// WithSigningKeys signs every asset with each of the given keys, clients pick
+// the signatures they can verify by key ID. The first key also produces the
+// legacy signature, in place of the PRIVATE_KEY file.
+func WithSigningKeys(keys ...*SigningKey) Option {
+	return func(g *ReleaseManager) {
+		g.signingKeys = keys
+	}
+}
+
+// WithReleaseProvider lists releases from the given provider instead of the
+// github repository, such as a GitLabProvider, assets are downloaded with the
+// provider's client. A manager has a single source of releases: it can't be
+// given along with another provider or the Github options.
+func WithReleaseProvider(p ReleaseProvider) Option {
+	return func(g *ReleaseManager) {
+		if g.provider != nil && g.provider != p {
+			panic(fmt.Sprintf("Releases can't come from both %T and %T", g.provider, p))
+		}
+		g.provider = p
+	}
+}
+
+// WithStorage persists the assets maps and generated patches to the given
+// storage. The assets maps are loaded from it when the manager is created, so
+// CheckForUpdate works before the first UpdateAssetsMap completes.
+func WithStorage(s Storage) Option {
+	return func(g *ReleaseManager) {
+		g.storage = s
+	}
+}
+
+// WithRefreshInterval sets how often a ReleaseManagerRegistry refreshes the
+// manager's assets, defaults to 30 minutes.
+func WithRefreshInterval(d time.Duration) Option {
+	return func(g *ReleaseManager) {
+		g.refreshInterval = d
+	}
+}
+
+// NewReleaseManager creates a manager for the releases of the given github
+// repository, or of the provider given WithReleaseProvider. It panics when
+// given both a provider and Github options.
+func NewReleaseManager(owner string, repo string, opts ...Option) *ReleaseManager {
 
 	ghc := &ReleaseManager{
-		client:          github.NewClient(nil),
-		owner:           owner,
-		repo:            repo,
-		mu:              new(sync.RWMutex),
-		updateAssetsMap: make(map[string]map[string]map[string]*Asset),
-		latestAssetsMap: make(map[string]map[string]*Asset),
+		mu:               new(sync.RWMutex),
+		updateAssetsMap:  make(map[string]map[string]map[string]*Asset),
+		latestAssetsMap:  make(map[string]map[string]map[string]*Asset),
+		eolPlatforms:     make(map[string]map[string]string),
+		minVersions:      make(map[string]map[string]semver.Version),
+		auxAssetsMap:     make(map[string]map[string]*Asset),
+		yanked:           make(map[string]bool),
+		pins:             make(map[string]map[string]semver.Version),
+		rollouts:         make(map[string]float64),
+		releaseRollouts:  make(map[string]float64),
+		releaseNotes:     make(map[string]string),
+		releaseDates:     make(map[string]time.Time),
+		releaseTags:      make(map[string]string),
+		notesLimit:       defaultReleaseNotesLimit,
+		changelogLimit:   defaultChangelogLimit,
+		firstSeen:        make(map[string]time.Time),
+		patches:          newPatchCache(defaultPatchCacheSize),
+		brokenPatches:    make(map[string]bool),
+		differs:          map[PatchType]Differ{PATCHTYPE_BSDIFF: BsdiffDiffer{}},
+		servedPatches:    make(map[string]bool),
+		manifests:        make(map[string]*SignedManifest),
+		maxPatchRatio:    defaultMaxPatchRatio,
+		goneCooldown:     defaultGoneAssetCooldown,
+		assetWorkers:     defaultAssetWorkers,
+		refreshInterval:  defaultRefreshInterval,
+		channelPromotion: true,
+		state:            NewMemoryStateStore(),
+		metrics:          noopMetrics{},
+		logger:           noopLogger{},
+		retryPolicy:      defaultRetryPolicy,
+		listRetry:        defaultReleasesRetryPolicy,
+		downloadTimeout:  defaultDownloadTimeout,
+		webhook:          webhookRefresh{debounce: defaultWebhookDebounce},
+	}
+
+	for _, opt := range opts {
+		opt(ghc)
+	}
+
+	if ghc.provider != nil && (ghc.token != "" || ghc.baseURL != "" || ghc.assetPages != nil || ghc.privateAssets != nil || ghc.httpClient != nil || ghc.githubLatest) {
+		panic(fmt.Sprintf("Github options can't be used with releases from %T", ghc.provider))
+	}
+	if ghc.provider == nil {
+		gp := newGithubProvider(owner, repo, ghc.httpClient, ghc.token, ghc.baseURL)
+		if ghc.assetPages != nil {
+			gp.assetPageThreshold = *ghc.assetPages
+		}
+		gp.privateAssets = ghc.privateAssets
+		gp.latestMarker = ghc.githubLatest
+		ghc.provider = gp
+	}
+
+	if _, quiet := ghc.logger.(noopLogger); !quiet {
+		ghc.logger = fieldLogger{ghc.logger, []any{"owner", owner, "repo", repo}}
+	}
+	if lp, ok := ghc.provider.(loggingProvider); ok {
+		lp.setLogger(ghc.logger)
+	}
+
+	if err := ghc.loadAssets(); err != nil {
+		log.Errorf("Could not load stored assets: %q", err)
+	} else {
+		ghc.renderManifests()
+	}
+
+	if ghc.janitorEvery > 0 {
+		ghc.StartJanitor(ghc.janitorEvery, ghc.janitorAge)
 	}
 
 	return ghc
 }
 
-// GetReleases queries github for all product releases.
+// NewReleaseManagerWithToken creates a wrapper of github.Client that
+// authenticates every API request with the given personal access token.
+func NewReleaseManagerWithToken(owner string, repo string, token string) *ReleaseManager {
+	return NewReleaseManager(owner, repo, WithToken(token))
+}
+
+// RateLimit returns the API rate limit status as of the last Github request,
+// the zero RateLimit when releases come from another provider.
+func (g *ReleaseManager) RateLimit() RateLimit {
+	if gp, ok := g.provider.(*githubProvider); ok {
+		return gp.rateLimit()
+	}
+	return RateLimit{}
+}
+
+// RateLimitedUntil returns when the rate limit a refresh last ran into frees
+// up, the zero time if none ever did. Periodic refreshes don't try again
+// before.
+func (g *ReleaseManager) RateLimitedUntil() time.Time {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.limitedUntil
+}
+
+// LastRefresh returns when the assets maps were last known to be up to date
+// with github, the zero time if UpdateAssetsMap never succeeded.
+func (g *ReleaseManager) LastRefresh() time.Time {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.lastRefresh
+}
+
+// GetReleases queries the release provider, github by default, for all
+// product releases, page by page, up to the limit set with SetReleaseLimit.
 func (g *ReleaseManager) GetReleases() ([]Release, error) {
-	rels, _, err := g.client.Repositories.ListReleases(g.owner, g.repo, nil)
+	return g.GetReleasesContext(context.Background())
+}
 
+// GetReleasesContext is like GetReleases, cancelling ctx aborts the request.
+// Transient failures are retried as told by SetReleasesRetryPolicy.
+func (g *ReleaseManager) GetReleasesContext(ctx context.Context) ([]Release, error) {
+	rs, _, err := g.listReleases(ctx, releasesValidator{})
 	if err != nil {
+		g.logger.Error("Could not list releases", "err", err)
 		return nil, err
 	}
 
-	releases := make([]Release, 0, len(rels))
+	g.mu.RLock()
+	limit := g.releaseLimit
+	g.mu.RUnlock()
+	return newestReleases(rs, limit), nil
+}
+
+// UpdateAssetsMap will pull published releases, scan for compatible
+// update-only binaries and will add them to the updateAssetsMap. The request
+// is conditional, the maps are left untouched when github reports the
+// releases did not change since the last successful run.
+// Assets are downloaded and signed by up to SetAssetWorkers at once. An asset
+// that fails is left out, or keeps its previous entry if there is one, and
+// the refresh goes on: the new maps are swapped in regardless and an
+// *AssetsError listing the failures is returned. Releases requests failing
+// with a transient error are retried as told by SetReleasesRetryPolicy.
+// Several update assets of a release for the same platform and format are
+// resolved the same way on every server: the one naming the release version
+// is kept, or else the one uploaded last, and the others are recorded in
+// Conflicts along with the releases SetDuplicatePolicy drops.
+func (g *ReleaseManager) UpdateAssetsMap() (err error) {
+	return g.UpdateAssetsMapContext(context.Background())
+}
+
+// UpdateAssetsMapContext is like UpdateAssetsMap, cancelling ctx aborts the
+// releases request and any asset download in progress. Concurrent calls run
+// one after the other.
+func (g *ReleaseManager) UpdateAssetsMapContext(ctx context.Context) (err error) {
+	// Overlapping refreshes would only download the same assets twice.
+	g.refreshMu.Lock()
+	defer g.refreshMu.Unlock()
 
-	for i := range rels {
-		version := *rels[i].TagName
-		v, err := semver.Parse(version)
+	g.logger.Debug("Refreshing assets")
+	start := time.Now()
+	// Counts of the releases listed and the assets indexed and skipped.
+	var released, indexed, skipped int
+	defer func() {
+		g.metrics.Refresh(time.Since(start), err)
 		if err != nil {
-			log.Debugf("Release %v is not semantically versioned, ignoring: %v", version, err)
-			continue
+			g.logger.Error("Could not refresh assets", "duration", time.Since(start), "releases", released, "assets", indexed, "skipped", skipped, "err", err)
+		} else {
+			g.logger.Info("Refreshed assets", "duration", time.Since(start), "releases", released, "assets", indexed, "skipped", skipped)
 		}
-		rel := Release{
-			id:      *rels[i].ID,
-			URL:     *rels[i].ZipballURL,
-			Version: v,
+	}()
+
+	g.mu.RLock()
+	since := releasesValidator{etag: g.etag, lastModified: g.lastModified}
+	g.mu.RUnlock()
+
+	listStart := time.Now()
+	rs, validator, err := g.listReleases(ctx, since)
+	if err != ErrNotModified {
+		g.extendedMetrics().ReleasesRequest(time.Since(listStart), err)
+	}
+	if err != nil {
+		if err == ErrNotModified {
+			g.logger.Debug("Releases not modified")
+			g.mu.Lock()
+			g.lastRefresh = time.Now()
+			g.staleSince = time.Time{}
+			g.mu.Unlock()
+			return nil
 		}
-		rel.Assets = make([]Asset, 0, len(rels[i].Assets))
-		for _, asset := range rels[i].Assets {
-			rel.Assets = append(rel.Assets, Asset{
-				id:   *asset.ID,
-				Name: *asset.Name,
-				URL:  *asset.BrowserDownloadURL,
-			})
+		g.metrics.GithubError(err)
+		var rle *RateLimitError
+		if errors.As(err, &rle) {
+			g.mu.Lock()
+			g.limitedUntil = rle.until()
+			g.mu.Unlock()
 		}
-		releases = append(releases, rel)
+		return err
 	}
 
-	sort.Sort(sort.Reverse(releasesByID(releases)))
+	g.mu.RLock()
+	policy := g.duplicatePolicy
+	releaseLimit := g.releaseLimit
+	g.mu.RUnlock()
 
-	return releases, nil
-}
+	var conflicts []Conflict
+	if rs, conflicts, err = dedupeReleases(rs, policy); err != nil {
+		return err
+	}
+	for _, c := range conflicts {
+		g.logger.Warn("Dropping release with a duplicate version", "version", c.Version, "kept", c.Kept, "dropped", c.Dropped)
+	}
+	listed := make(map[string]bool)
+	for i := range rs {
+		listed[rs[i].Version.String()] = true
+	}
+	rs = newestReleases(rs, releaseLimit)
+	released = len(rs)
+	stableHeld := g.holdStable(rs, time.Now())
+	markedLatest := make(map[string]semver.Version)
+	for i := range rs {
+		if rs[i].latest {
+			markedLatest[channelForRelease(&rs[i])] = rs[i].Version
+		}
+	}
 
-// UpdateAssetsMap will pull published releases, scan for compatible
-// update-only binaries and will add them to the updateAssetsMap.
-func (g *ReleaseManager) UpdateAssetsMap() (err error) {
+	// New maps are built off to the side and swapped in at once, so readers
+	// never see a half populated map.
+	updateAssetsMap := make(map[string]map[string]map[string]*Asset)
+	latestAssetsMap := make(map[string]map[string]map[string]*Asset)
+	auxAssetsMap := make(map[string]map[string]*Asset)
+	var releaseFloor semver.Version
+	releaseRollouts := make(map[string]float64)
 
-	var rs []Release
+	releaseNotes := make(map[string]string)
+	releaseDates := make(map[string]time.Time)
+	releaseTags := make(map[string]string)
 
-	if rs, err = g.GetReleases(); err != nil {
-		return err
-	}
+	g.mu.RLock()
+	verifyKeys := g.verifyKeys
+	notesLimit := g.notesLimit
+	g.mu.RUnlock()
 
+	// Update assets are prepared by workers once they're all known.
+	var jobs []assetJob
+	unverified := make(map[string]bool)
 	for i := range rs {
+		// Tags are only looked up for releases with update assets.
+		var tagVerified, tagChecked bool
+
+		if rs[i].minVersion.GT(releaseFloor) {
+			releaseFloor = rs[i].minVersion
+		}
+		if rs[i].staged {
+			releaseRollouts[rs[i].Version.String()] = rs[i].rollout
+		}
+		if notes := truncateNotes(rs[i].notes, notesLimit); notes != "" {
+			releaseNotes[rs[i].Version.String()] = notes
+		}
+		if !rs[i].created.IsZero() {
+			releaseDates[rs[i].Version.String()] = rs[i].created
+		}
+		if rs[i].Tag != "" {
+			releaseTags[rs[i].Version.String()] = rs[i].Tag
+		}
+
+		// Jobs of the release, by platform and format.
+		platformJobs := make(map[string]int)
+
+		// Detached signatures published along the binaries, by asset name.
+		detached := make(map[string]string)
+		for _, a := range rs[i].Assets {
+			if strings.HasSuffix(a.Name, signatureSuffix) {
+				detached[strings.TrimSuffix(a.Name, signatureSuffix)] = a.URL
+			}
+		}
+
 		for j := range rs[i].Assets {
+			if g.isAuxAsset(rs[i].Assets[j].Name) {
+				// Companion files are kept around for download but never
+				// offered as updates.
+				asset := rs[i].Assets[j]
+				asset.v = rs[i].Version
+				version := asset.v.String()
+				if auxAssetsMap[version] == nil {
+					auxAssetsMap[version] = make(map[string]*Asset)
+				}
+				auxAssetsMap[version][asset.Name] = &asset
+				g.logger.Debug("Keeping auxiliary asset", "asset", asset.Name, "version", version)
+				if !strings.HasSuffix(asset.Name, signatureSuffix) {
+					skipped++
+				}
+				continue
+			}
 			// Does this asset represent a binary update?
-			if isUpdateAsset(rs[i].Assets[j].Name) {
+			if g.isUpdateAsset(rs[i].Assets[j].Name) {
 				asset := rs[i].Assets[j]
 				asset.v = rs[i].Version
-				info, err := getAssetInfo(asset.Name)
+				asset.channel = channelForRelease(&rs[i])
+				info, version, err := g.assetInfo(asset.Name)
 				if err != nil {
-					return fmt.Errorf("Could not get asset info: %q", err)
+					g.logger.Warn("Skipping asset with an unparsable name", "asset", asset.URL, "release", asset.v.String(), "err", err)
+					skipped++
+					continue
+				}
+				if v, err := parseVersion(version); version != "" && (err != nil || !v.EQ(asset.v)) {
+					g.logger.Info("Skipping asset of another release", "asset", asset.Name, "release", asset.v.String())
+					skipped++
+					continue
+				}
+				asset.Ext = info.Ext
+				if g.provenance.verifiedTags && !tagChecked {
+					if tagVerified, err = g.releaseTagVerified(ctx, &rs[i]); err != nil {
+						g.metrics.GithubError(err)
+						return err
+					}
+					tagChecked = true
+				}
+				if err := g.verifyProvenance(&rs[i], &asset, tagVerified); err != nil {
+					g.logger.Warn("Excluding unverified asset", "asset", asset.Name, "release", asset.v.String(), "err", err)
+					g.metrics.UnverifiedAsset(asset.Name, err)
+					unverified[info.OS+"/"+info.Arch] = true
+					continue
 				}
-				if err = g.pushAsset(info.OS, info.Arch, &asset); err != nil {
-					return fmt.Errorf("Could not push asset: %q", err)
+				job := assetJob{asset: asset, os: info.OS, arch: info.Arch, sigURL: detached[asset.Name], named: version != ""}
+				platform := info.OS + "/" + info.Arch + info.Ext
+				if k, ok := platformJobs[platform]; ok {
+					kept, dropped := &jobs[k], &job
+					if preferredAsset(&job, &jobs[k]) {
+						kept, dropped = dropped, kept
+					}
+					c := Conflict{Version: asset.v.String(), Platform: platform, Kept: kept.asset.Name, Dropped: dropped.asset.Name}
+					g.logger.Warn("Dropping asset with a duplicate platform", "release", c.Version, "platform", platform, "kept", c.Kept, "dropped", c.Dropped)
+					conflicts = append(conflicts, c)
+					jobs[k] = *kept
+					continue
 				}
+				platformJobs[platform] = len(jobs)
+				jobs = append(jobs, job)
+				continue
 			}
+			if g.malformedUpdateAsset(rs[i].Assets[j].Name) {
+				g.logger.Warn("Skipping asset with an unparsable name", "asset", rs[i].Assets[j].URL, "release", rs[i].Version.String(), "pattern", updateAssetRe.String())
+				skipped++
+				continue
+			}
+			g.logger.Debug("Skipping asset, neither an update nor an auxiliary asset", "asset", rs[i].Assets[j].Name, "release", rs[i].Version.String())
+			skipped++
 		}
 	}
 
-	return nil
+	prepared, err := g.prepareAssets(ctx, jobs, verifyKeys)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	for _, asset := range prepared {
+		indexAsset(updateAssetsMap, latestAssetsMap, asset)
+	}
+	indexed = len(prepared)
+
+	g.mu.Lock()
+	if pin := g.latestPin; pin.tag != "" && !listed[pin.v.String()] {
+		g.logger.Error("Release served as latest is no longer listed, serving the highest", "tag", pin.tag)
+	}
+	forceLatest(updateAssetsMap, latestAssetsMap, g.forcedVersions(markedLatest))
+	discovered := false
+	for os := range updateAssetsMap {
+		for arch := range updateAssetsMap[os] {
+			for version := range updateAssetsMap[os][arch] {
+				if g.updateAssetsMap[os] == nil || g.updateAssetsMap[os][arch] == nil || g.updateAssetsMap[os][arch][version] == nil {
+					discovered = true
+				}
+			}
+		}
+	}
+	g.withdrawn = withdrawnReleases(g.withdrawn, g.updateAssetsMap, listed)
+	g.updateAssetsMap = updateAssetsMap
+	g.latestAssetsMap = latestAssetsMap
+	g.markedLatest = markedLatest
+	g.auxAssetsMap = auxAssetsMap
+	g.releaseFloor = releaseFloor
+	g.releaseRollouts = releaseRollouts
+	g.releaseNotes = releaseNotes
+	g.releaseDates = releaseDates
+	g.releaseTags = releaseTags
+	g.unverified = unverified
+	g.stableHeld = stableHeld
+	g.incomplete = g.incompleteReleases(updateAssetsMap, releaseDates, time.Now())
+	incomplete := g.incomplete
+	g.skippedAssets = skipped
+	g.conflicts = conflicts
+	// Validators are only kept once the maps reflect the releases they
+	// describe, failed assets are tried again next time.
+	if err == nil {
+		g.etag = validator.etag
+		g.lastModified = validator.lastModified
+	} else {
+		g.etag, g.lastModified = "", ""
+	}
+	g.lastRefresh = time.Now()
+	g.staleSince = time.Time{}
+	g.mu.Unlock()
+
+	for v, r := range incomplete {
+		g.logger.Warn("Holding back incomplete release", "release", v, "missing", strings.Join(r.missing, ","), "until", r.until)
+	}
+
+	g.saveAssets()
+	g.reportVersions(updateAssetsMap)
+	g.renderManifests()
+
+	if discovered {
+		// Patches against the previous latest versions are no longer served.
+		g.ClearPatchCache()
+	}
+
+	return err
+}
+
+// reportVersions tells the metrics how many versions of each platform are
+// known in the given update assets map.
+func (g *ReleaseManager) reportVersions(updateAssetsMap map[string]map[string]map[string]*Asset) {
+	m := g.extendedMetrics()
+	for os := range updateAssetsMap {
+		for arch, assets := range updateAssetsMap[os] {
+			versions := make(map[string]bool)
+			for _, a := range assets {
+				versions[a.v.String()] = true
+			}
+			m.AssetVersions(os, arch, len(versions))
+		}
+	}
 }
 
-func (g *ReleaseManager) getProductUpdate(os string, arch string) (asset *Asset, err error) {
+// assetJob is an update asset waiting to be prepared by UpdateAssetsMap.
+type assetJob struct {
+	asset  Asset
+	os     string
+	arch   string
+	sigURL string // of its detached signature, if any
+	named  bool   // the asset name tells its version
+}
+
+// SetReleaseLimit has UpdateAssetsMap and GetReleases keep only the given
+// number of releases with the highest versions, prereleases included, to
+// bound the memory and downloads a long release history takes. Clients
+// running an older version get full updates. Zero, the default, keeps every
+// release.
+func (g *ReleaseManager) SetReleaseLimit(n int) {
+	if n < 0 {
+		n = 0
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.releaseLimit = n
+}
+
+// newestReleases returns the n releases with the highest versions, in their
+// original order, or all of them if n is zero.
+func newestReleases(rs []Release, n int) []Release {
+	if n == 0 || len(rs) <= n {
+		return rs
+	}
+	byVersion := make([]*Release, len(rs))
+	for i := range rs {
+		byVersion[i] = &rs[i]
+	}
+	sort.Slice(byVersion, func(i, j int) bool { return byVersion[i].Version.GT(byVersion[j].Version) })
+	floor := byVersion[n-1].Version
+
+	kept := make([]Release, 0, n)
+	for i := range rs {
+		if rs[i].Version.GTE(floor) {
+			kept = append(kept, rs[i])
+		} else {
+			log.Debugf("Release %v is past the release limit, ignoring", rs[i].Version)
+		}
+	}
+	return kept
+}
+
+// SetAssetWorkers sets how many assets UpdateAssetsMap prepares at once, four
+// by default. Github throttles too many parallel downloads.
+func (g *ReleaseManager) SetAssetWorkers(workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.assetWorkers = workers
+}
+
+// prepareAssets prepares the assets of the given jobs across the manager's
+// workers, returning them in the jobs' order. Assets that fail are replaced by
+// their entry in the current maps, if any, and their errors returned in an
+// *AssetsError. Assets without a valid detached signature are skipped.
+func (g *ReleaseManager) prepareAssets(ctx context.Context, jobs []assetJob, verifyKeys []crypto.PublicKey) ([]*Asset, error) {
+	g.mu.RLock()
+	workers := g.assetWorkers
+	g.mu.RUnlock()
+
+	prepared := make([]*Asset, len(jobs))
+	errs := make([]error, len(jobs))
+
+	var wg sync.WaitGroup
+	work := make(chan int)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range work {
+				prepared[j], errs[j] = g.prepareJob(ctx, &jobs[j], verifyKeys)
+			}
+		}()
+	}
+	for j := range jobs {
+		work <- j
+	}
+	close(work)
+	wg.Wait()
+
+	assets := make([]*Asset, 0, len(jobs))
+	var failed []error
+	for j := range jobs {
+		if errs[j] != nil {
+			failed = append(failed, errs[j])
+			if prev := g.previousAsset(&jobs[j]); prev != nil {
+				g.logger.Warn("Keeping the previous asset", "asset", prev.URL, "err", errs[j])
+				assets = append(assets, prev)
+			}
+			continue
+		}
+		if prepared[j] != nil {
+			assets = append(assets, prepared[j])
+		}
+	}
+
+	if len(failed) > 0 {
+		return assets, &AssetsError{Errs: failed}
+	}
+	return assets, nil
+}
+
+// prepareJob prepares the asset of job, reusing the stored one if possible.
+// No asset and no error means it was skipped.
+func (g *ReleaseManager) prepareJob(ctx context.Context, job *assetJob, verifyKeys []crypto.PublicKey) (*Asset, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	asset := job.asset
+	if prev := g.storedAssetFor(job.os, job.arch, &asset); prev != nil {
+		// Same file as before, only the channel may have moved.
+		channel := asset.channel
+		asset = *prev
+		asset.channel = channel
+	} else if err := g.prepareAsset(ctx, job.os, job.arch, &asset); err != nil {
+		return nil, fmt.Errorf("Could not push asset %s: %w", asset.URL, err)
+	}
+
+	if len(verifyKeys) > 0 {
+		if err := g.verifyDetachedSignature(ctx, verifyKeys, job.sigURL, asset.Checksum); err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			// Never offer an asset we can't vouch for.
+			g.logger.Warn("Skipping asset without a valid signature", "asset", asset.URL, "err", err)
+			return nil, nil
+		}
+	}
+
+	return &asset, nil
+}
+
+// previousAsset returns the asset the current maps hold for the platform and
+// version of job.
+func (g *ReleaseManager) previousAsset(job *assetJob) *Asset {
 	g.mu.RLock()
 	defer g.mu.RUnlock()
+	return g.updateAssetsMap[job.os][job.arch][assetKey(&job.asset)]
+}
+
+// getProductUpdate returns the update for clients on the given channel and
+// platform, in the first of the given formats it's published in. instanceID
+// identifies the client for staged rollouts, an empty one bypasses them.
+func (g *ReleaseManager) getProductUpdate(channel string, os string, arch string, instanceID string, formats []string) (asset *Asset, err error) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	defer func() {
+		if err == nil {
+			asset = g.inFormat(asset, formats)
+		}
+	}()
+
+	if asset = g.pinnedAsset(os, arch); asset != nil {
+		return asset, nil
+	}
+
+	asset, err = g.latestAsset(channel, os, arch, instanceID, true)
+	if channel == Channel.Stable {
+		return asset, err
+	}
+
+	// Prerelease channels are offered a stable release when it outranks their
+	// latest prerelease, even while the stable lag holds it back.
+	stable, serr := g.latestAsset(Channel.Stable, os, arch, instanceID, false)
+	if serr != nil {
+		return asset, err
+	}
+	if err != nil || stable.v.GT(asset.v) {
+		return stable, nil
+	}
+	return asset, nil
+}
+
+// inFormat returns the asset published along with a, for the same version and
+// platform, whose extension comes first in formats. a itself is returned when
+// none does. g.mu must be held.
+func (g *ReleaseManager) inFormat(a *Asset, formats []string) *Asset {
+	for _, format := range formats {
+		ext := "." + strings.TrimPrefix(format, ".")
+		if strings.EqualFold(a.Ext, ext) {
+			return a
+		}
+		for _, b := range g.updateAssetsMap[a.OS][a.Arch] {
+			if b.v.EQ(a.v) && strings.EqualFold(b.Ext, ext) {
+				return b
+			}
+		}
+	}
+	return a
+}
 
+// latestAsset returns the latest asset of the given channel the client with
+// the given instance ID may get, leaving out the stable releases the stable
+// lag holds back if lagged. g.mu must be held.
+func (g *ReleaseManager) latestAsset(channel string, os string, arch string, instanceID string, lagged bool) (*Asset, error) {
 	if g.latestAssetsMap == nil {
 		return nil, fmt.Errorf("No updates available.")
 	}
 
-	if g.latestAssetsMap[os] == nil {
+	if g.latestAssetsMap[channel] == nil {
+		return nil, fmt.Errorf("No such channel.")
+	}
+
+	if g.latestAssetsMap[channel][os] == nil {
 		return nil, fmt.Errorf("No such OS.")
 	}
 
-	if g.latestAssetsMap[os][arch] == nil {
+	if g.latestAssetsMap[channel][os][arch] == nil {
 		return nil, fmt.Errorf("No such Arch.")
 	}
 
-	return g.latestAssetsMap[os][arch], nil
+	offered := func(a *Asset) bool {
+		if lagged && channel == Channel.Stable && g.heldFromStable(a.v) {
+			return false
+		}
+		if g.unsettled(a.v) {
+			return false
+		}
+		return g.servable(a.v, instanceID)
+	}
+
+	latest := g.latestAssetsMap[channel][os][arch]
+	if offered(latest) {
+		return latest, nil
+	}
+
+	// The latest version was yanked, is not rolled out to the client yet or
+	// is held back by the stable lag or for missing platforms, fall back to
+	// the best one left, below the one served as latest if any.
+	forced, isForced := g.forcedVersions(g.markedLatest)[channel]
+	latest = nil
+	for _, a := range g.updateAssetsMap[os][arch] {
+		if !offered(a) || assetChannel(a) != channel || isForced && a.v.GT(forced) {
+			continue
+		}
+		if latest == nil || a.v.GT(latest.v) || (a.v.EQ(latest.v) && defaultFormat(a, latest)) {
+			latest = a
+		}
+	}
+	if latest == nil {
+		return nil, fmt.Errorf("No good version left.")
+	}
+	return latest, nil
+}
+
+// SetChannelPromotion sets whether clients running a binary that was promoted
+// to another channel, like a beta that graduated to stable with the same
+// version, are told to switch channels. CheckForUpdate then fails with a
+// *ChannelChangeError instead of ErrNoUpdateAvailable. Enabled by default.
+func (g *ReleaseManager) SetChannelPromotion(enabled bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.channelPromotion = enabled
+}
+
+// SetYanked pulls a version from distribution, or puts it back. Clients are
+// never offered a yanked version and clients running one are made to update
+// to the latest good version.
+func (g *ReleaseManager) SetYanked(version string, yanked bool) error {
+	v, err := parseVersion(version)
+	if err != nil {
+		return err
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if yanked {
+		g.yanked[v.String()] = true
+	} else {
+		delete(g.yanked, v.String())
+	}
+	return nil
+}
+
+func (g *ReleaseManager) isYanked(v semver.Version) bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.yanked[v.String()]
+}
+
+// withdrawnReleases returns the versions of the releases taken down, like
+// those deleted or turned back into drafts on Github, by the checksums of
+// their assets: those already known to be and those indexed but no longer
+// listed. Releases listed again are no longer withdrawn.
+func withdrawnReleases(withdrawn map[string]string, indexed map[string]map[string]map[string]*Asset, listed map[string]bool) map[string]string {
+	next := make(map[string]string)
+	for checksum, version := range withdrawn {
+		if !listed[version] {
+			next[checksum] = version
+		}
+	}
+	for os := range indexed {
+		for arch := range indexed[os] {
+			for version, a := range indexed[os][arch] {
+				if listed[version] {
+					continue
+				}
+				next[a.Checksum] = version
+				if a.SHA1 != "" {
+					next[a.SHA1] = version
+				}
+			}
+		}
+	}
+	return next
+}
+
+// unknownPlatform tells whether nothing was ever published for the given
+// platform, while there are assets for others.
+func (g *ReleaseManager) unknownPlatform(os string, arch string) bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return len(g.updateAssetsMap) > 0 && len(g.updateAssetsMap[os][arch]) == 0
+}
+
+// isWithdrawn tells whether a client running v, with a binary of the given
+// checksum, runs a release taken down.
+func (g *ReleaseManager) isWithdrawn(v semver.Version, checksum string) bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	if _, ok := g.withdrawn[checksum]; ok {
+		return true
+	}
+	for _, version := range g.withdrawn {
+		if version == v.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// Version returns the version the asset was published with.
+func (a *Asset) Version() string {
+	return a.v.String()
+}
+
+// LatestAsset returns the newest stable asset of the given platform, the one
+// CheckForUpdate would offer stable clients, with nothing downloaded or
+// diffed: a cheap way for update screens to tell what's available. Platforms
+// without any asset fail with ErrUnsupportedPlatform, those past their end of
+// life with a *PlatformEOLError.
+func (g *ReleaseManager) LatestAsset(os string, arch string) (*Asset, error) {
+	arch = g.platformArch(os, normalizeArch(arch))
+	if err := g.platformEOL(os, arch); err != nil {
+		return nil, err
+	}
+	asset, err := g.getProductUpdate(Channel.Stable, os, arch, "", nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s/%s", ErrUnsupportedPlatform, os, arch)
+	}
+	return asset, nil
+}
+
+// LatestVersion is like LatestAsset, returning its version only.
+func (g *ReleaseManager) LatestVersion(os string, arch string) (string, error) {
+	asset, err := g.LatestAsset(os, arch)
+	if err != nil {
+		return "", err
+	}
+	return asset.Version(), nil
+}
+
+// AssetsForVersion returns the update assets of every platform published with
+// the given version, sorted by OS and arch.
+func (g *ReleaseManager) AssetsForVersion(version string) ([]*Asset, error) {
+	v, err := parseVersion(version)
+	if err != nil {
+		return nil, fmt.Errorf("Bad version string: %v", err)
+	}
+
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	var assets []*Asset
+	for os := range g.updateAssetsMap {
+		for arch := range g.updateAssetsMap[os] {
+			for _, asset := range g.updateAssetsMap[os][arch] {
+				if asset.v.EQ(v) {
+					assets = append(assets, asset)
+				}
+			}
+		}
+	}
+
+	if len(assets) == 0 {
+		return nil, ErrNoSuchVersion
+	}
+
+	sort.Sort(assetsByPlatform(assets))
+
+	return assets, nil
+}
+
+type assetsByPlatform []*Asset
+
+func (a assetsByPlatform) Len() int      { return len(a) }
+func (a assetsByPlatform) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a assetsByPlatform) Less(i, j int) bool {
+	if a[i].OS != a[j].OS {
+		return a[i].OS < a[j].OS
+	}
+	if a[i].Arch != a[j].Arch {
+		return a[i].Arch < a[j].Arch
+	}
+	return a[i].Ext < a[j].Ext
+}
+
+// SetAuxAssetPattern restricts the auxiliary assets kept by UpdateAssetsMap
+// to those whose name matches the given regular expression. Auxiliary assets
+// are release files that are not update binaries, like install scripts or
+// checksum lists. By default every one of them is kept, an empty pattern
+// brings that back.
+func (g *ReleaseManager) SetAuxAssetPattern(pattern string) error {
+	var re *regexp.Regexp
+	if pattern != "" {
+		var err error
+		if re, err = regexp.Compile(pattern); err != nil {
+			return err
+		}
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.auxAssetRe = re
+	return nil
 }
 
-func (g *ReleaseManager) lookupAssetWithChecksum(os string, arch string, checksum string) (asset *Asset, err error) {
+func (g *ReleaseManager) isAuxAsset(name string) bool {
+	if g.isUpdateAsset(name) {
+		return false
+	}
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.auxAssetRe == nil || g.auxAssetRe.MatchString(name)
+}
+
+// SetAssetPattern sets how update assets are named, so releases don't need to
+// follow the autoupdate-binary-<os>-<arch> convention. A pattern is either a
+// template with {os}, {arch} and optionally {version}, {variant} and {ext}
+// placeholders, like "myapp_{version}_{os}_{arch}.tar.gz", or a regular
+// expression with os, arch and optionally version, variant and ext named
+// groups. {ext} matches an optional extension, like ".msix" or ".tar.gz", and
+// {variant} the ARM variant of an arm arch, like "v7". Several patterns can
+// be given for a repo whose naming changed over time, an asset is taken after
+// the first one it matches. Assets whose version does not match their release
+// are skipped. No pattern, or an empty one, brings the default back.
+func (g *ReleaseManager) SetAssetPattern(patterns ...string) error {
+	res, err := compileAssetPatterns(patterns)
+	if err != nil {
+		return err
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.assetNameRes = res
+	return nil
+}
+
+// WithAssetPattern names update assets after the given patterns, see
+// SetAssetPattern. It panics if a pattern is invalid.
+func WithAssetPattern(patterns ...string) Option {
+	res, err := compileAssetPatterns(patterns)
+	if err != nil {
+		panic(err.Error())
+	}
+	return func(g *ReleaseManager) {
+		g.assetNameRes = res
+	}
+}
+
+// compileAssetPatterns compiles the non-empty patterns, nil if there are none.
+func compileAssetPatterns(patterns []string) ([]*regexp.Regexp, error) {
+	var res []*regexp.Regexp
+	for _, pattern := range patterns {
+		if pattern == "" {
+			continue
+		}
+		re, err := compileAssetPattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// compileAssetPattern turns an asset name template or regular expression into
+// a regular expression with os and arch groups.
+func compileAssetPattern(pattern string) (*regexp.Regexp, error) {
+	expr := pattern
+	if assetTemplateRe.MatchString(pattern) {
+		var b strings.Builder
+		b.WriteString("^")
+		last := 0
+		for _, loc := range assetTemplateRe.FindAllStringSubmatchIndex(pattern, -1) {
+			b.WriteString(regexp.QuoteMeta(pattern[last:loc[0]]))
+			b.WriteString(assetTemplateGroups[pattern[loc[2]:loc[3]]])
+			last = loc[1]
+		}
+		b.WriteString(regexp.QuoteMeta(pattern[last:]))
+		b.WriteString("$")
+		expr = b.String()
+	}
+
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make(map[string]bool)
+	for _, name := range re.SubexpNames() {
+		groups[name] = true
+	}
+	if !groups["os"] || !groups["arch"] {
+		return nil, fmt.Errorf("Asset pattern %q must capture os and arch.", pattern)
+	}
+	return re, nil
+}
+
+func (g *ReleaseManager) assetPatterns() []*regexp.Regexp {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	if g.assetNameRes == nil {
+		return []*regexp.Regexp{updateAssetRe}
+	}
+	return g.assetNameRes
+}
+
+// assetPattern returns the first asset pattern name matches, nil if none.
+func (g *ReleaseManager) assetPattern(name string) *regexp.Regexp {
+	for _, re := range g.assetPatterns() {
+		if re.MatchString(name) {
+			return re
+		}
+	}
+	return nil
+}
+
+func (g *ReleaseManager) isUpdateAsset(name string) bool {
+	return g.assetPattern(name) != nil && !strings.HasSuffix(name, signatureSuffix)
+}
+
+// malformedUpdateAsset tells whether name looks meant as an update asset
+// following the default naming but is for no platform known of, like
+// autoupdate-binary-osx-386. Every name is taken as it is with a custom
+// pattern.
+func (g *ReleaseManager) malformedUpdateAsset(name string) bool {
+	g.mu.RLock()
+	custom := g.assetNameRes != nil
+	g.mu.RUnlock()
+	return !custom && strings.HasPrefix(name, updateAssetPrefix) && !strings.HasSuffix(name, signatureSuffix)
+}
+
+// assetInfo extracts the platform of an update asset from its name, along
+// with its version if the asset pattern has one.
+func (g *ReleaseManager) assetInfo(name string) (*AssetInfo, string, error) {
+	re := g.assetPattern(name)
+	if re == nil {
+		return nil, "", fmt.Errorf("Could not find asset info.")
+	}
+	return matchAssetName(re, name)
+}
+
+// SkippedAssets returns how many assets of the releases listed at the last
+// refresh were not indexed as updates because their name matches no asset
+// pattern, auxiliary assets included, or does not belong to their release.
+// Signatures are not counted.
+func (g *ReleaseManager) SkippedAssets() int {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.skippedAssets
+}
+
+// AuxAsset returns the auxiliary asset with the given name published with the
+// given version. It fails with a *MaintenanceError during maintenance unless
+// downloads are allowed.
+func (g *ReleaseManager) AuxAsset(version string, name string) (*Asset, error) {
+	if m := g.inMaintenance(true); m != nil {
+		return nil, m
+	}
+
+	v, err := parseVersion(version)
+	if err != nil {
+		return nil, fmt.Errorf("Bad version string: %v", err)
+	}
+
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	if asset := g.auxAssetsMap[v.String()][name]; asset != nil {
+		return asset, nil
+	}
+	return nil, ErrNoSuchAuxAsset
+}
+
+// SetPlatformEOL marks an os/arch pair as no longer supported, update checks
+// coming from it will fail with a *PlatformEOLError pointing to migrationURL.
+// An empty arch marks every architecture of the given OS.
+func (g *ReleaseManager) SetPlatformEOL(os string, arch string, migrationURL string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.eolPlatforms[os] == nil {
+		g.eolPlatforms[os] = make(map[string]string)
+	}
+	g.eolPlatforms[os][arch] = migrationURL
+}
+
+// SetMinimumVersion sets the oldest version clients of the given platform may
+// run, older clients are made to download the full binary of the update. An
+// empty arch sets it for every architecture of the OS and an empty OS for
+// every platform. Releases can also raise it for every platform with a
+// "Minimum-Version: x.y.z" line in their notes. An empty version removes it.
+func (g *ReleaseManager) SetMinimumVersion(os string, arch string, version string) error {
+	var v semver.Version
+	if version != "" {
+		var err error
+		if v, err = parseVersion(version); err != nil {
+			return err
+		}
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.minVersions[os] == nil {
+		g.minVersions[os] = make(map[string]semver.Version)
+	}
+	if version == "" {
+		delete(g.minVersions[os], arch)
+	} else {
+		g.minVersions[os][arch] = v
+	}
+	return nil
+}
+
+// minimumVersion returns the oldest version clients of the given platform may
+// run, ok is false if there is no such floor.
+func (g *ReleaseManager) minimumVersion(os string, arch string) (floor semver.Version, ok bool) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	floor, ok = g.releaseFloor, !g.releaseFloor.EQ(emptyVersion)
+	for _, key := range [][2]string{{os, arch}, {os, ""}, {"", ""}} {
+		if v, found := g.minVersions[key[0]][key[1]]; found {
+			if !ok || v.GT(floor) {
+				floor = v
+			}
+			ok = true
+			break
+		}
+	}
+	return floor, ok
+}
+
+// platformEOL returns a non-nil error if the given platform reached its end
+// of life.
+func (g *ReleaseManager) platformEOL(os string, arch string) error {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	if g.eolPlatforms[os] == nil {
+		return nil
+	}
+	migrationURL, ok := g.eolPlatforms[os][arch]
+	if !ok {
+		if migrationURL, ok = g.eolPlatforms[os][""]; !ok {
+			return nil
+		}
+	}
+	return &PlatformEOLError{OS: os, Arch: arch, MigrationURL: migrationURL}
+}
+
+// SetAcceptSHA1 sets whether clients may still identify their binary with its
+// SHA-1, as older ones do, which is the default. Once they're gone, turning it
+// off rejects checks with a "sha1" checksum type and only matches SHA-256
+// checksums.
+func (g *ReleaseManager) SetAcceptSHA1(accept bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.rejectSHA1 = !accept
+}
+
+// acceptsSHA1 tells whether SHA-1 checksums are matched.
+func (g *ReleaseManager) acceptsSHA1() bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return !g.rejectSHA1
+}
+
+// lookupAssetWithChecksum returns the asset of the given platform whose digest
+// is checksum. A checksum of the given type, or of 40 digits when the type is
+// empty, is taken as a SHA-1 if those are accepted.
+func (g *ReleaseManager) lookupAssetWithChecksum(os string, arch string, checksum string, checksumType string) (asset *Asset, err error) {
 	g.mu.RLock()
 	defer g.mu.RUnlock()
 
@@ -206,8 +1580,18 @@ func (g *ReleaseManager) lookupAssetWithChecksum(os string, arch string, checksu
 		return nil, fmt.Errorf("No such Arch.")
 	}
 
+	// Hex digests may come in any case.
+	checksum = strings.ToLower(checksum)
+	legacy := !g.rejectSHA1 && (checksumType == ChecksumType.SHA1 || (checksumType == "" && len(checksum) == sha1.Size*2))
+
 	for _, a := range g.updateAssetsMap[os][arch] {
-		if a.Checksum == checksum {
+		if legacy {
+			if a.SHA1 == checksum {
+				return a, nil
+			}
+			continue
+		}
+		if a.Checksum == checksum || a.SHA256 == checksum {
 			return a, nil
 		}
 	}
@@ -215,10 +1599,25 @@ func (g *ReleaseManager) lookupAssetWithChecksum(os string, arch string, checksu
 	return nil, fmt.Errorf("Could not find a matching checksum in assets list.")
 }
 
+// pushAsset prepares the given asset and adds it to the live assets maps.
 func (g *ReleaseManager) pushAsset(os string, arch string, asset *Asset) (err error) {
+	if err = g.prepareAsset(context.Background(), os, arch, asset); err != nil {
+		return err
+	}
+
 	g.mu.Lock()
 	defer g.mu.Unlock()
 
+	indexAsset(g.updateAssetsMap, g.latestAssetsMap, asset)
+	forceLatest(g.updateAssetsMap, g.latestAssetsMap, g.forcedVersions(g.markedLatest))
+
+	return nil
+}
+
+// prepareAsset downloads the given asset and computes its checksum and
+// signature. It does not touch the assets maps so no lock is held while
+// downloading.
+func (g *ReleaseManager) prepareAsset(ctx context.Context, os string, arch string, asset *Asset) (err error) {
 	version := asset.v
 
 	asset.OS = os
@@ -228,62 +1627,214 @@ func (g *ReleaseManager) pushAsset(os string, arch string, asset *Asset) (err er
 		return fmt.Errorf("Missing asset version.")
 	}
 
-	var localfile string
-	if localfile, err = downloadAsset(asset.URL); err != nil {
+	// Patch generation must not delete the file from under the assets maps.
+	g.downloads.hold(assetFile(g.DownloadDir(), asset.URL))
+	if asset.LocalFile, err = g.downloadAsset(ctx, asset.URL, ""); err != nil {
+		return err
+	}
+	localfile := asset.LocalFile
+
+	// The release provider may tell the size, the download must have it.
+	reported := asset.Size
+	if asset.Size, err = fileSize(localfile); err != nil {
 		return err
 	}
+	if reported > 0 && reported != asset.Size {
+		return fmt.Errorf("%w: got %d of %d bytes", ErrCorruptDownload, asset.Size, reported)
+	}
 
 	if asset.Checksum, err = checksumForFile(localfile); err != nil {
 		return err
 	}
+	if asset.SHA1, err = sha1ForFile(localfile); err != nil {
+		return err
+	}
 
-	if asset.Signature, err = signatureForFile(localfile); err != nil {
+	// Github reports a sha256 digest for newer assets, our checksum must agree
+	// with it or the file was tampered with somewhere along the way.
+	if asset.SHA256, err = digestSHA256(asset.digest); err != nil {
 		return err
 	}
+	if asset.SHA256 == "" {
+		asset.SHA256 = asset.Checksum
+	} else if asset.SHA256 != asset.Checksum {
+		log.Errorf("Asset %s checksum %s does not match github digest %s", asset.URL, asset.Checksum, asset.SHA256)
+		return ErrDigestMismatch
+	}
+
+	if asset.Signature, asset.Signatures, err = g.signAsset(localfile, asset.Checksum); err != nil {
+		return err
+	}
+	if len(g.signingKeys) > 0 {
+		asset.SignatureKeyID = g.signingKeys[0].ID
+	}
+
+	return nil
+}
+
+// indexAsset adds a prepared asset to the given maps.
+func indexAsset(updateAssetsMap map[string]map[string]map[string]*Asset, latestAssetsMap map[string]map[string]map[string]*Asset, asset *Asset) {
+	os, arch := asset.OS, asset.Arch
 
 	// Pushing version.
-	if g.updateAssetsMap[os] == nil {
-		g.updateAssetsMap[os] = make(map[string]map[string]*Asset)
+	if updateAssetsMap[os] == nil {
+		updateAssetsMap[os] = make(map[string]map[string]*Asset)
 	}
-	if g.updateAssetsMap[os][arch] == nil {
-		g.updateAssetsMap[os][arch] = make(map[string]*Asset)
+	if updateAssetsMap[os][arch] == nil {
+		updateAssetsMap[os][arch] = make(map[string]*Asset)
 	}
-	g.updateAssetsMap[os][arch][version.String()] = asset
+	updateAssetsMap[os][arch][assetKey(asset)] = asset
 
-	// Setting latest version.
-	if g.latestAssetsMap[os] == nil {
-		g.latestAssetsMap[os] = make(map[string]*Asset)
+	indexLatest(latestAssetsMap, asset)
+}
+
+// indexLatest makes a prepared asset the latest of its channel and platform in
+// latestAssetsMap, if it's newer than the one there.
+func indexLatest(latestAssetsMap map[string]map[string]map[string]*Asset, asset *Asset) {
+	os, arch := asset.OS, asset.Arch
+
+	// Setting latest version for the channel the asset belongs to.
+	channel := assetChannel(asset)
+	if latestAssetsMap[channel] == nil {
+		latestAssetsMap[channel] = make(map[string]map[string]*Asset)
+	}
+	if latestAssetsMap[channel][os] == nil {
+		latestAssetsMap[channel][os] = make(map[string]*Asset)
 	}
-	if g.latestAssetsMap[os][arch] == nil {
-		g.latestAssetsMap[os][arch] = asset
+	if latestAssetsMap[channel][os][arch] == nil {
+		latestAssetsMap[channel][os][arch] = asset
 	} else {
 		// Compare against already set version
-		if asset.v.GT(g.latestAssetsMap[os][arch].v) {
-			g.latestAssetsMap[os][arch] = asset
+		latest := latestAssetsMap[channel][os][arch]
+		if asset.v.GT(latest.v) || (asset.v.EQ(latest.v) && defaultFormat(asset, latest)) {
+			latestAssetsMap[channel][os][arch] = asset
 		}
 	}
+}
 
-	return nil
+// assetKey returns the key of an update asset among those of its platform:
+// its version, followed by its extension so every format of a version is
+// kept.
+func assetKey(a *Asset) string {
+	return a.v.String() + a.Ext
+}
+
+// defaultFormat tells whether a is offered before b, of the same version, to
+// clients that don't ask for a format: bare binaries come first, then
+// extensions in alphabetical order.
+func defaultFormat(a *Asset, b *Asset) bool {
+	if (a.Ext == "") != (b.Ext == "") {
+		return a.Ext == ""
+	}
+	return strings.ToLower(a.Ext) < strings.ToLower(b.Ext)
+}
+
+// digestSHA256 extracts the hex encoded sum from a github "sha256:..."
+// digest, an empty digest yields an empty sum.
+func digestSHA256(digest string) (string, error) {
+	if digest == "" {
+		return "", nil
+	}
+	parts := strings.SplitN(digest, ":", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("Malformed digest %q.", digest)
+	}
+	if parts[0] != "sha256" {
+		// We can't check other algorithms, fall back to our own checksum.
+		return "", nil
+	}
+	return strings.ToLower(parts[1]), nil
+}
+
+// parseVersion parses a release tag as a semantic version, tolerating the
+// customary "v" prefix (v2.3.0-beta.1). Build metadata is dropped: it plays no
+// part in precedence, so 1.2.0+linux and 1.2.0 are the same version.
+func parseVersion(s string) (semver.Version, error) {
+	v, err := semver.Parse(strings.TrimPrefix(s, "v"))
+	if err != nil {
+		return v, err
+	}
+	v.Build = nil
+	return v, nil
+}
+
+// channelForVersion returns the name of the channel a version is published
+// on: stable when it has no prerelease tag, otherwise the first prerelease
+// identifier without its number, so 1.2.0-rc1 and 1.2.0-rc.2 are both on rc.
+// A numeric prerelease like 1.2.0-1 is on beta.
+func channelForVersion(v semver.Version) string {
+	if len(v.Pre) == 0 {
+		return Channel.Stable
+	}
+	if channel := strings.TrimRight(v.Pre[0].String(), "0123456789"); channel != "" {
+		return channel
+	}
+	return Channel.Beta
 }
 
+// assetChannel returns the name of the channel an asset is published on.
+func assetChannel(a *Asset) string {
+	if a.channel != "" {
+		return a.channel
+	}
+	return channelForVersion(a.v)
+}
+
+// channelForRelease returns the name of the channel a release is published
+// on. Releases flagged as prereleases on Github never make it to the stable
+// channel, even if their tag has no prerelease identifier.
+func channelForRelease(r *Release) string {
+	if r.Prerelease && len(r.Version.Pre) == 0 {
+		return Channel.Beta
+	}
+	return channelForVersion(r.Version)
+}
+
+// getAssetInfo extracts the platform of an update asset named after the
+// default pattern.
 func getAssetInfo(s string) (*AssetInfo, error) {
-	matches := updateAssetRe.FindStringSubmatch(s)
-	if len(matches) >= 3 {
-		if matches[1] != OS.Windows && matches[1] != OS.Linux && matches[1] != OS.Darwin {
-			return nil, fmt.Errorf("Unknown OS: \"%s\".", matches[1])
-		}
-		if matches[2] != Arch.X64 && matches[2] != Arch.X86 && matches[2] != Arch.ARM {
-			return nil, fmt.Errorf("Unknown architecture \"%s\".", matches[2])
+	info, _, err := matchAssetName(updateAssetRe, s)
+	return info, err
+}
+
+// matchAssetName extracts the OS, arch and, if re has a version group, the
+// version out of an asset name. A variant group qualifies an arm arch.
+func matchAssetName(re *regexp.Regexp, s string) (info *AssetInfo, version string, err error) {
+	matches := re.FindStringSubmatch(s)
+	if matches == nil {
+		return nil, "", fmt.Errorf("Could not find asset info.")
+	}
+	info = new(AssetInfo)
+	for i, name := range re.SubexpNames() {
+		switch name {
+		case "os":
+			info.OS = matches[i]
+		case "arch":
+			info.Arch = matches[i]
+			if m := armVariantRe.FindStringSubmatch(info.Arch); m != nil {
+				info.Variant = "v" + m[1]
+				info.Arch = Arch.ARM + info.Variant
+			}
+		case "version":
+			version = matches[i]
+		case "variant":
+			info.Variant = matches[i]
+		case "ext":
+			info.Ext = matches[i]
 		}
-		info := &AssetInfo{
-			OS:   matches[1],
-			Arch: matches[2],
+	}
+	if info.Variant != "" && !isArmVariant(info.Arch) {
+		if info.Arch != Arch.ARM {
+			return nil, "", fmt.Errorf("Variant \"%s\" of a non ARM architecture \"%s\".", info.Variant, info.Arch)
 		}
-		return info, nil
+		info.Variant = "v" + strings.TrimPrefix(info.Variant, "v")
+		info.Arch = Arch.ARM + info.Variant
 	}
-	return nil, fmt.Errorf("Could not find asset info.")
-}
-
-func isUpdateAsset(s string) bool {
-	return updateAssetRe.MatchString(s)
+	if info.OS != OS.Windows && info.OS != OS.Linux && info.OS != OS.Darwin {
+		return nil, "", fmt.Errorf("Unknown OS: \"%s\".", info.OS)
+	}
+	if info.Arch != Arch.X64 && info.Arch != Arch.X86 && info.Arch != Arch.ARM && info.Arch != Arch.ARM64 && !isArmVariant(info.Arch) {
+		return nil, "", fmt.Errorf("Unknown architecture \"%s\".", info.Arch)
+	}
+	return info, version, nil
 }
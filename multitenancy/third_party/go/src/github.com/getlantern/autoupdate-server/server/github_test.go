@@ -1,12 +1,31 @@
 package server
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
 	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
-)
+	"time"
 
-var testClient *ReleaseManager
+	"github.com/blang/semver"
+)
 
 func TestSplitUpdateAsset(t *testing.T) {
 	var err error
@@ -40,57 +59,451 @@ func TestSplitUpdateAsset(t *testing.T) {
 		t.Fatal("Failed to identify update asset.")
 	}
 
+	for name, want := range map[string]AssetInfo{
+		"autoupdate-binary-windows-arm64.msix":   {OS.Windows, Arch.ARM64, ".msix", ""},
+		"autoupdate-binary-darwin-amd64.pkg":     {OS.Darwin, Arch.X64, ".pkg", ""},
+		"autoupdate-binary-linux-amd64.AppImage": {OS.Linux, Arch.X64, ".AppImage", ""},
+		"autoupdate-binary-linux-arm64":          {OS.Linux, Arch.ARM64, "", ""},
+		"autoupdate-binary-darwin-arm64.dmg":     {OS.Darwin, Arch.ARM64, ".dmg", ""},
+		"autoupdate-binary-windows-arm64":        {OS.Windows, Arch.ARM64, "", ""},
+		"autoupdate-binary-linux-arm.v1":         {OS.Linux, Arch.ARM, ".v1", ""},
+		"autoupdate-binary-windows-amd64.exe":    {OS.Windows, Arch.X64, ".exe", ""},
+		"autoupdate-binary-windows-386.zip":      {OS.Windows, Arch.X86, ".zip", ""},
+		"autoupdate-binary-linux-amd64.tar.gz":   {OS.Linux, Arch.X64, ".tar.gz", ""},
+		"autoupdate-binary-linux-arm64.tar.xz":   {OS.Linux, Arch.ARM64, ".tar.xz", ""},
+		"autoupdate-binary-darwin-arm64.tar.bz2": {OS.Darwin, Arch.ARM64, ".tar.bz2", ""},
+		"autoupdate-binary-linux-armv7.tar.gz":   {OS.Linux, Arch.ARMv7, ".tar.gz", "v7"},
+		"autoupdate-binary-linux-arm6":           {OS.Linux, Arch.ARMv6, "", "v6"},
+		"autoupdate-binary-linux-arm5":           {OS.Linux, Arch.ARMv5, "", "v5"},
+	} {
+		if info, err = getAssetInfo(name); err != nil {
+			t.Fatalf("Failed to get asset info of %s: %q", name, err)
+		}
+		if *info != want {
+			t.Fatalf("Expecting %+v for %s, got %+v", want, name, *info)
+		}
+	}
+
 	if _, err = getAssetInfo("autoupdate-binary-osx-386"); err == nil {
 		t.Fatalf("Should have ignored the release, \"osx\" is not a valid OS value.")
 	}
+	if _, err = getAssetInfo("autoupdate-binary-osx-amd64.pkg"); err == nil {
+		t.Fatalf("Should have ignored the release, \"osx\" is not a valid OS value.")
+	}
+	for _, name := range []string{
+		"autoupdate-binary-linux-amd64.tar.gz.gz",
+		"autoupdate-binary-linux-amd64.",
+		"autoupdate-binary-linux-amd64..exe",
+		"autoupdate-binary-linux-amd64-debug.tar.gz",
+		"autoupdate-binary-linux.tar.gz",
+	} {
+		if info, err = getAssetInfo(name); err == nil {
+			t.Fatalf("Expecting %s to be rejected, got %+v", name, *info)
+		}
+	}
+}
+
+func TestArmArchitectures(t *testing.T) {
+	setTestPrivateKey(t)
+
+	names := []string{
+		"autoupdate-binary-linux-arm",
+		"autoupdate-binary-linux-arm64",
+		"autoupdate-binary-darwin-arm64.dmg",
+	}
+	contents := make(map[string]string)
+	var assets []string
+	for i, name := range names {
+		contents["/"+name] = "arm " + name
+		assets = append(assets, fmt.Sprintf(`{"id": %d, "name": "%s", "browser_download_url": "%%[1]s/%s"}`, 10+i, name, name))
+	}
+	files := newTestAssetServer(contents)
+	defer files.Close()
+	api := newTestReleasesAPI(fmt.Sprintf(`[{"id": 1, "tag_name": "1.0.0", "zipball_url": "%[1]s/1.0.0.zip", "assets": [`+strings.Join(assets, ",")+`]}]`, files.URL))
+	defer api.Close()
+
+	g := NewReleaseManager("getlantern", "autoupdate-server")
+	useTestGitHub(t, g, api)
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+	if len(g.updateAssetsMap[OS.Darwin][Arch.ARM64]) != 1 {
+		t.Fatal("Expecting the Apple Silicon asset to be indexed.")
+	}
+
+	for _, c := range []struct {
+		os, arch string
+		tags     map[string]string
+		want     string
+	}{
+		{OS.Linux, Arch.ARM, nil, "autoupdate-binary-linux-arm"},
+		{OS.Linux, Arch.ARM64, nil, "autoupdate-binary-linux-arm64"},
+		{OS.Linux, "aarch64", nil, "autoupdate-binary-linux-arm64"},
+		{"", "", map[string]string{"os": "linux", "arch": "aarch64"}, "autoupdate-binary-linux-arm64"},
+		{OS.Darwin, "aarch64", nil, "autoupdate-binary-darwin-arm64.dmg"},
+	} {
+		res, err := g.CheckForUpdate(&Params{
+			AppVersion: "0.9.0",
+			OS:         c.os,
+			Arch:       c.arch,
+			Tags:       c.tags,
+			Checksum:   "unknown",
+		})
+		if err != nil && !errors.Is(err, ErrUnknownVersion) {
+			t.Fatal(err)
+		}
+		if got := path.Base(res.URL); got != c.want {
+			t.Fatalf("Expecting %s for %s/%s %v, got %s", c.want, c.os, c.arch, c.tags, got)
+		}
+	}
+
+	// armv7 clients never get an aarch64 binary, even when there is nothing
+	// else.
+	if _, err := g.CheckForUpdate(&Params{AppVersion: "0.9.0", OS: OS.Darwin, Arch: Arch.ARM, Checksum: "unknown"}); err == nil {
+		t.Fatal("Expecting no update for darwin/arm")
+	}
+	if v, err := g.LatestVersion(OS.Darwin, "aarch64"); err != nil || v != "1.0.0" {
+		t.Fatalf("Expecting 1.0.0 for darwin/aarch64, got %q: %v", v, err)
+	}
+}
+
+func TestArmVariants(t *testing.T) {
+	setTestPrivateKey(t)
+
+	names := []string{
+		"autoupdate-binary-linux-arm",
+		"autoupdate-binary-linux-arm6",
+		"autoupdate-binary-linux-arm64",
+	}
+	contents := make(map[string]string)
+	var assets []string
+	for i, name := range names {
+		contents["/"+name] = "arm " + name
+		assets = append(assets, fmt.Sprintf(`{"id": %d, "name": "%s", "browser_download_url": "%%[1]s/%s"}`, 10+i, name, name))
+	}
+	files := newTestAssetServer(contents)
+	defer files.Close()
+	api := newTestReleasesAPI(fmt.Sprintf(`[{"id": 1, "tag_name": "1.0.0", "zipball_url": "%[1]s/1.0.0.zip", "assets": [`+strings.Join(assets, ",")+`]}]`, files.URL))
+	defer api.Close()
+
+	g := NewReleaseManager("getlantern", "autoupdate-server")
+	useTestGitHub(t, g, api)
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		arch string
+		want string
+	}{
+		// Variants get their own assets.
+		{"armv6l", "autoupdate-binary-linux-arm6"},
+		{Arch.ARMv6, "autoupdate-binary-linux-arm6"},
+		// Variants without them get the plain arm one, never arm64.
+		{"armv7l", "autoupdate-binary-linux-arm"},
+		{"armv8l", "autoupdate-binary-linux-arm"},
+		{"armv5tejl", "autoupdate-binary-linux-arm"},
+		{Arch.ARM, "autoupdate-binary-linux-arm"},
+		{"aarch64", "autoupdate-binary-linux-arm64"},
+	} {
+		res, err := g.CheckForUpdate(&Params{AppVersion: "0.9.0", OS: OS.Linux, Arch: c.arch, Checksum: "unknown"})
+		if err != nil && !errors.Is(err, ErrUnknownVersion) {
+			t.Fatal(err)
+		}
+		if got := path.Base(res.URL); got != c.want {
+			t.Fatalf("Expecting %s for linux/%s, got %s", c.want, c.arch, got)
+		}
+	}
+	if asset, err := g.LatestAsset(OS.Linux, "armv7l"); err != nil || asset.Arch != Arch.ARM {
+		t.Fatalf("Expecting the plain arm asset for armv7l, got %+v %v", asset, err)
+	}
+}
+
+func TestAssetFormats(t *testing.T) {
+	setTestPrivateKey(t)
+
+	names := []string{
+		"autoupdate-binary-linux-amd64",
+		"autoupdate-binary-linux-amd64.AppImage",
+		"autoupdate-binary-windows-arm64.msix",
+		"autoupdate-binary-windows-arm64.exe",
+	}
+	contents := make(map[string]string)
+	var assets []string
+	for _, name := range names {
+		contents["/"+name] = "formats " + name
+	}
+	files := newTestAssetServer(contents)
+	defer files.Close()
+	for i, name := range names {
+		assets = append(assets, fmt.Sprintf(`{"id": %d, "name": "%s", "browser_download_url": "%s/%s"}`, 10+i, name, files.URL, name))
+	}
+	api := newTestReleasesAPI(fmt.Sprintf(`[{"id": 1, "tag_name": "1.0.0", "zipball_url": "%s/1.0.0.zip", "assets": [%s]}]`,
+		files.URL, strings.Join(assets, ",")))
+	defer api.Close()
+
+	g := NewReleaseManager("getlantern", "autoupdate-server")
+	useTestGitHub(t, g, api)
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(g.updateAssetsMap[OS.Linux][Arch.X64]); n != 2 {
+		t.Fatalf("Expecting both linux formats to be indexed, got %d", n)
+	}
+	if n := len(g.updateAssetsMap[OS.Windows][Arch.ARM64]); n != 2 {
+		t.Fatalf("Expecting both windows formats to be indexed, got %d", n)
+	}
+
+	check := func(os string, arch string, formats ...string) string {
+		res, err := g.CheckForUpdate(&Params{
+			AppVersion: "0.9.0",
+			OS:         os,
+			Arch:       arch,
+			Checksum:   "unknown",
+			Formats:    formats,
+		})
+		if err != nil && !errors.Is(err, ErrUnknownVersion) {
+			t.Fatal(err)
+		}
+		return path.Base(res.URL)
+	}
+
+	for _, c := range []struct {
+		os, arch string
+		formats  []string
+		want     string
+	}{
+		{OS.Linux, Arch.X64, nil, "autoupdate-binary-linux-amd64"},
+		{OS.Linux, Arch.X64, []string{"AppImage"}, "autoupdate-binary-linux-amd64.AppImage"},
+		{OS.Linux, Arch.X64, []string{"deb", ".appimage"}, "autoupdate-binary-linux-amd64.AppImage"},
+		{OS.Linux, Arch.X64, []string{"deb"}, "autoupdate-binary-linux-amd64"},
+		{OS.Windows, Arch.ARM64, nil, "autoupdate-binary-windows-arm64.exe"},
+		{OS.Windows, Arch.ARM64, []string{"msix", "exe"}, "autoupdate-binary-windows-arm64.msix"},
+	} {
+		if got := check(c.os, c.arch, c.formats...); got != c.want {
+			t.Fatalf("Expecting %s for %s/%s accepting %v, got %s", c.want, c.os, c.arch, c.formats, got)
+		}
+	}
+}
+
+func TestAssetPattern(t *testing.T) {
+	setTestPrivateKey(t)
+
+	files := newTestAssetServer(map[string]string{
+		"/myapp_1.2.0_linux_amd64.tar.gz":   "myapp 1.2.0 linux",
+		"/myapp_1.1.0_linux_amd64.tar.gz":   "myapp 1.1.0 linux",
+		"/myapp_1.2.0_freebsd_amd64.tar.gz": "myapp 1.2.0 freebsd",
+	})
+	defer files.Close()
+
+	asset := func(id int, name string) string {
+		return fmt.Sprintf(`{"id": %d, "name": "%s", "browser_download_url": "%s/%s"}`, id, name, files.URL, name)
+	}
+	api := newTestReleasesAPI(fmt.Sprintf(`[{"id": 1, "tag_name": "1.2.0", "zipball_url": "%s/1.2.0.zip", "assets": [%s, %s, %s]}]`, files.URL,
+		asset(10, "myapp_1.2.0_linux_amd64.tar.gz"),
+		asset(11, "myapp_1.1.0_linux_amd64.tar.gz"),
+		asset(12, "myapp_1.2.0_freebsd_amd64.tar.gz")))
+	defer api.Close()
+
+	g := NewReleaseManager("getlantern", "autoupdate-server")
+	useTestGitHub(t, g, api)
+	if err := g.SetAssetPattern("myapp_{version}_{os}_{arch}.tar.gz"); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+	if a := g.updateAssetsMap[OS.Linux][Arch.X64]["1.2.0"]; a == nil || a.Name != "myapp_1.2.0_linux_amd64.tar.gz" {
+		t.Fatalf("Expecting the templated asset to be indexed, got %+v", a)
+	}
+	if len(g.updateAssetsMap) != 1 || len(g.updateAssetsMap[OS.Linux][Arch.X64]) != 1 {
+		t.Fatal("Expecting assets of another version or platform to be skipped.")
+	}
+
+	// Regular expressions name their groups.
+	re, err := compileAssetPattern(`^ReleaseNotes-(?P<version>v[0-9.]+)-(?P<os>[a-z]+)-(?P<arch>[0-9a-z]+)$`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, version, err := matchAssetName(re, "ReleaseNotes-v1.2.0-windows-386")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.OS != OS.Windows || info.Arch != Arch.X86 || version != "v1.2.0" {
+		t.Fatalf("Expecting windows/386 v1.2.0, got %+v %v", info, version)
+	}
+
+	if err = g.SetAssetPattern(`^myapp-(?P<os>[a-z]+)$`); err == nil {
+		t.Fatal("Expecting a pattern without arch to be rejected.")
+	}
+
+	// The default pattern is back with an empty one.
+	if err = g.SetAssetPattern(""); err != nil {
+		t.Fatal(err)
+	}
+	if !g.isUpdateAsset("autoupdate-binary-linux-amd64") || g.isUpdateAsset("myapp_1.2.0_linux_amd64.tar.gz") {
+		t.Fatal("Expecting the default pattern to be used.")
+	}
+}
+
+func TestAssetPatterns(t *testing.T) {
+	setTestPrivateKey(t)
+
+	files := newTestAssetServer(map[string]string{
+		"/myapp.2.0.0.linux.amd64":       "myapp 2.0.0 linux",
+		"/myapp.2.0.0.linux.arm.v7":      "myapp 2.0.0 linux armv7",
+		"/myapp_1.0.0_windows_386.zip":   "myapp 1.0.0 windows",
+		"/myapp_1.0.0_linux_amd64.zip":   "myapp 1.0.0 linux",
+		"/autoupdate-binary-linux-arm64": "myapp 1.0.0 linux arm64",
+	})
+	defer files.Close()
+
+	asset := func(id int, name string) string {
+		return fmt.Sprintf(`{"id": %d, "name": "%s", "browser_download_url": "%s/%s"}`, id, name, files.URL, name)
+	}
+	// The repo went from underscores to dots between the two releases.
+	api := newTestReleasesAPI(fmt.Sprintf(`[
+		{"id": 2, "tag_name": "2.0.0", "zipball_url": "%[1]s/2.0.0.zip", "assets": [%[2]s, %[3]s, %[4]s]},
+		{"id": 1, "tag_name": "1.0.0", "zipball_url": "%[1]s/1.0.0.zip", "assets": [%[5]s, %[6]s, %[7]s]}
+	]`, files.URL,
+		asset(20, "myapp.2.0.0.linux.amd64"),
+		asset(21, "myapp.2.0.0.linux.arm.v7"),
+		asset(22, "checksums.txt"),
+		asset(10, "myapp_1.0.0_windows_386.zip"),
+		asset(11, "myapp_1.0.0_linux_amd64.zip"),
+		asset(12, "autoupdate-binary-linux-arm64")))
+	defer api.Close()
+
+	g := NewReleaseManager("getlantern", "autoupdate-server", WithAssetPattern(
+		"myapp.{version}.{os}.{arch}.{variant}",
+		"myapp.{version}.{os}.{arch}",
+		`^myapp_(?P<version>[0-9.]+)_(?P<os>[a-z]+)_(?P<arch>[0-9a-z]+)\.zip$`))
+	useTestGitHub(t, g, api)
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+
+	if a := g.updateAssetsMap[OS.Linux][Arch.X64]["2.0.0"]; a == nil || a.Name != "myapp.2.0.0.linux.amd64" {
+		t.Fatalf("Expecting the dot separated asset to be indexed, got %+v", a)
+	}
+	if a := g.updateAssetsMap[OS.Linux][Arch.ARMv7]["2.0.0"]; a == nil || a.Name != "myapp.2.0.0.linux.arm.v7" {
+		t.Fatalf("Expecting the variant to qualify the arch, got %+v", a)
+	}
+	if a := g.updateAssetsMap[OS.Windows][Arch.X86]["1.0.0"]; a == nil || a.Name != "myapp_1.0.0_windows_386.zip" {
+		t.Fatalf("Expecting the underscore separated asset of the old release to be indexed, got %+v", a)
+	}
+	if a := g.updateAssetsMap[OS.Linux][Arch.X64]["1.0.0"]; a == nil {
+		t.Fatal("Expecting the old linux release to be indexed.")
+	}
+	if g.updateAssetsMap[OS.Linux][Arch.ARM64] != nil {
+		t.Fatal("Expecting the default naming not to be used along patterns.")
+	}
+	if n := g.SkippedAssets(); n != 2 {
+		t.Fatalf("Expecting 2 skipped assets, got %d", n)
+	}
+	if n := g.Inventory("", "").SkippedAssets; n != 2 {
+		t.Fatalf("Expecting the inventory to tell 2 skipped assets, got %d", n)
+	}
+
+	if _, _, err := matchAssetName(g.assetPattern("myapp.2.0.0.linux.amd64.v7"), "myapp.2.0.0.linux.amd64.v7"); err == nil {
+		t.Fatal("Expecting a variant of a non ARM arch to be refused.")
+	}
+	if err := g.SetAssetPattern("myapp.{version}.{os}.{arch}", "myapp-{os}"); err == nil {
+		t.Fatal("Expecting a pattern without arch to be rejected.")
+	}
+	if err := g.SetAssetPattern(); err != nil || !g.isUpdateAsset("autoupdate-binary-linux-arm64") {
+		t.Fatal("Expecting the default pattern to be back without patterns.")
+	}
 }
 
 func TestNewClient(t *testing.T) {
-	testClient = NewReleaseManager("getlantern", "autoupdate-server")
-	if testClient == nil {
+	if g := NewReleaseManager("getlantern", "autoupdate-server"); g == nil {
 		t.Fatal("Failed to create new client.")
 	}
 }
 
+// newTestMemoryManager returns a manager serving three releases of a linux
+// and a windows binary from memory.
+func newTestMemoryManager(t *testing.T) (*ReleaseManager, *MemoryProvider) {
+	setTestPrivateKey(t)
+
+	p := NewMemoryProvider()
+	for _, tag := range []string{"1.0.0", "1.1.0", "1.2.0"} {
+		assets := make(map[string][]byte)
+		for _, platform := range []string{"linux-amd64", "windows-386"} {
+			content := []byte(strings.Repeat(platform+" binary ", 256) + tag)
+			assets["autoupdate-binary-"+platform] = content
+		}
+		if err := p.AddRelease(tag, "", assets); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return NewReleaseManager("getlantern", "autoupdate-server", WithReleaseProvider(p)), p
+}
+
 func TestListReleases(t *testing.T) {
-	if _, err := testClient.GetReleases(); err != nil {
+	g, _ := newTestMemoryManager(t)
+	rs, err := g.GetReleases()
+	if err != nil {
 		t.Fatal(fmt.Errorf("Failed to pull releases: %q", err))
 	}
+	if len(rs) != 3 || len(rs[0].Assets) != 2 {
+		t.Fatalf("Expecting 3 releases of 2 assets, got %+v", rs)
+	}
 }
 
 func TestUpdateAssetsMap(t *testing.T) {
-	if err := testClient.UpdateAssetsMap(); err != nil {
+	g, _ := newTestMemoryManager(t)
+	if err := g.UpdateAssetsMap(); err != nil {
 		t.Fatal(fmt.Errorf("Failed to update assets map: %q", err))
 	}
-	if testClient.updateAssetsMap == nil {
+	if g.updateAssetsMap == nil {
 		t.Fatal("Assets map should not be nil at this point.")
 	}
-	if len(testClient.updateAssetsMap) == 0 {
-		t.Fatal("Assets map is empty.")
+	if len(g.updateAssetsMap) != 2 || len(g.updateAssetsMap[OS.Linux][Arch.X64]) != 3 {
+		t.Fatalf("Expecting 3 versions of 2 platforms, got %v", g.updateAssetsMap)
 	}
-	if testClient.latestAssetsMap == nil {
+	if g.latestAssetsMap == nil {
 		t.Fatal("Assets map should not be nil at this point.")
 	}
-	if len(testClient.latestAssetsMap) == 0 {
-		t.Fatal("Assets map is empty.")
+	if latest := g.latestAssetsMap[Channel.Stable][OS.Windows][Arch.X86]; latest == nil || latest.v.String() != "1.2.0" {
+		t.Fatalf("Expecting 1.2.0 to be the latest windows version, got %+v", latest)
 	}
 }
 
 func TestDownloadOldestVersionAndUpgradeIt(t *testing.T) {
+	t.Run("bsdiff", func(t *testing.T) {
+		requireBsdiff(t)
+		testDownloadOldestVersionAndUpgradeIt(t, PATCHTYPE_BSDIFF, BsdiffDiffer{})
+	})
+	t.Run("xdelta3", func(t *testing.T) {
+		d, err := NewXdelta3Differ()
+		if err != nil {
+			t.Skip(err)
+		}
+		testDownloadOldestVersionAndUpgradeIt(t, PATCHTYPE_XDELTA3, d)
+	})
+}
+
+func testDownloadOldestVersionAndUpgradeIt(t *testing.T, patchType PatchType, d Differ) {
+	g, _ := newTestMemoryManager(t)
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
 
-	if len(testClient.updateAssetsMap) == 0 {
+	if len(g.updateAssetsMap) == 0 {
 		t.Fatal("Assets map is empty.")
 	}
 
 	oldestVersionMap := make(map[string]map[string]*Asset)
 
 	// Using the updateAssetsMap to look for the oldest version of each release.
-	for os := range testClient.updateAssetsMap {
-		for arch := range testClient.updateAssetsMap[os] {
+	for os := range g.updateAssetsMap {
+		for arch := range g.updateAssetsMap[os] {
 			var oldestAsset *Asset
 
-			for i := range testClient.updateAssetsMap[os][arch] {
-				asset := testClient.updateAssetsMap[os][arch][i]
+			for i := range g.updateAssetsMap[os][arch] {
+				asset := g.updateAssetsMap[os][arch][i]
 				if oldestAsset == nil {
 					oldestAsset = asset
 				} else {
@@ -112,6 +525,10 @@ func TestDownloadOldestVersionAndUpgradeIt(t *testing.T) {
 	// Let's download each one of the oldest versions.
 	var err error
 	var p *Patch
+	ctx := context.Background()
+	download := keepDownload(func(ctx context.Context, uri string) (string, error) {
+		return g.downloadAsset(ctx, uri, "")
+	})
 
 	if len(oldestVersionMap) == 0 {
 		t.Fatal("No older software versions to test with.")
@@ -122,7 +539,7 @@ func TestDownloadOldestVersionAndUpgradeIt(t *testing.T) {
 	for os := range oldestVersionMap {
 		for arch := range oldestVersionMap[os] {
 			asset := oldestVersionMap[os][arch]
-			newAsset := testClient.latestAssetsMap[os][arch]
+			newAsset := g.latestAssetsMap[Channel.Stable][os][arch]
 
 			if asset == newAsset {
 				t.Logf("Skipping version %s %s %s", os, arch, asset.v)
@@ -131,24 +548,24 @@ func TestDownloadOldestVersionAndUpgradeIt(t *testing.T) {
 			}
 
 			// Generate a binary diff of the two assets.
-			if p, err = GeneratePatch(asset.URL, newAsset.URL); err != nil {
+			if p, err = generatePatch(ctx, patchesDirectory, download, generations, patchType, d, asset.URL, newAsset.URL); err != nil {
 				t.Fatal(fmt.Errorf("Unable to generate patch: %q", err))
 			}
 
 			// Apply patch.
 			var oldAssetFile string
-			if oldAssetFile, err = downloadAsset(asset.URL); err != nil {
+			if oldAssetFile, err = g.downloadAsset(ctx, asset.URL, ""); err != nil {
 				t.Fatal(err)
 			}
 
 			var newAssetFile string
-			if newAssetFile, err = downloadAsset(newAsset.URL); err != nil {
+			if newAssetFile, err = g.downloadAsset(ctx, newAsset.URL, ""); err != nil {
 				t.Fatal(err)
 			}
 
 			patchedFile := "_tests/" + path.Base(asset.URL)
 
-			if err = bspatch(oldAssetFile, patchedFile, p.File); err != nil {
+			if err = d.Patch(oldAssetFile, patchedFile, p.File); err != nil {
 				t.Fatal(fmt.Sprintf("Failed to apply binary diff: %q", err))
 			}
 
@@ -163,7 +580,7 @@ func TestDownloadOldestVersionAndUpgradeIt(t *testing.T) {
 
 			var cs string
 			if cs, err = checksumForFile(patchedFile); err != nil {
-				t.Fatal("Could not get checksum for %s: %q", patchedFile, err)
+				t.Fatalf("Could not get checksum for %s: %q", patchedFile, err)
 			}
 
 			if cs == asset.Checksum {
@@ -176,7 +593,7 @@ func TestDownloadOldestVersionAndUpgradeIt(t *testing.T) {
 
 			var ss string
 			if ss, err = signatureForFile(patchedFile); err != nil {
-				t.Fatal("Could not get signature for %s: %q", patchedFile, err)
+				t.Fatalf("Could not get signature for %s: %q", patchedFile, err)
 			}
 
 			if ss == asset.Signature {
@@ -209,11 +626,11 @@ func TestDownloadOldestVersionAndUpgradeIt(t *testing.T) {
 
 			// fmt.Printf("params: %s", params)
 
-			_, err := testClient.CheckForUpdate(&params)
+			_, err := g.CheckForUpdate(&params)
 			if err != nil {
 				if err == ErrNoUpdateAvailable {
 					// That's OK, let's make sure.
-					newAsset := testClient.latestAssetsMap[os][arch]
+					newAsset := g.latestAssetsMap[Channel.Stable][os][arch]
 					if asset != newAsset {
 						t.Fatal("CheckForUpdate said no update was available!")
 					}
@@ -227,3 +644,1502 @@ func TestDownloadOldestVersionAndUpgradeIt(t *testing.T) {
 	}
 
 }
+
+// TestLiveGitHub runs against the releases of getlantern/autoupdate-server on
+// github, only when AUTOUPDATE_LIVE_TEST is set.
+func TestLiveGitHub(t *testing.T) {
+	if os.Getenv("AUTOUPDATE_LIVE_TEST") == "" {
+		t.Skip("AUTOUPDATE_LIVE_TEST is not set")
+	}
+
+	g := NewReleaseManager("getlantern", "autoupdate-server")
+	if _, err := g.GetReleases(); err != nil {
+		t.Fatal(fmt.Errorf("Failed to pull releases: %q", err))
+	}
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(fmt.Errorf("Failed to update assets map: %q", err))
+	}
+	if len(g.updateAssetsMap) == 0 || len(g.latestAssetsMap) == 0 {
+		t.Fatal("Assets map is empty.")
+	}
+	if _, err := downloadAsset(testAssetURL); err != nil {
+		t.Fatal(fmt.Errorf("Failed to download asset: %q", err))
+	}
+}
+
+// setTestPrivateKey generates a throwaway signing key for offline tests, used
+// until the test is done.
+func setTestPrivateKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "autoupdate-key")
+	if err = ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	previous := privateKeyFile
+	t.Cleanup(func() {
+		SetPrivateKey(previous)
+		os.Remove(file)
+	})
+	SetPrivateKey(file)
+}
+
+// newTestAssetServer serves the given files, keyed by path, as release
+// assets.
+func newTestAssetServer(files map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(content))
+	}))
+}
+
+func TestChannelForVersion(t *testing.T) {
+	tests := map[string]string{
+		"2.3.0":         Channel.Stable,
+		"v2.3.0":        Channel.Stable,
+		"v2.3.0-beta.1": Channel.Beta,
+		"2.3.0-beta":    Channel.Beta,
+		"2.3.0-rc1":     "rc",
+		"2.3.0-rc.2":    "rc",
+		"2.3.0-1":       Channel.Beta,
+	}
+	for tag, expected := range tests {
+		v, err := parseVersion(tag)
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %q", tag, err)
+		}
+		if channel := channelForVersion(v); channel != expected {
+			t.Fatalf("Expecting channel %q for %q, got %q.", expected, tag, channel)
+		}
+	}
+}
+
+func TestVersionPrecedence(t *testing.T) {
+	ordered := []string{"1.1.0", "1.2.0-alpha", "1.2.0-rc.2", "1.2.0-rc.10", "1.2.0-rc1", "1.2.0-rc2", "1.2.0", "v1.2.1+build.7"}
+	for i := 1; i < len(ordered); i++ {
+		a, _ := parseVersion(ordered[i-1])
+		b, err := parseVersion(ordered[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !a.LT(b) {
+			t.Fatalf("Expecting %s < %s", ordered[i-1], ordered[i])
+		}
+	}
+
+	// Build metadata plays no part, in ordering or in the assets map keys.
+	a, _ := parseVersion("1.2.0+linux.1")
+	b, _ := parseVersion("1.2.0+linux.2")
+	if !a.EQ(b) || a.String() != "1.2.0" {
+		t.Fatalf("Expecting build metadata to be dropped, got %v and %v", a, b)
+	}
+
+	setTestPrivateKey(t)
+	files := newTestAssetServer(map[string]string{
+		"/1.1.0":     "precedence 1.1.0",
+		"/1.2.0-rc1": "precedence 1.2.0-rc1",
+		"/1.2.0-rc2": "precedence 1.2.0-rc2",
+		"/1.2.0":     "precedence 1.2.0",
+		"/nightly":   "precedence nightly",
+	})
+	defer files.Close()
+
+	release := func(id int, tag string, prerelease bool, file string) string {
+		return fmt.Sprintf(`{"id": %d, "tag_name": "%s", "prerelease": %v, "zipball_url": "%s/%s.zip", "assets": [
+			{"id": %d, "name": "autoupdate-binary-linux-amd64", "browser_download_url": "%s/%s"}
+		]}`, id, tag, prerelease, files.URL, file, id*10, files.URL, file)
+	}
+	// The release candidates come last, one of them is not even marked as a
+	// prerelease.
+	api := newTestReleasesAPI("[" + strings.Join([]string{
+		release(1, "1.1.0", false, "1.1.0"),
+		release(2, "1.2.0+build.3", false, "1.2.0"),
+		release(3, "1.2.0-rc1", true, "1.2.0-rc1"),
+		release(4, "v1.2.0-rc2", false, "1.2.0-rc2"),
+		release(5, "nightly-2024-05-01", false, "nightly"),
+	}, ",") + "]")
+	defer api.Close()
+
+	logger := &testLogger{}
+	g := NewReleaseManager("getlantern", "autoupdate-server", WithLogger(logger))
+	useTestGitHub(t, g, api)
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+	if n := logger.count("WARN", "Skipping release, its tag is not a semantic version"); n != 1 {
+		t.Fatalf("Expecting the nightly tag to be skipped with a warning, got %d in %q", n, logger.entries)
+	}
+
+	if latest := g.latestAssetsMap[Channel.Stable][OS.Linux][Arch.X64]; latest.v.String() != "1.2.0" {
+		t.Fatalf("Expecting the latest stable release to be 1.2.0, got %v", latest.v)
+	}
+	if latest := g.latestAssetsMap["rc"][OS.Linux][Arch.X64]; latest == nil || latest.v.String() != "1.2.0-rc2" {
+		t.Fatalf("Expecting both release candidates on the rc channel, got %+v", g.latestAssetsMap)
+	}
+
+	check := func(version string, channel string) string {
+		res, err := g.CheckForUpdate(&Params{AppVersion: version, OS: OS.Linux, Arch: Arch.X64, Checksum: "unknown", Channel: channel})
+		if err == ErrNoUpdateAvailable {
+			return ""
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.Version
+	}
+	for _, c := range []struct{ version, channel, want string }{
+		{"1.1.0", Channel.Stable, "1.2.0"},
+		{"1.2.0-rc1", Channel.Stable, "1.2.0"},
+		{"1.2.0-rc2", Channel.Stable, "1.2.0"},
+		{"1.2.0", Channel.Stable, ""},
+		{"1.2.0+build.9", Channel.Stable, ""},
+		{"v1.1.0", Channel.Stable, "1.2.0"},
+		{"v1.2.0-rc1", Channel.Stable, "1.2.0"},
+		{"v1.2.0", Channel.Stable, ""},
+		{"1.1.0", "rc", "1.2.0"},
+	} {
+		if got := check(c.version, c.channel); got != c.want {
+			t.Fatalf("Expecting %s on %s to be offered %q, got %q", c.version, c.channel, c.want, got)
+		}
+	}
+}
+
+func TestVersionedAssetNames(t *testing.T) {
+	for name, want := range map[string]struct {
+		info    AssetInfo
+		version string
+	}{
+		"autoupdate-binary-linux-amd64.v3.1.0-rc.2":              {AssetInfo{OS.Linux, Arch.X64, "", ""}, "v3.1.0-rc.2"},
+		"autoupdate-binary-linux-amd64.v3.1.0":                   {AssetInfo{OS.Linux, Arch.X64, "", ""}, "v3.1.0"},
+		"autoupdate-binary-windows-amd64.v3.1.0-beta.1.exe":      {AssetInfo{OS.Windows, Arch.X64, ".exe", ""}, "v3.1.0-beta.1"},
+		"autoupdate-binary-linux-arm64.v3.1.0+build.45.tar.gz":   {AssetInfo{OS.Linux, Arch.ARM64, ".tar.gz", ""}, "v3.1.0+build.45"},
+		"autoupdate-binary-darwin-arm64.v3.1.0-rc.2+build.7.dmg": {AssetInfo{OS.Darwin, Arch.ARM64, ".dmg", ""}, "v3.1.0-rc.2+build.7"},
+		"autoupdate-binary-darwin-amd64.v1":                      {AssetInfo{OS.Darwin, Arch.X64, ".v1", ""}, ""},
+	} {
+		info, version, err := matchAssetName(updateAssetRe, name)
+		if err != nil {
+			t.Fatalf("Failed to get asset info of %s: %q", name, err)
+		}
+		if *info != want.info || version != want.version {
+			t.Fatalf("Expecting %+v %q for %s, got %+v %q", want.info, want.version, name, *info, version)
+		}
+	}
+
+	// Templates take full versions too.
+	re, err := compileAssetPattern("myapp_{version}_{os}_{arch}{ext}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, version, err := matchAssetName(re, "myapp_3.1.0-rc.2+build.45_windows_amd64.exe"); err != nil || version != "3.1.0-rc.2+build.45" || info.Ext != ".exe" {
+		t.Fatalf("Expecting 3.1.0-rc.2+build.45 with .exe, got %+v %q %v", info, version, err)
+	}
+
+	setTestPrivateKey(t)
+	files := newTestAssetServer(map[string]string{
+		"/rc":    "versioned 3.1.0-rc.2",
+		"/final": "versioned 3.1.0",
+		"/stray": "versioned 3.0.0",
+	})
+	defer files.Close()
+
+	api := newTestReleasesAPI(fmt.Sprintf(`[
+		{"id": 1, "tag_name": "v3.1.0-rc.2", "prerelease": true, "zipball_url": "%[1]s/rc.zip", "assets": [
+			{"id": 11, "name": "autoupdate-binary-linux-amd64.v3.1.0-rc.2", "browser_download_url": "%[1]s/rc"}
+		]},
+		{"id": 2, "tag_name": "v3.1.0+build.45", "zipball_url": "%[1]s/final.zip", "assets": [
+			{"id": 21, "name": "autoupdate-binary-linux-amd64.v3.1.0+build.45", "browser_download_url": "%[1]s/final"},
+			{"id": 22, "name": "autoupdate-binary-linux-arm64.v3.0.0", "browser_download_url": "%[1]s/stray"}
+		]}
+	]`, files.URL))
+	defer api.Close()
+
+	g := NewReleaseManager("getlantern", "autoupdate-server")
+	useTestGitHub(t, g, api)
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+	if latest := g.latestAssetsMap[Channel.Stable][OS.Linux][Arch.X64]; latest == nil || latest.v.String() != "3.1.0" {
+		t.Fatalf("Expecting 3.1.0 to beat 3.1.0-rc.2, got %+v", latest)
+	}
+	if latest := g.latestAssetsMap["rc"][OS.Linux][Arch.X64]; latest == nil || latest.v.String() != "3.1.0-rc.2" {
+		t.Fatalf("Expecting the release candidate on the rc channel, got %+v", latest)
+	}
+	if g.updateAssetsMap[OS.Linux][Arch.ARM64] != nil {
+		t.Fatal("Expecting the asset named after another version to be skipped.")
+	}
+
+	// Clients may report their version with a prefix and build metadata too.
+	rc := g.latestAssetsMap["rc"][OS.Linux][Arch.X64]
+	res, err := g.CheckForUpdate(&Params{AppVersion: "v3.1.0-rc.2+build.7", OS: OS.Linux, Arch: Arch.X64, Checksum: rc.Checksum})
+	if (err != nil && !errors.Is(err, ErrPatchUnavailable)) || res == nil || res.Version != "3.1.0" {
+		t.Fatalf("Expecting v3.1.0-rc.2+build.7 to be offered 3.1.0, got %+v %v", res, err)
+	}
+}
+
+func TestLatestAssetPerChannel(t *testing.T) {
+	setTestPrivateKey(t)
+
+	srv := newTestAssetServer(map[string]string{
+		"/2.2.0":        "stable 2.2.0",
+		"/2.3.0-beta.1": "beta 2.3.0-beta.1",
+		"/2.3.0-beta.2": "beta 2.3.0-beta.2",
+	})
+	defer srv.Close()
+
+	g := NewReleaseManager("getlantern", "autoupdate-server")
+	for _, tag := range []string{"2.2.0", "2.3.0-beta.1", "2.3.0-beta.2"} {
+		asset := &Asset{Name: "autoupdate-binary-linux-amd64", URL: srv.URL + "/" + tag}
+		asset.v, _ = parseVersion(tag)
+		if err := g.pushAsset(OS.Linux, Arch.X64, asset); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stable, err := g.getProductUpdate(Channel.Stable, OS.Linux, Arch.X64, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stable.v.String() != "2.2.0" {
+		t.Fatalf("Stable channel must never offer a prerelease, got %v.", stable.v)
+	}
+
+	beta, err := g.getProductUpdate(Channel.Beta, OS.Linux, Arch.X64, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if beta.v.String() != "2.3.0-beta.2" {
+		t.Fatalf("Expecting latest beta to be 2.3.0-beta.2, got %v.", beta.v)
+	}
+
+	// An empty channel must keep today's stable-only behavior.
+	res, err := g.CheckForUpdate(&Params{
+		AppVersion: "2.1.0",
+		OS:         OS.Linux,
+		Arch:       Arch.X64,
+		Checksum:   "unknown",
+	})
+	if err != nil && !errors.Is(err, ErrUnknownVersion) {
+		t.Fatal(err)
+	}
+	if res.Version != "2.2.0" {
+		t.Fatalf("Expecting stable update 2.2.0, got %v.", res.Version)
+	}
+}
+
+func TestPrereleaseChannel(t *testing.T) {
+	setTestPrivateKey(t)
+
+	files := newTestAssetServer(map[string]string{
+		"/2.2.0":        "stable 2.2.0",
+		"/3.0.0":        "prerelease 3.0.0",
+		"/3.1.0-beta.1": "beta 3.1.0-beta.1",
+		"/3.1.0":        "stable 3.1.0",
+	})
+	defer files.Close()
+
+	release := func(id int, tag string, prerelease bool) string {
+		return fmt.Sprintf(`{"id": %d, "tag_name": "%s", "prerelease": %v, "zipball_url": "%s/%s.zip", "assets": [
+			{"id": %d, "name": "autoupdate-binary-linux-amd64", "browser_download_url": "%s/%s"}
+		]}`, id, tag, prerelease, files.URL, tag, id*10, files.URL, tag)
+	}
+
+	check := func(g *ReleaseManager, channel string) string {
+		res, err := g.CheckForUpdate(&Params{
+			AppVersion: "2.0.0",
+			OS:         OS.Linux,
+			Arch:       Arch.X64,
+			Checksum:   "unknown",
+			Channel:    channel,
+		})
+		if err != nil && !errors.Is(err, ErrUnknownVersion) {
+			t.Fatal(err)
+		}
+		return res.Version
+	}
+
+	// A release flagged as prerelease on Github only reaches beta users.
+	api := newTestReleasesAPI("[" + release(1, "2.2.0", false) + "," + release(2, "3.0.0", true) + "]")
+	defer api.Close()
+
+	g := NewReleaseManager("getlantern", "autoupdate-server")
+	useTestGitHub(t, g, api)
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+	if v := check(g, ""); v != "2.2.0" {
+		t.Fatalf("Stable users must never be offered a prerelease, got %v.", v)
+	}
+	if v := check(g, Channel.Beta); v != "3.0.0" {
+		t.Fatalf("Expecting beta users to be offered 3.0.0, got %v.", v)
+	}
+
+	// A stable release that outranks the latest beta is offered to beta users.
+	api2 := newTestReleasesAPI("[" + release(3, "3.1.0-beta.1", true) + "," + release(4, "3.1.0", false) + "]")
+	defer api2.Close()
+
+	g = NewReleaseManager("getlantern", "autoupdate-server")
+	useTestGitHub(t, g, api2)
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+	if v := check(g, Channel.Beta); v != "3.1.0" {
+		t.Fatalf("Expecting beta users to be offered stable 3.1.0, got %v.", v)
+	}
+	if v := check(g, Channel.Stable); v != "3.1.0" {
+		t.Fatalf("Expecting stable users to be offered 3.1.0, got %v.", v)
+	}
+
+	// Including those already running the beta it comes after.
+	res, err := g.CheckForUpdate(&Params{
+		AppVersion: "3.1.0-beta.1",
+		OS:         OS.Linux,
+		Arch:       Arch.X64,
+		Checksum:   "unknown",
+		Channel:    Channel.Beta,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Version != "3.1.0" {
+		t.Fatalf("Expecting 3.1.0-beta.1 to be upgraded to stable 3.1.0, got %v.", res.Version)
+	}
+}
+
+// useTestGitHub points the manager's github client at a fake API server,
+// retrying failed requests almost right away.
+func useTestGitHub(t *testing.T, g *ReleaseManager, srv *httptest.Server) {
+	u, err := url.Parse(srv.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.provider.(*githubProvider).client.BaseURL = u
+	g.SetReleasesRetryPolicy(RetryPolicy{Attempts: 3, Backoff: time.Millisecond})
+}
+
+func TestReleaseManagerWithToken(t *testing.T) {
+	const token = "s3cr3t"
+
+	var lastAuth string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lastAuth = r.Header.Get("Authorization")
+		if lastAuth != "" && lastAuth != "token "+token {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"message": "Bad credentials"}`))
+			return
+		}
+		w.Write([]byte(`[{"id": 1, "tag_name": "1.0.0", "zipball_url": "http://example.com/1.0.0.zip"}]`))
+	}))
+	defer api.Close()
+
+	// No token: anonymous requests keep working for public repos.
+	g := NewReleaseManagerWithToken("getlantern", "autoupdate-server", "")
+	useTestGitHub(t, g, api)
+	if rs, err := g.GetReleases(); err != nil || len(rs) != 1 {
+		t.Fatalf("Expecting one release without a token, got %v: %q", rs, err)
+	}
+	if lastAuth != "" {
+		t.Fatalf("Expecting an anonymous request, got Authorization: %q", lastAuth)
+	}
+
+	// Valid token.
+	g = NewReleaseManagerWithToken("getlantern", "autoupdate-server", token)
+	useTestGitHub(t, g, api)
+	if rs, err := g.GetReleases(); err != nil || len(rs) != 1 {
+		t.Fatalf("Expecting one release with a valid token, got %v: %q", rs, err)
+	}
+	if lastAuth != "token "+token {
+		t.Fatalf("Expecting the token to be sent, got Authorization: %q", lastAuth)
+	}
+
+	// Invalid token must surface as a clear error.
+	g = NewReleaseManagerWithToken("getlantern", "autoupdate-server", "bogus")
+	useTestGitHub(t, g, api)
+	if _, err := g.GetReleases(); err != ErrUnauthorized {
+		t.Fatalf("Expecting ErrUnauthorized, got %q", err)
+	}
+	if err := g.UpdateAssetsMap(); err != ErrUnauthorized {
+		t.Fatalf("Expecting UpdateAssetsMap to fail with ErrUnauthorized, got %q", err)
+	}
+}
+
+func TestPrivateAssets(t *testing.T) {
+	setTestPrivateKey(t)
+	const token, content = "s3cr3t", "private linux binary"
+
+	var storageAuth atomic.Value
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		storageAuth.Store(r.Header.Get("Authorization"))
+		if r.URL.Query().Get("sig") != "short-lived" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(content))
+	}))
+	defer storage.Close()
+
+	var apiAccept atomic.Value
+	var api *httptest.Server
+	api = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "token "+token {
+			http.NotFound(w, r)
+			return
+		}
+		switch r.URL.Path {
+		case "/repos/getlantern/autoupdate-server":
+			w.Write([]byte(`{"id": 1, "name": "autoupdate-server", "private": true}`))
+		case "/repos/getlantern/autoupdate-server/releases":
+			fmt.Fprintf(w, `[{"id": 1, "tag_name": "1.0.0", "zipball_url": "%[1]s/1.0.0.zip", "assets": [
+				{"id": 11, "name": "autoupdate-binary-linux-amd64", "url": "%[1]s/repos/getlantern/autoupdate-server/releases/assets/11", "browser_download_url": "%[1]s/download/1.0.0/autoupdate-binary-linux-amd64"}
+			]}]`, api.URL)
+		case "/repos/getlantern/autoupdate-server/releases/assets/11":
+			apiAccept.Store(r.Header.Get("Accept"))
+			http.Redirect(w, r, storage.URL+"/asset?sig=short-lived", http.StatusFound)
+		default:
+			// Browser URLs of private assets need a session.
+			http.NotFound(w, r)
+		}
+	}))
+	defer api.Close()
+
+	g := NewReleaseManager("getlantern", "autoupdate-server", WithToken(token), WithBaseURL(api.URL))
+	if err := g.SetDownloadDir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+	a := g.updateAssetsMap[OS.Linux][Arch.X64]["1.0.0"]
+	if a == nil || !a.Private || a.SHA256 != fmt.Sprintf("%x", sha256.Sum256([]byte(content))) {
+		t.Fatalf("Expecting the private asset to be downloaded from the API, got %+v", a)
+	}
+	if accept, _ := apiAccept.Load().(string); accept != "application/octet-stream" {
+		t.Fatalf("Expecting the content of the asset to be asked for, got Accept: %q", accept)
+	}
+	if auth, _ := storageAuth.Load().(string); auth != "" {
+		t.Fatalf("Expecting the token not to reach the storage host, got Authorization: %q", auth)
+	}
+
+	rec := httptest.NewRecorder()
+	handler := NewHandler(g, "http://updates.example.com/")
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/update?os=linux&arch=amd64&app_version=0.9.0&checksum=unknown", nil))
+	if want := `"url":"http://updates.example.com/assets/1.0.0/autoupdate-binary-linux-amd64"`; !strings.Contains(rec.Body.String(), want) {
+		t.Fatalf("Expecting clients to be pointed at the server for the private asset, got %d %s", rec.Code, rec.Body)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/assets/1.0.0/autoupdate-binary-linux-amd64", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != content {
+		t.Fatalf("Expecting the private asset to be served, got %d %q", rec.Code, rec.Body)
+	}
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/assets/1.0.0/README.md", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("Expecting 404 for an unknown asset, got %d", rec.Code)
+	}
+}
+
+// newTestReleasesAPI serves a fixed JSON releases list for
+// getlantern/autoupdate-server.
+func newTestReleasesAPI(releasesJSON string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repos/getlantern/autoupdate-server/releases" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(releasesJSON))
+	}))
+}
+
+func TestGithubDigest(t *testing.T) {
+	setTestPrivateKey(t)
+
+	const content = "linux binary with a digest"
+	files := newTestAssetServer(map[string]string{"/autoupdate-binary-linux-amd64": content})
+	defer files.Close()
+
+	sum := fmt.Sprintf("%x", sha256.Sum256([]byte(content)))
+	releases := func(digest string) string {
+		return fmt.Sprintf(`[{"id": 1, "tag_name": "1.0.0", "zipball_url": "%s/1.0.0.zip", "assets": [
+			{"id": 10, "name": "autoupdate-binary-linux-amd64", "browser_download_url": "%s/autoupdate-binary-linux-amd64", "digest": "%s"}
+		]}]`, files.URL, files.URL, digest)
+	}
+
+	// Matching digest is used as the SHA-256 of the asset.
+	api := newTestReleasesAPI(releases("sha256:" + sum))
+	defer api.Close()
+
+	g := NewReleaseManager("getlantern", "autoupdate-server")
+	useTestGitHub(t, g, api)
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+	asset := g.updateAssetsMap[OS.Linux][Arch.X64]["1.0.0"]
+	if asset == nil {
+		t.Fatal("Expecting asset to be indexed.")
+	}
+	if asset.SHA256 != sum {
+		t.Fatalf("Expecting SHA256 %s, got %s", sum, asset.SHA256)
+	}
+
+	// A digest that disagrees with the downloaded bytes is flagged.
+	tampered := newTestReleasesAPI(releases("sha256:" + fmt.Sprintf("%x", sha256.Sum256([]byte("something else")))))
+	defer tampered.Close()
+
+	g = NewReleaseManager("getlantern", "autoupdate-server")
+	useTestGitHub(t, g, tampered)
+	rs, err := g.GetReleases()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := rs[0].Assets[0]
+	a.v = rs[0].Version
+	if err = g.pushAsset(OS.Linux, Arch.X64, &a); err != ErrDigestMismatch {
+		t.Fatalf("Expecting ErrDigestMismatch, got %q", err)
+	}
+	if err = g.UpdateAssetsMap(); err == nil {
+		t.Fatal("Expecting UpdateAssetsMap to fail on a tampered asset.")
+	}
+
+	// Without a digest the checksum is computed locally.
+	nodigest := newTestReleasesAPI(releases(""))
+	defer nodigest.Close()
+
+	g = NewReleaseManager("getlantern", "autoupdate-server")
+	useTestGitHub(t, g, nodigest)
+	if err = g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+	if asset = g.updateAssetsMap[OS.Linux][Arch.X64]["1.0.0"]; asset.SHA256 != sum {
+		t.Fatalf("Expecting computed SHA256 %s, got %s", sum, asset.SHA256)
+	}
+}
+
+func TestDuplicateVersions(t *testing.T) {
+	setTestPrivateKey(t)
+
+	files := newTestAssetServer(map[string]string{
+		"/retagged/autoupdate-binary-linux-amd64": "retagged 1.1.0",
+		"/original/autoupdate-binary-linux-amd64": "original 1.1.0",
+	})
+	defer files.Close()
+
+	// The re-tagged release has the lower id but was created last.
+	retagged := fmt.Sprintf(`{"id": 2, "tag_name": "v1.1.0", "created_at": "2024-05-02T00:00:00Z", "zipball_url": "%[1]s/2.zip", "assets": [
+		{"id": 20, "name": "autoupdate-binary-linux-amd64", "browser_download_url": "%[1]s/retagged/autoupdate-binary-linux-amd64"}
+	]}`, files.URL)
+	original := fmt.Sprintf(`{"id": 3, "tag_name": "1.1.0", "created_at": "2024-05-01T00:00:00Z", "zipball_url": "%[1]s/3.zip", "assets": [
+		{"id": 30, "name": "autoupdate-binary-linux-amd64", "browser_download_url": "%[1]s/original/autoupdate-binary-linux-amd64"}
+	]}`, files.URL)
+
+	// Whatever the order github lists them in, the newest one wins.
+	for _, list := range []string{"[" + retagged + "," + original + "]", "[" + original + "," + retagged + "]"} {
+		api := newTestReleasesAPI(list)
+		g := NewReleaseManager("getlantern", "autoupdate-server")
+		useTestGitHub(t, g, api)
+		err := g.UpdateAssetsMap()
+		api.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		asset := g.updateAssetsMap[OS.Linux][Arch.X64]["1.1.0"]
+		if asset == nil || asset.URL != files.URL+"/retagged/autoupdate-binary-linux-amd64" {
+			t.Fatalf("Expecting the most recently created release to win, got %+v", asset)
+		}
+		if c := g.Conflicts(); len(c) != 1 || c[0] != (Conflict{Version: "1.1.0", Kept: "v1.1.0", Dropped: "1.1.0"}) {
+			t.Fatalf("Expecting the dropped release to be recorded, got %v", c)
+		}
+	}
+
+	rs := []Release{{id: 1, Version: semver.MustParse("1.0.0")}, {id: 2, Version: semver.MustParse("1.0.0")}}
+	if rs, _, _ = dedupeReleases(rs, DuplicateNewest); len(rs) != 1 || rs[0].id != 2 {
+		t.Fatalf("Expecting the highest id to break the tie, got %+v", rs)
+	}
+
+	api := newTestReleasesAPI("[" + retagged + "," + original + "]")
+	defer api.Close()
+
+	g := NewReleaseManager("getlantern", "autoupdate-server")
+	useTestGitHub(t, g, api)
+	g.SetDuplicatePolicy(DuplicateError)
+	if err := g.UpdateAssetsMap(); !errors.Is(err, ErrDuplicateVersion) {
+		t.Fatalf("Expecting ErrDuplicateVersion, got %v", err)
+	}
+	if len(g.updateAssetsMap) != 0 {
+		t.Fatal("Expecting no assets to be indexed.")
+	}
+}
+
+func TestDuplicateAssets(t *testing.T) {
+	setTestPrivateKey(t)
+
+	for i := 0; i < 3; i++ {
+		p := NewMemoryProvider()
+		// Both name 1.0.0 for linux, the one telling its version wins.
+		if err := p.AddRelease("1.0.0", "", map[string][]byte{
+			"autoupdate-binary-linux-amd64":               []byte("duplicate plain 1.0.0"),
+			"autoupdate-binary-linux-amd64.v1.0.0":        []byte("duplicate named 1.0.0"),
+			"autoupdate-binary-linux-amd64.v1.0.0.tar.gz": []byte("duplicate tarball 1.0.0"),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		// Uploaded twice, the last upload wins.
+		if err := p.AddRelease("1.1.0", "", map[string][]byte{"autoupdate-binary-windows-386": []byte("duplicate first 1.1.0")}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+		if err := p.AddRelease("1.1.0", "", map[string][]byte{"autoupdate-binary-windows-386.v1.1.0": []byte("duplicate second 1.1.0")}); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.AddRelease("1.1.0", "", map[string][]byte{"autoupdate-binary-windows-arm64": []byte("duplicate arm 1.1.0")}); err != nil {
+			t.Fatal(err)
+		}
+
+		g := NewReleaseManager("getlantern", "autoupdate-server", WithReleaseProvider(p))
+		if err := g.UpdateAssetsMap(); err != nil {
+			t.Fatal(err)
+		}
+		if a := g.updateAssetsMap[OS.Linux][Arch.X64]["1.0.0"]; a == nil || a.Name != "autoupdate-binary-linux-amd64.v1.0.0" {
+			t.Fatalf("Expecting the asset naming the release version to win, got %+v", a)
+		}
+		if a := g.updateAssetsMap[OS.Linux][Arch.X64]["1.0.0.tar.gz"]; a == nil {
+			t.Fatal("Expecting another format not to conflict.")
+		}
+		if a := g.updateAssetsMap[OS.Windows][Arch.X86]["1.1.0"]; a == nil || a.Name != "autoupdate-binary-windows-386.v1.1.0" {
+			t.Fatalf("Expecting the last uploaded asset to win, got %+v", a)
+		}
+
+		conflicts := g.Inventory("", "").Conflicts
+		sort.Slice(conflicts, func(i, j int) bool { return conflicts[i].Version < conflicts[j].Version })
+		want := []Conflict{
+			{Version: "1.0.0", Platform: "linux/amd64", Kept: "autoupdate-binary-linux-amd64.v1.0.0", Dropped: "autoupdate-binary-linux-amd64"},
+			{Version: "1.1.0", Platform: "windows/386", Kept: "autoupdate-binary-windows-386.v1.1.0", Dropped: "autoupdate-binary-windows-386"},
+		}
+		if fmt.Sprint(conflicts) != fmt.Sprint(want) {
+			t.Fatalf("Expecting the conflicts to be recorded as %v, got %v", want, conflicts)
+		}
+	}
+}
+
+func TestAssetWorkers(t *testing.T) {
+	setTestPrivateKey(t)
+
+	var mu sync.Mutex
+	var running, most int
+	files := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/missing/") {
+			http.NotFound(w, r)
+			return
+		}
+		mu.Lock()
+		if running++; running > most {
+			most = running
+		}
+		mu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		w.Write([]byte("asset workers " + r.URL.Path))
+	}))
+	defer files.Close()
+
+	platforms := []string{"linux-amd64", "linux-386", "windows-386", "darwin-amd64"}
+	releases := func(broken string) string {
+		var rels []string
+		for i, version := range []string{"1.0.0", "1.1.0"} {
+			var assets []string
+			for j, platform := range platforms {
+				dir := version
+				if version+"/"+platform == broken {
+					dir = "missing"
+				}
+				assets = append(assets, fmt.Sprintf(`{"id": %d, "name": "autoupdate-binary-%s", "browser_download_url": "%s/%s/autoupdate-binary-%s"}`,
+					(i+1)*10+j, platform, files.URL, dir, platform))
+			}
+			rels = append(rels, fmt.Sprintf(`{"id": %d, "tag_name": "%s", "zipball_url": "%s/%s.zip", "assets": [%s]}`,
+				i+1, version, files.URL, version, strings.Join(assets, ",")))
+		}
+		return "[" + strings.Join(rels, ",") + "]"
+	}
+
+	api := newTestReleasesAPI(releases(""))
+	g := NewReleaseManager("getlantern", "autoupdate-server")
+	useTestGitHub(t, g, api)
+	g.SetAssetWorkers(3)
+	err := g.UpdateAssetsMap()
+	api.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if most < 2 || most > 3 {
+		t.Fatalf("Expecting up to 3 assets to be downloaded at once, got %d", most)
+	}
+	previous := g.updateAssetsMap[OS.Linux][Arch.X86]["1.1.0"]
+	if previous == nil {
+		t.Fatal("Expecting the asset to be indexed.")
+	}
+
+	// A failing asset keeps its previous entry, the others are refreshed.
+	api = newTestReleasesAPI(releases("1.1.0/linux-386"))
+	defer api.Close()
+	useTestGitHub(t, g, api)
+	err = g.UpdateAssetsMap()
+	var assetsErr *AssetsError
+	if !errors.As(err, &assetsErr) || len(assetsErr.Errs) != 1 || !errors.Is(err, ErrAssetUnreachable) {
+		t.Fatalf("Expecting a single unreachable asset, got %v", err)
+	}
+	if a := g.updateAssetsMap[OS.Linux][Arch.X86]["1.1.0"]; a != previous {
+		t.Fatalf("Expecting the previous entry to be kept, got %+v", a)
+	}
+	for _, version := range []string{"1.0.0", "1.1.0"} {
+		if len(g.updateAssetsMap[OS.Linux]) != 2 || g.updateAssetsMap[OS.Windows][Arch.X86][version] == nil || g.updateAssetsMap[OS.Darwin][Arch.X64][version] == nil {
+			t.Fatalf("Expecting every other asset of %s to be indexed.", version)
+		}
+	}
+
+	// Without a previous entry the asset is left out.
+	g = NewReleaseManager("getlantern", "autoupdate-server")
+	useTestGitHub(t, g, api)
+	if err = g.UpdateAssetsMap(); !errors.As(err, &assetsErr) {
+		t.Fatalf("Expecting an *AssetsError, got %v", err)
+	}
+	if g.updateAssetsMap[OS.Linux][Arch.X86]["1.1.0"] != nil || g.updateAssetsMap[OS.Linux][Arch.X86]["1.0.0"] == nil {
+		t.Fatal("Expecting only the failing asset to be left out.")
+	}
+}
+
+func TestReleasesPagination(t *testing.T) {
+	setTestPrivateKey(t)
+
+	files := newTestAssetServer(map[string]string{
+		"/1.0.0": "paginated 1.0.0",
+		"/1.1.0": "paginated 1.1.0",
+	})
+	defer files.Close()
+
+	release := func(id int, tag string) string {
+		return fmt.Sprintf(`[{"id": %d, "tag_name": "%s", "zipball_url": "%s/%s.zip", "assets": [
+			{"id": %d, "name": "autoupdate-binary-linux-amd64", "browser_download_url": "%s/%s"}
+		]}]`, id, tag, files.URL, tag, id*10, files.URL, tag)
+	}
+
+	var limited int32
+	var api *httptest.Server
+	api = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repos/getlantern/autoupdate-server/releases" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.URL.Query().Get("page") != "2" {
+			w.Header().Set("Link", fmt.Sprintf(`<%s%s?page=2>; rel="next", <%s%s?page=2>; rel="last"`, api.URL, r.URL.Path, api.URL, r.URL.Path))
+			w.Write([]byte(release(2, "1.1.0")))
+			return
+		}
+		if atomic.LoadInt32(&limited) == 1 {
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.Header().Set("X-RateLimit-Reset", fmt.Sprint(time.Now().Add(time.Hour).Unix()))
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"message": "API rate limit exceeded"}`))
+			return
+		}
+		// The last page links back to the first one.
+		w.Header().Set("Link", fmt.Sprintf(`<%s%s?page=1>; rel="prev", <%s%s?page=1>; rel="first"`, api.URL, r.URL.Path, api.URL, r.URL.Path))
+		w.Write([]byte(release(1, "1.0.0")))
+	}))
+	defer api.Close()
+
+	g := NewReleaseManager("getlantern", "autoupdate-server")
+	useTestGitHub(t, g, api)
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+	for _, version := range []string{"1.0.0", "1.1.0"} {
+		if g.updateAssetsMap[OS.Linux][Arch.X64][version] == nil {
+			t.Fatalf("Expecting %s to be found on its page", version)
+		}
+	}
+
+	// Running out of rate limit halfway keeps every release indexed.
+	atomic.StoreInt32(&limited, 1)
+	if err := g.UpdateAssetsMap(); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("Expecting the rate limit error, got %v", err)
+	}
+	if g.updateAssetsMap[OS.Linux][Arch.X64]["1.0.0"] == nil {
+		t.Fatal("Expecting releases of the missing page to be kept.")
+	}
+}
+
+func TestManyReleases(t *testing.T) {
+	setTestPrivateKey(t)
+
+	// 120 releases, a hundred per page: the last page is partially full.
+	const count = 120
+	contents := make(map[string]string)
+	var releases []string
+	for i := count; i >= 1; i-- {
+		tag := fmt.Sprintf("1.%d.0", i)
+		contents["/"+tag] = "many " + tag
+		releases = append(releases, fmt.Sprintf(`{"id": %d, "tag_name": "%s", "zipball_url": "%%[1]s/%s.zip", "assets": [
+			{"id": %d, "name": "autoupdate-binary-linux-amd64", "browser_download_url": "%%[1]s/%s"}
+		]}`, i, tag, tag, i*10, tag))
+	}
+	files := newTestAssetServer(contents)
+	defer files.Close()
+
+	var requests int32
+	var api *httptest.Server
+	api = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		perPage, _ := strconv.Atoi(r.URL.Query().Get("per_page"))
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		if perPage != githubPageSize || page < 1 {
+			t.Errorf("Expecting pages of %d releases, got %s", githubPageSize, r.URL.RawQuery)
+			http.NotFound(w, r)
+			return
+		}
+		start, end := (page-1)*perPage, page*perPage
+		if end >= len(releases) {
+			end = len(releases)
+		} else {
+			w.Header().Set("Link", fmt.Sprintf(`<%s%s?per_page=%d&page=%d>; rel="next"`, api.URL, r.URL.Path, perPage, page+1))
+		}
+		w.Write([]byte(fmt.Sprintf("["+strings.Join(releases[start:end], ",")+"]", files.URL)))
+	}))
+	defer api.Close()
+
+	g := NewReleaseManager("getlantern", "autoupdate-server")
+	useTestGitHub(t, g, api)
+	rs, err := g.GetReleases()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rs) != count || atomic.LoadInt32(&requests) != 2 {
+		t.Fatalf("Expecting %d releases over 2 pages, got %d over %d", count, len(rs), requests)
+	}
+	if err = g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(g.updateAssetsMap[OS.Linux][Arch.X64]); n != count {
+		t.Fatalf("Expecting every release to be indexed, got %d", n)
+	}
+	if g.updateAssetsMap[OS.Linux][Arch.X64]["1.1.0"] == nil {
+		t.Fatal("Expecting the oldest release, on the last page, to be indexed")
+	}
+
+	// Capped, only the newest versions are kept.
+	g.SetReleaseLimit(50)
+	if rs, err = g.GetReleases(); err != nil || len(rs) != 50 || rs[0].Version.String() != "1.120.0" || rs[49].Version.String() != "1.71.0" {
+		t.Fatalf("Expecting the 50 newest releases, got %d: %v", len(rs), err)
+	}
+	g.SetReleaseLimit(10)
+	if err = g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(g.updateAssetsMap[OS.Linux][Arch.X64]); n != 10 {
+		t.Fatalf("Expecting 10 releases to be indexed, got %d", n)
+	}
+}
+
+func TestReleaseHistory(t *testing.T) {
+	setTestPrivateKey(t)
+
+	files := newTestAssetServer(map[string]string{
+		"/1.0.0":        "history 1.0.0",
+		"/1.1.0":        "history 1.1.0",
+		"/1.2.0":        "history 1.2.0",
+		"/1.3.0":        "history 1.3.0",
+		"/1.4.0-beta.1": "history 1.4.0-beta.1",
+	})
+	defer files.Close()
+
+	release := func(id int, tag string, extra string) string {
+		return fmt.Sprintf(`{"id": %d, "tag_name": "%s", "zipball_url": "%s/%s.zip", %s "assets": [
+			{"id": %d, "name": "autoupdate-binary-linux-amd64", "browser_download_url": "%s/%s"}
+		]}`, id, tag, files.URL, tag, extra, id*10, files.URL, tag)
+	}
+	// Newest first, like github lists them, the draft looking like the
+	// latest release.
+	pages := []string{
+		"[" + release(6, "1.4.0-beta.1", `"prerelease": true,`) + "," + release(5, "1.3.0", "") + "]",
+		"[" + release(7, "2.0.0", `"draft": true,`) + "," + release(3, "1.2.0", "") + "]",
+		"[" + release(2, "1.1.0", "") + "," + release(1, "1.0.0", "") + "]",
+	}
+
+	var api *httptest.Server
+	api = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repos/getlantern/autoupdate-server/releases" {
+			http.NotFound(w, r)
+			return
+		}
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		if page < 1 || page > len(pages) {
+			page = 1
+		}
+		if page < len(pages) {
+			w.Header().Set("Link", fmt.Sprintf(`<%s%s?page=%d>; rel="next", <%s%s?page=%d>; rel="last"`, api.URL, r.URL.Path, page+1, api.URL, r.URL.Path, len(pages)))
+		}
+		w.Write([]byte(pages[page-1]))
+	}))
+	defer api.Close()
+
+	g := NewReleaseManager("getlantern", "autoupdate-server")
+	useTestGitHub(t, g, api)
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The oldest release, on the last page, is still there for clients
+	// running it to get patches.
+	for _, version := range []string{"1.0.0", "1.1.0", "1.2.0", "1.3.0", "1.4.0-beta.1"} {
+		if g.updateAssetsMap[OS.Linux][Arch.X64][version] == nil {
+			t.Fatalf("Expecting %s to be indexed", version)
+		}
+	}
+	if g.updateAssetsMap[OS.Linux][Arch.X64]["2.0.0"] != nil {
+		t.Fatal("Expecting drafts to be left out.")
+	}
+	if latest := g.latestAssetsMap[Channel.Stable][OS.Linux][Arch.X64]; latest.v.String() != "1.3.0" {
+		t.Fatalf("Expecting the latest stable release to leave out the prerelease, got %v", latest.v)
+	}
+	if latest := g.latestAssetsMap[Channel.Beta][OS.Linux][Arch.X64]; latest.v.String() != "1.4.0-beta.1" {
+		t.Fatalf("Expecting the beta channel to opt in to the prerelease, got %v", latest.v)
+	}
+
+	// A limit keeps the newest releases only, prereleases included.
+	g.SetReleaseLimit(3)
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+	var kept []string
+	for version := range g.updateAssetsMap[OS.Linux][Arch.X64] {
+		kept = append(kept, version)
+	}
+	sort.Strings(kept)
+	if strings.Join(kept, " ") != "1.2.0 1.3.0 1.4.0-beta.1" {
+		t.Fatalf("Expecting the three newest releases to be kept, got %q", kept)
+	}
+}
+
+func TestAssetPagination(t *testing.T) {
+	setTestPrivateKey(t)
+
+	files := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("asset pagination " + r.URL.Path))
+	}))
+	defer files.Close()
+
+	asset := func(id int, platform string) string {
+		return fmt.Sprintf(`{"id": %d, "name": "autoupdate-binary-%s", "browser_download_url": "%s/1.0.0/autoupdate-binary-%s"}`,
+			id, platform, files.URL, platform)
+	}
+
+	var api *httptest.Server
+	api = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repos/getlantern/autoupdate-server/releases":
+			// Only the first page of assets is embedded.
+			fmt.Fprintf(w, `[{"id": 1, "tag_name": "1.0.0", "zipball_url": "%s/1.0.0.zip", "assets": [%s, %s]}]`,
+				files.URL, asset(10, "linux-amd64"), asset(11, "linux-386"))
+		case "/repos/getlantern/autoupdate-server/releases/1/assets":
+			if r.URL.Query().Get("page") == "2" {
+				fmt.Fprintf(w, `[%s, %s]`, asset(12, "windows-386"), asset(13, "darwin-amd64"))
+				return
+			}
+			w.Header().Set("Link", fmt.Sprintf(`<%s%s?per_page=2&page=2>; rel="next"`, api.URL, r.URL.Path))
+			fmt.Fprintf(w, `[%s, %s]`, asset(10, "linux-amd64"), asset(11, "linux-386"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer api.Close()
+
+	g := NewReleaseManager("getlantern", "autoupdate-server", WithAssetPagination(2))
+	useTestGitHub(t, g, api)
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+	for _, platform := range [][2]string{{OS.Linux, Arch.X64}, {OS.Linux, Arch.X86}, {OS.Windows, Arch.X86}, {OS.Darwin, Arch.X64}} {
+		if g.updateAssetsMap[platform[0]][platform[1]]["1.0.0"] == nil {
+			t.Fatalf("Expecting an asset for %s/%s from every page", platform[0], platform[1])
+		}
+	}
+
+	// Without pagination only the embedded assets are found.
+	g = NewReleaseManager("getlantern", "autoupdate-server", WithAssetPagination(-1))
+	useTestGitHub(t, g, api)
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+	if g.updateAssetsMap[OS.Windows][Arch.X86]["1.0.0"] != nil || g.updateAssetsMap[OS.Linux][Arch.X86]["1.0.0"] == nil {
+		t.Fatal("Expecting only the embedded assets without pagination.")
+	}
+}
+
+func TestReleaseManagerWithBaseURL(t *testing.T) {
+	const token = "ghs_installation"
+
+	// Downloads redirect to storage, which must never see the token.
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte("stored asset"))
+	}))
+	defer storage.Close()
+
+	exhausted := false
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/download/asset" && r.Header.Get("Authorization") == "token "+token {
+			http.Redirect(w, r, storage.URL+"/asset", http.StatusFound)
+			return
+		}
+		if r.URL.Path != "/api/v3/repos/getlantern/autoupdate-server/releases" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("Authorization") != "token "+token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("X-RateLimit-Limit", "5000")
+		w.Header().Set("X-RateLimit-Reset", "1700000000")
+		if exhausted {
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"message": "API rate limit exceeded"}`))
+			return
+		}
+		w.Header().Set("X-RateLimit-Remaining", "4999")
+		w.Write([]byte(`[]`))
+	}))
+	defer api.Close()
+
+	g := NewReleaseManager("getlantern", "autoupdate-server", WithToken(token), WithBaseURL(api.URL+"/api/v3"))
+	if _, err := g.GetReleases(); err != nil {
+		t.Fatal(err)
+	}
+	if rl := g.RateLimit(); rl.Limit != 5000 || rl.Remaining != 4999 {
+		t.Fatalf("Expecting rate limit 4999/5000, got %+v", rl)
+	}
+
+	exhausted = true
+	_, err := g.GetReleases()
+	rle, ok := err.(*RateLimitError)
+	if !ok {
+		t.Fatalf("Expecting a *RateLimitError, got %q", err)
+	}
+	if !errors.Is(err, ErrRateLimited) {
+		t.Fatal("Expecting the error to match ErrRateLimited.")
+	}
+	if rle.Reset.Unix() != 1700000000 {
+		t.Fatalf("Expecting reset time to be reported, got %v", rle.Reset)
+	}
+	if rl := g.RateLimit(); rl.Remaining != 0 {
+		t.Fatalf("Expecting no remaining requests, got %+v", rl)
+	}
+	if err = g.UpdateAssetsMap(); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("Expecting the refresh to be rate limited, got %q", err)
+	}
+	if until := g.RateLimitedUntil(); until.Unix() != 1700000000 {
+		t.Fatalf("Expecting the refresh to wait for the reset, got %v", until)
+	}
+
+	// Downloads from Github carry the token.
+	if err = g.SetDownloadDir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	file, err := g.downloadAsset(context.Background(), api.URL+"/download/asset", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := ioutil.ReadFile(file); string(content) != "stored asset" {
+		t.Fatalf("Expecting the stored asset, got %q", content)
+	}
+}
+
+func TestConcurrentUpdateAndCheck(t *testing.T) {
+	setTestPrivateKey(t)
+
+	files := newTestAssetServer(map[string]string{
+		"/1.0.0": "concurrent linux binary 1.0.0",
+		"/1.1.0": "concurrent linux binary 1.1.0",
+	})
+	defer files.Close()
+
+	release := func(id int, tag string) string {
+		return fmt.Sprintf(`{"id": %d, "tag_name": "%s", "zipball_url": "%s/%s.zip", "assets": [
+			{"id": %d, "name": "autoupdate-binary-linux-amd64", "browser_download_url": "%s/%s"}
+		]}`, id, tag, files.URL, tag, id*10, files.URL, tag)
+	}
+
+	// Every other refresh publishes 1.1.0, so the maps keep being swapped
+	// while clients check.
+	var refreshes int32
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repos/getlantern/autoupdate-server/releases" {
+			http.NotFound(w, r)
+			return
+		}
+		if atomic.AddInt32(&refreshes, 1)%2 == 0 {
+			w.Write([]byte("[" + release(2, "1.1.0") + "," + release(1, "1.0.0") + "]"))
+			return
+		}
+		w.Write([]byte("[" + release(1, "1.0.0") + "]"))
+	}))
+	defer api.Close()
+
+	g := NewReleaseManager("getlantern", "autoupdate-server")
+	useTestGitHub(t, g, api)
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			if err := g.UpdateAssetsMap(); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				res, err := g.CheckForUpdate(&Params{
+					AppVersion: "0.1.0",
+					OS:         OS.Linux,
+					Arch:       Arch.X64,
+					Checksum:   "unknown",
+				})
+				if err != nil && !errors.Is(err, ErrUnknownVersion) {
+					errs <- err
+					return
+				}
+				// Whichever snapshot was seen, the asset must be the one
+				// of the offered version.
+				if (res.Version != "1.0.0" && res.Version != "1.1.0") || res.URL != files.URL+"/"+res.Version {
+					errs <- fmt.Errorf("Expecting 1.0.0 or 1.1.0 from its own asset, got %v from %v.", res.Version, res.URL)
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func TestUpdateAssetsMapNotModified(t *testing.T) {
+	setTestPrivateKey(t)
+
+	files := newTestAssetServer(map[string]string{"/autoupdate-binary-linux-amd64": "etag linux binary"})
+	defer files.Close()
+
+	const etag = `"releases-v1"`
+	releases := fmt.Sprintf(`[{"id": 1, "tag_name": "1.0.0", "zipball_url": "%s/1.0.0.zip", "assets": [
+		{"id": 10, "name": "autoupdate-binary-linux-amd64", "browser_download_url": "%s/autoupdate-binary-linux-amd64"}
+	]}]`, files.URL, files.URL)
+
+	var lastIfNoneMatch string
+	full := 0
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lastIfNoneMatch = r.Header.Get("If-None-Match")
+		if lastIfNoneMatch == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		full++
+		w.Header().Set("ETag", etag)
+		w.Write([]byte(releases))
+	}))
+	defer api.Close()
+
+	g := NewReleaseManager("getlantern", "autoupdate-server")
+	useTestGitHub(t, g, api)
+
+	if !g.LastRefresh().IsZero() {
+		t.Fatal("Expecting no refresh before UpdateAssetsMap.")
+	}
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+	first := g.LastRefresh()
+	if first.IsZero() {
+		t.Fatal("Expecting the refresh time to be recorded.")
+	}
+	asset := g.updateAssetsMap[OS.Linux][Arch.X64]["1.0.0"]
+
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+	if lastIfNoneMatch != etag {
+		t.Fatalf("Expecting If-None-Match %s, got %q", etag, lastIfNoneMatch)
+	}
+	if full != 1 {
+		t.Fatalf("Expecting a single full releases list, got %d", full)
+	}
+	if g.updateAssetsMap[OS.Linux][Arch.X64]["1.0.0"] != asset {
+		t.Fatal("Expecting the assets map to be left untouched.")
+	}
+	if g.LastRefresh().Before(first) {
+		t.Fatal("Expecting a not modified response to count as a refresh.")
+	}
+
+	// GetReleases always returns the full list, unchanged pages are taken
+	// from the last one.
+	rs, err := g.GetReleases()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rs) != 1 || full != 1 {
+		t.Fatalf("Expecting GetReleases to return the list at hand, got %d releases after %d full lists", len(rs), full)
+	}
+}
+
+func TestUpdateAssetsMapNotModifiedPages(t *testing.T) {
+	setTestPrivateKey(t)
+
+	contents := make(map[string]string)
+	for _, tag := range []string{"1.0.0", "1.1.0", "1.2.0"} {
+		contents["/"+tag] = "paged linux binary " + tag
+	}
+	contents["/1.0.0.exe"] = "paged windows binary 1.0.0"
+	files := newTestAssetServer(contents)
+	defer files.Close()
+
+	release := func(id int, tag string, extra string) string {
+		return fmt.Sprintf(`{"id": %d, "tag_name": "%s", "zipball_url": "%s/%s.zip", "assets": [
+			{"id": %d, "name": "autoupdate-binary-linux-amd64", "browser_download_url": "%s/%s"}%s
+		]}`, id, tag, files.URL, tag, 10*id, files.URL, tag, extra)
+	}
+	var mu sync.Mutex
+	pages := []string{
+		"[" + release(3, "1.2.0", "") + "]",
+		"[" + release(2, "1.1.0", "") + "," + release(1, "1.0.0", "") + "]",
+	}
+	full := make(map[int]int)
+
+	var api *httptest.Server
+	api = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		if page < 1 || page > len(pages) {
+			page = 1
+		}
+		etag := fmt.Sprintf(`"%x"`, sha256.Sum256([]byte(pages[page-1])))
+		if page < len(pages) {
+			w.Header().Set("Link", fmt.Sprintf(`<%s%s?page=%d>; rel="next"`, api.URL, r.URL.Path, page+1))
+		}
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		full[page]++
+		w.Header().Set("ETag", etag)
+		w.Write([]byte(pages[page-1]))
+	}))
+	defer api.Close()
+
+	m := newTestMetrics()
+	g := NewReleaseManager("getlantern", "autoupdate-server", WithMetrics(m))
+	useTestGitHub(t, g, api)
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+	asset := g.updateAssetsMap[OS.Linux][Arch.X64]["1.0.0"]
+	if asset == nil {
+		t.Fatal("Expecting the release of the second page to be indexed.")
+	}
+
+	// Nothing changed on any page.
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+	if full[1] != 1 || full[2] != 1 {
+		t.Fatalf("Expecting every page to be fetched in full once, got %v", full)
+	}
+	if g.updateAssetsMap[OS.Linux][Arch.X64]["1.0.0"] != asset {
+		t.Fatal("Expecting the assets map to be left untouched.")
+	}
+	if m.github != 0 {
+		t.Fatalf("Expecting not modified pages not to count as errors, got %d", m.github)
+	}
+
+	// An asset added down the list leaves the first page as it was.
+	mu.Lock()
+	pages[1] = "[" + release(2, "1.1.0", "") + "," + release(1, "1.0.0", `,
+			{"id": 11, "name": "autoupdate-binary-windows-386", "browser_download_url": "`+files.URL+`/1.0.0.exe"}`) + "]"
+	mu.Unlock()
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+	if full[1] != 1 || full[2] != 2 {
+		t.Fatalf("Expecting the second page only to be fetched again, got %v", full)
+	}
+	if g.updateAssetsMap[OS.Windows][Arch.X86]["1.0.0"] == nil {
+		t.Fatal("Expecting the asset added to the second page to be indexed.")
+	}
+	if g.updateAssetsMap[OS.Linux][Arch.X64]["1.2.0"] == nil {
+		t.Fatal("Expecting the release of the unchanged first page to be kept.")
+	}
+}
+
+func TestAuxAssets(t *testing.T) {
+	setTestPrivateKey(t)
+
+	files := newTestAssetServer(map[string]string{"/autoupdate-binary-linux-amd64": "aux linux binary"})
+	defer files.Close()
+
+	api := newTestReleasesAPI(fmt.Sprintf(`[{"id": 1, "tag_name": "v1.0.0", "zipball_url": "%s/1.0.0.zip", "assets": [
+		{"id": 10, "name": "autoupdate-binary-linux-amd64", "browser_download_url": "%s/autoupdate-binary-linux-amd64"},
+		{"id": 11, "name": "install.sh", "browser_download_url": "%s/install.sh"},
+		{"id": 12, "name": "SHA256SUMS", "browser_download_url": "%s/SHA256SUMS"}
+	]}]`, files.URL, files.URL, files.URL, files.URL))
+	defer api.Close()
+
+	g := NewReleaseManager("getlantern", "autoupdate-server")
+	useTestGitHub(t, g, api)
+	if err := g.SetAuxAssetPattern(`\.sh$`); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+
+	aux, err := g.AuxAsset("1.0.0", "install.sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aux.URL != files.URL+"/install.sh" {
+		t.Fatalf("Expecting install.sh to point at its download URL, got %q", aux.URL)
+	}
+	if _, err = g.AuxAsset("1.0.0", "SHA256SUMS"); err != ErrNoSuchAuxAsset {
+		t.Fatalf("Expecting names not matching the pattern to be dropped, got %q", err)
+	}
+	if _, err = g.AuxAsset("1.0.0", "autoupdate-binary-linux-amd64"); err != ErrNoSuchAuxAsset {
+		t.Fatal("Expecting update assets not to be auxiliary.")
+	}
+
+	for _, asset := range g.updateAssetsMap[OS.Linux][Arch.X64] {
+		if asset.Name == "install.sh" {
+			t.Fatal("Expecting install.sh not to be an update asset.")
+		}
+	}
+	if len(g.updateAssetsMap[OS.Linux][Arch.X64]) != 1 {
+		t.Fatalf("Expecting a single update asset, got %d", len(g.updateAssetsMap[OS.Linux][Arch.X64]))
+	}
+}
+
+func TestAssetsForVersion(t *testing.T) {
+	setTestPrivateKey(t)
+
+	contents := map[string]string{
+		"/1.0.0/autoupdate-binary-linux-amd64":  "1.0.0 linux amd64",
+		"/1.0.0/autoupdate-binary-darwin-amd64": "1.0.0 darwin amd64",
+		"/1.0.0/autoupdate-binary-windows-386":  "1.0.0 windows 386",
+		"/0.9.0/autoupdate-binary-linux-amd64":  "0.9.0 linux amd64",
+	}
+	files := newTestAssetServer(contents)
+	defer files.Close()
+
+	asset := func(id int, path string) string {
+		return fmt.Sprintf(`{"id": %d, "name": "%s", "browser_download_url": "%s%s"}`, id, path[7:], files.URL, path)
+	}
+	api := newTestReleasesAPI(fmt.Sprintf(`[
+		{"id": 2, "tag_name": "1.0.0", "zipball_url": "%s/1.0.0.zip", "assets": [%s, %s, %s]},
+		{"id": 1, "tag_name": "0.9.0", "zipball_url": "%s/0.9.0.zip", "assets": [%s]}
+	]`, files.URL,
+		asset(20, "/1.0.0/autoupdate-binary-linux-amd64"),
+		asset(21, "/1.0.0/autoupdate-binary-darwin-amd64"),
+		asset(22, "/1.0.0/autoupdate-binary-windows-386"),
+		files.URL,
+		asset(10, "/0.9.0/autoupdate-binary-linux-amd64")))
+	defer api.Close()
+
+	g := NewReleaseManager("getlantern", "autoupdate-server")
+	useTestGitHub(t, g, api)
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+
+	assets, err := g.AssetsForVersion("v1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []AssetInfo{{OS: OS.Darwin, Arch: Arch.X64}, {OS: OS.Linux, Arch: Arch.X64}, {OS: OS.Windows, Arch: Arch.X86}}
+	if len(assets) != len(expected) {
+		t.Fatalf("Expecting %d assets, got %d", len(expected), len(assets))
+	}
+	for i, a := range assets {
+		if a.AssetInfo != expected[i] {
+			t.Fatalf("Expecting %v at %d, got %v", expected[i], i, a.AssetInfo)
+		}
+		path := "/1.0.0/" + a.Name
+		content := contents[path]
+		if a.URL != files.URL+path {
+			t.Fatalf("Expecting URL %s, got %s", files.URL+path, a.URL)
+		}
+		if a.Size != int64(len(content)) {
+			t.Fatalf("Expecting size %d for %s, got %d", len(content), a.Name, a.Size)
+		}
+		if sum := fmt.Sprintf("%x", sha256.Sum256([]byte(content))); a.Checksum != sum {
+			t.Fatalf("Expecting checksum %s for %s, got %s", sum, a.Name, a.Checksum)
+		}
+	}
+
+	if _, err = g.AssetsForVersion("2.0.0"); err != ErrNoSuchVersion {
+		t.Fatalf("Expecting ErrNoSuchVersion, got %q", err)
+	}
+}
+
+func TestLatestAsset(t *testing.T) {
+	g, _, update := newTestUpdatePair(t, nil)
+	m := newTestMetrics()
+	WithMetrics(m)(g)
+
+	a, err := g.LatestAsset(OS.Linux, Arch.X64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a != update || a.Version() != "1.1.0" || a.URL == "" || a.Checksum == "" || a.Signature == "" {
+		t.Fatalf("Expecting the 1.1.0 asset with its checksum and signature, got %+v", a)
+	}
+	if m.generations != 0 || m.hits+m.misses != 0 {
+		t.Fatal("Expecting no patch to be looked up.")
+	}
+
+	// Yanked versions are not offered.
+	if err = g.SetYanked("1.1.0", true); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := g.LatestVersion(OS.Linux, Arch.X64); err != nil || v != "1.0.0" {
+		t.Fatalf("Expecting 1.0.0 once 1.1.0 is yanked, got %q, %v", v, err)
+	}
+
+	if _, err = g.LatestAsset(OS.Windows, Arch.X64); !errors.Is(err, ErrNoSuchPlatform) {
+		t.Fatalf("Expecting ErrNoSuchPlatform, got %v", err)
+	}
+	g.SetPlatformEOL(OS.Linux, Arch.X64, "https://example.com/migrate")
+	if _, err = g.LatestAsset(OS.Linux, Arch.X64); !errors.Is(err, ErrPlatformEOL) {
+		t.Fatalf("Expecting ErrPlatformEOL, got %v", err)
+	}
+}
@@ -0,0 +1,296 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Number of items asked for per page of a GitLab list, the most it allows.
+const gitlabPageSize = 100
+
+// GitLabProvider is a ReleaseProvider listing the releases of a GitLab
+// project. The update assets of a release are its asset links, along with the
+// files of the generic package versioned like the release, so binaries can be
+// uploaded to the package registry without linking each of them.
+type GitLabProvider struct {
+	baseURL *url.URL
+	project string
+	token   string
+	client  *http.Client
+	tagLog
+}
+
+// GitLabOption configures a GitLabProvider when it's created.
+type GitLabOption func(*GitLabProvider)
+
+// WithGitLabToken authenticates every API request and asset download with the
+// given personal, project or group access token, needed for private projects.
+func WithGitLabToken(token string) GitLabOption {
+	return func(p *GitLabProvider) {
+		p.token = token
+	}
+}
+
+// WithGitLabHTTPClient sets the HTTP client used to talk to GitLab.
+func WithGitLabHTTPClient(c *http.Client) GitLabOption {
+	return func(p *GitLabProvider) {
+		p.client = c
+	}
+}
+
+// NewGitLabProvider returns a provider for the given project of the GitLab
+// installation at baseURL (https://gitlab.example.com), by numeric ID or
+// path, e.g. "getlantern/lantern".
+func NewGitLabProvider(baseURL string, project string, opts ...GitLabOption) (*GitLabProvider, error) {
+	u, err := url.Parse(strings.TrimSuffix(baseURL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("Bad GitLab URL: %v", err)
+	}
+	if project == "" {
+		return nil, errors.New("Missing GitLab project")
+	}
+
+	p := &GitLabProvider{baseURL: u, project: project}
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	var base http.Client
+	if p.client != nil {
+		base = *p.client
+	}
+	transport := base.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	base.Transport = &gitlabTransport{host: u.Host, token: p.token, base: transport}
+	p.client = &base
+
+	return p, nil
+}
+
+// Client returns the HTTP client authenticating with GitLab, asset downloads
+// go through it.
+func (p *GitLabProvider) Client() *http.Client {
+	return p.client
+}
+
+type gitlabRelease struct {
+	TagName         string    `json:"tag_name"`
+	Description     string    `json:"description"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpcomingRelease bool      `json:"upcoming_release"`
+	Links           struct {
+		Self string `json:"self"`
+	} `json:"_links"`
+	Assets struct {
+		Links []gitlabAssetLink `json:"links"`
+	} `json:"assets"`
+}
+
+type gitlabAssetLink struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+type gitlabPackage struct {
+	ID      int    `json:"id"`
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type gitlabPackageFile struct {
+	FileName   string `json:"file_name"`
+	FileSHA256 string `json:"file_sha256"`
+}
+
+// Releases lists the releases of the project page by page, and the files of
+// the generic packages named after their version. Upcoming releases are left
+// out until they are released.
+func (p *GitLabProvider) Releases(ctx context.Context) ([]Release, error) {
+	var rels []gitlabRelease
+	for page := 1; page != 0; {
+		var batch []gitlabRelease
+		next, err := p.get(ctx, "releases", page, &batch)
+		if err != nil {
+			return nil, err
+		}
+		rels = append(rels, batch...)
+		page = next
+	}
+
+	packages, err := p.genericPackages(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	releases := make([]Release, 0, len(rels))
+	for _, r := range rels {
+		if r.UpcomingRelease {
+			log.Debugf("Release %v is not released yet, ignoring", r.TagName)
+			continue
+		}
+		v, err := parseVersion(r.TagName)
+		if err != nil {
+			p.skipTag(r.TagName, err)
+			continue
+		}
+
+		rel := Release{
+			URL:        r.Links.Self,
+			Tag:        r.TagName,
+			Version:    v,
+			Prerelease: len(v.Pre) > 0,
+			created:    r.CreatedAt,
+		}
+		rel.parseNotes(r.Description)
+
+		// Links come first, they may well point at the package files.
+		seen := make(map[string]bool)
+		for _, l := range r.Assets.Links {
+			if seen[l.Name] {
+				continue
+			}
+			seen[l.Name] = true
+			rel.Assets = append(rel.Assets, Asset{Name: l.Name, URL: l.URL})
+		}
+
+		for _, pkg := range packages[r.TagName] {
+			files, err := p.packageFiles(ctx, pkg)
+			if err != nil {
+				return nil, err
+			}
+			for _, f := range files {
+				if seen[f.FileName] {
+					continue
+				}
+				seen[f.FileName] = true
+				a := Asset{
+					Name: f.FileName,
+					URL:  p.endpoint(fmt.Sprintf("packages/generic/%s/%s/%s", url.PathEscape(pkg.Name), url.PathEscape(pkg.Version), url.PathEscape(f.FileName))),
+				}
+				if f.FileSHA256 != "" {
+					a.digest = "sha256:" + f.FileSHA256
+				}
+				rel.Assets = append(rel.Assets, a)
+			}
+		}
+
+		releases = append(releases, rel)
+	}
+
+	return releases, nil
+}
+
+// genericPackages lists the generic packages of the project by the release
+// tag they go with, their version with or without a leading "v". Projects
+// with the package registry disabled have none.
+func (p *GitLabProvider) genericPackages(ctx context.Context) (map[string][]gitlabPackage, error) {
+	packages := make(map[string][]gitlabPackage)
+	for page := 1; page != 0; {
+		var batch []gitlabPackage
+		next, err := p.get(ctx, "packages?package_type=generic", page, &batch)
+		if err != nil {
+			var se *statusError
+			if errors.As(err, &se) && se.code == http.StatusNotFound {
+				return packages, nil
+			}
+			return nil, err
+		}
+		for _, pkg := range batch {
+			packages[pkg.Version] = append(packages[pkg.Version], pkg)
+			if !strings.HasPrefix(pkg.Version, "v") {
+				packages["v"+pkg.Version] = append(packages["v"+pkg.Version], pkg)
+			}
+		}
+		page = next
+	}
+	return packages, nil
+}
+
+// packageFiles lists the files of the given package page by page.
+func (p *GitLabProvider) packageFiles(ctx context.Context, pkg gitlabPackage) ([]gitlabPackageFile, error) {
+	var files []gitlabPackageFile
+	for page := 1; page != 0; {
+		var batch []gitlabPackageFile
+		next, err := p.get(ctx, fmt.Sprintf("packages/%d/package_files", pkg.ID), page, &batch)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, batch...)
+		page = next
+	}
+	return files, nil
+}
+
+// endpoint returns the URL of the given API path of the project.
+func (p *GitLabProvider) endpoint(path string) string {
+	return fmt.Sprintf("%s/api/v4/projects/%s/%s", p.baseURL, url.PathEscape(p.project), path)
+}
+
+// get decodes the given page of the list at the API path of the project into
+// v, returning the next page or zero past the last one.
+func (p *GitLabProvider) get(ctx context.Context, path string, page int, v interface{}) (next int, err error) {
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	uri := fmt.Sprintf("%s%sper_page=%d&page=%d", p.endpoint(path), sep, gitlabPageSize, page)
+
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return 0, newStatusError(res, fmt.Sprintf("GitLab rejected the credentials for %s: %s", uri, res.Status))
+	default:
+		return 0, newStatusError(res, fmt.Sprintf("Expecting 200 OK from %s, got: %s", uri, res.Status))
+	}
+
+	if err = json.NewDecoder(res.Body).Decode(v); err != nil {
+		return 0, fmt.Errorf("Could not read %s: %v", uri, err)
+	}
+
+	// A next page pointing back is taken as the last one rather than
+	// looping.
+	if next, _ = strconv.Atoi(res.Header.Get("X-Next-Page")); next <= page {
+		return 0, nil
+	}
+	return next, nil
+}
+
+// gitlabTransport adds the access token to requests to GitLab. Requests to
+// other hosts, like external asset links or the object storage downloads
+// redirect to, are sent as they are.
+type gitlabTransport struct {
+	host  string
+	token string
+	base  http.RoundTripper
+}
+
+func (t *gitlabTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.token == "" || req.URL.Host != t.host {
+		return t.base.RoundTrip(req)
+	}
+	// A RoundTripper must not modify the original request.
+	r := req.Clone(req.Context())
+	r.Header.Set("PRIVATE-TOKEN", t.token)
+	return t.base.RoundTrip(r)
+}
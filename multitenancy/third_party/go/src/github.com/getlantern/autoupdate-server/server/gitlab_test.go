@@ -0,0 +1,150 @@
+package server
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGitLabProvider(t *testing.T) {
+	setTestPrivateKey(t)
+	const token = "glpat-s3cr3t"
+
+	// Asset links may point anywhere, the token must not leak there.
+	var leaked bool
+	files := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("PRIVATE-TOKEN") != "" {
+			leaked = true
+		}
+		w.Write([]byte("gitlab " + r.URL.Path))
+	}))
+	defer files.Close()
+
+	pages := []string{
+		fmt.Sprintf(`[
+			{"tag_name": "v1.2.0", "upcoming_release": true, "assets": {"links": [
+				{"name": "autoupdate-binary-linux-amd64", "url": "%[1]s/1.2.0"}
+			]}},
+			{"tag_name": "v1.1.0", "description": "Minimum version: 0.9.0", "_links": {"self": "https://gitlab.example.com/getlantern/lantern/-/releases/v1.1.0"}, "assets": {"links": []}}
+		]`, files.URL),
+		fmt.Sprintf(`[
+			{"tag_name": "nightly", "assets": {"links": []}},
+			{"tag_name": "v1.0.0", "assets": {"links": [
+				{"name": "autoupdate-binary-linux-amd64", "url": "%[1]s/1.0.0"},
+				{"name": "autoupdate-binary-linux-amd64", "url": "%[1]s/duplicate"}
+			]}}
+		]`, files.URL),
+	}
+	packageFile := "gitlab package 1.1.0"
+
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("PRIVATE-TOKEN") != token {
+			http.Error(w, `{"message": "401 Unauthorized"}`, http.StatusUnauthorized)
+			return
+		}
+		const prefix = "/api/v4/projects/getlantern%2Flantern/"
+		if !strings.HasPrefix(r.URL.EscapedPath(), prefix) {
+			http.NotFound(w, r)
+			return
+		}
+		switch strings.TrimPrefix(r.URL.EscapedPath(), prefix) {
+		case "releases":
+			if r.URL.Query().Get("page") == "1" {
+				w.Header().Set("X-Next-Page", "2")
+				w.Write([]byte(pages[0]))
+				return
+			}
+			w.Write([]byte(pages[1]))
+		case "packages":
+			if r.URL.Query().Get("package_type") != "generic" {
+				t.Errorf("Expecting only generic packages to be listed, got %q", r.URL.RawQuery)
+			}
+			w.Write([]byte(`[{"id": 7, "name": "lantern", "version": "1.1.0", "package_type": "generic"}]`))
+		case "packages/7/package_files":
+			fmt.Fprintf(w, `[
+				{"file_name": "autoupdate-binary-linux-amd64", "file_sha256": "%x"},
+				{"file_name": "checksums.txt"}
+			]`, sha256.Sum256([]byte(packageFile)))
+		case "packages/generic/lantern/1.1.0/autoupdate-binary-linux-amd64":
+			w.Write([]byte(packageFile))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	// Without a token the project can't be listed.
+	p, err := NewGitLabProvider(srv.URL, "getlantern/lantern")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = NewReleaseManager("getlantern", "lantern", WithReleaseProvider(p)).UpdateAssetsMap(); err == nil || !strings.Contains(err.Error(), "rejected the credentials") {
+		t.Fatalf("Expecting GitLab to reject anonymous requests, got %v", err)
+	}
+
+	if p, err = NewGitLabProvider(srv.URL+"/", "getlantern/lantern", WithGitLabToken(token)); err != nil {
+		t.Fatal(err)
+	}
+	g := NewReleaseManager("getlantern", "lantern", WithReleaseProvider(p))
+	if err = g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+
+	linked := g.updateAssetsMap[OS.Linux][Arch.X64]["1.0.0"]
+	if linked == nil || linked.URL != files.URL+"/1.0.0" {
+		t.Fatalf("Expecting the first asset link to be indexed, got %+v", linked)
+	}
+	packaged := g.updateAssetsMap[OS.Linux][Arch.X64]["1.1.0"]
+	if packaged == nil || packaged.Checksum != fmt.Sprintf("%x", sha256.Sum256([]byte(packageFile))) {
+		t.Fatalf("Expecting the package file to be indexed, got %+v", packaged)
+	}
+	if g.updateAssetsMap[OS.Linux][Arch.X64]["1.2.0"] != nil {
+		t.Fatal("Expecting upcoming releases to be left out.")
+	}
+	if leaked {
+		t.Fatal("Expecting the token to be sent to GitLab only.")
+	}
+
+	res, err := g.CheckForUpdate(&Params{
+		AppVersion: "1.0.0",
+		OS:         OS.Linux,
+		Arch:       Arch.X64,
+		Checksum:   "unknown",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Version != "1.1.0" || res.URL != packaged.URL {
+		t.Fatalf("Expecting an update to the 1.1.0 package file, got %+v", res)
+	}
+}
+
+func TestSingleReleaseSource(t *testing.T) {
+	p, err := NewGitLabProvider("https://gitlab.example.com", "42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := NewHTTPProvider("https://example.com/index.json", nil)
+
+	for _, opts := range [][]Option{
+		{WithReleaseProvider(p), WithToken("s3cr3t")},
+		{WithBaseURL("https://github.example.com/api/v3/"), WithReleaseProvider(p)},
+		{WithReleaseProvider(p), WithReleaseProvider(other)},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatal("Expecting mixing release sources to panic.")
+				}
+			}()
+			NewReleaseManager("getlantern", "lantern", opts...)
+		}()
+	}
+
+	// Giving the same provider twice is harmless.
+	NewReleaseManager("getlantern", "lantern", WithReleaseProvider(p), WithReleaseProvider(p))
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// gzipSuffix names the compressed variant of a patch file next to it.
+const gzipSuffix = ".gz"
+
+var gzipFlight flightGroup
+
+// Gzipped returns the gzip compressed variant of the patch file, compressing
+// it the first time only. The variant is removed along with the patch.
+func (p *Patch) Gzipped() (string, error) {
+	gzfile := p.File + gzipSuffix
+	if fileExists(gzfile) {
+		return gzfile, nil
+	}
+
+	gz, err := gzipFlight.do(context.Background(), gzfile, func() (*Patch, error) {
+		if fileExists(gzfile) {
+			return &Patch{File: gzfile}, nil
+		}
+		if err := gzipFile(p.File, gzfile); err != nil {
+			return nil, err
+		}
+		return &Patch{File: gzfile}, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return gz.File, nil
+}
+
+// gzipFile compresses src into dst, which is only created once complete.
+func gzipFile(src string, dst string) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	fp, err := ioutil.TempFile(filepath.Dir(dst), filepath.Base(dst)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			fp.Close()
+			os.Remove(fp.Name())
+		}
+	}()
+
+	zw, err := gzip.NewWriterLevel(fp, gzip.BestCompression)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(zw, in); err != nil {
+		return err
+	}
+	if err = zw.Close(); err != nil {
+		return err
+	}
+	if err = fp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(fp.Name(), dst)
+}
+
+// removePatchFile deletes a patch file and its compressed variants, if any.
+func removePatchFile(file string) error {
+	for _, variant := range []string{file + zstdSuffix, file + gzipSuffix} {
+		if err := os.Remove(variant); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Remove(file)
+}
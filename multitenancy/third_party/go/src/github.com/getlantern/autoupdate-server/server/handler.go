@@ -0,0 +1,777 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// busyRetryAfter is how long clients are told to wait before checking again
+// when too many patches are being generated.
+const busyRetryAfter = 30 * time.Second
+
+// checkTimeout is the time budget for answering an update check, including
+// generating a patch.
+const checkTimeout = 30 * time.Second
+
+// maxParamsBody bounds the JSON body of an update check, params are a few
+// hundred bytes.
+const maxParamsBody = 64 << 10
+
+// channelHeader carries the channel a client should switch to along with a
+// no content response.
+const channelHeader = "X-Update-Channel"
+
+// NewHandler returns a handler speaking the whole update protocol: update
+// checks on /update, as NewUpdateHandler, downloads of the patches they
+// point to on /patches/{name}, of private assets on /assets/{version}/{name}
+// and signed manifests on /manifest/{os}/{arch}.
+func NewHandler(rm *ReleaseManager, publicAddr string) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/update", NewUpdateHandler(rm, publicAddr))
+	mux.Handle("/patches/", NewServerTimingHandler("patch", http.StripPrefix("/patches/", NewPatchHandler(rm))))
+	mux.Handle("/assets/", http.StripPrefix("/assets/", NewAssetHandler(rm)))
+	mux.Handle("/manifest/", http.StripPrefix("/manifest/", NewManifestHandler(rm)))
+	return mux
+}
+
+type updateHandler struct {
+	rm         *ReleaseManager
+	publicAddr string
+}
+
+// NewUpdateHandler returns a handler for go-update clients checking for
+// updates. Params are read from a JSON body or from the os, arch,
+// app_version, checksum, channel, instance_id, device_id, wants_release_notes
+// and comma separated formats query parameters. Patch URLs in results are
+// prefixed with publicAddr, unless they point at an asset store, and so are
+// the URLs of private assets.
+// Without an os or arch, the platform is told by the X-Update-Platform
+// header, like "windows/amd64", or else the User-Agent, and sent back in the
+// X-Update-Inferred-Platform header.
+// Malformed params are answered with 400 and a JSON {"error": ...} body, with
+// a "code" of "unknown_platform" when the platform can't be told and
+// "unknown_version" when a binary is rejected for matching no asset of its
+// version, updates fitting in none of the client's available_bytes with 507
+// and a JSON body of code "insufficient_space" telling the required_bytes,
+// bodies over 64KB with 413, no update with 204, paused updates with 503 and
+// the maintenance message, patches generated in the background with 202 and
+// when to check again, as are checks while too many patches are being
+// generated under GenerationOverflowFailBusy with 503, checks taking over 30
+// seconds with 504 and failures with 500.
+func NewUpdateHandler(rm *ReleaseManager, publicAddr string) http.Handler {
+	return &updateHandler{rm: rm, publicAddr: publicAddr}
+}
+
+func (u *updateHandler) closeWithStatus(w http.ResponseWriter, status int) {
+	w.WriteHeader(status)
+	w.Write([]byte(http.StatusText(status)))
+}
+
+// publicURL returns the URL a client downloads the patch or private asset at
+// u from, leaving absolute URLs alone.
+func (u *updateHandler) publicURL(patchURL string) string {
+	if patchURL == "" || strings.Contains(patchURL, "://") {
+		return patchURL
+	}
+	return u.publicAddr + patchURL
+}
+
+// errorBody is the JSON body of a rejected update check.
+type errorBody struct {
+	Error string `json:"error"`
+	// machine readable reason, like "unknown_platform", if any
+	Code string `json:"code,omitempty"`
+	// bytes the smallest download of the update takes, along with the
+	// "insufficient_space" code
+	RequiredBytes int64 `json:"required_bytes,omitempty"`
+}
+
+// errorCode returns the machine readable reason of a rejected update check,
+// empty if it has none.
+func errorCode(err error) string {
+	switch {
+	case errors.Is(err, ErrUnknownPlatform):
+		return "unknown_platform"
+	case errors.Is(err, ErrUnknownVersion):
+		return "unknown_version"
+	}
+	return ""
+}
+
+// badRequest tells the client why its params were rejected.
+func (u *updateHandler) badRequest(w http.ResponseWriter, err error) {
+	content, _ := json.Marshal(errorBody{Error: err.Error(), Code: errorCode(err)})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write(content)
+}
+
+func (u *updateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var params Params
+
+	switch r.Method {
+	case "POST":
+		defer r.Body.Close()
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxParamsBody)).Decode(&params); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				u.closeWithStatus(w, http.StatusRequestEntityTooLarge)
+				return
+			}
+			u.badRequest(w, &ParamsError{fmt.Sprintf("Could not decode params: %v", err)})
+			return
+		}
+	case "GET":
+	default:
+		u.closeWithStatus(w, http.StatusNotFound)
+		return
+	}
+
+	// The JSON body carries no os/arch outside of tags, both may come from
+	// the query instead.
+	q := r.URL.Query()
+	for _, v := range []struct {
+		dst *string
+		key string
+	}{
+		{&params.OS, "os"},
+		{&params.Arch, "arch"},
+		{&params.AppVersion, "app_version"},
+		{&params.Checksum, "checksum"},
+		{&params.Channel, "channel"},
+		{&params.InstanceID, "instance_id"},
+		{&params.DeviceID, "device_id"},
+	} {
+		if *v.dst == "" {
+			*v.dst = q.Get(v.key)
+		}
+	}
+	if len(params.Formats) == 0 && q.Get("formats") != "" {
+		params.Formats = strings.Split(q.Get("formats"), ",")
+	}
+	if notes, err := strconv.ParseBool(q.Get("wants_release_notes")); err == nil && notes {
+		params.WantsReleaseNotes = true
+	}
+
+	// Old clients send no platform, their headers may still tell it.
+	platform, err := inferPlatform(r, &params)
+	if err != nil {
+		u.badRequest(w, err)
+		return
+	}
+	if platform != "" {
+		log.Debugf("Inferred platform %s from the request headers", platform)
+		w.Header().Set(inferredPlatformHeader, platform)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+	defer cancel()
+	ctx, timing := withServerTiming(ctx)
+
+	res, err := u.rm.CheckForUpdateContext(ctx, &params)
+	if h := timing.header(); h != "" {
+		w.Header().Set("Server-Timing", h)
+	}
+	if err != nil && res == nil {
+		log.Debugf("CheckForUpdate failed with error: %q", err)
+		var eol *PlatformEOLError
+		var promoted *ChannelChangeError
+		var paused *MaintenanceError
+		var pending *PatchPendingError
+		var space *InsufficientSpaceError
+		switch {
+		case errors.As(err, &paused):
+			serveMaintenance(w, paused)
+		case errors.As(err, &pending):
+			// Accepted, the patch will be there if the client comes back.
+			w.Header().Set("Retry-After", strconv.Itoa(int(pending.RetryAfter/time.Second)))
+			u.closeWithStatus(w, http.StatusAccepted)
+		case errors.Is(err, ErrPatchBusy):
+			w.Header().Set("Retry-After", strconv.Itoa(int(busyRetryAfter/time.Second)))
+			u.closeWithStatus(w, http.StatusServiceUnavailable)
+		case errors.As(err, &promoted):
+			// Nothing to download, the client only has to switch channels.
+			w.Header().Set(channelHeader, promoted.Channel)
+			u.closeWithStatus(w, http.StatusNoContent)
+		case err == ErrNoUpdateAvailable:
+			u.closeWithStatus(w, http.StatusNoContent)
+		case errors.As(err, &eol):
+			// The body carries the migration page for the client to show.
+			w.WriteHeader(http.StatusUpgradeRequired)
+			w.Write([]byte(eol.Error()))
+		case errors.As(err, &space):
+			content, _ := json.Marshal(errorBody{Error: space.Error(), Code: "insufficient_space", RequiredBytes: space.Required})
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInsufficientStorage)
+			w.Write(content)
+		case errors.Is(err, ErrInvalidParams):
+			u.badRequest(w, err)
+		case errors.Is(err, ErrUnsupportedPlatform):
+			u.closeWithStatus(w, http.StatusNotFound)
+		case errors.Is(err, context.DeadlineExceeded):
+			u.closeWithStatus(w, http.StatusGatewayTimeout)
+		default:
+			u.closeWithStatus(w, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if err != nil {
+		// ErrPatchUnavailable or ErrUnknownVersion, the full update is
+		// still good.
+		log.Debugf("Serving full update: %q", err)
+	}
+
+	res.URL = u.publicURL(res.URL)
+	res.PatchURL = u.publicURL(res.PatchURL)
+	for i := range res.Patches {
+		res.Patches[i].PatchURL = u.publicURL(res.Patches[i].PatchURL)
+	}
+
+	content, err := json.Marshal(res)
+	if err != nil {
+		u.closeWithStatus(w, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(content)
+}
+
+type patchHandler struct {
+	rm *ReleaseManager
+}
+
+// NewPatchHandler returns a handler serving the patches in the manager's patch
+// cache directory by file name, as found in the PatchURL of results, with an
+// ETag holding the patch checksum. A single byte range may be asked for, with
+// If-Range, to resume an interrupted download, the patch is not evicted while
+// it is being sent. Clients sending Accept-Encoding: gzip get
+// the patch gzip compressed, compressed once and kept next to it, unless it's
+// a zstd artifact. Patches handed out to clients that are no longer cached
+// are answered with 410 Gone, unknown ones with 404, and everything with 503
+// during maintenance unless downloads are allowed.
+func NewPatchHandler(rm *ReleaseManager) http.Handler {
+	return &patchHandler{rm: rm}
+}
+
+func (h *patchHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if m := h.rm.inMaintenance(true); m != nil {
+		serveMaintenance(w, m)
+		return
+	}
+
+	name := r.URL.Path
+	if name == "" || filepath.Base(name) != name || strings.HasPrefix(name, ".") || strings.HasSuffix(name, gzipSuffix) {
+		http.NotFound(w, r)
+		return
+	}
+
+	p, ok := cachedPatchFile(filepath.Join(h.rm.PatchCacheDir(), name))
+	if !ok {
+		if h.rm.patchServed(name) {
+			http.Error(w, http.StatusText(http.StatusGone), http.StatusGone)
+			return
+		}
+		http.NotFound(w, r)
+		return
+	}
+	defer serving.add(p.File)()
+
+	checksum, err := checksumForFile(p.File)
+	if err != nil {
+		// Evicted since we looked.
+		http.Error(w, http.StatusText(http.StatusGone), http.StatusGone)
+		return
+	}
+
+	file, etag := p.File, `"`+checksum+`"`
+	w.Header().Set("Vary", "Accept-Encoding")
+	// zstd artifacts wouldn't get any smaller.
+	if acceptsGzip(r) && !strings.HasSuffix(name, zstdSuffix) {
+		if file, err = p.Gzipped(); err != nil {
+			log.Errorf("Could not compress patch %s: %q", p.File, err)
+			file = p.File
+		} else {
+			w.Header().Set("Content-Encoding", "gzip")
+			etag = `"` + checksum + `-gzip"`
+		}
+	}
+
+	defer serving.add(file)()
+	fp, err := os.Open(file)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusGone), http.StatusGone)
+		return
+	}
+	defer fp.Close()
+
+	fi, err := fp.Stat()
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("ETag", etag)
+	cw := &countingWriter{ResponseWriter: w}
+	http.ServeContent(cw, r, name, fi.ModTime(), fp)
+	if cw.n > 0 {
+		h.rm.metrics.PatchServed(cw.n)
+	}
+}
+
+// acceptsGzip tells whether the client takes gzip encoded responses.
+func acceptsGzip(r *http.Request) bool {
+	for _, field := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(field, ";")
+		if strings.TrimSpace(parts[0]) != "gzip" {
+			continue
+		}
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+			if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// countingWriter counts the bytes of the response body.
+type countingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+type rolloutHandler struct {
+	rm *ReleaseManager
+}
+
+// rolloutBody describes where a client lands in the rollout of a version.
+type rolloutBody struct {
+	Version    string  `json:"version"`
+	InstanceID string  `json:"instance_id"`
+	Percent    float64 `json:"percent"`
+	Bucket     float64 `json:"bucket"`
+	InRollout  bool    `json:"in_rollout"`
+}
+
+// NewRolloutHandler returns an admin handler telling whether the client given
+// by the instance_id query parameter would be offered the version parameter,
+// at the percent parameter if given or at the version's current rollout
+// otherwise. The live rollout is never changed.
+func NewRolloutHandler(rm *ReleaseManager) http.Handler {
+	return &rolloutHandler{rm: rm}
+}
+
+func (h *rolloutHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	body := rolloutBody{Version: q.Get("version"), InstanceID: q.Get("instance_id")}
+
+	v, err := parseVersion(body.Version)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Bad version: %v", err), http.StatusBadRequest)
+		return
+	}
+	if body.InstanceID == "" {
+		http.Error(w, "Missing instance_id", http.StatusBadRequest)
+		return
+	}
+
+	if s := q.Get("percent"); s != "" {
+		if body.Percent, err = parseRollout(s); err != nil {
+			http.Error(w, fmt.Sprintf("Bad percent: %v", err), http.StatusBadRequest)
+			return
+		}
+	} else if body.Percent, err = h.rm.Rollout(body.Version); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	body.Version = v.String()
+	body.Bucket = rolloutBucket(v, body.InstanceID)
+	body.InRollout = inRollout(v, body.InstanceID, body.Percent)
+
+	content, err := json.Marshal(body)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(content)
+}
+
+type pinsHandler struct {
+	rm *ReleaseManager
+}
+
+// NewPinsHandler returns an admin handler listing the platforms pinned to a
+// version with PinVersion, as a JSON array of Pin.
+func NewPinsHandler(rm *ReleaseManager) http.Handler {
+	return &pinsHandler{rm: rm}
+}
+
+func (h *pinsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	pins := h.rm.Pins()
+	if pins == nil {
+		pins = []Pin{}
+	}
+	content, err := json.Marshal(pins)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(content)
+}
+
+type auxHandler struct {
+	rm *ReleaseManager
+}
+
+// NewAuxHandler returns a handler redirecting to the download URL of the
+// auxiliary asset of a release named by the path, as {version}/{name}. Unknown
+// assets are answered with 404, and everything with 503 during maintenance.
+func NewAuxHandler(rm *ReleaseManager) http.Handler {
+	return &auxHandler{rm: rm}
+}
+
+func (h *auxHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(r.URL.Path, "/", 2)
+	if r.Method != "GET" || len(parts) != 2 || parts[1] == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	asset, err := h.rm.AuxAsset(parts[0], parts[1])
+	if err != nil {
+		log.Debugf("AuxAsset failed with error: %q", err)
+		var paused *MaintenanceError
+		if errors.As(err, &paused) {
+			serveMaintenance(w, paused)
+			return
+		}
+		http.NotFound(w, r)
+		return
+	}
+
+	http.Redirect(w, r, asset.URL, http.StatusFound)
+}
+
+type releasesHandler struct {
+	rm *ReleaseManager
+}
+
+// releaseAsset is the JSON description of an asset listed by releasesHandler.
+type releaseAsset struct {
+	OS        string `json:"os"`
+	Arch      string `json:"arch"`
+	Name      string `json:"name"`
+	URL       string `json:"url"`
+	Size      int64  `json:"size"`
+	Checksum  string `json:"checksum"`
+	SHA256    string `json:"sha256"`
+	Signature string `json:"signature"`
+}
+
+// NewReleasesHandler returns a handler listing the assets of every platform
+// for the version named by the path, as a JSON array. Unknown versions are
+// answered with 404.
+func NewReleasesHandler(rm *ReleaseManager) http.Handler {
+	return &releasesHandler{rm: rm}
+}
+
+func (h *releasesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	version := r.URL.Path
+	if r.Method != "GET" || version == "" || strings.Contains(version, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	assets, err := h.rm.AssetsForVersion(version)
+	if err != nil {
+		log.Debugf("AssetsForVersion failed with error: %q", err)
+		http.NotFound(w, r)
+		return
+	}
+
+	res := make([]releaseAsset, 0, len(assets))
+	for _, a := range assets {
+		res = append(res, releaseAsset{
+			OS:        a.OS,
+			Arch:      a.Arch,
+			Name:      a.Name,
+			URL:       a.URL,
+			Size:      a.Size,
+			Checksum:  a.Checksum,
+			SHA256:    a.SHA256,
+			Signature: a.Signature,
+		})
+	}
+
+	content, err := json.Marshal(res)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(content)
+}
+
+type assetHandler struct {
+	rm *ReleaseManager
+}
+
+// NewAssetHandler returns a handler serving the private update assets named
+// by the path, as {version}/{name}, downloaded from github with the token for
+// clients that don't have it. Other assets are answered with 404, and
+// everything with 503 during maintenance unless downloads are allowed.
+func NewAssetHandler(rm *ReleaseManager) http.Handler {
+	return &assetHandler{rm: rm}
+}
+
+func (h *assetHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if m := h.rm.inMaintenance(true); m != nil {
+		serveMaintenance(w, m)
+		return
+	}
+
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	a := h.rm.privateAsset(parts[0], parts[1])
+	if a == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	file, release, err := h.rm.downloadKnownAsset(r.Context(), a.URL)
+	if err != nil {
+		log.Errorf("Could not download private asset %s: %q", a.URL, err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	defer release()
+	defer serving.add(file)()
+
+	fp, err := os.Open(file)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer fp.Close()
+
+	fi, err := fp.Stat()
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("ETag", `"`+a.Checksum+`"`)
+	http.ServeContent(w, r, a.Name, fi.ModTime(), fp)
+}
+
+type manifestHandler struct {
+	rm *ReleaseManager
+}
+
+// NewManifestHandler returns a handler serving the JSON of the SignedManifest
+// of the platform named by the path, as {os}/{arch}, on the channel query
+// parameter, stable if missing. Unknown platforms are answered with 404,
+// platforms that reached their end of life with 426 and the migration page.
+func NewManifestHandler(rm *ReleaseManager) http.Handler {
+	return &manifestHandler{rm: rm}
+}
+
+func (h *manifestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	platform := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(platform) != 2 || platform[0] == "" || platform[1] == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	m, err := h.rm.Manifest(r.URL.Query().Get("channel"), platform[0], platform[1])
+	if err != nil {
+		var eol *PlatformEOLError
+		switch {
+		case errors.Is(err, ErrNoSuchPlatform):
+			http.NotFound(w, r)
+		case errors.As(err, &eol):
+			w.WriteHeader(http.StatusUpgradeRequired)
+			w.Write([]byte(eol.Error()))
+		default:
+			log.Errorf("Could not serve manifest: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	content, err := json.Marshal(m)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(content)
+}
+
+type inventoryHandler struct {
+	rm *ReleaseManager
+}
+
+// NewInventoryHandler returns an admin handler telling what the manager
+// serves, as the JSON of its Inventory for the os and arch query parameters.
+func NewInventoryHandler(rm *ReleaseManager) http.Handler {
+	return &inventoryHandler{rm: rm}
+}
+
+func (h *inventoryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	content, err := json.Marshal(h.rm.Inventory(q.Get("os"), q.Get("arch")))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(content)
+}
+
+type adoptionHandler struct {
+	rm *ReleaseManager
+}
+
+// NewAdoptionHandler returns an admin handler telling how many clients checked
+// for updates from each version and platform, as the JSON of the Snapshot of
+// the manager's Adoption. Managers not counting them, without WithAdoption,
+// are answered with 404.
+func NewAdoptionHandler(rm *ReleaseManager) http.Handler {
+	return &adoptionHandler{rm: rm}
+}
+
+func (h *adoptionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	a := h.rm.Adoption()
+	if a == nil {
+		http.NotFound(w, r)
+		return
+	}
+	content, err := json.Marshal(a.Snapshot())
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(content)
+}
+
+type healthHandler struct {
+	rm *ReleaseManager
+}
+
+// healthBody is the JSON body of a health check.
+type healthBody struct {
+	Status      string     `json:"status"`
+	LastRefresh *time.Time `json:"last_refresh,omitempty"`
+	StaleSince  *time.Time `json:"stale_since,omitempty"`
+	// Tag of the release served as latest with SetLatestOverride.
+	LatestOverride string `json:"latest_override,omitempty"`
+}
+
+// NewHealthHandler returns a handler reporting whether the manager serves
+// updates: "ok" once UpdateAssetsMap succeeded, "stale" while it serves stored
+// assets last known to be up to date at stale_since, both with 200. A manager
+// with nothing to serve is answered with 503. An active SetLatestOverride is
+// told by latest_override.
+func NewHealthHandler(rm *ReleaseManager) http.Handler {
+	return &healthHandler{rm: rm}
+}
+
+func (h *healthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body := healthBody{Status: "ok", LatestOverride: h.rm.LatestOverride()}
+	status := http.StatusOK
+
+	lastRefresh, staleSince := h.rm.LastRefresh(), h.rm.StaleSince()
+	switch {
+	case !staleSince.IsZero():
+		body.Status = "stale"
+		body.StaleSince = &staleSince
+	case lastRefresh.IsZero():
+		body.Status = "unavailable"
+		status = http.StatusServiceUnavailable
+	default:
+		body.LastRefresh = &lastRefresh
+	}
+
+	content, err := json.Marshal(body)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(content)
+}
@@ -0,0 +1,518 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUpdateHandler(t *testing.T) {
+	g, current, update := newTestUpdatePair(t, nil)
+	g.SetMaxPatchRatio(0)
+
+	h := NewUpdateHandler(g, "https://update.example.com/")
+
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	decode := func(rec *httptest.ResponseRecorder) *Result {
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expecting status %d, got %d", http.StatusOK, rec.Code)
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+			t.Fatalf("Expecting a JSON response, got %q", ct)
+		}
+		var res Result
+		if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		return &res
+	}
+
+	// Unknown binaries get the full update, params from the query.
+	rec := serve(httptest.NewRequest("GET", "/update?os=linux&arch=amd64&app_version=1.0.0&checksum=unknown", nil))
+	if body := rec.Body.String(); !strings.Contains(body, `"patch_type":"none"`) {
+		t.Fatalf("Expecting full updates to say there is no patch, got %s", body)
+	}
+	res := decode(rec)
+	if res.PatchType != PATCHTYPE_NONE || res.URL != update.URL || res.Checksum != update.Checksum {
+		t.Fatalf("Expecting a full update to 1.1.0, got %+v", res)
+	}
+
+	// So do those of an unpublished version, the check comes along with
+	// ErrUnknownVersion.
+	res = decode(serve(httptest.NewRequest("GET", "/update?os=linux&arch=amd64&app_version=0.9.0&checksum=unknown", nil)))
+	if res.URL != update.URL {
+		t.Fatalf("Expecting a full update to 1.1.0 for an unknown version, got %+v", res)
+	}
+
+	// Known binaries get a patch, params from the body.
+	if _, err := exec.LookPath("bsdiff"); err == nil {
+		body := `{"app_version": "1.0.0", "checksum": "` + current.Checksum + `", "tags": {"os": "linux", "arch": "amd64"}}`
+		res = decode(serve(httptest.NewRequest("POST", "/update", strings.NewReader(body))))
+		if res.PatchType != PATCHTYPE_BSDIFF || !strings.HasPrefix(res.PatchURL, "https://update.example.com/patches/") {
+			t.Fatalf("Expecting a patch under the public address, got %+v", res)
+		}
+	}
+
+	// Up to date clients get no content.
+	body := `{"app_version": "1.1.0", "checksum": "` + update.Checksum + `", "tags": {"os": "linux", "arch": "amd64"}}`
+	if rec := serve(httptest.NewRequest("POST", "/update", strings.NewReader(body))); rec.Code != http.StatusNoContent {
+		t.Fatalf("Expecting status %d, got %d", http.StatusNoContent, rec.Code)
+	}
+
+	// Malformed params.
+	for _, req := range []*http.Request{
+		httptest.NewRequest("POST", "/update", strings.NewReader(`{"app_version": `)),
+		httptest.NewRequest("GET", "/update?os=linux&arch=amd64&app_version=1.0.0", nil),
+		httptest.NewRequest("GET", "/update?os=linux&arch=amd64&app_version=one&checksum=abc", nil),
+	} {
+		if rec := serve(req); rec.Code != http.StatusBadRequest {
+			t.Fatalf("Expecting status %d for %s, got %d", http.StatusBadRequest, req.URL, rec.Code)
+		}
+	}
+
+	// Oversized params.
+	body = `{"app_version": "1.0.0", "checksum": "` + strings.Repeat("a", maxParamsBody) + `"}`
+	if rec := serve(httptest.NewRequest("POST", "/update", strings.NewReader(body))); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Expecting status %d, got %d", http.StatusRequestEntityTooLarge, rec.Code)
+	}
+}
+
+func TestUpdateHandlerBusy(t *testing.T) {
+	requireBsdiff(t)
+
+	g, current, _ := newTestUpdatePair(t, nil)
+	g.SetMaxPatchRatio(0)
+	g.SetMaxConcurrentGenerations(1, 0)
+	g.SetGenerationOverflow(GenerationOverflowFailBusy)
+	release, err := g.limiter().acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	rec := httptest.NewRecorder()
+	NewUpdateHandler(g, "https://update.example.com/").ServeHTTP(rec,
+		httptest.NewRequest("GET", "/update?os=linux&arch=amd64&app_version=1.0.0&checksum="+current.Checksum, nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "30" {
+		t.Fatalf("Expecting 503 and when to check again, got %d %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+}
+
+func TestUpdateHandlerErrors(t *testing.T) {
+	g, current, _ := newTestUpdatePair(t, func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	})
+	h := NewUpdateHandler(g, "https://update.example.com/")
+	serve := func(query string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/update?"+query, nil))
+		return rec
+	}
+
+	if rec := serve("os=freebsd&arch=amd64&app_version=1.0.0&checksum=unknown"); rec.Code != http.StatusNotFound {
+		t.Fatalf("Expecting 404 for an unsupported platform, got %d", rec.Code)
+	}
+
+	var e errorBody
+	rec := serve("os=linux&arch=amd64&app_version=1.0&checksum=unknown")
+	if rec.Code != http.StatusBadRequest || json.NewDecoder(rec.Body).Decode(&e) != nil || e.Code != "" {
+		t.Fatalf("Expecting 400 without a code for a malformed version, got %d %+v", rec.Code, e)
+	}
+
+	// The old binary is gone, the full update is served.
+	var res Result
+	rec = serve("os=linux&arch=amd64&app_version=1.0.0&checksum=" + current.Checksum)
+	if rec.Code != http.StatusOK || json.NewDecoder(rec.Body).Decode(&res) != nil || !res.PatchUnavailable {
+		t.Fatalf("Expecting the full update when no patch can be made, got %d %+v", rec.Code, res)
+	}
+
+	// So it is to clients of an unknown version.
+	rec = serve("os=linux&arch=amd64&app_version=0.9.0&checksum=unknown")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expecting the full update for an unknown version, got %d", rec.Code)
+	}
+
+	// Unless they're rejected.
+	g.SetVersionMismatchPolicy(VersionMismatchReject)
+	rec = serve("os=linux&arch=amd64&app_version=1.0.0&checksum=unknown")
+	if rec.Code != http.StatusBadRequest || json.NewDecoder(rec.Body).Decode(&e) != nil || e.Code != "unknown_version" {
+		t.Fatalf("Expecting 400 with an unknown_version code, got %d %+v", rec.Code, e)
+	}
+}
+
+func TestAuxHandler(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"id": 1, "tag_name": "1.0.0", "zipball_url": "https://example.com/1.0.0.zip", "assets": [
+			{"id": 11, "name": "install.sh", "browser_download_url": "https://example.com/install.sh"}
+		]}]`))
+	}))
+	defer api.Close()
+
+	g := NewReleaseManager("getlantern", "autoupdate-server", WithBaseURL(api.URL))
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+	h := http.StripPrefix("/aux/", NewAuxHandler(g))
+	serve := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/aux/"+path, nil))
+		return rec
+	}
+
+	rec := serve("1.0.0/install.sh")
+	if rec.Code != http.StatusFound {
+		t.Fatalf("Expecting status %d, got %d", http.StatusFound, rec.Code)
+	}
+	if loc := rec.Header().Get("Location"); loc != "https://example.com/install.sh" {
+		t.Fatalf("Expecting a redirect to install.sh, got %q", loc)
+	}
+
+	for _, path := range []string{"1.0.0/missing.sh", "2.0.0/install.sh", "1.0.0/", "1.0.0"} {
+		if rec = serve(path); rec.Code != http.StatusNotFound {
+			t.Fatalf("Expecting status %d for %q, got %d", http.StatusNotFound, path, rec.Code)
+		}
+	}
+
+	g.SetMaintenance(true, "Back soon")
+	if rec = serve("1.0.0/install.sh"); rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("Expecting 503 and when to try again during maintenance, got %d", rec.Code)
+	}
+}
+
+func TestReleasesHandler(t *testing.T) {
+	setTestPrivateKey(t)
+
+	files := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("releases handler binary"))
+	}))
+	defer files.Close()
+
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"id": 1, "tag_name": "1.0.0", "zipball_url": "https://example.com/1.0.0.zip", "assets": [
+			{"id": 10, "name": "autoupdate-binary-linux-amd64", "browser_download_url": "` + files.URL + `/releases-handler/autoupdate-binary-linux-amd64"}
+		]}]`))
+	}))
+	defer api.Close()
+
+	g := NewReleaseManager("getlantern", "autoupdate-server", WithBaseURL(api.URL))
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+	h := http.StripPrefix("/releases/", NewReleasesHandler(g))
+	serve := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/releases/"+path, nil))
+		return rec
+	}
+
+	rec := serve("1.0.0")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expecting status %d, got %d", http.StatusOK, rec.Code)
+	}
+	var assets []releaseAsset
+	if err := json.NewDecoder(rec.Body).Decode(&assets); err != nil {
+		t.Fatal(err)
+	}
+	if len(assets) != 1 || assets[0].OS != OS.Linux || assets[0].Size != int64(len("releases handler binary")) || assets[0].Signature == "" {
+		t.Fatalf("Expecting the signed linux asset to be listed, got %+v", assets)
+	}
+
+	for _, path := range []string{"2.0.0", "1.0.0/extra", ""} {
+		if rec = serve(path); rec.Code != http.StatusNotFound {
+			t.Fatalf("Expecting status %d for %q, got %d", http.StatusNotFound, path, rec.Code)
+		}
+	}
+}
+
+func TestServerTiming(t *testing.T) {
+	requireBsdiff(t)
+
+	g, current, _ := newTestUpdatePair(t, nil)
+	g.SetMaxPatchRatio(0)
+
+	h := NewUpdateHandler(g, "https://update.example.com/")
+
+	// A known binary with no patch generated yet goes through every phase.
+	body := `{"app_version": "1.0.0", "checksum": "` + current.Checksum + `", "tags": {"os": "linux", "arch": "amd64"}}`
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/update", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expecting status %d, got %d", http.StatusOK, rec.Code)
+	}
+
+	timing := rec.Header().Get("Server-Timing")
+	for _, phase := range []string{timingLookup, timingCache, timingGenerate, timingSign} {
+		if !strings.Contains(timing, phase+";dur=") {
+			t.Fatalf("Expecting phase %q in Server-Timing, got %q", phase, timing)
+		}
+	}
+
+	// Patch files are timed by the middleware.
+	files := NewServerTimingHandler("patch", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("patch"))
+	}))
+	rec = httptest.NewRecorder()
+	files.ServeHTTP(rec, httptest.NewRequest("GET", "/patches/abc", nil))
+	if timing = rec.Header().Get("Server-Timing"); !strings.HasPrefix(timing, "patch;dur=") {
+		t.Fatalf("Expecting a patch phase in Server-Timing, got %q", timing)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	requireBsdiff(t)
+
+	g, current, update := newTestUpdatePair(t, nil)
+	g.SetMaxPatchRatio(0)
+
+	var h http.Handler
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	h = NewHandler(g, srv.URL+"/")
+
+	check := func(body string) *http.Response {
+		res, err := http.Post(srv.URL+"/update", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { res.Body.Close() })
+		return res
+	}
+
+	// Malformed params get a JSON error.
+	res := check(`{"app_version": `)
+	if res.StatusCode != http.StatusBadRequest || res.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("Expecting a JSON 400, got %d %q", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+	var e errorBody
+	if err := json.NewDecoder(res.Body).Decode(&e); err != nil || e.Error == "" {
+		t.Fatalf("Expecting an error message, got %+v, %q", e, err)
+	}
+
+	// Platforms with no releases are not found, rather than up to date.
+	if res = check(`{"app_version": "1.0.0", "checksum": "abc", "tags": {"os": "plan9", "arch": "amd64"}}`); res.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expecting status %d, got %d", http.StatusNotFound, res.StatusCode)
+	}
+
+	// Up to date clients get no content.
+	if res = check(`{"app_version": "1.1.0", "checksum": "` + update.Checksum + `", "tags": {"os": "linux", "arch": "amd64"}}`); res.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expecting status %d, got %d", http.StatusNoContent, res.StatusCode)
+	}
+
+	res = check(`{"app_version": "1.0.0", "checksum": "` + current.Checksum + `", "tags": {"os": "linux", "arch": "amd64"}}`)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expecting status %d, got %d", http.StatusOK, res.StatusCode)
+	}
+	var r Result
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		t.Fatal(err)
+	}
+	if r.PatchType != PATCHTYPE_BSDIFF || !strings.HasPrefix(r.PatchURL, srv.URL+"/patches/") {
+		t.Fatalf("Expecting a patch served by the handler, got %+v", r)
+	}
+
+	// The patch downloads with its size and checksum.
+	patch, err := g.CachedPatch(current, update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checksum, err := checksumForFile(patch.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, err := fileSize(patch.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Go clients ask for gzip unless told otherwise.
+	req, _ := http.NewRequest("GET", r.PatchURL, nil)
+	req.Header.Set("Accept-Encoding", "identity")
+	if res, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expecting status %d, got %d", http.StatusOK, res.StatusCode)
+	}
+	if res.ContentLength != size {
+		t.Fatalf("Expecting Content-Length %d, got %d", size, res.ContentLength)
+	}
+	etag := res.Header.Get("ETag")
+	if etag != `"`+checksum+`"` {
+		t.Fatalf("Expecting the patch checksum as ETag, got %q", etag)
+	}
+
+	if res.Header.Get("Accept-Ranges") != "bytes" {
+		t.Fatalf("Expecting byte ranges to be accepted, got %q", res.Header.Get("Accept-Ranges"))
+	}
+
+	// Interrupted downloads resume.
+	raw, err := ioutil.ReadFile(patch.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ifRange, status := range map[string]int{etag: http.StatusPartialContent, `"stale"`: http.StatusOK} {
+		req, _ = http.NewRequest("GET", r.PatchURL, nil)
+		req.Header.Set("Accept-Encoding", "identity")
+		req.Header.Set("Range", "bytes=100-")
+		req.Header.Set("If-Range", ifRange)
+		if res, err = http.DefaultClient.Do(req); err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := raw
+		if status == http.StatusPartialContent {
+			want = raw[100:]
+		}
+		if res.StatusCode != status || !bytes.Equal(body, want) || res.ContentLength != int64(len(want)) {
+			t.Fatalf("Expecting status %d and %d bytes for If-Range %s, got %d and %d bytes", status, len(want), ifRange, res.StatusCode, len(body))
+		}
+	}
+
+	req, _ = http.NewRequest("GET", r.PatchURL, nil)
+	req.Header.Set("Accept-Encoding", "identity")
+	req.Header.Set("If-None-Match", etag)
+	if res, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotModified {
+		t.Fatalf("Expecting status %d, got %d", http.StatusNotModified, res.StatusCode)
+	}
+
+	// Evicted patches are gone, unknown ones were never there.
+	if err = os.Remove(patch.File); err != nil {
+		t.Fatal(err)
+	}
+	for url, status := range map[string]int{
+		r.PatchURL:                     http.StatusGone,
+		srv.URL + "/patches/unknown":   http.StatusNotFound,
+		srv.URL + "/patches/../assets": http.StatusNotFound,
+	} {
+		if res, err = http.Get(url); err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != status {
+			t.Fatalf("Expecting status %d for %s, got %d", status, url, res.StatusCode)
+		}
+	}
+}
+
+func TestPatchGzip(t *testing.T) {
+	requireBsdiff(t)
+
+	g, current, update := newTestUpdatePair(t, nil)
+	g.SetMaxPatchRatio(0)
+
+	h := http.StripPrefix("/patches/", NewPatchHandler(g))
+	patch, err := g.CachedPatch(current, update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := ioutil.ReadFile(patch.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Base(patch.File)
+
+	get := func(acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/patches/"+name, nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expecting status %d, got %d", http.StatusOK, rec.Code)
+		}
+		return rec
+	}
+
+	// Clients not asking for gzip get the raw patch.
+	for _, accept := range []string{"", "identity", "gzip;q=0"} {
+		rec := get(accept)
+		if rec.Header().Get("Content-Encoding") != "" || !bytes.Equal(rec.Body.Bytes(), raw) {
+			t.Fatalf("Expecting the raw patch for Accept-Encoding %q", accept)
+		}
+	}
+
+	rec := get("br, gzip;q=0.8")
+	if rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Expecting a gzip encoded patch, got %q", rec.Header().Get("Content-Encoding"))
+	}
+	if rec.Header().Get("ETag") == get("").Header().Get("ETag") {
+		t.Fatal("Expecting the compressed patch to have its own ETag.")
+	}
+	gzfile := patch.File + gzipSuffix
+	fi, err := os.Stat(gzfile)
+	if err != nil {
+		t.Fatalf("Expecting the compressed patch to be cached: %q", err)
+	}
+
+	// Served again from the cached variant.
+	since := fi.ModTime()
+	time.Sleep(10 * time.Millisecond)
+	get("gzip")
+	if fi, err = os.Stat(gzfile); err != nil || !fi.ModTime().Equal(since) {
+		t.Fatal("Expecting the patch to be compressed once.")
+	}
+
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decompressed, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decompressed, raw) {
+		t.Fatal("Expecting the decompressed patch to match the raw one.")
+	}
+
+	// The decompressed patch turns the current binary into the update.
+	dir, err := ioutil.TempDir("", "patch-gzip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	patchfile, newfile := filepath.Join(dir, "patch"), filepath.Join(dir, "new")
+	if err = ioutil.WriteFile(patchfile, decompressed, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = bspatch(current.LocalFile, newfile, patchfile); err != nil {
+		t.Fatal(err)
+	}
+	if checksum, _ := checksumForFile(newfile); checksum != update.Checksum {
+		t.Fatalf("Expecting the patched binary to match the update, got %s", checksum)
+	}
+
+	// The compressed variant goes away with the patch.
+	if err = removePatchFile(patch.File); err != nil {
+		t.Fatal(err)
+	}
+	if fileExists(gzfile) {
+		t.Fatal("Expecting the compressed patch to be removed.")
+	}
+}
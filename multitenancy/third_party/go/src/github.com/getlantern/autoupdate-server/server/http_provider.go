@@ -0,0 +1,138 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// HTTPProvider is a ReleaseProvider reading releases from a JSON index served
+// over HTTP, e.g. from a static directory next to the update assets:
+//
+//	[{
+//	  "version": "2.1.0",
+//	  "prerelease": false,
+//	  "created_at": "2024-05-01T12:00:00Z",
+//	  "notes": "Minimum version: 2.0.0",
+//	  "assets": [{"name": "update_linux_amd64.bz2", "url": "2.1.0/update_linux_amd64.bz2", "digest": "sha256:..."}]
+//	}]
+//
+// Asset URLs may be relative to the index. The digest is optional, like
+// github's.
+type HTTPProvider struct {
+	indexURL *url.URL
+	client   *http.Client
+	tagLog
+}
+
+// NewHTTPProvider returns a provider for the index at indexURL, fetched with
+// the given client or http.DefaultClient if nil.
+func NewHTTPProvider(indexURL string, c *http.Client) (*HTTPProvider, error) {
+	u, err := url.Parse(indexURL)
+	if err != nil {
+		return nil, fmt.Errorf("Bad index URL: %v", err)
+	}
+	if c == nil {
+		c = http.DefaultClient
+	}
+	return &HTTPProvider{indexURL: u, client: c}, nil
+}
+
+// Client returns the client the index is fetched with, assets are downloaded
+// with it too.
+func (p *HTTPProvider) Client() *http.Client {
+	return p.client
+}
+
+type httpIndexRelease struct {
+	Version    string           `json:"version"`
+	Prerelease bool             `json:"prerelease"`
+	Notes      string           `json:"notes"`
+	CreatedAt  time.Time        `json:"created_at"`
+	Assets     []httpIndexAsset `json:"assets"`
+}
+
+type httpIndexAsset struct {
+	Name   string `json:"name"`
+	URL    string `json:"url"`
+	Digest string `json:"digest"`
+}
+
+// Releases fetches and reads the index.
+func (p *HTTPProvider) Releases(ctx context.Context) ([]Release, error) {
+	releases, _, err := p.releasesSince(ctx, releasesValidator{})
+	return releases, err
+}
+
+// releasesSince fetches the index unless it still matches the given
+// validators, the ones of the last response otherwise.
+func (p *HTTPProvider) releasesSince(ctx context.Context, since releasesValidator) ([]Release, releasesValidator, error) {
+	var validator releasesValidator
+
+	req, err := http.NewRequest("GET", p.indexURL.String(), nil)
+	if err != nil {
+		return nil, validator, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if since.etag != "" {
+		req.Header.Set("If-None-Match", since.etag)
+	} else if since.lastModified != "" {
+		req.Header.Set("If-Modified-Since", since.lastModified)
+	}
+
+	res, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, validator, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil, since, ErrNotModified
+	default:
+		return nil, validator, newStatusError(res, fmt.Sprintf("Expecting 200 OK from %s, got: %s", p.indexURL, res.Status))
+	}
+
+	var index []httpIndexRelease
+	if err = json.NewDecoder(res.Body).Decode(&index); err != nil {
+		return nil, validator, fmt.Errorf("Could not read release index %s: %v", p.indexURL, err)
+	}
+
+	validator.etag = res.Header.Get("ETag")
+	validator.lastModified = res.Header.Get("Last-Modified")
+
+	releases := make([]Release, 0, len(index))
+	for _, r := range index {
+		v, err := parseVersion(r.Version)
+		if err != nil {
+			p.skipTag(r.Version, err)
+			continue
+		}
+		rel := Release{
+			URL:        p.indexURL.String(),
+			Version:    v,
+			Prerelease: r.Prerelease,
+			created:    r.CreatedAt,
+		}
+		rel.parseNotes(r.Notes)
+		for _, a := range r.Assets {
+			u, err := p.indexURL.Parse(a.URL)
+			if err != nil {
+				log.Debugf("Asset %v of release %v has a bad URL, ignoring: %v", a.Name, r.Version, err)
+				continue
+			}
+			rel.Assets = append(rel.Assets, Asset{
+				Name:   a.Name,
+				URL:    u.String(),
+				digest: a.Digest,
+			})
+		}
+		releases = append(releases, rel)
+	}
+
+	return releases, validator, nil
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestHTTPProvider(t *testing.T) {
+	setTestPrivateKey(t)
+
+	assets := map[string]string{
+		"/releases/1.0.0/autoupdate-binary-linux-amd64": "http 1.0.0",
+		"/releases/1.1.0/autoupdate-binary-linux-amd64": "http 1.1.0",
+	}
+	index := fmt.Sprintf(`[
+		{"version": "1.0.0", "assets": [{"name": "autoupdate-binary-linux-amd64", "url": "1.0.0/autoupdate-binary-linux-amd64"}]},
+		{"version": "1.1.0", "notes": "Minimum version: 0.9.0", "assets": [
+			{"name": "autoupdate-binary-linux-amd64", "url": "1.1.0/autoupdate-binary-linux-amd64", "digest": "sha256:%x"},
+			{"name": "README.md", "url": "1.1.0/README.md"}
+		]},
+		{"version": "nightly", "assets": []}
+	]`, sha256.Sum256([]byte("http 1.1.0")))
+
+	var indexFetches int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/releases/index.json" {
+			atomic.AddInt32(&indexFetches, 1)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", `"v1"`)
+			w.Write([]byte(index))
+			return
+		}
+		content, ok := assets[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(content))
+	}))
+	defer srv.Close()
+
+	p, err := NewHTTPProvider(srv.URL+"/releases/index.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := NewReleaseManager("getlantern", "lantern", WithReleaseProvider(p))
+	if err = g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, version := range []string{"1.0.0", "1.1.0"} {
+		a := g.updateAssetsMap[OS.Linux][Arch.X64][version]
+		if a == nil {
+			t.Fatalf("Expecting an asset for %s", version)
+		}
+		if a.URL != srv.URL+"/releases/"+version+"/autoupdate-binary-linux-amd64" {
+			t.Fatalf("Expecting the asset URL to be resolved against the index, got %q", a.URL)
+		}
+		if a.Checksum != fmt.Sprintf("%x", sha256.Sum256([]byte("http "+version))) {
+			t.Fatalf("Expecting the asset checksum to match its content, got %+v", a)
+		}
+	}
+
+	// The index did not change, nothing is fetched again.
+	if err = g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&indexFetches); n != 2 {
+		t.Fatalf("Expecting the index to be requested twice, got %d", n)
+	}
+
+	res, err := g.CheckForUpdate(&Params{
+		AppVersion: "1.0.0",
+		OS:         OS.Linux,
+		Arch:       Arch.X64,
+		Checksum:   "unknown",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Version != "1.1.0" || res.URL != srv.URL+"/releases/1.1.0/autoupdate-binary-linux-amd64" {
+		t.Fatalf("Expecting an update to 1.1.0, got %+v", res)
+	}
+}
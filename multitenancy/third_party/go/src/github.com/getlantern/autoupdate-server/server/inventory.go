@@ -0,0 +1,109 @@
+package server
+
+import (
+	"sort"
+	"time"
+)
+
+// InventoryAsset is the latest asset a platform is offered on a channel.
+type InventoryAsset struct {
+	Version     string    `json:"version"`
+	Checksum    string    `json:"checksum"`
+	URL         string    `json:"url"`
+	Size        int64     `json:"size,omitempty"`
+	PublishedAt time.Time `json:"published_at,omitzero"`
+}
+
+// PlatformInventory tells what the manager serves a platform.
+type PlatformInventory struct {
+	OS   string `json:"os"`
+	Arch string `json:"arch"`
+	// Latest is the asset offered on each channel, by channel name.
+	Latest map[string]InventoryAsset `json:"latest"`
+	// Versions is the number of versions indexed, patches are made from.
+	Versions int `json:"versions"`
+}
+
+// PatchCacheInventory tells how full the patch cache is and, if the manager
+// reports to a *Stats, how often it is hit.
+type PatchCacheInventory struct {
+	Entries int    `json:"entries"`
+	Size    int    `json:"size"` // zero or less means unbounded
+	Hits    *int64 `json:"hits,omitempty"`
+	Misses  *int64 `json:"misses,omitempty"`
+}
+
+// Inventory is what the manager is serving, as of its last refresh.
+type Inventory struct {
+	LastRefresh time.Time           `json:"last_refresh,omitzero"`
+	StaleSince  time.Time           `json:"stale_since,omitzero"`
+	Platforms   []PlatformInventory `json:"platforms"`
+	PatchCache  PatchCacheInventory `json:"patch_cache"`
+	// SkippedAssets is the number of release assets matching no asset
+	// pattern, see ReleaseManager.SkippedAssets.
+	SkippedAssets int `json:"skipped_assets"`
+	// Incomplete holds the releases held back for missing platforms, see
+	// ReleaseManager.SetReleaseSettle, by version to the platforms missing.
+	Incomplete map[string][]string `json:"incomplete,omitempty"`
+	// Conflicts holds the releases and assets left out for conflicting
+	// with others, see ReleaseManager.Conflicts.
+	Conflicts []Conflict `json:"conflicts,omitempty"`
+}
+
+// Inventory returns what the manager serves each platform, sorted by OS and
+// arch. Empty os or arch match any, arch is normalized like clients' ones.
+// The assets maps are read at once, never half refreshed.
+func (g *ReleaseManager) Inventory(os string, arch string) *Inventory {
+	arch = normalizeArch(arch)
+
+	g.mu.RLock()
+	inv := &Inventory{LastRefresh: g.lastRefresh, StaleSince: g.staleSince, Platforms: []PlatformInventory{}, SkippedAssets: g.skippedAssets, Conflicts: append([]Conflict(nil), g.conflicts...)}
+	for o := range g.updateAssetsMap {
+		if os != "" && o != os {
+			continue
+		}
+		for a, versions := range g.updateAssetsMap[o] {
+			if arch != "" && a != arch {
+				continue
+			}
+			p := PlatformInventory{OS: o, Arch: a, Latest: make(map[string]InventoryAsset), Versions: len(versions)}
+			for channel := range g.latestAssetsMap {
+				latest := g.latestAssetsMap[channel][o][a]
+				if latest == nil {
+					continue
+				}
+				p.Latest[channel] = InventoryAsset{
+					Version:     latest.v.String(),
+					Checksum:    latest.Checksum,
+					URL:         latest.URL,
+					Size:        latest.Size,
+					PublishedAt: g.releaseDates[latest.v.String()],
+				}
+			}
+			inv.Platforms = append(inv.Platforms, p)
+		}
+	}
+	for v, r := range g.incomplete {
+		if time.Now().Before(r.until) {
+			if inv.Incomplete == nil {
+				inv.Incomplete = make(map[string][]string)
+			}
+			inv.Incomplete[v] = r.missing
+		}
+	}
+	g.mu.RUnlock()
+
+	sort.Slice(inv.Platforms, func(i, j int) bool {
+		if inv.Platforms[i].OS != inv.Platforms[j].OS {
+			return inv.Platforms[i].OS < inv.Platforms[j].OS
+		}
+		return inv.Platforms[i].Arch < inv.Platforms[j].Arch
+	})
+
+	inv.PatchCache.Entries, inv.PatchCache.Size = g.patches.stats()
+	if s, ok := g.metrics.(*Stats); ok {
+		snapshot := s.Snapshot()
+		inv.PatchCache.Hits, inv.PatchCache.Misses = &snapshot.CacheHits, &snapshot.CacheMisses
+	}
+	return inv
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestInventory(t *testing.T) {
+	setTestPrivateKey(t)
+
+	files := newTestAssetServer(map[string]string{
+		"/1.0.0":        "inventory linux 1.0.0",
+		"/1.1.0":        "inventory linux 1.1.0",
+		"/1.2.0-beta.1": "inventory linux 1.2.0-beta.1",
+		"/windows":      "inventory windows 1.1.0",
+	})
+	defer files.Close()
+
+	api := newTestReleasesAPI(fmt.Sprintf(`[
+		{"id": 3, "tag_name": "1.2.0-beta.1", "zipball_url": "%[1]s/1.2.0-beta.1.zip", "prerelease": true, "assets": [
+			{"id": 31, "name": "autoupdate-binary-linux-amd64", "browser_download_url": "%[1]s/1.2.0-beta.1"}
+		]},
+		{"id": 2, "tag_name": "1.1.0", "zipball_url": "%[1]s/1.1.0.zip", "created_at": "2024-04-01T12:00:00Z", "assets": [
+			{"id": 21, "name": "autoupdate-binary-linux-amd64", "browser_download_url": "%[1]s/1.1.0"},
+			{"id": 22, "name": "autoupdate-binary-windows-386", "browser_download_url": "%[1]s/windows"}
+		]},
+		{"id": 1, "tag_name": "1.0.0", "zipball_url": "%[1]s/1.0.0.zip", "assets": [
+			{"id": 11, "name": "autoupdate-binary-linux-amd64", "browser_download_url": "%[1]s/1.0.0"}
+		]}
+	]`, files.URL))
+	defer api.Close()
+
+	stats := NewStats()
+	g := NewReleaseManager("getlantern", "autoupdate-server", WithMetrics(stats))
+	useTestGitHub(t, g, api)
+
+	if inv := g.Inventory("", ""); len(inv.Platforms) != 0 || !inv.LastRefresh.IsZero() {
+		t.Fatalf("Expecting nothing served before a refresh, got %+v", inv)
+	}
+
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+	stats.PatchCacheLookup(false)
+
+	inv := g.Inventory("", "")
+	if inv.LastRefresh.IsZero() {
+		t.Fatal("Expecting the last refresh to be told.")
+	}
+	if len(inv.Platforms) != 2 || inv.Platforms[0].OS != OS.Linux || inv.Platforms[1].OS != OS.Windows {
+		t.Fatalf("Expecting linux and windows sorted, got %+v", inv.Platforms)
+	}
+	linux := inv.Platforms[0]
+	if linux.Arch != Arch.X64 || linux.Versions != 3 {
+		t.Fatalf("Expecting 3 linux/amd64 versions, got %+v", linux)
+	}
+	stable := linux.Latest[Channel.Stable]
+	published := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+	update := g.updateAssetsMap[OS.Linux][Arch.X64]["1.1.0"]
+	if stable.Version != "1.1.0" || stable.Checksum != update.Checksum || !stable.PublishedAt.Equal(published) {
+		t.Fatalf("Expecting 1.1.0 published at %v on stable, got %+v", published, stable)
+	}
+	if beta := linux.Latest[Channel.Beta]; beta.Version != "1.2.0-beta.1" || !beta.PublishedAt.IsZero() {
+		t.Fatalf("Expecting 1.2.0-beta.1 on beta, got %+v", beta)
+	}
+	if inv.PatchCache.Size != defaultPatchCacheSize || inv.PatchCache.Misses == nil || *inv.PatchCache.Misses != 1 {
+		t.Fatalf("Expecting the patch cache statistics, got %+v", inv.PatchCache)
+	}
+
+	// Filtered over HTTP, arch as clients report it.
+	rec := httptest.NewRecorder()
+	NewInventoryHandler(g).ServeHTTP(rec, httptest.NewRequest("GET", "/admin/inventory?os=windows&arch=386", nil))
+	var body Inventory
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Platforms) != 1 || body.Platforms[0].Latest[Channel.Stable].Version != "1.1.0" || body.Platforms[0].Versions != 1 {
+		t.Fatalf("Expecting windows/386 only, got %+v", body.Platforms)
+	}
+
+	rec = httptest.NewRecorder()
+	NewInventoryHandler(g).ServeHTTP(rec, httptest.NewRequest("GET", "/admin/inventory?arch=aarch64", nil))
+	body = Inventory{}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Platforms == nil || len(body.Platforms) != 0 {
+		t.Fatalf("Expecting an empty list of platforms, got %+v", body.Platforms)
+	}
+
+	// Patch cache hits are only known with a *Stats.
+	if inv := NewReleaseManager("getlantern", "autoupdate-server").Inventory("", ""); inv.PatchCache.Hits != nil {
+		t.Fatalf("Expecting no cache hits without stats, got %d", *inv.PatchCache.Hits)
+	}
+}
@@ -0,0 +1,371 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// writing holds the files being written, so Cleanup leaves them and their
+// temporary files alone.
+var writing writeRefs
+
+// serving holds the patch files being sent to clients, so they are not
+// deleted halfway.
+var serving writeRefs
+
+// writeRefs counts the writers, or readers, of every file.
+type writeRefs struct {
+	mu    sync.Mutex
+	files map[string]int
+}
+
+// add marks file as being written until the returned func is called.
+func (w *writeRefs) add(file string) (done func()) {
+	file = filepath.Clean(file)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.files == nil {
+		w.files = make(map[string]int)
+	}
+	w.files[file]++
+	return func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if w.files[file]--; w.files[file] <= 0 {
+			delete(w.files, file)
+		}
+	}
+}
+
+// has tells whether file, or the file a temporary file named like
+// "<name>.<random>.tmp" is written for, is being written.
+func (w *writeRefs) has(file string) bool {
+	file = filepath.Clean(file)
+	if strings.HasSuffix(file, ".tmp") {
+		if i := strings.LastIndex(strings.TrimSuffix(file, ".tmp"), "."); i > 0 {
+			file = file[:i]
+		}
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.files[file] > 0
+}
+
+// janitor is the background cleanup started by StartJanitor.
+type janitor struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// WithJanitor starts the manager with a janitor, see StartJanitor.
+func WithJanitor(interval time.Duration, olderThan time.Duration) Option {
+	return func(g *ReleaseManager) {
+		g.janitorEvery = interval
+		g.janitorAge = olderThan
+	}
+}
+
+// SetWorkDir keeps downloaded assets in dir/assets and generated patches in
+// dir/patches, both are created if they do not exist.
+func (g *ReleaseManager) SetWorkDir(dir string) error {
+	if err := g.SetDownloadDir(filepath.Join(dir, "assets")); err != nil {
+		return err
+	}
+	return g.SetPatchCacheDir(filepath.Join(dir, "patches"))
+}
+
+// indexedFiles returns the local files of the assets still indexed.
+func (g *ReleaseManager) indexedFiles() map[string]bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	indexed := make(map[string]bool)
+	for os := range g.updateAssetsMap {
+		for arch := range g.updateAssetsMap[os] {
+			for _, a := range g.updateAssetsMap[os][arch] {
+				if a.LocalFile != "" {
+					indexed[filepath.Clean(a.LocalFile)] = true
+				}
+			}
+		}
+	}
+	return indexed
+}
+
+// Cleanup deletes the downloaded assets and generated patches that were last
+// used more than olderThan ago, along with temporary files left behind by
+// interrupted downloads and generations, then the least recently used files
+// past the budget set with SetCacheMaxBytes. The local files of assets still
+// indexed, files being downloaded or patched and files being written or
+// served are kept. Files that can't be deleted are logged and skipped.
+func (g *ReleaseManager) Cleanup(olderThan time.Duration) error {
+	cutoff := time.Now().Add(-olderThan)
+	indexed := g.indexedFiles()
+
+	var removed int
+	downloads, err := g.staleFiles(g.DownloadDir(), cutoff)
+	if err != nil {
+		return err
+	}
+	for _, file := range downloads {
+		if indexed[file] || !g.downloads.forget(file) {
+			continue
+		}
+		size, _ := fileSize(file)
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			g.logger.Warn("Could not remove downloaded file", "file", file, "err", err)
+			continue
+		}
+		g.cacheMetrics().CacheEvicted(size)
+		removed++
+	}
+
+	patches, err := g.staleFiles(g.PatchCacheDir(), cutoff)
+	if err != nil {
+		return err
+	}
+	for _, file := range patches {
+		if base := strings.TrimSuffix(strings.TrimSuffix(file, gzipSuffix), zstdSuffix); base != file && fileExists(base) {
+			// Goes along with its patch.
+			continue
+		}
+		size := patchFilesSize(file)
+		if err := removePatchFile(file); err != nil && !os.IsNotExist(err) {
+			g.logger.Warn("Could not remove patch", "patch", file, "err", err)
+			continue
+		}
+		g.cacheMetrics().CacheEvicted(size)
+		removed++
+	}
+
+	g.logger.Info("Cleaned up work files", "removed", removed, "older_than", olderThan)
+	return g.fitCache("")
+}
+
+// patchFilesSize returns the size of a patch file along with its compressed
+// variants.
+func patchFilesSize(file string) int64 {
+	var total int64
+	for _, f := range []string{file, file + gzipSuffix, file + zstdSuffix} {
+		if size, err := fileSize(f); err == nil {
+			total += size
+		}
+	}
+	return total
+}
+
+// SetCacheMaxBytes caps the total size of the downloaded assets and generated
+// patches. When a download or a patch takes them over it, and on Cleanup, the
+// least recently used files are deleted until they fit. The local files of
+// indexed assets and files in use are never deleted, the cache may stay over
+// budget because of them. Zero means unbounded.
+func (g *ReleaseManager) SetCacheMaxBytes(max int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.cacheMaxBytes = max
+}
+
+// cacheWritten is told about a file just added to the cache, which is brought
+// back within its budget if there's one. file itself is kept.
+func (g *ReleaseManager) cacheWritten(file string) {
+	g.mu.RLock()
+	max := g.cacheMaxBytes
+	g.mu.RUnlock()
+	if max <= 0 {
+		return
+	}
+	if err := g.fitCache(file); err != nil {
+		g.logger.Warn("Could not fit the cache in its budget", "err", err)
+	}
+}
+
+// inUse tells whether file, or one of its compressed variants, is being
+// written or served.
+func inUse(file string) bool {
+	for _, f := range []string{file, file + gzipSuffix, file + zstdSuffix} {
+		if writing.has(f) || serving.has(f) {
+			return true
+		}
+	}
+	return false
+}
+
+// cachedFile is a file of the cache, a patch with its compressed variants.
+type cachedFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+	patch   bool
+}
+
+// fitCache measures the cache and deletes its least recently used files until
+// it fits the budget set with SetCacheMaxBytes, keep aside. Usage and
+// evictions are reported to the manager's metrics.
+func (g *ReleaseManager) fitCache(keep string) error {
+	g.mu.RLock()
+	max := g.cacheMaxBytes
+	g.mu.RUnlock()
+
+	g.cacheMu.Lock()
+	defer g.cacheMu.Unlock()
+
+	downloads, downloadsSize, err := listCachedFiles(g.DownloadDir(), false)
+	if err != nil {
+		return err
+	}
+	patches, patchesSize, err := listCachedFiles(g.PatchCacheDir(), true)
+	if err != nil {
+		return err
+	}
+	total := downloadsSize + patchesSize
+
+	var evicted int
+	var evictedBytes int64
+	if max > 0 && total > max {
+		files := append(downloads, patches...)
+		sort.SliceStable(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+		indexed := g.indexedFiles()
+		for _, f := range files {
+			if total <= max {
+				break
+			}
+			if f.path == filepath.Clean(keep) || indexed[f.path] || inUse(f.path) {
+				continue
+			}
+			remove := removePatchFile
+			if !f.patch {
+				if !g.downloads.forget(f.path) {
+					continue
+				}
+				remove = os.Remove
+			}
+			if err := remove(f.path); err != nil && !os.IsNotExist(err) {
+				g.logger.Warn("Could not evict cached file", "file", f.path, "err", err)
+				continue
+			}
+			total -= f.size
+			evicted++
+			evictedBytes += f.size
+			g.cacheMetrics().CacheEvicted(f.size)
+		}
+		g.logger.Info("Evicted cached files over budget", "evicted", evicted, "bytes", evictedBytes, "usage", total, "max_bytes", max)
+	}
+	g.cacheMetrics().CacheUsage(total)
+	return nil
+}
+
+// listCachedFiles lists the files in dir that may be evicted, along with the
+// total size of dir, temporary files included. The compressed variants of a
+// patch are counted along with it.
+func listCachedFiles(dir string, patches bool) ([]cachedFile, int64, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, 0, nil
+		}
+		return nil, 0, fmt.Errorf("Could not read %s: %q", dir, err)
+	}
+	var total int64
+	byName := make(map[string]*cachedFile)
+	var variants []os.FileInfo
+	for _, fi := range entries {
+		if fi.IsDir() {
+			continue
+		}
+		total += fi.Size()
+		name := fi.Name()
+		switch {
+		case strings.HasSuffix(name, ".tmp"):
+			continue
+		case patches && (strings.HasSuffix(name, gzipSuffix) || strings.HasSuffix(name, zstdSuffix)):
+			variants = append(variants, fi)
+			continue
+		}
+		byName[name] = &cachedFile{path: filepath.Join(dir, name), size: fi.Size(), modTime: fi.ModTime(), patch: patches}
+	}
+	for _, fi := range variants {
+		base := strings.TrimSuffix(strings.TrimSuffix(fi.Name(), gzipSuffix), zstdSuffix)
+		if f := byName[base]; f != nil {
+			f.size += fi.Size()
+			continue
+		}
+		// An orphan, evicted on its own.
+		byName[fi.Name()] = &cachedFile{path: filepath.Join(dir, fi.Name()), size: fi.Size(), modTime: fi.ModTime()}
+	}
+	files := make([]cachedFile, 0, len(byName))
+	for _, f := range byName {
+		files = append(files, *f)
+	}
+	return files, total, nil
+}
+
+// staleFiles lists the files in dir last modified before cutoff that are not
+// being written.
+func (g *ReleaseManager) staleFiles(dir string, cutoff time.Time) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Could not read %s: %q", dir, err)
+	}
+	var files []string
+	for _, fi := range entries {
+		file := filepath.Join(dir, fi.Name())
+		if fi.IsDir() || !fi.ModTime().Before(cutoff) || writing.has(file) || serving.has(file) {
+			continue
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// StartJanitor calls Cleanup every interval in a goroutine until StopJanitor
+// is called. Calling it again replaces the running janitor.
+func (g *ReleaseManager) StartJanitor(interval time.Duration, olderThan time.Duration) {
+	g.StopJanitor()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &janitor{cancel: cancel, done: make(chan struct{})}
+
+	g.mu.Lock()
+	g.janitor = j
+	g.mu.Unlock()
+
+	go func() {
+		defer close(j.done)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				return
+			}
+			if err := g.Cleanup(olderThan); err != nil {
+				g.logger.Error("Could not clean up work files", "err", err)
+			}
+		}
+	}()
+}
+
+// StopJanitor stops the janitor started by StartJanitor and waits for it to
+// return.
+func (g *ReleaseManager) StopJanitor() {
+	g.mu.Lock()
+	j := g.janitor
+	g.janitor = nil
+	g.mu.Unlock()
+
+	if j == nil {
+		return
+	}
+	j.cancel()
+	<-j.done
+}
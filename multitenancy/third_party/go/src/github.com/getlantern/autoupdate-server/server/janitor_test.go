@@ -0,0 +1,185 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCleanup(t *testing.T) {
+	setTestPrivateKey(t)
+
+	srv := newTestAssetServer(map[string]string{
+		"/1.0.0": "janitor 1.0.0",
+		"/1.1.0": "janitor 1.1.0",
+	})
+	defer srv.Close()
+
+	work := t.TempDir()
+	g := NewReleaseManager("getlantern", "autoupdate-server")
+	if err := g.SetWorkDir(work); err != nil {
+		t.Fatal(err)
+	}
+	for _, tag := range []string{"1.0.0", "1.1.0"} {
+		asset := &Asset{Name: "autoupdate-binary-linux-amd64", URL: srv.URL + "/" + tag}
+		asset.v, _ = parseVersion(tag)
+		if err := g.pushAsset(OS.Linux, Arch.X64, asset); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assets, patches := filepath.Join(work, "assets"), filepath.Join(work, "patches")
+
+	old := time.Now().Add(-2 * time.Hour)
+	create := func(file string, modTime time.Time) string {
+		if err := ioutil.WriteFile(file, []byte(file), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+
+	// The local files of indexed assets are kept however old.
+	var indexed []string
+	for _, a := range g.updateAssetsMap[OS.Linux][Arch.X64] {
+		indexed = append(indexed, a.LocalFile)
+		os.Chtimes(a.LocalFile, old, old)
+	}
+	if len(indexed) != 2 || filepath.Dir(indexed[0]) != assets {
+		t.Fatalf("Expecting assets to be downloaded to the work directory, got %v", indexed)
+	}
+
+	removedAsset := create(filepath.Join(assets, "autoupdate-binary-linux-amd64.0123"), old)
+	interrupted := create(filepath.Join(assets, "autoupdate-binary-linux-amd64.4567.123.tmp"), old)
+	inUse := create(filepath.Join(assets, "autoupdate-binary-linux-amd64.89ab"), old)
+	g.downloads.acquire(inUse)
+	beingWritten := create(filepath.Join(patches, "cdef.456.tmp"), old)
+	done := writing.add(filepath.Join(patches, "cdef"))
+	stalePatch := create(filepath.Join(patches, "0123"), old)
+	stalePatchGzip := create(stalePatch+gzipSuffix, old)
+	orphanGzip := create(filepath.Join(patches, "4567"+gzipSuffix), old)
+	recentPatch := create(filepath.Join(patches, "89ab"), time.Now())
+
+	if err := g.Cleanup(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range append(indexed, inUse, beingWritten, recentPatch) {
+		if !fileExists(file) {
+			t.Fatalf("Expecting %s to be kept", file)
+		}
+	}
+	for _, file := range []string{removedAsset, interrupted, stalePatch, stalePatchGzip, orphanGzip} {
+		if fileExists(file) {
+			t.Fatalf("Expecting %s to be deleted", file)
+		}
+	}
+
+	// Files are let go once done with.
+	g.downloads.release(inUse)
+	done()
+	if err := g.Cleanup(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if fileExists(beingWritten) {
+		t.Fatal("Expecting the temporary file to be deleted once written.")
+	}
+
+	// The janitor does the same in the background.
+	g.StartJanitor(10*time.Millisecond, time.Hour)
+	defer g.StopJanitor()
+	stale := create(filepath.Join(patches, "fedc"), old)
+	deadline := time.Now().Add(5 * time.Second)
+	for fileExists(stale) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expecting the janitor to delete the stale patch.")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, file := range indexed {
+		if !fileExists(file) {
+			t.Fatalf("Expecting the janitor to keep %s", file)
+		}
+	}
+}
+
+func TestCacheBudget(t *testing.T) {
+	p := NewMemoryProvider()
+	if err := p.AddRelease("1.0.0", "", map[string][]byte{"autoupdate-binary-linux-amd64": make([]byte, 300)}); err != nil {
+		t.Fatal(err)
+	}
+	stats := NewStats()
+	g := NewReleaseManager("getlantern", "autoupdate-server", WithReleaseProvider(p), WithMetrics(stats))
+	work := t.TempDir()
+	if err := g.SetWorkDir(work); err != nil {
+		t.Fatal(err)
+	}
+	assets, patches := filepath.Join(work, "assets"), filepath.Join(work, "patches")
+
+	// Every file is 100 bytes, last used an hour apart.
+	now := time.Now()
+	create := func(file string, hoursAgo int) string {
+		if err := ioutil.WriteFile(file, make([]byte, 100), 0600); err != nil {
+			t.Fatal(err)
+		}
+		used := now.Add(-time.Duration(hoursAgo) * time.Hour)
+		if err := os.Chtimes(file, used, used); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	oldest := create(filepath.Join(assets, "autoupdate-binary-linux-amd64.0123"), 6)
+	served := create(filepath.Join(patches, "4567"), 5)
+	servedGzip := create(served+gzipSuffix, 5)
+	older := create(filepath.Join(patches, "89ab"), 4)
+	olderZstd := create(older+zstdSuffix, 4)
+	old := create(filepath.Join(assets, "autoupdate-binary-linux-amd64.cdef"), 3)
+	recent := create(filepath.Join(patches, "fedc"), 1)
+
+	// The oldest files go first, but for the patch being served.
+	done := serving.add(servedGzip)
+	g.SetCacheMaxBytes(400)
+	if err := g.Cleanup(24 * time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{oldest, older, olderZstd} {
+		if fileExists(file) {
+			t.Fatalf("Expecting %s to be evicted", file)
+		}
+	}
+	for _, file := range []string{served, servedGzip, old, recent} {
+		if !fileExists(file) {
+			t.Fatalf("Expecting %s to be kept", file)
+		}
+	}
+	snapshot := stats.Snapshot()
+	if snapshot.EvictedBytes != 300 || snapshot.CacheBytes != 400 {
+		t.Fatalf("Expecting 300 bytes evicted out of 400 used, got %d out of %d", snapshot.EvictedBytes, snapshot.CacheBytes)
+	}
+	done()
+
+	// A download over budget makes room right away, keeping what it wrote.
+	rs, err := p.Releases(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	localfile, err := g.downloadAsset(context.Background(), rs[0].Assets[0].URL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{served, servedGzip, old} {
+		if fileExists(file) {
+			t.Fatalf("Expecting %s to be evicted by the download", file)
+		}
+	}
+	if !fileExists(localfile) || !fileExists(recent) {
+		t.Fatal("Expecting the download and the most recent patch to be kept.")
+	}
+	if snapshot = stats.Snapshot(); snapshot.EvictedBytes != 600 || snapshot.CacheBytes != 400 {
+		t.Fatalf("Expecting 600 bytes evicted out of 400 used, got %d out of %d", snapshot.EvictedBytes, snapshot.CacheBytes)
+	}
+}
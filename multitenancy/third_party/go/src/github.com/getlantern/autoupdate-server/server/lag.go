@@ -0,0 +1,86 @@
+package server
+
+import (
+	"time"
+
+	"github.com/blang/semver"
+)
+
+// StableLag holds new stable releases back from stable clients while beta
+// clients try them first, they're offered to beta clients right away. A release
+// reaches the stable channel once either lag is met, a zero lag is never met.
+type StableLag struct {
+	// Versions is how many newer releases, of any channel, must be out.
+	Versions int
+	// Age is how long the release must have been out, since it was created
+	// or first listed if its creation time is unknown.
+	Age time.Duration
+}
+
+// SetStableLag sets how far the stable channel lags behind beta. Releases are
+// checked against it on the next UpdateAssetsMap. The zero StableLag, the
+// default, offers stable releases to everyone as soon as they're out.
+func (g *ReleaseManager) SetStableLag(lag StableLag) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.stableLag = lag
+}
+
+// holdStable returns the stable releases among rs the stable lag holds back,
+// with the time their age lets them through or zero if only newer releases
+// will. Releases seen for the first time are remembered as listed at now.
+func (g *ReleaseManager) holdStable(rs []Release, now time.Time) map[string]time.Time {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for i := range rs {
+		if _, ok := g.firstSeen[rs[i].Version.String()]; !ok {
+			g.firstSeen[rs[i].Version.String()] = now
+		}
+	}
+
+	lag := g.stableLag
+	if lag.Versions <= 0 && lag.Age <= 0 {
+		return nil
+	}
+
+	held := make(map[string]time.Time)
+	for i := range rs {
+		if channelForRelease(&rs[i]) != Channel.Stable {
+			continue
+		}
+		if lag.Versions > 0 && newerReleases(rs, rs[i].Version) >= lag.Versions {
+			continue
+		}
+		var until time.Time
+		if lag.Age > 0 {
+			out := rs[i].created
+			if out.IsZero() {
+				out = g.firstSeen[rs[i].Version.String()]
+			}
+			if until = out.Add(lag.Age); !now.Before(until) {
+				continue
+			}
+		}
+		held[rs[i].Version.String()] = until
+	}
+	return held
+}
+
+// newerReleases counts the releases of rs newer than v.
+func newerReleases(rs []Release, v semver.Version) int {
+	n := 0
+	for i := range rs {
+		if rs[i].Version.GT(v) {
+			n++
+		}
+	}
+	return n
+}
+
+// heldFromStable tells whether the stable lag still keeps v from stable
+// clients, g.mu must be held.
+func (g *ReleaseManager) heldFromStable(v semver.Version) bool {
+	until, held := g.stableHeld[v.String()]
+	return held && (until.IsZero() || time.Now().Before(until))
+}
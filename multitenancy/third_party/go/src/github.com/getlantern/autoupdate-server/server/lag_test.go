@@ -0,0 +1,87 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestStableLag(t *testing.T) {
+	setTestPrivateKey(t)
+
+	files := newTestAssetServer(map[string]string{
+		"/2.2.0":        "stable 2.2.0",
+		"/3.0.0":        "stable 3.0.0",
+		"/3.1.0-beta.1": "beta 3.1.0-beta.1",
+	})
+	defer files.Close()
+
+	// Releases without a creation time are aged from when they're first
+	// listed.
+	release := func(id int, tag string, createdAt string) string {
+		return fmt.Sprintf(`{"id": %d, "tag_name": "%s", %s"zipball_url": "%s/%s.zip", "assets": [
+			{"id": %d, "name": "autoupdate-binary-linux-amd64", "browser_download_url": "%s/%s"}
+		]}`, id, tag, createdAt, files.URL, tag, id*10, files.URL, tag)
+	}
+	old := release(1, "2.2.0", `"created_at": "2020-01-01T00:00:00Z", `)
+
+	check := func(g *ReleaseManager, channel string) string {
+		res, err := g.CheckForUpdate(&Params{
+			AppVersion: "2.0.0",
+			OS:         OS.Linux,
+			Arch:       Arch.X64,
+			Checksum:   "unknown",
+			Channel:    channel,
+		})
+		if err != nil && !errors.Is(err, ErrUnknownVersion) {
+			t.Fatal(err)
+		}
+		return res.Version
+	}
+
+	const age = 500 * time.Millisecond
+	api := newTestReleasesAPI("[" + old + "," + release(2, "3.0.0", "") + "]")
+	defer api.Close()
+
+	g := NewReleaseManager("getlantern", "autoupdate-server")
+	g.SetStableLag(StableLag{Age: age})
+	useTestGitHub(t, g, api)
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+	if v := check(g, Channel.Beta); v != "3.0.0" {
+		t.Fatalf("Expecting beta users to be offered 3.0.0 right away, got %v.", v)
+	}
+	if v := check(g, Channel.Stable); v != "2.2.0" {
+		t.Fatalf("Expecting stable users to stay on 2.2.0 during the lag, got %v.", v)
+	}
+	time.Sleep(age)
+	if v := check(g, Channel.Stable); v != "3.0.0" {
+		t.Fatalf("Expecting stable users to be offered 3.0.0 after the lag, got %v.", v)
+	}
+
+	// A version lag is met once enough newer releases are out.
+	g = NewReleaseManager("getlantern", "autoupdate-server")
+	g.SetStableLag(StableLag{Versions: 1})
+	useTestGitHub(t, g, api)
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+	if v := check(g, Channel.Stable); v != "2.2.0" {
+		t.Fatalf("Expecting stable users to stay one release behind, got %v.", v)
+	}
+
+	api2 := newTestReleasesAPI("[" + old + "," + release(2, "3.0.0", "") + "," + release(3, "3.1.0-beta.1", "") + "]")
+	defer api2.Close()
+	useTestGitHub(t, g, api2)
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+	if v := check(g, Channel.Beta); v != "3.1.0-beta.1" {
+		t.Fatalf("Expecting beta users to be offered 3.1.0-beta.1, got %v.", v)
+	}
+	if v := check(g, Channel.Stable); v != "3.0.0" {
+		t.Fatalf("Expecting stable users to be offered 3.0.0 once a newer beta is out, got %v.", v)
+	}
+}
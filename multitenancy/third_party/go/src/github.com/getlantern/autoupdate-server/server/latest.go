@@ -0,0 +1,165 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/blang/semver"
+)
+
+// latestOverride is the release served as the latest of its channel, see
+// SetLatestOverride.
+type latestOverride struct {
+	tag     string // empty when none is set
+	v       semver.Version
+	channel string
+}
+
+// WithGithubLatest serves the release github marks as latest as the latest
+// stable one, rather than the highest version. Platforms it has no asset for
+// keep the highest version.
+func WithGithubLatest() Option {
+	return func(g *ReleaseManager) {
+		g.githubLatest = true
+	}
+}
+
+// SetLatestOverride serves the release of the given tag as the latest of its
+// channel, whatever the versions above it, until ClearLatestOverride. Clients
+// running a newer version are left alone. The release must have an asset for
+// every platform of its channel, it fails with ErrNoSuchVersion when there is
+// no such release and ErrNoSuchPlatform when it misses some. The override is
+// kept across UpdateAssetsMap and restarts with storage.
+func (g *ReleaseManager) SetLatestOverride(tag string) error {
+	v, err := parseVersion(tag)
+	if err != nil {
+		return err
+	}
+
+	g.mu.Lock()
+	channel, ok := versionChannel(g.updateAssetsMap, v)
+	if !ok {
+		g.mu.Unlock()
+		return fmt.Errorf("%w: no release %s to serve as latest", ErrNoSuchVersion, tag)
+	}
+	var missing []string
+	for os := range g.latestAssetsMap[channel] {
+		for arch := range g.latestAssetsMap[channel][os] {
+			if channelAsset(g.updateAssetsMap, os, arch, channel, v) == nil {
+				missing = append(missing, os+"/"+arch)
+			}
+		}
+	}
+	if len(missing) > 0 {
+		g.mu.Unlock()
+		sort.Strings(missing)
+		return fmt.Errorf("%w: release %s has no %s asset", ErrNoSuchPlatform, tag, strings.Join(missing, ", "))
+	}
+	g.latestPin = latestOverride{tag: tag, v: v, channel: channel}
+	g.latestAssetsMap = buildLatest(g.updateAssetsMap, g.forcedVersions(g.markedLatest))
+	g.mu.Unlock()
+
+	g.logger.Info("Serving release as latest", "tag", tag, "channel", channel)
+	g.saveAssets()
+	g.renderManifests()
+	return nil
+}
+
+// ClearLatestOverride serves the latest release of the channel of the
+// override again.
+func (g *ReleaseManager) ClearLatestOverride() {
+	g.mu.Lock()
+	if g.latestPin.tag == "" {
+		g.mu.Unlock()
+		return
+	}
+	g.latestPin = latestOverride{}
+	g.latestAssetsMap = buildLatest(g.updateAssetsMap, g.forcedVersions(g.markedLatest))
+	g.mu.Unlock()
+
+	g.saveAssets()
+	g.renderManifests()
+}
+
+// LatestOverride returns the tag of the release set with SetLatestOverride,
+// empty if none is.
+func (g *ReleaseManager) LatestOverride() string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.latestPin.tag
+}
+
+// forcedVersions returns the versions served as the latest of their channel
+// instead of the highest one: those github marks as latest, given by channel,
+// and the override of its channel. g.mu must be held.
+func (g *ReleaseManager) forcedVersions(marked map[string]semver.Version) map[string]semver.Version {
+	forced := make(map[string]semver.Version)
+	for channel, v := range marked {
+		forced[channel] = v
+	}
+	if g.latestPin.tag != "" {
+		forced[g.latestPin.channel] = g.latestPin.v
+	}
+	return forced
+}
+
+// buildLatest returns the latest assets of updateAssetsMap by channel, os and
+// arch: those of the forced version of their channel, or of the highest one on
+// the platforms the forced version has no asset for.
+func buildLatest(updateAssetsMap map[string]map[string]map[string]*Asset, forced map[string]semver.Version) map[string]map[string]map[string]*Asset {
+	latestAssetsMap := make(map[string]map[string]map[string]*Asset)
+	for os := range updateAssetsMap {
+		for arch := range updateAssetsMap[os] {
+			for _, a := range updateAssetsMap[os][arch] {
+				indexLatest(latestAssetsMap, a)
+			}
+		}
+	}
+	forceLatest(updateAssetsMap, latestAssetsMap, forced)
+	return latestAssetsMap
+}
+
+// forceLatest replaces the latest assets of the channels in forced with those
+// of their forced version.
+func forceLatest(updateAssetsMap map[string]map[string]map[string]*Asset, latestAssetsMap map[string]map[string]map[string]*Asset, forced map[string]semver.Version) {
+	for channel, v := range forced {
+		for os := range latestAssetsMap[channel] {
+			for arch := range latestAssetsMap[channel][os] {
+				a := channelAsset(updateAssetsMap, os, arch, channel, v)
+				if a == nil {
+					log.Errorf("Version %v served as the latest %s release has no %s/%s asset, serving the highest", v, channel, os, arch)
+					continue
+				}
+				latestAssetsMap[channel][os][arch] = a
+			}
+		}
+	}
+}
+
+// channelAsset returns the asset of version v of the channel for the os/arch
+// platform in the default format, nil if there is none.
+func channelAsset(updateAssetsMap map[string]map[string]map[string]*Asset, os string, arch string, channel string, v semver.Version) *Asset {
+	var found *Asset
+	for _, a := range updateAssetsMap[os][arch] {
+		if a.v.EQ(v) && assetChannel(a) == channel && (found == nil || defaultFormat(a, found)) {
+			found = a
+		}
+	}
+	return found
+}
+
+// versionChannel returns the channel of the assets of version v, ok is false
+// if there is none.
+func versionChannel(updateAssetsMap map[string]map[string]map[string]*Asset, v semver.Version) (channel string, ok bool) {
+	for os := range updateAssetsMap {
+		for arch := range updateAssetsMap[os] {
+			for _, a := range updateAssetsMap[os][arch] {
+				if a.v.EQ(v) {
+					return assetChannel(a), true
+				}
+			}
+		}
+	}
+	return "", false
+}
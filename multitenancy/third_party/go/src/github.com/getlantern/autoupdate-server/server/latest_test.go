@@ -0,0 +1,126 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/blang/semver"
+)
+
+func TestSetLatestOverride(t *testing.T) {
+	storage, err := NewFileStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, p := newTestMemoryManager(t)
+	WithStorage(storage)(g)
+	if err := p.AddRelease("1.1.5", "", map[string][]byte{"autoupdate-binary-linux-amd64": []byte("linux-amd64 binary 1.1.5")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+	check := func(version string) (*Result, error) {
+		return g.CheckForUpdate(&Params{
+			AppVersion: version,
+			OS:         OS.Linux,
+			Arch:       Arch.X64,
+			Checksum:   g.assetOfVersion(OS.Linux, Arch.X64, semver.MustParse(version)).Checksum,
+		})
+	}
+
+	if err := g.SetLatestOverride("1.5.0"); !errors.Is(err, ErrNoSuchVersion) {
+		t.Fatalf("Expecting ErrNoSuchVersion for an unknown release, got %v", err)
+	}
+	if err := g.SetLatestOverride("1.1.5"); !errors.Is(err, ErrNoSuchPlatform) {
+		t.Fatalf("Expecting ErrNoSuchPlatform for a release missing windows, got %v", err)
+	}
+	if err := g.SetLatestOverride("1.1.0"); err != nil {
+		t.Fatal(err)
+	}
+
+	if res, err := check("1.0.0"); err != nil || res.Version != "1.1.0" {
+		t.Fatalf("Expecting an update to the overridden release, got %+v, %v", res, err)
+	}
+	if _, err := check("1.2.0"); err != ErrNoUpdateAvailable {
+		t.Fatalf("Expecting clients past the override to be left alone, got %v", err)
+	}
+
+	// Newer releases don't lift the override.
+	if err := p.AddRelease("1.3.0", "", map[string][]byte{"autoupdate-binary-linux-amd64": []byte("linux-amd64 binary 1.3.0")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := check("1.0.0"); err != nil || res.Version != "1.1.0" {
+		t.Fatalf("Expecting the override to survive a refresh, got %+v, %v", res, err)
+	}
+
+	rec := httptest.NewRecorder()
+	NewHealthHandler(g).ServeHTTP(rec, httptest.NewRequest("GET", "/health", nil))
+	var body healthBody
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil || body.LatestOverride != "1.1.0" {
+		t.Fatalf("Expecting the health check to tell the override, got %+v, %v", body, err)
+	}
+
+	// And neither does a restart.
+	g = NewReleaseManager("getlantern", "autoupdate-server", WithReleaseProvider(p), WithStorage(storage))
+	if tag := g.LatestOverride(); tag != "1.1.0" {
+		t.Fatalf("Expecting the override to be loaded from storage, got %q", tag)
+	}
+	if res, err := check("1.0.0"); err != nil || res.Version != "1.1.0" {
+		t.Fatalf("Expecting the loaded override to be served, got %+v, %v", res, err)
+	}
+
+	g.ClearLatestOverride()
+	if res, err := check("1.0.0"); err != nil || res.Version != "1.3.0" {
+		t.Fatalf("Expecting the highest release without the override, got %+v, %v", res, err)
+	}
+}
+
+func TestGithubLatest(t *testing.T) {
+	setTestPrivateKey(t)
+
+	files := newTestAssetServer(map[string]string{
+		"/1.0.0/autoupdate-binary-linux-amd64": "linux binary 1.0.0",
+		"/1.1.0/autoupdate-binary-linux-amd64": "linux binary 1.1.0",
+	})
+	defer files.Close()
+
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repos/getlantern/autoupdate-server/releases":
+			fmt.Fprintf(w, `[
+				{"id": 2, "tag_name": "1.1.0", "zipball_url": "%[1]s/1.1.0.zip", "assets": [{"id": 20, "name": "autoupdate-binary-linux-amd64", "browser_download_url": "%[1]s/1.1.0/autoupdate-binary-linux-amd64"}]},
+				{"id": 1, "tag_name": "1.0.0", "zipball_url": "%[1]s/1.0.0.zip", "assets": [{"id": 10, "name": "autoupdate-binary-linux-amd64", "browser_download_url": "%[1]s/1.0.0/autoupdate-binary-linux-amd64"}]}
+			]`, files.URL)
+		case "/repos/getlantern/autoupdate-server/releases/latest":
+			w.Write([]byte(`{"id": 1, "tag_name": "1.0.0"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer api.Close()
+
+	for _, tc := range []struct {
+		opts   []Option
+		latest string
+	}{
+		{nil, "1.1.0"},
+		{[]Option{WithGithubLatest()}, "1.0.0"},
+	} {
+		g := NewReleaseManager("getlantern", "autoupdate-server", tc.opts...)
+		useTestGitHub(t, g, api)
+		if err := g.UpdateAssetsMap(); err != nil {
+			t.Fatal(err)
+		}
+		if v := g.latestAssetsMap[Channel.Stable][OS.Linux][Arch.X64].v.String(); v != tc.latest {
+			t.Fatalf("Expecting %s as the latest release, got %s", tc.latest, v)
+		}
+	}
+}
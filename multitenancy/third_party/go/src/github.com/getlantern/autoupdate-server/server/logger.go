@@ -0,0 +1,51 @@
+package server
+
+import "log/slog"
+
+// Logger receives leveled diagnostics from a ReleaseManager: refreshes and
+// releases requests, skipped assets, download retries, patch generations and
+// the outcome of update checks. Messages are followed by alternating keys and
+// values, so a *slog.Logger is a Logger, starting with the owner and repo of
+// the manager. Methods are called concurrently and must be safe for
+// concurrent use.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// A *slog.Logger is used as it is, WithLogger(slog.Default()) logs through
+// the default handler.
+var _ Logger = (*slog.Logger)(nil)
+
+// noopLogger is the Logger used when none is set, embedders get no output.
+type noopLogger struct{}
+
+func (noopLogger) Debug(string, ...any) {}
+func (noopLogger) Info(string, ...any)  {}
+func (noopLogger) Warn(string, ...any)  {}
+func (noopLogger) Error(string, ...any) {}
+
+// fieldLogger prepends the same fields to every message.
+type fieldLogger struct {
+	Logger
+	fields []any
+}
+
+func (l fieldLogger) with(args []any) []any {
+	return append(append(make([]any, 0, len(l.fields)+len(args)), l.fields...), args...)
+}
+
+func (l fieldLogger) Debug(msg string, args ...any) { l.Logger.Debug(msg, l.with(args)...) }
+func (l fieldLogger) Info(msg string, args ...any)  { l.Logger.Info(msg, l.with(args)...) }
+func (l fieldLogger) Warn(msg string, args ...any)  { l.Logger.Warn(msg, l.with(args)...) }
+func (l fieldLogger) Error(msg string, args ...any) { l.Logger.Error(msg, l.with(args)...) }
+
+// WithLogger sends the manager's diagnostics to l, nothing is logged by
+// default.
+func WithLogger(l Logger) Option {
+	return func(g *ReleaseManager) {
+		g.logger = l
+	}
+}
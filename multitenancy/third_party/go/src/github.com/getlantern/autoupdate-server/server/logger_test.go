@@ -0,0 +1,189 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testLogger records the messages a manager logs, by level, and their
+// fields.
+type testLogger struct {
+	mu      sync.Mutex
+	entries []string
+	args    [][]any
+}
+
+func (l *testLogger) log(level string, msg string, args []any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, level+" "+msg)
+	l.args = append(l.args, args)
+}
+
+func (l *testLogger) Debug(msg string, args ...any) { l.log("DEBUG", msg, args) }
+func (l *testLogger) Info(msg string, args ...any)  { l.log("INFO", msg, args) }
+func (l *testLogger) Warn(msg string, args ...any)  { l.log("WARN", msg, args) }
+func (l *testLogger) Error(msg string, args ...any) { l.log("ERROR", msg, args) }
+
+// count returns how many times msg was logged at the given level.
+func (l *testLogger) count(level string, msg string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var n int
+	for _, e := range l.entries {
+		if e == level+" "+msg {
+			n++
+		}
+	}
+	return n
+}
+
+// field returns the value of key in the fields of the first message logged
+// as msg at the given level, nil if there is none.
+func (l *testLogger) field(level string, msg string, key string) any {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, e := range l.entries {
+		if e != level+" "+msg {
+			continue
+		}
+		for j := 0; j+1 < len(l.args[i]); j += 2 {
+			if l.args[i][j] == key {
+				return l.args[i][j+1]
+			}
+		}
+		return nil
+	}
+	return nil
+}
+
+func TestLogger(t *testing.T) {
+	requireBsdiff(t)
+	setTestPrivateKey(t)
+
+	var failures int32
+	files := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The first download of 1.1.0 fails and is retried.
+		if r.URL.Path == "/1.1.0" && atomic.AddInt32(&failures, 1) == 1 {
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("logged " + r.URL.Path))
+	}))
+	defer files.Close()
+
+	api := newTestReleasesAPI(fmt.Sprintf(`[
+		{"id": 1, "tag_name": "1.0.0", "zipball_url": "%[1]s/1.0.0.zip", "assets": [
+			{"id": 11, "name": "autoupdate-binary-linux-amd64", "browser_download_url": "%[1]s/1.0.0"},
+			{"id": 12, "name": "autoupdate-binary-osx-386", "browser_download_url": "%[1]s/osx"},
+			{"id": 13, "name": "README.md", "browser_download_url": "%[1]s/README.md"}
+		]},
+		{"id": 2, "tag_name": "1.1.0", "zipball_url": "%[1]s/1.1.0.zip", "assets": [
+			{"id": 21, "name": "autoupdate-binary-linux-amd64", "browser_download_url": "%[1]s/1.1.0"}
+		]}
+	]`, files.URL))
+	defer api.Close()
+
+	logger := &testLogger{}
+	g := NewReleaseManager("getlantern", "autoupdate-server", WithLogger(logger))
+	useTestGitHub(t, g, api)
+	g.SetDownloadRetryPolicy(RetryPolicy{Attempts: 2, Backoff: time.Millisecond})
+	if err := g.SetAuxAssetPattern(`^install\.sh$`); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.SetPatchCacheDir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+	if n := logger.count("WARN", "Skipping asset with an unparsable name"); n != 1 {
+		t.Fatalf("Expecting the malformed osx asset name to be warned about once, got %d in %q", n, logger.entries)
+	}
+	if asset := logger.field("WARN", "Skipping asset with an unparsable name", "asset"); asset != files.URL+"/osx" {
+		t.Fatalf("Expecting the warning to tell the asset URL, got %v", asset)
+	}
+	if n := logger.count("DEBUG", "Skipping asset, neither an update nor an auxiliary asset"); n != 1 {
+		t.Fatalf("Expecting the README skip to be logged once, got %d in %q", n, logger.entries)
+	}
+	if n := logger.count("INFO", "Refreshed assets"); n != 1 {
+		t.Fatalf("Expecting the refresh to be logged once, got %d in %q", n, logger.entries)
+	}
+	if repo := logger.field("INFO", "Refreshed assets", "repo"); repo != "autoupdate-server" {
+		t.Fatalf("Expecting messages to tell the repo, got %v", repo)
+	}
+	for key, want := range map[string]int{"releases": 2, "assets": 2, "skipped": 2} {
+		if n := logger.field("INFO", "Refreshed assets", key); n != want {
+			t.Fatalf("Expecting the refresh to tell %d %s, got %v", want, key, n)
+		}
+	}
+	if n := logger.count("WARN", "Retrying download"); n != 1 {
+		t.Fatalf("Expecting one download retry to be logged, got %d in %q", n, logger.entries)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := g.GeneratePatch(files.URL+"/1.0.0", files.URL+"/1.1.0"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := logger.count("DEBUG", "Generating patch"); n != 1 {
+		t.Fatalf("Expecting a single patch generation to start, got %d in %q", n, logger.entries)
+	}
+	if n := logger.count("INFO", "Generated patch"); n != 1 {
+		t.Fatalf("Expecting a single patch generation to finish, got %d in %q", n, logger.entries)
+	}
+	if size, ok := logger.field("INFO", "Generated patch", "size").(int64); !ok || size <= 0 {
+		t.Fatalf("Expecting the patch size to be told, got %v", size)
+	}
+	if n := logger.count("DEBUG", "Patch cache hit"); n != 1 {
+		t.Fatalf("Expecting the second patch to be a cache hit, got %d in %q", n, logger.entries)
+	}
+
+	if _, err := g.CheckForUpdate(&Params{AppVersion: "1.0.0", OS: OS.Linux, Arch: Arch.X64, Checksum: "unknown"}); err != nil {
+		t.Fatal(err)
+	}
+	if v := logger.field("INFO", "Offering update", "new"); v != "1.1.0" {
+		t.Fatalf("Expecting the update to 1.1.0 to be logged, got %v in %q", v, logger.entries)
+	}
+	if _, err := g.CheckForUpdate(&Params{AppVersion: "1.0.0", OS: OS.Linux, Arch: Arch.X64}); err == nil {
+		t.Fatal("Expecting a check without a checksum to fail")
+	}
+	if n := logger.count("DEBUG", "Update check turned down"); n != 1 {
+		t.Fatalf("Expecting a bad check to be a debug message, got %d in %q", n, logger.entries)
+	}
+	if n := logger.count("WARN", "Update check failed"); n != 0 {
+		t.Fatalf("Expecting a bad check not to be warned about, got %d in %q", n, logger.entries)
+	}
+}
+
+func TestLoggerQuietByDefault(t *testing.T) {
+	g := NewReleaseManager("getlantern", "autoupdate-server")
+	if _, ok := g.logger.(noopLogger); !ok {
+		t.Fatalf("Expecting nothing to be logged by default, got %T", g.logger)
+	}
+}
+
+func TestSlogLogger(t *testing.T) {
+	var buf bytes.Buffer
+	g := NewReleaseManager("getlantern", "autoupdate-server", WithLogger(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))))
+	if _, err := g.CheckForUpdate(&Params{AppVersion: "1.0.0", OS: OS.Linux, Arch: Arch.X64}); err == nil {
+		t.Fatal("Expecting a check without a checksum to fail")
+	}
+
+	var entry map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("Expecting a JSON entry, got %q: %v", buf.String(), err)
+	}
+	if entry["msg"] != "Update check turned down" || entry["level"] != "DEBUG" || entry["repo"] != "autoupdate-server" || entry["os"] != OS.Linux || entry["old"] != "1.0.0" {
+		t.Fatalf("Expecting the check to be logged with its fields, got %v", entry)
+	}
+}
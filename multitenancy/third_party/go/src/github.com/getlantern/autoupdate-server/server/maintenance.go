@@ -0,0 +1,63 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maintenanceRetryAfter is how long clients are told to wait before checking
+// again while updates are paused.
+const maintenanceRetryAfter = 15 * time.Minute
+
+// maintenance tells whether updates are paused, see SetMaintenance.
+type maintenance struct {
+	active    bool
+	message   string
+	downloads bool // patches and auxiliary assets are still served
+}
+
+// SetMaintenance pauses or resumes every update offer. While active,
+// CheckForUpdate fails with a *MaintenanceError carrying message for every
+// client, and patches and auxiliary assets are no longer served unless
+// SetMaintenanceDownloads allows them.
+func (g *ReleaseManager) SetMaintenance(active bool, message string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.maintenance.active = active
+	g.maintenance.message = message
+	if active {
+		log.Debugf("Pausing updates for maintenance: %s", message)
+	}
+}
+
+// SetMaintenanceDownloads sets whether patches already handed out and
+// auxiliary assets are still served during maintenance, they are not by
+// default.
+func (g *ReleaseManager) SetMaintenanceDownloads(allow bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.maintenance.downloads = allow
+}
+
+// inMaintenance returns the error update checks fail with while updates are
+// paused, nil otherwise. When downloads is true it only does if downloads are
+// paused too.
+func (g *ReleaseManager) inMaintenance(downloads bool) *MaintenanceError {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	m := g.maintenance
+	if !m.active || (downloads && m.downloads) {
+		return nil
+	}
+	return &MaintenanceError{Message: m.message, RetryAfter: maintenanceRetryAfter}
+}
+
+// serveMaintenance answers with 503, the maintenance message and when to try
+// again.
+func serveMaintenance(w http.ResponseWriter, e *MaintenanceError) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(e.RetryAfter/time.Second)))
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write([]byte(e.Error()))
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMaintenance(t *testing.T) {
+	g, _, update := newTestUpdatePair(t, nil)
+	const message = "Migrating to new servers, back soon"
+
+	check := func(os string, version string) (*Result, error) {
+		return g.CheckForUpdate(&Params{
+			AppVersion: version,
+			OS:         os,
+			Arch:       Arch.X64,
+			Checksum:   "unknown",
+		})
+	}
+
+	g.SetMaintenance(true, message)
+
+	// Every client is paused, known platform or not.
+	for _, c := range []struct{ os, version string }{{OS.Linux, "1.0.0"}, {OS.Windows, "0.1.0"}, {OS.Linux, "1.1.0"}} {
+		_, err := check(c.os, c.version)
+		var paused *MaintenanceError
+		if !errors.Is(err, ErrMaintenance) || !errors.As(err, &paused) {
+			t.Fatalf("Expecting %s %s to be paused, got %v", c.os, c.version, err)
+		}
+		if paused.Message != message || err.Error() != message || paused.RetryAfter <= 0 {
+			t.Fatalf("Expecting the maintenance message and a delay, got %+v", paused)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	NewHandler(g, "").ServeHTTP(rec, httptest.NewRequest("GET", "/update?os=linux&arch=amd64&app_version=1.0.0&checksum=unknown", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Body.String() != message || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("Expecting 503 with the message and Retry-After, got %d %q %v", rec.Code, rec.Body.String(), rec.Header())
+	}
+
+	auxAssets := map[string]map[string]*Asset{"1.1.0": {"install.sh": {Name: "install.sh"}}}
+	g.mu.Lock()
+	g.auxAssetsMap = auxAssets
+	g.mu.Unlock()
+
+	// Downloads are paused too, unless allowed.
+	rec = httptest.NewRecorder()
+	NewHandler(g, "").ServeHTTP(rec, httptest.NewRequest("GET", "/patches/unknown", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expecting patch downloads to be paused, got %d", rec.Code)
+	}
+	if _, err := g.AuxAsset("1.1.0", "install.sh"); !errors.Is(err, ErrMaintenance) {
+		t.Fatalf("Expecting auxiliary assets to be paused, got %v", err)
+	}
+
+	g.SetMaintenanceDownloads(true)
+	rec = httptest.NewRecorder()
+	NewHandler(g, "").ServeHTTP(rec, httptest.NewRequest("GET", "/patches/unknown", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("Expecting patch downloads to be served, got %d", rec.Code)
+	}
+	if _, err := g.AuxAsset("1.1.0", "install.sh"); err != nil {
+		t.Fatalf("Expecting auxiliary assets to be served, got %v", err)
+	}
+	if _, err := check(OS.Linux, "1.0.0"); !errors.Is(err, ErrMaintenance) {
+		t.Fatalf("Expecting update checks to stay paused, got %v", err)
+	}
+
+	g.SetMaintenance(false, "")
+	res, err := check(OS.Linux, "1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.URL != update.URL {
+		t.Fatalf("Expecting updates to resume, got %+v", res)
+	}
+}
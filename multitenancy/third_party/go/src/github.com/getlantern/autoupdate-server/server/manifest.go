@@ -0,0 +1,135 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Manifest describes the full binary of the latest version a platform is
+// offered on a channel, for clients that can't apply patches.
+type Manifest struct {
+	OS          string    `json:"os"`
+	Arch        string    `json:"arch"`
+	Channel     string    `json:"channel"`
+	Version     string    `json:"version"`
+	URL         string    `json:"url"`
+	SHA256      string    `json:"sha256"`
+	Size        int64     `json:"size"`
+	PublishedAt time.Time `json:"published_at,omitzero"`
+}
+
+// SignedManifest is the JSON of a Manifest along with its detached signature.
+// The signature is over the SHA-256 of the manifest bytes exactly as sent,
+// made like the signatures of assets by the key KeyID names, or by the
+// PRIVATE_KEY file when it's empty.
+type SignedManifest struct {
+	Manifest  json.RawMessage `json:"manifest"`
+	Signature string          `json:"signature"`
+	KeyID     string          `json:"key_id,omitempty"`
+	checksum  string          // of the asset described
+}
+
+// manifestKey is the key of a platform's manifest on a channel.
+func manifestKey(channel string, os string, arch string) string {
+	return channel + "/" + os + "/" + arch
+}
+
+// Manifest returns the signed manifest of the update offered to os/arch on
+// channel, stable if empty, leaving staged rollouts out like LatestAsset
+// does. It fails with ErrNoSuchPlatform if there's none. Manifests are made
+// on every refresh, and again as soon as the update offered changes.
+func (g *ReleaseManager) Manifest(channel string, os string, arch string) (*SignedManifest, error) {
+	if channel == "" {
+		channel = Channel.Stable
+	}
+	arch = g.platformArch(os, normalizeArch(arch))
+	if err := g.platformEOL(os, arch); err != nil {
+		return nil, err
+	}
+	asset, err := g.getProductUpdate(channel, os, arch, "", nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s/%s", ErrNoSuchPlatform, os, arch)
+	}
+
+	key := manifestKey(channel, os, arch)
+	g.mu.RLock()
+	m := g.manifests[key]
+	g.mu.RUnlock()
+	if m != nil && m.checksum == asset.Checksum {
+		return m, nil
+	}
+
+	if m, err = g.signManifest(channel, os, arch, asset); err != nil {
+		return nil, err
+	}
+	g.mu.Lock()
+	g.manifests[key] = m
+	g.mu.Unlock()
+	return m, nil
+}
+
+// signManifest renders and signs the manifest of asset as the update of
+// os/arch on channel.
+func (g *ReleaseManager) signManifest(channel string, os string, arch string, asset *Asset) (*SignedManifest, error) {
+	content, err := json.Marshal(Manifest{
+		OS:          os,
+		Arch:        arch,
+		Channel:     channel,
+		Version:     asset.v.String(),
+		URL:         asset.clientURL(),
+		SHA256:      asset.SHA256,
+		Size:        asset.Size,
+		PublishedAt: g.releaseDateFor(asset.v),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(content)
+	m := &SignedManifest{Manifest: content, checksum: asset.Checksum}
+	if len(g.signingKeys) > 0 {
+		m.KeyID = g.signingKeys[0].ID
+		m.Signature, err = g.signingKeys[0].sign(sum[:])
+	} else {
+		m.Signature, err = signLegacy(sum[:])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not sign the manifest of %s/%s: %v", os, arch, err)
+	}
+	return m, nil
+}
+
+// renderManifests makes the manifest of every platform on every channel, the
+// ones of the previous assets maps are dropped.
+func (g *ReleaseManager) renderManifests() {
+	g.mu.RLock()
+	var keys [][3]string
+	for channel := range g.latestAssetsMap {
+		for os := range g.latestAssetsMap[channel] {
+			for arch := range g.latestAssetsMap[channel][os] {
+				keys = append(keys, [3]string{channel, os, arch})
+			}
+		}
+	}
+	g.mu.RUnlock()
+
+	manifests := make(map[string]*SignedManifest, len(keys))
+	for _, k := range keys {
+		asset, err := g.getProductUpdate(k[0], k[1], k[2], "", nil)
+		if err != nil {
+			continue
+		}
+		m, err := g.signManifest(k[0], k[1], k[2], asset)
+		if err != nil {
+			g.logger.Error("Could not make manifest", "channel", k[0], "os", k[1], "arch", k[2], "err", err)
+			continue
+		}
+		manifests[manifestKey(k[0], k[1], k[2])] = m
+	}
+
+	g.mu.Lock()
+	g.manifests = manifests
+	g.mu.Unlock()
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestManifest(t *testing.T) {
+	setTestPrivateKey(t)
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewMemoryProvider()
+	for _, tag := range []string{"1.0.0", "1.1.0"} {
+		if err := p.AddRelease(tag, "", map[string][]byte{"autoupdate-binary-linux-amd64": []byte("manifest " + tag)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	g := NewReleaseManager("getlantern", "autoupdate-server", WithReleaseProvider(p), WithSigningKeys(NewRSASigningKey("k1", key)))
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+	if len(g.manifests) != 1 {
+		t.Fatalf("Expecting the manifest to be made on refresh, got %v", g.manifests)
+	}
+
+	rec := httptest.NewRecorder()
+	NewHandler(g, "").ServeHTTP(rec, httptest.NewRequest("GET", "/manifest/linux/amd64", nil))
+	var signed SignedManifest
+	if err := json.NewDecoder(rec.Body).Decode(&signed); err != nil {
+		t.Fatal(err)
+	}
+	var m Manifest
+	if err := json.Unmarshal(signed.Manifest, &m); err != nil {
+		t.Fatal(err)
+	}
+	latest := g.updateAssetsMap[OS.Linux][Arch.X64]["1.1.0"]
+	if m.Version != "1.1.0" || m.URL != latest.URL || m.SHA256 != latest.SHA256 || m.Size != int64(len("manifest 1.1.0")) || m.Channel != Channel.Stable {
+		t.Fatalf("Expecting the manifest of 1.1.0, got %+v", m)
+	}
+
+	verify := func(content []byte, signature string, pub *rsa.PublicKey) error {
+		sig, err := hex.DecodeString(signature)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(content)
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], sig)
+	}
+	if signed.KeyID != "k1" {
+		t.Fatalf("Expecting the key ID to be told, got %q", signed.KeyID)
+	}
+	if err := verify(signed.Manifest, signed.Signature, &key.PublicKey); err != nil {
+		t.Fatalf("Expecting the signature to verify: %v", err)
+	}
+	tampered := append([]byte(nil), signed.Manifest...)
+	tampered[len(tampered)/2] ^= 1
+	if err := verify(tampered, signed.Signature, &key.PublicKey); err == nil {
+		t.Fatal("Expecting a tampered manifest to fail verification.")
+	}
+
+	rec = httptest.NewRecorder()
+	NewManifestHandler(g).ServeHTTP(rec, httptest.NewRequest("GET", "/windows/386", nil))
+	if rec.Code != 404 {
+		t.Fatalf("Expecting 404 for a platform without assets, got %d", rec.Code)
+	}
+
+	// Without signing keys manifests are signed with the legacy key.
+	legacy := NewReleaseManager("getlantern", "autoupdate-server", WithReleaseProvider(p))
+	if err := legacy.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+	lm, err := legacy.Manifest("", OS.Linux, Arch.X64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemBytes, err := ioutil.ReadFile(privateKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(pemBytes)
+	legacyKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verify(lm.Manifest, lm.Signature, &legacyKey.PublicKey); err != nil || lm.KeyID != "" {
+		t.Fatalf("Expecting a signature by the legacy key, got %v %q", err, lm.KeyID)
+	}
+}
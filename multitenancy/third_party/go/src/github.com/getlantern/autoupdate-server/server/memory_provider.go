@@ -0,0 +1,163 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// memoryAssetsURL is where MemoryProvider clients serve assets from.
+const memoryAssetsURL = "http://memory.invalid/"
+
+// memoryProviders numbers the providers, so their assets URLs don't collide in
+// a download directory.
+var memoryProviders int64
+
+// MemoryProvider is a ReleaseProvider serving releases and their assets from
+// memory, to run a manager without a network, as in tests:
+//
+//	p := NewMemoryProvider()
+//	p.AddRelease("1.0.0", "", map[string][]byte{"autoupdate-binary-linux-amd64": binary})
+//	g := NewReleaseManager("getlantern", "autoupdate-server", WithReleaseProvider(p))
+//
+// Its client serves an asset at http://memory.invalid/<n>/<tag>/<name>, n
+// numbering the provider, without ever dialing.
+type MemoryProvider struct {
+	mu       sync.RWMutex
+	baseURL  string
+	releases []Release
+	blobs    map[string][]byte // by URL
+	client   *http.Client
+}
+
+// NewMemoryProvider returns a provider without releases.
+func NewMemoryProvider() *MemoryProvider {
+	p := &MemoryProvider{
+		baseURL: fmt.Sprintf("%s%d/", memoryAssetsURL, atomic.AddInt64(&memoryProviders, 1)),
+		blobs:   make(map[string][]byte),
+	}
+	p.client = &http.Client{Transport: memoryTransport{p}}
+	return p
+}
+
+// AddRelease publishes a release tagged tag, with the given notes and assets
+// by name. Releases flagged as prereleases on github are told apart by their
+// tag only. Adding a release already published uploads more assets to it,
+// its notes and the assets it has are left as they were. It fails if tag is
+// not a semantic version.
+func (p *MemoryProvider) AddRelease(tag string, notes string, assets map[string][]byte) error {
+	v, err := parseVersion(tag)
+	if err != nil {
+		return fmt.Errorf("Release %v is not semantically versioned: %v", tag, err)
+	}
+
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var rel *Release
+	for i := range p.releases {
+		if p.releases[i].Tag == tag {
+			rel = &p.releases[i]
+		}
+	}
+	if rel == nil {
+		p.releases = append(p.releases, Release{
+			id:      len(p.releases) + 1,
+			URL:     p.baseURL + url.PathEscape(tag),
+			Tag:     tag,
+			Version: v,
+			created: now,
+		})
+		rel = &p.releases[len(p.releases)-1]
+		rel.parseNotes(notes)
+	}
+	// Assets are numbered in name order, for ids not to depend on the map's.
+	names := make([]string, 0, len(assets))
+	for name := range assets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		content := assets[name]
+		u := rel.URL + "/" + url.PathEscape(name)
+		if _, ok := p.blobs[u]; ok {
+			continue
+		}
+		rel.Assets = append(rel.Assets, Asset{
+			id:   rel.id*1000 + len(rel.Assets),
+			Name: name,
+			URL:  u,
+			Size: int64(len(content)),
+			// Assets added later are uploaded later.
+			uploaded: now,
+		})
+		p.blobs[u] = content
+	}
+	return nil
+}
+
+// Releases returns the releases added so far, the latest added first like
+// github lists them.
+func (p *MemoryProvider) Releases(ctx context.Context) ([]Release, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	releases := make([]Release, len(p.releases))
+	for i := range p.releases {
+		rel := p.releases[len(p.releases)-1-i]
+		rel.Assets = append([]Asset(nil), rel.Assets...)
+		releases[i] = rel
+	}
+	return releases, nil
+}
+
+// Client returns a client serving the assets of the releases.
+func (p *MemoryProvider) Client() *http.Client {
+	return p.client
+}
+
+// memoryTransport answers requests for the assets of a MemoryProvider.
+type memoryTransport struct {
+	p *MemoryProvider
+}
+
+func (t memoryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := req.Context().Err(); err != nil {
+		return nil, err
+	}
+	u := *req.URL
+	u.RawQuery, u.Fragment = "", ""
+
+	t.p.mu.RLock()
+	content, ok := t.p.blobs[u.String()]
+	t.p.mu.RUnlock()
+
+	res := &http.Response{
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Request:    req,
+	}
+	if !ok || req.Method != "GET" {
+		res.StatusCode, res.Status = http.StatusNotFound, "404 Not Found"
+		res.Body = ioutil.NopCloser(bytes.NewReader(nil))
+		return res, nil
+	}
+	res.StatusCode, res.Status = http.StatusOK, "200 OK"
+	res.Header.Set("Content-Type", "application/octet-stream")
+	res.Header.Set("Content-Length", strconv.Itoa(len(content)))
+	res.ContentLength = int64(len(content))
+	res.Body = ioutil.NopCloser(bytes.NewReader(content))
+	return res, nil
+}
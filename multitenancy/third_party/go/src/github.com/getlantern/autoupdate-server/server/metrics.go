@@ -0,0 +1,362 @@
+package server
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Outcomes of an update check, as reported to Metrics.
+const (
+	CheckOutcomePatch       = "patch"       // a patch was served
+	CheckOutcomeFull        = "full"        // the full binary was served
+	CheckOutcomeNoUpdate    = "no_update"   // the client is up to date
+	CheckOutcomeUnsupported = "unsupported" // nothing is published for the platform
+	CheckOutcomePending     = "pending"     // the patch is being generated
+	CheckOutcomeError       = "error"       // the check failed
+)
+
+// Metrics receives instrumentation events from a ReleaseManager, to be
+// adapted to a metrics system like Prometheus. Methods are called from
+// concurrent update checks and must be safe for concurrent use.
+type Metrics interface {
+	// UpdateCheck counts an update check from the given platform.
+	UpdateCheck(os string, arch string, outcome string)
+	// PatchCacheLookup counts a look for an already generated patch.
+	PatchCacheLookup(hit bool)
+	// PatchGeneration observes the time spent generating a patch, err is
+	// nil if it succeeded.
+	PatchGeneration(d time.Duration, err error)
+	// DownloadError counts a failed asset download.
+	DownloadError(err error)
+	// GithubError counts a failed request for the releases list, to github
+	// or to the release provider.
+	GithubError(err error)
+	// Refresh observes the time an UpdateAssetsMap took, err is nil if it
+	// succeeded.
+	Refresh(d time.Duration, err error)
+	// PatchServed counts the bytes of a patch sent by the patch handler.
+	PatchServed(bytes int64)
+	// UnverifiedAsset counts an update asset left out for failing the
+	// provenance checks.
+	UnverifiedAsset(name string, err error)
+}
+
+// ExtendedMetrics is a Metrics also told about sizes, releases requests and
+// the versions known. A ReleaseManager reports these events to its Metrics
+// when it implements ExtendedMetrics too, so existing Metrics keep working.
+type ExtendedMetrics interface {
+	Metrics
+	// PatchSize observes the size in bytes of a generated patch.
+	PatchSize(bytes int64)
+	// AssetDownloaded counts the bytes of an asset downloaded in full.
+	AssetDownloaded(bytes int64)
+	// ReleasesRequest observes the time a request for the releases list
+	// took, err is nil if it succeeded.
+	ReleasesRequest(d time.Duration, err error)
+	// AssetVersions tells how many versions of the update asset of the
+	// given platform are known, after each refresh.
+	AssetVersions(os string, arch string, versions int)
+}
+
+// CacheMetrics is a Metrics also told how large the downloaded assets and
+// generated patches kept on disk grow. A ReleaseManager reports these events
+// to its Metrics when it implements CacheMetrics too.
+type CacheMetrics interface {
+	Metrics
+	// CacheEvicted counts the bytes of a file deleted by the janitor, for
+	// its age or to fit the cache budget.
+	CacheEvicted(bytes int64)
+	// CacheUsage tells the total size in bytes of the cached files, each
+	// time the janitor measures it.
+	CacheUsage(bytes int64)
+}
+
+// noopMetrics is the Metrics used when none is set.
+type noopMetrics struct{}
+
+func (noopMetrics) UpdateCheck(string, string, string)   {}
+func (noopMetrics) PatchCacheLookup(bool)                {}
+func (noopMetrics) PatchGeneration(time.Duration, error) {}
+func (noopMetrics) DownloadError(error)                  {}
+func (noopMetrics) GithubError(error)                    {}
+func (noopMetrics) Refresh(time.Duration, error)         {}
+func (noopMetrics) PatchServed(int64)                    {}
+func (noopMetrics) UnverifiedAsset(string, error)        {}
+func (noopMetrics) PatchSize(int64)                      {}
+func (noopMetrics) AssetDownloaded(int64)                {}
+func (noopMetrics) ReleasesRequest(time.Duration, error) {}
+func (noopMetrics) AssetVersions(string, string, int)    {}
+func (noopMetrics) CacheEvicted(int64)                   {}
+func (noopMetrics) CacheUsage(int64)                     {}
+
+// extendedMetrics returns the manager's Metrics if it is an ExtendedMetrics,
+// one ignoring every event otherwise.
+func (g *ReleaseManager) extendedMetrics() ExtendedMetrics {
+	if m, ok := g.metrics.(ExtendedMetrics); ok {
+		return m
+	}
+	return noopMetrics{}
+}
+
+// cacheMetrics returns the manager's Metrics if it is a CacheMetrics, one
+// ignoring every event otherwise.
+func (g *ReleaseManager) cacheMetrics() CacheMetrics {
+	if m, ok := g.metrics.(CacheMetrics); ok {
+		return m
+	}
+	return noopMetrics{}
+}
+
+// WithMetrics reports instrumentation events to m.
+func WithMetrics(m Metrics) Option {
+	return func(g *ReleaseManager) {
+		g.metrics = m
+	}
+}
+
+// checkOutcome tells how an update check ended.
+func checkOutcome(res *Result, err error) string {
+	switch {
+	case res != nil && (res.PatchType != PATCHTYPE_NONE || len(res.Patches) > 0):
+		return CheckOutcomePatch
+	case res != nil:
+		return CheckOutcomeFull
+	case errors.Is(err, ErrNoUpdateAvailable):
+		return CheckOutcomeNoUpdate
+	case errors.Is(err, ErrNoSuchPlatform):
+		return CheckOutcomeUnsupported
+	case errors.Is(err, ErrPatchPending):
+		return CheckOutcomePending
+	default:
+		return CheckOutcomeError
+	}
+}
+
+// Stats is an ExtendedMetrics and a CacheMetrics keeping counters in memory, safe for concurrent
+// use without taking any lock. Its Snapshot can be exported as is or adapted
+// to a metrics system.
+type Stats struct {
+	platforms sync.Map // os/arch -> *platformStats
+
+	cacheHits        int64
+	cacheMisses      int64
+	patchesGenerated int64
+	generationErrors int64
+	generationTime   int64 // nanoseconds
+	downloadErrors   int64
+	githubErrors     int64
+	refreshes        int64
+	refreshErrors    int64
+	refreshTime      int64 // nanoseconds
+	patchBytesServed int64
+	unverifiedAssets int64
+	patchBytes       int64 // generated
+	downloadedBytes  int64
+	releasesRequests int64
+	releasesTime     int64 // nanoseconds
+	evictedBytes     int64
+	cacheBytes       int64
+}
+
+type platformStats struct {
+	checks      int64
+	patches     int64
+	fulls       int64
+	noUpdate    int64
+	unsupported int64
+	pending     int64
+	errors      int64
+	versions    int64
+}
+
+// NewStats returns a Stats with every counter at zero.
+func NewStats() *Stats {
+	return &Stats{}
+}
+
+// PlatformStats counts the update checks from a platform.
+type PlatformStats struct {
+	Checks      int64 `json:"checks"`
+	Patches     int64 `json:"patches"`     // checks answered with a patch
+	Fulls       int64 `json:"fulls"`       // checks answered with the full binary
+	NoUpdate    int64 `json:"no_update"`   // checks from up to date clients
+	Unsupported int64 `json:"unsupported"` // checks from a platform nothing is published for
+	Pending     int64 `json:"pending"`     // checks told to come back for a patch being generated
+	Errors      int64 `json:"errors"`
+	Versions    int64 `json:"versions"` // of the update asset, as of the last refresh
+}
+
+// StatsSnapshot is a copy of the counters of a Stats.
+type StatsSnapshot struct {
+	Platforms        map[string]PlatformStats `json:"platforms"` // by "os/arch"
+	CacheHits        int64                    `json:"cache_hits"`
+	CacheMisses      int64                    `json:"cache_misses"`
+	PatchesGenerated int64                    `json:"patches_generated"`
+	GenerationErrors int64                    `json:"generation_errors"`
+	GenerationTime   time.Duration            `json:"generation_time"` // total
+	DownloadErrors   int64                    `json:"download_errors"`
+	GithubErrors     int64                    `json:"github_errors"`
+	Refreshes        int64                    `json:"refreshes"`
+	RefreshErrors    int64                    `json:"refresh_errors"`
+	RefreshTime      time.Duration            `json:"refresh_time"` // total
+	PatchBytesServed int64                    `json:"patch_bytes_served"`
+	UnverifiedAssets int64                    `json:"unverified_assets"`
+	PatchBytes       int64                    `json:"patch_bytes"` // generated
+	DownloadedBytes  int64                    `json:"downloaded_bytes"`
+	ReleasesRequests int64                    `json:"releases_requests"`
+	ReleasesTime     time.Duration            `json:"releases_time"` // total
+	EvictedBytes     int64                    `json:"evicted_bytes"` // deleted by the janitor
+	CacheBytes       int64                    `json:"cache_bytes"`   // of downloads and patches, as last measured
+}
+
+func (s *Stats) platform(os string, arch string) *platformStats {
+	key := os + "/" + arch
+	if ps, ok := s.platforms.Load(key); ok {
+		return ps.(*platformStats)
+	}
+	ps, _ := s.platforms.LoadOrStore(key, new(platformStats))
+	return ps.(*platformStats)
+}
+
+// UpdateCheck implements Metrics.
+func (s *Stats) UpdateCheck(os string, arch string, outcome string) {
+	ps := s.platform(os, arch)
+	atomic.AddInt64(&ps.checks, 1)
+	switch outcome {
+	case CheckOutcomePatch:
+		atomic.AddInt64(&ps.patches, 1)
+	case CheckOutcomeFull:
+		atomic.AddInt64(&ps.fulls, 1)
+	case CheckOutcomeNoUpdate:
+		atomic.AddInt64(&ps.noUpdate, 1)
+	case CheckOutcomeUnsupported:
+		atomic.AddInt64(&ps.unsupported, 1)
+	case CheckOutcomePending:
+		atomic.AddInt64(&ps.pending, 1)
+	default:
+		atomic.AddInt64(&ps.errors, 1)
+	}
+}
+
+// PatchCacheLookup implements Metrics.
+func (s *Stats) PatchCacheLookup(hit bool) {
+	if hit {
+		atomic.AddInt64(&s.cacheHits, 1)
+	} else {
+		atomic.AddInt64(&s.cacheMisses, 1)
+	}
+}
+
+// PatchGeneration implements Metrics.
+func (s *Stats) PatchGeneration(d time.Duration, err error) {
+	if err != nil {
+		atomic.AddInt64(&s.generationErrors, 1)
+	} else {
+		atomic.AddInt64(&s.patchesGenerated, 1)
+	}
+	atomic.AddInt64(&s.generationTime, int64(d))
+}
+
+// DownloadError implements Metrics.
+func (s *Stats) DownloadError(err error) {
+	atomic.AddInt64(&s.downloadErrors, 1)
+}
+
+// GithubError implements Metrics.
+func (s *Stats) GithubError(err error) {
+	atomic.AddInt64(&s.githubErrors, 1)
+}
+
+// Refresh implements Metrics.
+func (s *Stats) Refresh(d time.Duration, err error) {
+	atomic.AddInt64(&s.refreshes, 1)
+	if err != nil {
+		atomic.AddInt64(&s.refreshErrors, 1)
+	}
+	atomic.AddInt64(&s.refreshTime, int64(d))
+}
+
+// PatchServed implements Metrics.
+func (s *Stats) PatchServed(bytes int64) {
+	atomic.AddInt64(&s.patchBytesServed, bytes)
+}
+
+// UnverifiedAsset implements Metrics.
+func (s *Stats) UnverifiedAsset(name string, err error) {
+	atomic.AddInt64(&s.unverifiedAssets, 1)
+}
+
+// PatchSize implements ExtendedMetrics.
+func (s *Stats) PatchSize(bytes int64) {
+	atomic.AddInt64(&s.patchBytes, bytes)
+}
+
+// AssetDownloaded implements ExtendedMetrics.
+func (s *Stats) AssetDownloaded(bytes int64) {
+	atomic.AddInt64(&s.downloadedBytes, bytes)
+}
+
+// ReleasesRequest implements ExtendedMetrics, errors are already counted by
+// GithubError.
+func (s *Stats) ReleasesRequest(d time.Duration, err error) {
+	atomic.AddInt64(&s.releasesRequests, 1)
+	atomic.AddInt64(&s.releasesTime, int64(d))
+}
+
+// AssetVersions implements ExtendedMetrics.
+func (s *Stats) AssetVersions(os string, arch string, versions int) {
+	atomic.StoreInt64(&s.platform(os, arch).versions, int64(versions))
+}
+
+// CacheEvicted implements CacheMetrics.
+func (s *Stats) CacheEvicted(bytes int64) {
+	atomic.AddInt64(&s.evictedBytes, bytes)
+}
+
+// CacheUsage implements CacheMetrics.
+func (s *Stats) CacheUsage(bytes int64) {
+	atomic.StoreInt64(&s.cacheBytes, bytes)
+}
+
+// Snapshot returns the current value of every counter.
+func (s *Stats) Snapshot() StatsSnapshot {
+	snapshot := StatsSnapshot{
+		CacheHits:        atomic.LoadInt64(&s.cacheHits),
+		CacheMisses:      atomic.LoadInt64(&s.cacheMisses),
+		PatchesGenerated: atomic.LoadInt64(&s.patchesGenerated),
+		GenerationErrors: atomic.LoadInt64(&s.generationErrors),
+		GenerationTime:   time.Duration(atomic.LoadInt64(&s.generationTime)),
+		DownloadErrors:   atomic.LoadInt64(&s.downloadErrors),
+		GithubErrors:     atomic.LoadInt64(&s.githubErrors),
+		Refreshes:        atomic.LoadInt64(&s.refreshes),
+		RefreshErrors:    atomic.LoadInt64(&s.refreshErrors),
+		RefreshTime:      time.Duration(atomic.LoadInt64(&s.refreshTime)),
+		PatchBytesServed: atomic.LoadInt64(&s.patchBytesServed),
+		UnverifiedAssets: atomic.LoadInt64(&s.unverifiedAssets),
+		PatchBytes:       atomic.LoadInt64(&s.patchBytes),
+		DownloadedBytes:  atomic.LoadInt64(&s.downloadedBytes),
+		ReleasesRequests: atomic.LoadInt64(&s.releasesRequests),
+		ReleasesTime:     time.Duration(atomic.LoadInt64(&s.releasesTime)),
+		EvictedBytes:     atomic.LoadInt64(&s.evictedBytes),
+		CacheBytes:       atomic.LoadInt64(&s.cacheBytes),
+	}
+
+	snapshot.Platforms = make(map[string]PlatformStats)
+	s.platforms.Range(func(key, value interface{}) bool {
+		ps := value.(*platformStats)
+		snapshot.Platforms[key.(string)] = PlatformStats{
+			Checks:      atomic.LoadInt64(&ps.checks),
+			Patches:     atomic.LoadInt64(&ps.patches),
+			Fulls:       atomic.LoadInt64(&ps.fulls),
+			NoUpdate:    atomic.LoadInt64(&ps.noUpdate),
+			Unsupported: atomic.LoadInt64(&ps.unsupported),
+			Pending:     atomic.LoadInt64(&ps.pending),
+			Errors:      atomic.LoadInt64(&ps.errors),
+			Versions:    atomic.LoadInt64(&ps.versions),
+		}
+		return true
+	})
+	return snapshot
+}
@@ -0,0 +1,239 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testMetrics records the events it gets.
+type testMetrics struct {
+	mu          sync.Mutex
+	checks      map[string]int
+	hits        int
+	misses      int
+	generations int
+	downloads   int
+	github      int
+	unverified  int
+}
+
+func newTestMetrics() *testMetrics {
+	return &testMetrics{checks: make(map[string]int)}
+}
+
+func (m *testMetrics) UpdateCheck(os string, arch string, outcome string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.checks[os+"/"+arch+"/"+outcome]++
+}
+
+func (m *testMetrics) PatchCacheLookup(hit bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if hit {
+		m.hits++
+	} else {
+		m.misses++
+	}
+}
+
+func (m *testMetrics) PatchGeneration(d time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.generations++
+}
+
+func (m *testMetrics) DownloadError(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.downloads++
+}
+
+func (m *testMetrics) GithubError(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.github++
+}
+
+func (m *testMetrics) Refresh(d time.Duration, err error) {}
+
+func (m *testMetrics) PatchServed(bytes int64) {}
+
+func (m *testMetrics) UnverifiedAsset(name string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.unverified++
+}
+
+func TestMetrics(t *testing.T) {
+	g, current, update := newTestUpdatePair(t, nil)
+	g.SetMaxPatchRatio(0)
+	m := newTestMetrics()
+	WithMetrics(m)(g)
+
+	check := func(version string, checksum string) {
+		g.CheckForUpdate(&Params{
+			AppVersion: version,
+			OS:         OS.Linux,
+			Arch:       Arch.X64,
+			Checksum:   checksum,
+		})
+	}
+
+	check("1.0.0", "unknown")
+	check("1.1.0", update.Checksum)
+	check("1.0.0", "")
+	if m.checks["linux/amd64/full"] != 1 || m.checks["linux/amd64/no_update"] != 1 || m.checks["linux/amd64/error"] != 1 {
+		t.Fatalf("Expecting a full, an up to date and a failed check, got %v", m.checks)
+	}
+
+	if _, err := exec.LookPath("bsdiff"); err == nil {
+		check("1.0.0", current.Checksum)
+		check("1.0.0", current.Checksum)
+		if m.checks["linux/amd64/patch"] != 2 {
+			t.Fatalf("Expecting two patches served, got %v", m.checks)
+		}
+		if m.misses != 1 || m.generations != 1 || m.hits != 1 {
+			t.Fatalf("Expecting a patch generated once and then found in cache, got %d misses, %d generations and %d hits", m.misses, m.generations, m.hits)
+		}
+	}
+
+	// Failed downloads and releases requests.
+	missing := &Asset{Name: "autoupdate-binary-linux-amd64", URL: current.URL + "/missing"}
+	missing.v, _ = parseVersion("1.2.0")
+	if err := g.pushAsset(OS.Linux, Arch.X64, missing); err == nil {
+		t.Fatal("Expecting the download to fail.")
+	}
+	if m.downloads != 1 {
+		t.Fatalf("Expecting a download error, got %d", m.downloads)
+	}
+
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer api.Close()
+	useTestGitHub(t, g, api)
+	if err := g.UpdateAssetsMap(); err == nil {
+		t.Fatal("Expecting the releases request to fail.")
+	}
+	if m.github != 1 {
+		t.Fatalf("Expecting a github error, got %d", m.github)
+	}
+}
+
+func TestStats(t *testing.T) {
+	g, current, update := newTestUpdatePair(t, nil)
+	g.SetMaxPatchRatio(0)
+	stats := NewStats()
+	WithMetrics(stats)(g)
+
+	// Counters hold up under concurrent checks.
+	const checks = 50
+	var wg sync.WaitGroup
+	for i := 0; i < checks; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			p := &Params{AppVersion: "1.0.0", OS: OS.Linux, Arch: Arch.X64, Checksum: "unknown"}
+			if i%2 == 0 {
+				p.AppVersion, p.Checksum = "1.1.0", update.Checksum
+			}
+			g.CheckForUpdate(p)
+		}(i)
+	}
+	wg.Wait()
+
+	snapshot := stats.Snapshot()
+	ps := snapshot.Platforms["linux/amd64"]
+	if ps.Checks != checks || ps.Fulls != checks/2 || ps.NoUpdate != checks/2 {
+		t.Fatalf("Expecting %d checks, half of them up to date, got %+v", checks, ps)
+	}
+
+	if _, err := exec.LookPath("bsdiff"); err == nil {
+		res, err := g.CheckForUpdate(&Params{AppVersion: "1.0.0", OS: OS.Linux, Arch: Arch.X64, Checksum: current.Checksum})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		http.StripPrefix("/patches/", NewPatchHandler(g)).ServeHTTP(rec, httptest.NewRequest("GET", "/"+res.PatchURL, nil))
+
+		snapshot = stats.Snapshot()
+		if snapshot.PatchesGenerated != 1 || snapshot.CacheMisses != 1 || snapshot.Platforms["linux/amd64"].Patches != 1 {
+			t.Fatalf("Expecting a generated patch, got %+v", snapshot)
+		}
+		if snapshot.PatchBytesServed != int64(rec.Body.Len()) || snapshot.PatchBytesServed == 0 {
+			t.Fatalf("Expecting %d patch bytes served, got %d", rec.Body.Len(), snapshot.PatchBytesServed)
+		}
+	}
+
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer api.Close()
+	useTestGitHub(t, g, api)
+	g.UpdateAssetsMap()
+
+	snapshot = stats.Snapshot()
+	if snapshot.Refreshes != 1 || snapshot.RefreshErrors != 1 || snapshot.GithubErrors != 1 || snapshot.RefreshTime <= 0 {
+		t.Fatalf("Expecting a failed refresh, got %+v", snapshot)
+	}
+}
+
+func TestExtendedStats(t *testing.T) {
+	setTestPrivateKey(t)
+
+	files := newTestAssetServer(map[string]string{
+		"/1.0.0": "stats 1.0.0",
+		"/1.1.0": "stats 1.1.0, a little longer",
+	})
+	defer files.Close()
+
+	api := newTestReleasesAPI(fmt.Sprintf(`[
+		{"id": 1, "tag_name": "1.0.0", "zipball_url": "%[1]s/1.0.0.zip", "assets": [
+			{"id": 11, "name": "autoupdate-binary-linux-amd64", "browser_download_url": "%[1]s/1.0.0"}
+		]},
+		{"id": 2, "tag_name": "1.1.0", "zipball_url": "%[1]s/1.1.0.zip", "assets": [
+			{"id": 21, "name": "autoupdate-binary-linux-amd64", "browser_download_url": "%[1]s/1.1.0"}
+		]}
+	]`, files.URL))
+	defer api.Close()
+
+	stats := NewStats()
+	g := NewReleaseManager("getlantern", "autoupdate-server", WithMetrics(stats))
+	useTestGitHub(t, g, api)
+	g.SetMaxPatchRatio(0)
+	if err := g.SetPatchCacheDir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot := stats.Snapshot()
+	if want := int64(len("stats 1.0.0") + len("stats 1.1.0, a little longer")); snapshot.DownloadedBytes != want {
+		t.Fatalf("Expecting %d bytes downloaded, got %d", want, snapshot.DownloadedBytes)
+	}
+	if snapshot.ReleasesRequests != 1 || snapshot.ReleasesTime <= 0 {
+		t.Fatalf("Expecting a timed releases request, got %+v", snapshot)
+	}
+	if v := snapshot.Platforms["linux/amd64"].Versions; v != 2 {
+		t.Fatalf("Expecting 2 versions of linux/amd64, got %d", v)
+	}
+
+	current := g.updateAssetsMap[OS.Linux][Arch.X64]["1.0.0"]
+	if _, err := g.CheckForUpdate(&Params{AppVersion: "1.0.0", OS: OS.Linux, Arch: Arch.X64, Checksum: current.Checksum}); err != nil {
+		t.Fatal(err)
+	}
+	snapshot = stats.Snapshot()
+	if snapshot.Platforms["linux/amd64"].Checks != 1 {
+		t.Fatalf("Expecting the check to be counted, got %+v", snapshot.Platforms)
+	}
+	if _, err := exec.LookPath("bsdiff"); err == nil && (snapshot.PatchesGenerated != 1 || snapshot.PatchBytes == 0) {
+		t.Fatalf("Expecting the size of the generated patch, got %+v", snapshot)
+	}
+}
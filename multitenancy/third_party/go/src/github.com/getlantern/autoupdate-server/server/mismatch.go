@@ -0,0 +1,92 @@
+package server
+
+import (
+	"github.com/blang/semver"
+)
+
+// VersionMismatchPolicy tells CheckForUpdate what to do when the checksum a
+// client sends contradicts its AppVersion: it matches the asset of another
+// version, or none while that version has one.
+type VersionMismatchPolicy int
+
+const (
+	// VersionMismatchIgnore patches from the asset the checksum matches, if
+	// any, and tells whether an update is due from the version, the default.
+	VersionMismatchIgnore VersionMismatchPolicy = iota
+	// VersionMismatchTrustChecksum takes the client to run the version of
+	// the asset its checksum matches and patches from it. A checksum matching
+	// no asset tells nothing about the binary, the version is used then.
+	VersionMismatchTrustChecksum
+	// VersionMismatchTrustVersion takes the client to run AppVersion and
+	// patches from its asset, clients get a full update when there is none.
+	VersionMismatchTrustVersion
+	// VersionMismatchReject fails the check with a *VersionMismatchError.
+	VersionMismatchReject
+	// VersionMismatchFullUpdate takes the client to run AppVersion and gives
+	// it the complete new binary, a patch may not apply to what it runs.
+	VersionMismatchFullUpdate
+)
+
+// SetVersionMismatchPolicy sets how clients whose checksum and version
+// disagree are answered.
+func (g *ReleaseManager) SetVersionMismatchPolicy(policy VersionMismatchPolicy) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.versionMismatch = policy
+}
+
+// resolveVersionMismatch applies the mismatch policy to a client claiming to
+// run v, returning the version it's taken to run. When pinned, base is the
+// asset to patch from instead of the one the checksum matches, nil meaning
+// the client gets a full update.
+func (g *ReleaseManager) resolveVersionMismatch(p *Params, v semver.Version) (version semver.Version, base *Asset, pinned bool, err error) {
+	g.mu.RLock()
+	policy := g.versionMismatch
+	g.mu.RUnlock()
+
+	if policy == VersionMismatchIgnore {
+		return v, nil, false, nil
+	}
+
+	matched, _ := g.lookupAssetWithChecksum(p.OS, p.Arch, p.Checksum, p.ChecksumType)
+	claimed := g.assetOfVersion(p.OS, p.Arch, v)
+	if (matched != nil && matched.v.EQ(v)) || (matched == nil && claimed == nil) {
+		return v, nil, false, nil
+	}
+
+	switch policy {
+	case VersionMismatchReject:
+		e := &VersionMismatchError{AppVersion: p.AppVersion}
+		if matched != nil {
+			e.ChecksumVersion = matched.v.String()
+		}
+		return v, nil, false, e
+	case VersionMismatchFullUpdate:
+		log.Debugf("Client binary does not match version %v, serving full update", v)
+		return v, nil, true, nil
+	case VersionMismatchTrustChecksum:
+		if matched == nil {
+			return v, nil, false, nil
+		}
+		log.Debugf("Client claims %v but runs %v, going by its checksum", v, matched.v)
+		return matched.v, matched, true, nil
+	default:
+		log.Debugf("Client binary does not match version %v, going by its version", v)
+		return v, claimed, true, nil
+	}
+}
+
+// assetOfVersion returns the asset of version v for the given platform, a bare
+// binary if there are several formats.
+func (g *ReleaseManager) assetOfVersion(os string, arch string, v semver.Version) *Asset {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	var found *Asset
+	for _, a := range g.updateAssetsMap[os][arch] {
+		if a.v.EQ(v) && (found == nil || defaultFormat(a, found)) {
+			found = a
+		}
+	}
+	return found
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/blang/semver"
+)
+
+// defaultReleaseNotesLimit is how many bytes of release notes are kept per
+// release.
+const defaultReleaseNotesLimit = 8 << 10
+
+// defaultChangelogLimit is how many bytes of release notes a changelog
+// carries.
+const defaultChangelogLimit = 64 << 10
+
+// ReleaseNote is the entry of a release in a changelog. Notes are passed as
+// they were published, markdown included, and empty for a release without
+// any.
+type ReleaseNote struct {
+	Version     string    `json:"version"`
+	Tag         string    `json:"tag,omitempty"`
+	PublishedAt time.Time `json:"published_at,omitzero"`
+	Notes       string    `json:"notes,omitempty"`
+}
+
+// SetReleaseNotesLimit sets how many bytes of release notes are kept per
+// release, longer ones are truncated. Zero means no limit, 8KB by default.
+// It applies from the next UpdateAssetsMap.
+func (g *ReleaseManager) SetReleaseNotesLimit(limit int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.notesLimit = limit
+}
+
+// SetChangelogLimit sets how many bytes of release notes the changelog sent
+// to clients carries, the oldest notes are left out past it. Zero means no
+// limit, 64KB by default.
+func (g *ReleaseManager) SetChangelogLimit(limit int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.changelogLimit = limit
+}
+
+// truncateNotes trims notes down to at most limit bytes, without splitting a
+// character.
+func truncateNotes(notes string, limit int) string {
+	notes = strings.TrimSpace(notes)
+	if limit <= 0 || len(notes) <= limit {
+		return notes
+	}
+	for limit > 0 && !utf8.RuneStart(notes[limit]) {
+		limit--
+	}
+	return strings.TrimSpace(notes[:limit])
+}
+
+// releaseNotesFor returns the release notes of version v, empty if it has
+// none.
+func (g *ReleaseManager) releaseNotesFor(v semver.Version) string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.releaseNotes[v.String()]
+}
+
+// changelog returns the notes of the versions published for os/arch after
+// from up to update, oldest first. Only stable versions and those of the
+// update's channel are in. The oldest notes are left out, and truncated is
+// true, when they don't fit in the changelog limit.
+func (g *ReleaseManager) changelog(os string, arch string, from semver.Version, update *Asset) (notes []ReleaseNote, truncated bool) {
+	channel := assetChannel(update)
+
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	var versions []semver.Version
+	for _, a := range g.updateAssetsMap[os][arch] {
+		if a.v.LTE(from) || a.v.GT(update.v) {
+			continue
+		}
+		if c := assetChannel(a); c != Channel.Stable && c != channel {
+			continue
+		}
+		versions = append(versions, a.v)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].LT(versions[j]) })
+
+	// Newer notes are kept first.
+	left := g.changelogLimit
+	start := 0
+	notes = make([]ReleaseNote, len(versions))
+	for i := len(versions) - 1; i >= 0; i-- {
+		v := versions[i].String()
+		notes[i] = ReleaseNote{Version: v, Tag: g.releaseTags[v], PublishedAt: g.releaseDates[v], Notes: g.releaseNotes[v]}
+		if g.changelogLimit <= 0 {
+			continue
+		}
+		if len(notes[i].Notes) > left {
+			// The notes that overflow are cut, older ones left out.
+			start, truncated = i+1, true
+			if left > 0 {
+				notes[i].Notes = truncateNotes(notes[i].Notes, left)
+				start = i
+			}
+			break
+		}
+		left -= len(notes[i].Notes)
+	}
+	return notes[start:], truncated
+}
+
+// releaseDateFor returns when version v was released, the zero time if the
+// provider did not tell.
+func (g *ReleaseManager) releaseDateFor(v semver.Version) time.Time {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.releaseDates[v.String()]
+}
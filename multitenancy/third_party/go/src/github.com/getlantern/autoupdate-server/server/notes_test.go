@@ -0,0 +1,164 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReleaseNotes(t *testing.T) {
+	setTestPrivateKey(t)
+
+	files := newTestAssetServer(map[string]string{
+		"/1.0.0":        "notes 1.0.0",
+		"/1.1.0":        "notes 1.1.0",
+		"/1.2.0-beta.1": "notes 1.2.0-beta.1",
+	})
+	defer files.Close()
+
+	api := newTestReleasesAPI(fmt.Sprintf(`[
+		{"id": 1, "tag_name": "1.0.0", "zipball_url": "%[1]s/1.0.0.zip", "body": "First release", "assets": [
+			{"id": 11, "name": "autoupdate-binary-linux-amd64", "browser_download_url": "%[1]s/1.0.0"}
+		]},
+		{"id": 2, "tag_name": "1.1.0", "zipball_url": "%[1]s/1.1.0.zip", "body": "", "assets": [
+			{"id": 21, "name": "autoupdate-binary-linux-amd64", "browser_download_url": "%[1]s/1.1.0"}
+		]},
+		{"id": 3, "tag_name": "1.2.0-beta.1", "zipball_url": "%[1]s/1.2.0-beta.1.zip", "prerelease": true, "created_at": "2024-05-01T12:00:00Z", "body": "Faster patches\nNew café icon", "assets": [
+			{"id": 31, "name": "autoupdate-binary-linux-amd64", "browser_download_url": "%[1]s/1.2.0-beta.1"}
+		]}
+	]`, files.URL))
+	defer api.Close()
+
+	g := NewReleaseManager("getlantern", "autoupdate-server")
+	useTestGitHub(t, g, api)
+	// Cuts the é in half.
+	g.SetReleaseNotesLimit(len("Faster patches\nNew caf") + 1)
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(channel string, notes bool) *Result {
+		res, err := g.CheckForUpdate(&Params{
+			AppVersion:        "1.0.0",
+			OS:                OS.Linux,
+			Arch:              Arch.X64,
+			Checksum:          g.updateAssetsMap[OS.Linux][Arch.X64]["1.0.0"].Checksum,
+			Channel:           channel,
+			WantsReleaseNotes: notes,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	res := check(Channel.Beta, true)
+	if res.Version != "1.2.0-beta.1" || res.ReleaseNotes != "Faster patches\nNew caf" {
+		t.Fatalf("Expecting the truncated notes of 1.2.0-beta.1, got %+v", res)
+	}
+	if want := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC); !res.PublishedAt.Equal(want) {
+		t.Fatalf("Expecting 1.2.0-beta.1 to be published at %v, got %v", want, res.PublishedAt)
+	}
+	if res.Size != int64(len("notes 1.2.0-beta.1")) {
+		t.Fatalf("Expecting the size of the new binary, got %d", res.Size)
+	}
+	if res = check(Channel.Beta, false); res.ReleaseNotes != "" {
+		t.Fatalf("Expecting no notes unless asked for, got %q", res.ReleaseNotes)
+	}
+
+	// Releases without notes have none, that's no error.
+	if res = check(Channel.Stable, true); res.Version != "1.1.0" || res.ReleaseNotes != "" {
+		t.Fatalf("Expecting 1.1.0 without notes, got %+v", res)
+	}
+	if b, _ := json.Marshal(res); !res.PublishedAt.IsZero() || strings.Contains(string(b), "published_at") {
+		t.Fatalf("Expecting no release date for 1.1.0, got %s", b)
+	}
+
+	if got := truncateNotes("  "+strings.Repeat("a", 10)+"\n", 0); got != strings.Repeat("a", 10) {
+		t.Fatalf("Expecting notes to be kept whole without a limit, got %q", got)
+	}
+}
+
+func TestChangelog(t *testing.T) {
+	setTestPrivateKey(t)
+
+	files := newTestAssetServer(map[string]string{
+		"/1.0.0":        "changelog 1.0.0",
+		"/1.1.0":        "changelog 1.1.0",
+		"/1.2.0-beta.1": "changelog 1.2.0-beta.1",
+		"/1.2.0":        "changelog 1.2.0",
+		"/1.3.0":        "changelog 1.3.0",
+	})
+	defer files.Close()
+
+	api := newTestReleasesAPI(fmt.Sprintf(`[
+		{"id": 5, "tag_name": "v1.3.0", "zipball_url": "%[1]s/1.3.0.zip", "created_at": "2024-06-01T12:00:00Z", "body": "## Faster\n\n* **bold** <b>move</b>", "assets": [
+			{"id": 51, "name": "autoupdate-binary-linux-amd64", "browser_download_url": "%[1]s/1.3.0"}
+		]},
+		{"id": 4, "tag_name": "v1.2.0", "zipball_url": "%[1]s/1.2.0.zip", "assets": [
+			{"id": 41, "name": "autoupdate-binary-linux-amd64", "browser_download_url": "%[1]s/1.2.0"}
+		]},
+		{"id": 3, "tag_name": "v1.2.0-beta.1", "zipball_url": "%[1]s/1.2.0-beta.1.zip", "prerelease": true, "body": "Beta", "assets": [
+			{"id": 31, "name": "autoupdate-binary-linux-amd64", "browser_download_url": "%[1]s/1.2.0-beta.1"}
+		]},
+		{"id": 2, "tag_name": "v1.1.0", "zipball_url": "%[1]s/1.1.0.zip", "body": "Second", "assets": [
+			{"id": 21, "name": "autoupdate-binary-linux-amd64", "browser_download_url": "%[1]s/1.1.0"}
+		]},
+		{"id": 1, "tag_name": "v1.0.0", "zipball_url": "%[1]s/1.0.0.zip", "body": "First", "assets": [
+			{"id": 11, "name": "autoupdate-binary-linux-amd64", "browser_download_url": "%[1]s/1.0.0"}
+		]}
+	]`, files.URL))
+	defer api.Close()
+
+	g := NewReleaseManager("getlantern", "autoupdate-server")
+	useTestGitHub(t, g, api)
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func() *Result {
+		res, err := g.CheckForUpdate(&Params{
+			AppVersion:        "1.0.0",
+			OS:                OS.Linux,
+			Arch:              Arch.X64,
+			Checksum:          g.updateAssetsMap[OS.Linux][Arch.X64]["1.0.0"].Checksum,
+			WantsReleaseNotes: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	res := check()
+	if res.Version != "1.3.0" || res.ChangelogTruncated {
+		t.Fatalf("Expecting a whole changelog up to 1.3.0, got %+v", res)
+	}
+	versions := make([]string, len(res.Changelog))
+	for i, n := range res.Changelog {
+		versions[i] = n.Version
+	}
+	if got := strings.Join(versions, " "); got != "1.1.0 1.2.0 1.3.0" {
+		t.Fatalf("Expecting the stable versions after 1.0.0 oldest first, got %v", got)
+	}
+	if n := res.Changelog[1]; n.Tag != "v1.2.0" || n.Notes != "" {
+		t.Fatalf("Expecting 1.2.0 to be in without notes, got %+v", n)
+	}
+	published := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	if n := res.Changelog[2]; n.Notes != "## Faster\n\n* **bold** <b>move</b>" || !n.PublishedAt.Equal(published) {
+		t.Fatalf("Expecting the notes of 1.3.0 as published, got %+v", n)
+	}
+
+	// The oldest notes make way for the newest.
+	g.SetChangelogLimit(len("## Faster\n\n* **bold** <b>move</b>") + len("Sec"))
+	res = check()
+	if len(res.Changelog) != 3 || !res.ChangelogTruncated || res.Changelog[0].Notes != "Sec" {
+		t.Fatalf("Expecting the notes of 1.1.0 to be cut, got %+v", res.Changelog)
+	}
+	g.SetChangelogLimit(len("## Faster"))
+	if res = check(); len(res.Changelog) != 1 || res.Changelog[0].Notes != "## Faster" || !res.ChangelogTruncated {
+		t.Fatalf("Expecting only the cut notes of 1.3.0, got %+v", res.Changelog)
+	}
+}
@@ -0,0 +1,290 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const (
+	ociManifestType = "application/vnd.oci.image.manifest.v1+json"
+
+	// Annotations of OCI artifacts as pushed by oras: the file name of a
+	// layer and the description of the artifact, read as release notes.
+	ociTitleAnnotation       = "org.opencontainers.image.title"
+	ociDescriptionAnnotation = "org.opencontainers.image.description"
+)
+
+// A "Bearer realm=...,service=...,scope=..." authentication challenge.
+var ociChallengeParamRe = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// OCIProvider is a ReleaseProvider listing the tags of an OCI artifact
+// repository in a container registry. Every tag named after a version is a
+// release, its update assets are the layers of the artifact, named by their
+// title annotation. Asset URLs point at the registry blobs.
+type OCIProvider struct {
+	baseURL    *url.URL
+	repository string
+	username   string
+	password   string
+	client     *http.Client
+	tagLog
+}
+
+// OCIOption configures an OCIProvider when it's created.
+type OCIOption func(*OCIProvider)
+
+// WithOCICredentials authenticates with the registry using the given username
+// and password or token, directly or to obtain a bearer token.
+func WithOCICredentials(username string, password string) OCIOption {
+	return func(p *OCIProvider) {
+		p.username = username
+		p.password = password
+	}
+}
+
+// WithOCIHTTPClient sets the HTTP client used to talk to the registry.
+func WithOCIHTTPClient(c *http.Client) OCIOption {
+	return func(p *OCIProvider) {
+		p.client = c
+	}
+}
+
+// NewOCIProvider returns a provider for the given repository of the registry
+// at baseURL (https://registry.example.com), e.g. "getlantern/lantern".
+func NewOCIProvider(baseURL string, repository string, opts ...OCIOption) (*OCIProvider, error) {
+	u, err := url.Parse(strings.TrimSuffix(baseURL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("Bad registry URL: %v", err)
+	}
+
+	p := &OCIProvider{baseURL: u, repository: repository}
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	var base http.Client
+	if p.client != nil {
+		base = *p.client
+	}
+	transport := base.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	base.Transport = &ociTransport{provider: p, base: transport}
+	p.client = &base
+
+	return p, nil
+}
+
+// Client returns the HTTP client authenticating with the registry, blob
+// downloads go through it.
+func (p *OCIProvider) Client() *http.Client {
+	return p.client
+}
+
+type ociTagList struct {
+	Tags []string `json:"tags"`
+}
+
+type ociDescriptor struct {
+	Digest      string            `json:"digest"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+type ociManifest struct {
+	Layers      []ociDescriptor   `json:"layers"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+// Releases lists the tags of the repository and reads the manifest of every
+// one named after a version.
+func (p *OCIProvider) Releases(ctx context.Context) ([]Release, error) {
+	var tags ociTagList
+	if err := p.get(ctx, p.endpoint("tags/list"), "application/json", &tags); err != nil {
+		return nil, err
+	}
+
+	releases := make([]Release, 0, len(tags.Tags))
+	for _, tag := range tags.Tags {
+		v, err := parseVersion(tag)
+		if err != nil {
+			p.skipTag(tag, err)
+			continue
+		}
+
+		manifestURL := p.endpoint("manifests/" + tag)
+		var m ociManifest
+		if err = p.get(ctx, manifestURL, ociManifestType, &m); err != nil {
+			return nil, err
+		}
+
+		rel := Release{
+			URL:        manifestURL,
+			Version:    v,
+			Prerelease: len(v.Pre) > 0,
+		}
+		if notes := m.Annotations[ociDescriptionAnnotation]; notes != "" {
+			rel.parseNotes(notes)
+		}
+		for _, layer := range m.Layers {
+			name := layer.Annotations[ociTitleAnnotation]
+			if name == "" {
+				continue
+			}
+			rel.Assets = append(rel.Assets, Asset{
+				Name:   name,
+				URL:    p.endpoint("blobs/" + layer.Digest),
+				digest: layer.Digest,
+			})
+		}
+		releases = append(releases, rel)
+	}
+
+	return releases, nil
+}
+
+// endpoint returns the URL of the given registry API path of the repository.
+func (p *OCIProvider) endpoint(path string) string {
+	return fmt.Sprintf("%s/v2/%s/%s", p.baseURL, p.repository, path)
+}
+
+// get decodes the JSON document at uri into v.
+func (p *OCIProvider) get(ctx context.Context, uri string, accept string, v interface{}) error {
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", accept)
+
+	res, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return fmt.Errorf("Registry rejected the credentials for %s: %s", uri, res.Status)
+	default:
+		return fmt.Errorf("Expecting 200 OK from %s, got: %s", uri, res.Status)
+	}
+
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// ociTransport authenticates requests to the registry, answering its
+// challenges with basic credentials or a bearer token from its token service.
+// Requests to other hosts, like the storage blobs redirect to, are sent as
+// they are.
+type ociTransport struct {
+	provider *OCIProvider
+	base     http.RoundTripper
+
+	mu    sync.Mutex
+	token string
+}
+
+func (t *ociTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != t.provider.baseURL.Host {
+		return t.base.RoundTrip(req)
+	}
+
+	res, err := t.base.RoundTrip(t.authorize(req))
+	if err != nil || res.StatusCode != http.StatusUnauthorized || req.Body != nil {
+		return res, err
+	}
+
+	// Answer a token challenge and try once more, basic credentials were
+	// already sent if there are any.
+	challenge := res.Header.Get("WWW-Authenticate")
+	if !strings.EqualFold(strings.SplitN(challenge, " ", 2)[0], "bearer") {
+		return res, nil
+	}
+	res.Body.Close()
+	if err = t.answer(req, challenge); err != nil {
+		return nil, err
+	}
+	return t.base.RoundTrip(t.authorize(req))
+}
+
+// authorize returns a copy of req carrying the current credentials.
+func (t *ociTransport) authorize(req *http.Request) *http.Request {
+	t.mu.Lock()
+	token := t.token
+	t.mu.Unlock()
+
+	r := req.Clone(req.Context())
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	} else if t.provider.username != "" {
+		r.SetBasicAuth(t.provider.username, t.provider.password)
+	}
+	return r
+}
+
+// answer obtains a token from the service named by the given bearer
+// challenge.
+func (t *ociTransport) answer(req *http.Request, challenge string) error {
+	params := make(map[string]string)
+	for _, m := range ociChallengeParamRe.FindAllStringSubmatch(challenge, -1) {
+		params[m[1]] = m[2]
+	}
+	if params["realm"] == "" {
+		return fmt.Errorf("Registry challenge has no realm: %q", challenge)
+	}
+
+	u, err := url.Parse(params["realm"])
+	if err != nil {
+		return fmt.Errorf("Bad registry token realm: %v", err)
+	}
+	q := u.Query()
+	for _, key := range []string{"service", "scope"} {
+		if params[key] != "" {
+			q.Set(key, params[key])
+		}
+	}
+	u.RawQuery = q.Encode()
+
+	tokenReq, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	if t.provider.username != "" {
+		tokenReq.SetBasicAuth(t.provider.username, t.provider.password)
+	}
+
+	res, err := t.base.RoundTrip(tokenReq.WithContext(req.Context()))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Could not get a registry token: %s", res.Status)
+	}
+
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return err
+	}
+	if body.Token == "" {
+		body.Token = body.AccessToken
+	}
+	if body.Token == "" {
+		return fmt.Errorf("Registry token service returned no token.")
+	}
+
+	t.mu.Lock()
+	t.token = body.Token
+	t.mu.Unlock()
+	return nil
+}
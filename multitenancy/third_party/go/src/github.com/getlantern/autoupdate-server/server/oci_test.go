@@ -0,0 +1,134 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newTestOCIRegistry serves the given artifacts, tag -> layer title ->
+// content, in the getlantern/lantern repository behind a bearer token.
+func newTestOCIRegistry(t *testing.T, artifacts map[string]map[string]string) *httptest.Server {
+	const token = "registry-token"
+
+	blobs := make(map[string]string)
+	manifests := make(map[string][]byte)
+	tags := []string{"latest"}
+	for tag, layers := range artifacts {
+		var m struct {
+			Layers []map[string]interface{} `json:"layers"`
+		}
+		for title, content := range layers {
+			digest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(content)))
+			blobs[digest] = content
+			m.Layers = append(m.Layers, map[string]interface{}{
+				"mediaType":   "application/octet-stream",
+				"digest":      digest,
+				"size":        len(content),
+				"annotations": map[string]string{ociTitleAnnotation: title},
+			})
+		}
+		manifests[tag], _ = json.Marshal(m)
+		tags = append(tags, tag)
+	}
+
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			if user, pass, _ := r.BasicAuth(); user != "ci" || pass != "s3cr3t" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"token": token})
+			return
+		}
+
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="registry",scope="repository:getlantern/lantern:pull"`, srv.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		const prefix = "/v2/getlantern/lantern/"
+		path := strings.TrimPrefix(r.URL.Path, prefix)
+		switch {
+		case path == "tags/list":
+			json.NewEncoder(w).Encode(map[string]interface{}{"name": "getlantern/lantern", "tags": tags})
+		case strings.HasPrefix(path, "manifests/"):
+			m, ok := manifests[strings.TrimPrefix(path, "manifests/")]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", ociManifestType)
+			w.Write(m)
+		case strings.HasPrefix(path, "blobs/"):
+			content, ok := blobs[strings.TrimPrefix(path, "blobs/")]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write([]byte(content))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestOCIProvider(t *testing.T) {
+	setTestPrivateKey(t)
+
+	srv := newTestOCIRegistry(t, map[string]map[string]string{
+		"1.0.0": {"autoupdate-binary-linux-amd64": "oci 1.0.0", "README.md": "not an update"},
+		"1.1.0": {"autoupdate-binary-linux-amd64": "oci 1.1.0"},
+	})
+
+	// Without credentials the registry refuses the token.
+	p, err := NewOCIProvider(srv.URL, "getlantern/lantern")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = NewReleaseManager("getlantern", "lantern", WithReleaseProvider(p)).UpdateAssetsMap(); err == nil {
+		t.Fatal("Expecting the registry to reject anonymous requests.")
+	}
+
+	if p, err = NewOCIProvider(srv.URL, "getlantern/lantern", WithOCICredentials("ci", "s3cr3t")); err != nil {
+		t.Fatal(err)
+	}
+	g := NewReleaseManager("getlantern", "lantern", WithReleaseProvider(p))
+	if err = g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, version := range []string{"1.0.0", "1.1.0"} {
+		a := g.updateAssetsMap[OS.Linux][Arch.X64][version]
+		if a == nil {
+			t.Fatalf("Expecting an asset for %s", version)
+		}
+		if a.Checksum != fmt.Sprintf("%x", sha256.Sum256([]byte("oci "+version))) || a.SHA256 != a.Checksum {
+			t.Fatalf("Expecting the asset checksum to match the blob, got %+v", a)
+		}
+		if !strings.HasPrefix(a.URL, srv.URL+"/v2/getlantern/lantern/blobs/sha256:") {
+			t.Fatalf("Expecting a registry blob URL, got %q", a.URL)
+		}
+	}
+
+	res, err := g.CheckForUpdate(&Params{
+		AppVersion: "1.0.0",
+		OS:         OS.Linux,
+		Arch:       Arch.X64,
+		Checksum:   "unknown",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Version != "1.1.0" || res.URL != g.updateAssetsMap[OS.Linux][Arch.X64]["1.1.0"].URL {
+		t.Fatalf("Expecting an update to the 1.1.0 blob, got %+v", res)
+	}
+}
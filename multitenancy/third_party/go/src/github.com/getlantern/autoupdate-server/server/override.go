@@ -0,0 +1,114 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/blang/semver"
+)
+
+// Override is a device served a given version rather than the latest, see
+// SetOverride.
+type Override struct {
+	DeviceID string `json:"device_id"`
+	Version  string `json:"version"`
+}
+
+// SetOverride serves the given version to the device whose checks carry
+// deviceID, whatever the latest version of its channel and platform, until
+// ClearOverride. Devices running a newer version are rolled back to it, that
+// update being mandatory. Overrides are kept along with the assets in
+// storage, it fails with ErrNoSuchVersion when no asset of the version is
+// published.
+func (g *ReleaseManager) SetOverride(deviceID string, version string) error {
+	if deviceID == "" {
+		return errors.New("Expecting a device ID")
+	}
+	v, err := parseVersion(version)
+	if err != nil {
+		return err
+	}
+
+	g.mu.Lock()
+	if !g.publishedVersion(v) {
+		g.mu.Unlock()
+		return fmt.Errorf("%w: no asset of version %v to serve %s", ErrNoSuchVersion, v, deviceID)
+	}
+	if g.overrides == nil {
+		g.overrides = make(map[string]semver.Version)
+	}
+	g.overrides[deviceID] = v
+	g.mu.Unlock()
+
+	g.saveAssets()
+	return nil
+}
+
+// ClearOverride serves the latest version to the device again.
+func (g *ReleaseManager) ClearOverride(deviceID string) {
+	g.mu.Lock()
+	delete(g.overrides, deviceID)
+	g.mu.Unlock()
+
+	g.saveAssets()
+}
+
+// Overrides returns the devices served a given version, sorted by device ID.
+func (g *ReleaseManager) Overrides() []Override {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	var overrides []Override
+	for id, v := range g.overrides {
+		overrides = append(overrides, Override{DeviceID: id, Version: v.String()})
+	}
+	sort.Slice(overrides, func(i, j int) bool {
+		return overrides[i].DeviceID < overrides[j].DeviceID
+	})
+	return overrides
+}
+
+// publishedVersion tells whether any platform has an asset of version v. g.mu
+// must be held.
+func (g *ReleaseManager) publishedVersion(v semver.Version) bool {
+	for os := range g.updateAssetsMap {
+		for _, assets := range g.updateAssetsMap[os] {
+			for _, a := range assets {
+				if a.v.EQ(v) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// overriddenAsset returns the asset of the version the device is served on the
+// os/arch platform, in the first of the given formats it's published in. It
+// returns nil if the device has no override or no asset of its version is
+// published for the platform.
+func (g *ReleaseManager) overriddenAsset(deviceID string, os string, arch string, formats []string) *Asset {
+	if deviceID == "" {
+		return nil
+	}
+
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	v, ok := g.overrides[deviceID]
+	if !ok {
+		return nil
+	}
+	var found *Asset
+	for _, a := range g.updateAssetsMap[os][arch] {
+		if a.v.EQ(v) && (found == nil || defaultFormat(a, found)) {
+			found = a
+		}
+	}
+	if found == nil {
+		log.Debugf("Version %v overridden for %s has no %s/%s asset, serving the latest", v, deviceID, os, arch)
+		return nil
+	}
+	return g.inFormat(found, formats)
+}
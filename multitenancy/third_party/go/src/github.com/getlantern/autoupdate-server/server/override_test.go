@@ -0,0 +1,69 @@
+package server
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/blang/semver"
+)
+
+func TestSetOverride(t *testing.T) {
+	storage, err := NewFileStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, p := newTestMemoryManager(t)
+	WithStorage(storage)(g)
+	if err := g.SetPatchCacheDir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+	check := func(version string, deviceID string) (*Result, error) {
+		return g.CheckForUpdate(&Params{
+			AppVersion: version,
+			OS:         OS.Linux,
+			Arch:       Arch.X64,
+			Checksum:   g.assetOfVersion(OS.Linux, Arch.X64, semver.MustParse(version)).Checksum,
+			DeviceID:   deviceID,
+		})
+	}
+
+	if err := g.SetOverride("", "1.1.0"); err == nil {
+		t.Fatal("Expecting an override without a device ID to be rejected.")
+	}
+	if err := g.SetOverride("device", "1.5.0"); !errors.Is(err, ErrNoSuchVersion) {
+		t.Fatalf("Expecting ErrNoSuchVersion for an unknown version, got %v", err)
+	}
+	if err := g.SetOverride("device", "1.1.0"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The device gets its version, the others the latest.
+	if res, err := check("1.0.0", "device"); err != nil || res.Version != "1.1.0" || res.Mandatory {
+		t.Fatalf("Expecting the device to update to 1.1.0, got %+v, %v", res, err)
+	}
+	if res, err := check("1.0.0", "other"); err != nil || res.Version != "1.2.0" {
+		t.Fatalf("Expecting other devices to update to 1.2.0, got %+v, %v", res, err)
+	}
+	if _, err := check("1.1.0", "device"); err != ErrNoUpdateAvailable {
+		t.Fatalf("Expecting no update on the overridden version, got %v", err)
+	}
+	// Devices past it are rolled back.
+	if res, err := check("1.2.0", "device"); err != nil || res.Version != "1.1.0" || !res.Mandatory || !res.Downgrade {
+		t.Fatalf("Expecting a mandatory downgrade to 1.1.0, got %+v, %v", res, err)
+	}
+
+	// Overrides survive a restart.
+	g = NewReleaseManager("getlantern", "autoupdate-server", WithReleaseProvider(p), WithStorage(storage))
+	if overrides := g.Overrides(); !reflect.DeepEqual(overrides, []Override{{DeviceID: "device", Version: "1.1.0"}}) {
+		t.Fatalf("Expecting the override to be loaded from storage, got %+v", overrides)
+	}
+
+	g.ClearOverride("device")
+	if res, err := check("1.0.0", "device"); err != nil || res.Version != "1.2.0" {
+		t.Fatalf("Expecting the device to update to 1.2.0 without its override, got %+v, %v", res, err)
+	}
+}
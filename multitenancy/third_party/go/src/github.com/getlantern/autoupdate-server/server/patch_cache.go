@@ -0,0 +1,574 @@
+package server
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPatchCacheSize = 256
+
+	// Number of patches PrecomputePatches generates at once, each one
+	// downloading a pair of assets.
+	precomputeWorkers = 2
+)
+
+// patchCache is a bounded LRU cache of generated patches keyed by the
+// (old, new) asset pair and compression. It is safe for concurrent use.
+type patchCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type patchCacheEntry struct {
+	key   string
+	patch *Patch
+}
+
+func newPatchCache(size int) *patchCache {
+	return &patchCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func patchCacheKey(oldfileURL string, newfileURL string, compression string) string {
+	return oldfileURL + "|" + newfileURL + "|" + compression
+}
+
+// typedPatchCacheKey is patchCacheKey for patches of type t, bsdiff patches
+// keep their key.
+func typedPatchCacheKey(t PatchType, oldfileURL string, newfileURL string, compression string) string {
+	if t == PATCHTYPE_BSDIFF {
+		return patchCacheKey(oldfileURL, newfileURL, compression)
+	}
+	return patchCacheKey(oldfileURL, newfileURL, compression) + "|" + string(t)
+}
+
+// get returns the cached patch for key, if any.
+func (c *patchCache) get(key string) (*Patch, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		c.order.MoveToFront(e)
+		return e.Value.(*patchCacheEntry).patch, true
+	}
+	return nil, false
+}
+
+// put adds a patch to the cache, evicting the least recently used entries if
+// the cache grows beyond its size.
+func (c *patchCache) put(key string, p *Patch) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*patchCacheEntry).patch = p
+		c.order.MoveToFront(e)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&patchCacheEntry{key: key, patch: p})
+	c.evict()
+}
+
+// resize changes the maximum number of entries, a size of zero or less means
+// unbounded.
+func (c *patchCache) resize(size int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.size = size
+	c.evict()
+}
+
+// evict drops least recently used entries until the cache fits its size, c.mu
+// must be held.
+func (c *patchCache) evict() {
+	for c.size > 0 && c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*patchCacheEntry).key)
+	}
+}
+
+// remove drops the patch cached for key, if any.
+func (c *patchCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		c.order.Remove(e)
+		delete(c.entries, key)
+	}
+}
+
+// len returns the number of cached patches.
+func (c *patchCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// stats returns the number of cached patches and the maximum number of
+// entries.
+func (c *patchCache) stats() (entries int, size int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len(), c.size
+}
+
+// clear drops every cached patch.
+func (c *patchCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.order.Init()
+	c.entries = make(map[string]*list.Element)
+}
+
+// flightGroup makes sure only one patch is generated at a time for any given
+// key, concurrent callers for the same key wait for and share the result.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	done  chan struct{}
+	patch *Patch
+	err   error
+}
+
+// do runs fn unless a call for key is already in flight, in which case it
+// waits for that call's result or for ctx to be done.
+func (fg *flightGroup) do(ctx context.Context, key string, fn func() (*Patch, error)) (*Patch, error) {
+	fg.mu.Lock()
+	if fg.calls == nil {
+		fg.calls = make(map[string]*flightCall)
+	}
+	if c, ok := fg.calls[key]; ok {
+		fg.mu.Unlock()
+		select {
+		case <-c.done:
+			return c.patch, c.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	c := &flightCall{done: make(chan struct{})}
+	fg.calls[key] = c
+	fg.mu.Unlock()
+
+	c.patch, c.err = fn()
+	close(c.done)
+
+	fg.mu.Lock()
+	delete(fg.calls, key)
+	fg.mu.Unlock()
+
+	return c.patch, c.err
+}
+
+// SetPatchCacheDir sets the directory generated patches are stored in, it is
+// created if it does not exist.
+func (g *ReleaseManager) SetPatchCacheDir(dir string) error {
+	if err := os.MkdirAll(dir, os.ModeDir|0700); err != nil {
+		return fmt.Errorf("Could not create patch cache directory: %q", err)
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.patchDir = dir
+	return nil
+}
+
+// PatchCacheDir returns the directory generated patches are stored in.
+func (g *ReleaseManager) PatchCacheDir() string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	if g.patchDir == "" {
+		return patchesDirectory
+	}
+	return g.patchDir
+}
+
+// SetPatchCacheMaxBytes caps the total size of the patch cache directory,
+// least recently used patches are deleted first. Zero means unbounded.
+func (g *ReleaseManager) SetPatchCacheMaxBytes(max int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.patchMaxBytes = max
+}
+
+// CachedPatch returns the patch between the two given assets, looking it up
+// in the patch cache directory by the assets checksums before downloading
+// anything. Concurrent requests for the same pair generate a single patch.
+// Patches that failed verification while warming are not served, an
+// ErrPatchVerification is returned instead.
+func (g *ReleaseManager) CachedPatch(oldAsset *Asset, newAsset *Asset) (*Patch, error) {
+	return g.CachedPatchContext(context.Background(), oldAsset, newAsset)
+}
+
+// CachedPatchContext is like CachedPatch, cancelling ctx aborts waiting for or
+// generating the patch.
+func (g *ReleaseManager) CachedPatchContext(ctx context.Context, oldAsset *Asset, newAsset *Asset) (*Patch, error) {
+	return g.cachedTypedPatch(ctx, PATCHTYPE_BSDIFF, oldAsset, newAsset)
+}
+
+// cachedTypedPatch is CachedPatchContext for patches of type t.
+func (g *ReleaseManager) cachedTypedPatch(ctx context.Context, t PatchType, oldAsset *Asset, newAsset *Asset) (*Patch, error) {
+	patchfile := g.typedPatchFile(t, oldAsset, newAsset)
+
+	g.mu.RLock()
+	broken := g.brokenPatches[patchfile]
+	g.mu.RUnlock()
+
+	if broken {
+		return nil, ErrPatchVerification
+	}
+
+	return g.cachedPatch(ctx, t, patchfile, oldAsset, newAsset)
+}
+
+func (g *ReleaseManager) patchFile(oldAsset *Asset, newAsset *Asset) string {
+	return g.typedPatchFile(PATCHTYPE_BSDIFF, oldAsset, newAsset)
+}
+
+func (g *ReleaseManager) typedPatchFile(t PatchType, oldAsset *Asset, newAsset *Asset) string {
+	return filepath.Join(g.PatchCacheDir(), typedPatchFileName(t, oldAsset.Checksum, newAsset.Checksum))
+}
+
+func (g *ReleaseManager) cachedPatch(ctx context.Context, t PatchType, patchfile string, oldAsset *Asset, newAsset *Asset) (*Patch, error) {
+	cacheStart := time.Now()
+	p, ok := cachedPatchFile(patchfile)
+	trackTime(ctx, timingCache, cacheStart)
+	if ok {
+		// Misses are counted by GeneratePatchContext.
+		g.metrics.PatchCacheLookup(true)
+		return p, nil
+	}
+
+	defer trackTime(ctx, timingGenerate, time.Now())
+	return g.patchFlight.do(ctx, patchfile, func() (*Patch, error) {
+		// Someone may have just finished generating it.
+		if p, ok := cachedPatchFile(patchfile); ok {
+			return p, nil
+		}
+		return g.typedPatch(ctx, t, oldAsset.URL, newAsset.URL)
+	})
+}
+
+// markPatchServed remembers a patch file name was handed out to a client.
+func (g *ReleaseManager) markPatchServed(name string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.servedPatches[name] = true
+}
+
+// patchServed tells whether a patch file name was ever handed out to a
+// client.
+func (g *ReleaseManager) patchServed(name string) bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.servedPatches[name]
+}
+
+// cachedPatchFile returns a patch for the given file if it exists and is not
+// empty, marking it as recently used.
+func cachedPatchFile(patchfile string) (*Patch, bool) {
+	fi, err := os.Stat(patchfile)
+	if err != nil || fi.Size() == 0 {
+		return nil, false
+	}
+	now := time.Now()
+	os.Chtimes(patchfile, now, now)
+	return &Patch{File: patchfile, Size: fi.Size()}, true
+}
+
+// diskPatch returns the patch of type t between the indexed assets behind the
+// given URLs if it's already in the patch cache directory.
+func (g *ReleaseManager) diskPatch(t PatchType, oldfileURL string, newfileURL string) (*Patch, bool) {
+	oldAsset, newAsset := g.assetByURL(oldfileURL), g.assetByURL(newfileURL)
+	if oldAsset == nil || newAsset == nil || oldAsset.Checksum == "" || newAsset.Checksum == "" {
+		return nil, false
+	}
+	return cachedPatchFile(g.typedPatchFile(t, oldAsset, newAsset))
+}
+
+// evictPatchFiles deletes the least recently used patches until the cache
+// directory fits its size budget, keep and the patches being sent are never
+// deleted.
+func (g *ReleaseManager) evictPatchFiles(keep string) {
+	g.mu.RLock()
+	max := g.patchMaxBytes
+	g.mu.RUnlock()
+
+	if max <= 0 {
+		return
+	}
+
+	dir := g.PatchCacheDir()
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		log.Errorf("Could not read patch cache directory: %q", err)
+		return
+	}
+
+	var total int64
+	files := make([]os.FileInfo, 0, len(entries))
+	for _, fi := range entries {
+		// Compressed variants go along with their patch.
+		if fi.IsDir() || strings.HasSuffix(fi.Name(), ".tmp") || strings.HasSuffix(fi.Name(), gzipSuffix) || strings.HasSuffix(fi.Name(), zstdSuffix) {
+			continue
+		}
+		total += fi.Size()
+		files = append(files, fi)
+	}
+
+	sort.Sort(byModTime(files))
+
+	for _, fi := range files {
+		if total <= max {
+			break
+		}
+		file := filepath.Join(dir, fi.Name())
+		if file == filepath.Clean(keep) || inUse(file) {
+			continue
+		}
+		if err := removePatchFile(file); err != nil {
+			log.Errorf("Could not evict patch %s: %q", file, err)
+			continue
+		}
+		total -= fi.Size()
+	}
+}
+
+type byModTime []os.FileInfo
+
+func (a byModTime) Len() int           { return len(a) }
+func (a byModTime) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byModTime) Less(i, j int) bool { return a[i].ModTime().Before(a[j].ModTime()) }
+
+// patchPair is an (old, new) pair of assets a patch can be generated for.
+type patchPair struct {
+	old *Asset
+	new *Asset
+}
+
+// patchPairs returns the pairs of a known asset and the latest asset of each
+// channel for the same platform and packaging, from the n most recent older
+// versions only if n is positive.
+func (g *ReleaseManager) patchPairs(n int) []patchPair {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	var pairs []patchPair
+	for channel := range g.latestAssetsMap {
+		for os := range g.latestAssetsMap[channel] {
+			for arch, latest := range g.latestAssetsMap[channel][os] {
+				var older []*Asset
+				for _, asset := range g.updateAssetsMap[os][arch] {
+					if asset.v.LT(latest.v) && strings.EqualFold(asset.Ext, latest.Ext) {
+						older = append(older, asset)
+					}
+				}
+				if n > 0 && len(older) > n {
+					sort.Slice(older, func(i, j int) bool { return older[i].v.GT(older[j].v) })
+					older = older[:n]
+				}
+				for _, asset := range older {
+					pairs = append(pairs, patchPair{old: asset, new: latest})
+				}
+			}
+		}
+	}
+	return pairs
+}
+
+// SetPatchVerifyWorkers makes WarmPatchCache verify every patch by applying
+// it to the old asset and comparing the result against the new one, using up
+// to the given number of concurrent workers. Zero disables verification.
+func (g *ReleaseManager) SetPatchVerifyWorkers(workers int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.verifyWorkers = workers
+}
+
+// PatchFailure is a pair of assets WarmPatchCache could not produce a valid
+// patch for.
+type PatchFailure struct {
+	Old *Asset
+	New *Asset
+	Err error
+}
+
+// WarmSummary reports the outcome of WarmPatchCache.
+type WarmSummary struct {
+	Total  int
+	Cached int
+	Failed []PatchFailure
+}
+
+// WarmPatchCache generates the patches from every known version to the
+// latest version of each channel, so clients don't have to wait for bsdiff
+// the first time they check for updates. Patches that fail verification are
+// removed from the cache and clients get the full binary instead.
+func (g *ReleaseManager) WarmPatchCache() (*WarmSummary, error) {
+	workers, verify := g.warmWorkers()
+	if !verify {
+		workers = 1
+	}
+	return g.warmPatches(context.Background(), g.patchPairs(0), workers, verify)
+}
+
+// PrecomputePatches generates the patches to the latest version of each
+// channel from its n most recent older versions on every platform, the
+// upgrades most clients check for right after a release. Meant to run after
+// UpdateAssetsMap, a couple of patches are generated at once so downloads of
+// old assets don't take all the bandwidth. Pairs that fail are logged and
+// reported in the summary without stopping the others, the error then tells
+// how many did. Cancelling ctx stops the run.
+func (g *ReleaseManager) PrecomputePatches(ctx context.Context, n int) (*WarmSummary, error) {
+	if n < 1 {
+		return &WarmSummary{}, nil
+	}
+	workers, verify := g.warmWorkers()
+	if workers < precomputeWorkers {
+		workers = precomputeWorkers
+	}
+	return g.warmPatches(ctx, g.patchPairs(n), workers, verify)
+}
+
+// warmWorkers returns the number of patch verification workers and whether
+// warmed patches are verified.
+func (g *ReleaseManager) warmWorkers() (int, bool) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	// Transformed patches no longer apply as they are.
+	return g.verifyWorkers, g.verifyWorkers > 0 && g.patchPostProcess == nil
+}
+
+// warmPatches generates and, if asked to, verifies the patches of the given
+// pairs with up to the given number of workers.
+func (g *ReleaseManager) warmPatches(ctx context.Context, pairs []patchPair, workers int, verify bool) (*WarmSummary, error) {
+	summary := &WarmSummary{Total: len(pairs)}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	work := make(chan patchPair)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for pair := range work {
+				err := g.warmPatch(ctx, pair, verify)
+				mu.Lock()
+				if err != nil {
+					log.Errorf("Could not warm patch %s -> %s: %q", pair.old.URL, pair.new.URL, err)
+					summary.Failed = append(summary.Failed, PatchFailure{Old: pair.old, New: pair.new, Err: err})
+				} else {
+					summary.Cached++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, pair := range pairs {
+		if ctx.Err() != nil {
+			break
+		}
+		select {
+		case work <- pair:
+		case <-ctx.Done():
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return summary, ctx.Err()
+	}
+
+	log.Debugf("Warmed %d out of %d patches, %d failed.", summary.Cached, summary.Total, len(summary.Failed))
+
+	if len(summary.Failed) > 0 {
+		return summary, fmt.Errorf("Could not generate %d out of %d patches.", len(summary.Failed), summary.Total)
+	}
+	return summary, nil
+}
+
+// warmPatch generates the patch for the given pair and, if asked to, verifies
+// it. A patch that fails verification is dropped from the cache.
+func (g *ReleaseManager) warmPatch(ctx context.Context, pair patchPair, verify bool) error {
+	patchfile := g.patchFile(pair.old, pair.new)
+
+	p, err := g.cachedPatch(ctx, PATCHTYPE_BSDIFF, patchfile, pair.old, pair.new)
+	if err != nil {
+		return err
+	}
+
+	if verify {
+		if err = g.verifyPatch(p.File, pair.old, pair.new); err != nil {
+			removePatchFile(p.File)
+			g.patches.remove(patchCacheKey(pair.old.URL, pair.new.URL, Compression.None))
+			g.patches.remove(patchCacheKey(pair.old.URL, pair.new.URL, Compression.Zstd))
+		}
+	}
+
+	g.mu.Lock()
+	if err != nil {
+		g.brokenPatches[patchfile] = true
+	} else {
+		delete(g.brokenPatches, patchfile)
+	}
+	g.mu.Unlock()
+
+	return err
+}
+
+// verifyPatch applies the patch to the old asset and checks the result
+// matches the new asset's checksum.
+func (g *ReleaseManager) verifyPatch(patchfile string, oldAsset *Asset, newAsset *Asset) error {
+	oldfile, release, err := g.downloadKnownAsset(context.Background(), oldAsset.URL)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	fp, err := ioutil.TempFile(g.DownloadDir(), "patch-verify")
+	if err != nil {
+		return err
+	}
+	fp.Close()
+	defer os.Remove(fp.Name())
+
+	d := g.differ(PATCHTYPE_BSDIFF)
+	if d == nil {
+		d = BsdiffDiffer{}
+	}
+	if err = d.Patch(oldfile, fp.Name(), patchfile); err != nil {
+		return fmt.Errorf("%w: %v", ErrPatchVerification, err)
+	}
+
+	checksum, err := checksumForFile(fp.Name())
+	if err != nil {
+		return err
+	}
+	if checksum != newAsset.Checksum {
+		return ErrPatchVerification
+	}
+
+	return nil
+}
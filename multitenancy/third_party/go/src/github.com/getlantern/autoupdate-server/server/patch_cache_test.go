@@ -0,0 +1,416 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// requireBsdiff skips tests that need the bsdiff/bspatch binaries.
+func requireBsdiff(t testing.TB) {
+	for _, bin := range []string{"bsdiff", "bspatch"} {
+		if _, err := exec.LookPath(bin); err != nil {
+			t.Skipf("%s is not installed", bin)
+		}
+	}
+}
+
+func TestPatchCacheEviction(t *testing.T) {
+	c := newPatchCache(2)
+
+	c.put("a", &Patch{File: "a"})
+	c.put("b", &Patch{File: "b"})
+
+	// Touching "a" makes "b" the least recently used entry.
+	if _, ok := c.get("a"); !ok {
+		t.Fatal("Expecting a cached patch for a.")
+	}
+	c.put("c", &Patch{File: "c"})
+
+	if _, ok := c.get("b"); ok {
+		t.Fatal("Expecting b to be evicted.")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := c.get(key); !ok {
+			t.Fatalf("Expecting a cached patch for %s.", key)
+		}
+	}
+
+	c.resize(1)
+	if c.len() != 1 {
+		t.Fatalf("Expecting one entry after resize, got %d.", c.len())
+	}
+
+	c.clear()
+	if c.len() != 0 {
+		t.Fatal("Expecting an empty cache after clear.")
+	}
+}
+
+func TestPatchCacheConcurrentAccess(t *testing.T) {
+	c := newPatchCache(8)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				key := fmt.Sprintf("%d", (i+j)%12)
+				c.put(key, &Patch{File: key})
+				c.get(key)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if c.len() > 8 {
+		t.Fatalf("Cache grew beyond its size: %d.", c.len())
+	}
+}
+
+func TestGeneratePatchIsCached(t *testing.T) {
+	requireBsdiff(t)
+
+	srv := newTestAssetServer(map[string]string{
+		"/old": "in a gadda da vida, honey, don't you know that I'm loving you.",
+		"/new": "in a gadda da vida, baby, don't you know that I'll always be true.",
+	})
+	defer srv.Close()
+
+	g := NewReleaseManager("getlantern", "autoupdate-server")
+
+	p1, err := g.GeneratePatch(srv.URL+"/old", srv.URL+"/new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p2, err := g.GeneratePatch(srv.URL+"/old", srv.URL+"/new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p1 != p2 {
+		t.Fatal("Expecting the second request to be served from the cache.")
+	}
+
+	g.ClearPatchCache()
+	if g.patches.len() != 0 {
+		t.Fatal("Expecting an empty cache.")
+	}
+}
+
+func TestFlightGroupCoalesces(t *testing.T) {
+	var fg flightGroup
+	var runs int32
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fg.do(context.Background(), "same-pair", func() (*Patch, error) {
+				atomic.AddInt32(&runs, 1)
+				time.Sleep(50 * time.Millisecond)
+				return &Patch{File: "patch"}, nil
+			})
+		}()
+	}
+	wg.Wait()
+
+	if runs != 1 {
+		t.Fatalf("Expecting a single patch generation, got %d.", runs)
+	}
+}
+
+func TestCachedPatchHitSkipsDownload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "patch-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	g := NewReleaseManager("getlantern", "autoupdate-server")
+	if err = g.SetPatchCacheDir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	oldAsset := &Asset{URL: "http://127.0.0.1:1/unreachable-old", Checksum: "aaaa"}
+	newAsset := &Asset{URL: "http://127.0.0.1:1/unreachable-new", Checksum: "bbbb"}
+
+	patchfile := filepath.Join(dir, patchFileName(oldAsset.Checksum, newAsset.Checksum))
+	if err = writeFile(patchfile, []byte("cached patch")); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := g.CachedPatch(oldAsset, newAsset)
+	if err != nil {
+		t.Fatalf("Expecting a cache hit without downloading, got %q", err)
+	}
+	if p.File != patchfile {
+		t.Fatalf("Expecting %s, got %s", patchfile, p.File)
+	}
+}
+
+func TestGeneratePatchFromCacheDir(t *testing.T) {
+	g, current, update := newTestUpdatePair(t, nil)
+	logger := &testLogger{}
+	g.logger = logger
+	if err := g.SetPatchCacheDir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Left over by a previous run of the server.
+	patchfile := g.patchFile(current, update)
+	if err := writeFile(patchfile, []byte("cached patch")); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := g.GeneratePatch(current.URL, update.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.File != patchfile {
+		t.Fatalf("Expecting %s, got %s", patchfile, p.File)
+	}
+	if n := logger.count("DEBUG", "Generating patch"); n != 0 {
+		t.Fatalf("Expecting the patch not to be generated again, got %q", logger.entries)
+	}
+	if _, ok := g.patches.get(patchCacheKey(current.URL, update.URL, Compression.None)); !ok {
+		t.Fatal("Expecting the patch to be cached in memory")
+	}
+}
+
+func TestPatchCacheDirEviction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "patch-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	g := NewReleaseManager("getlantern", "autoupdate-server")
+	if err = g.SetPatchCacheDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	g.SetPatchCacheMaxBytes(25)
+
+	// Three 10 byte patches, "a" being the least recently used.
+	now := time.Now()
+	for i, name := range []string{"a", "b", "c"} {
+		file := filepath.Join(dir, name)
+		if err = writeFile(file, []byte("0123456789")); err != nil {
+			t.Fatal(err)
+		}
+		mtime := now.Add(time.Duration(i-3) * time.Hour)
+		if err = os.Chtimes(file, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	g.evictPatchFiles(filepath.Join(dir, "c"))
+
+	if fileExists(filepath.Join(dir, "a")) {
+		t.Fatal("Expecting the least recently used patch to be evicted.")
+	}
+	for _, name := range []string{"b", "c"} {
+		if !fileExists(filepath.Join(dir, name)) {
+			t.Fatalf("Expecting patch %s to be kept.", name)
+		}
+	}
+
+	// Patches being sent to clients are left for the next one.
+	done := serving.add(filepath.Join(dir, "b"))
+	g.SetPatchCacheMaxBytes(5)
+	g.evictPatchFiles(filepath.Join(dir, "c"))
+	done()
+	if !fileExists(filepath.Join(dir, "b")) {
+		t.Fatal("Expecting the patch being served to be kept.")
+	}
+}
+
+func TestWarmPatchCache(t *testing.T) {
+	requireBsdiff(t)
+	setTestPrivateKey(t)
+
+	dir, err := ioutil.TempDir("", "patch-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv := newTestAssetServer(map[string]string{
+		"/1.0.0": "in a gadda da vida, honey",
+		"/1.1.0": "in a gadda da vida, baby",
+		"/1.2.0": "in a gadda da vida, honey, don't you know",
+	})
+	defer srv.Close()
+
+	g := NewReleaseManager("getlantern", "autoupdate-server")
+	if err = g.SetPatchCacheDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	for _, tag := range []string{"1.0.0", "1.1.0", "1.2.0"} {
+		asset := &Asset{Name: "autoupdate-binary-linux-amd64", URL: srv.URL + "/" + tag}
+		asset.v, _ = parseVersion(tag)
+		if err = g.pushAsset(OS.Linux, Arch.X64, asset); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	summary, err := g.WarmPatchCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Total != 2 || summary.Cached != 2 {
+		t.Fatalf("Expecting 2 out of 2 patches to be warmed, got %+v", summary)
+	}
+
+	latest := g.updateAssetsMap[OS.Linux][Arch.X64]["1.2.0"]
+	for _, tag := range []string{"1.0.0", "1.1.0"} {
+		old := g.updateAssetsMap[OS.Linux][Arch.X64][tag]
+		if !fileExists(filepath.Join(dir, patchFileName(old.Checksum, latest.Checksum))) {
+			t.Fatalf("Expecting a warmed patch from %s.", tag)
+		}
+	}
+}
+
+func TestPrecomputePatches(t *testing.T) {
+	requireBsdiff(t)
+	setTestPrivateKey(t)
+
+	srv := newTestAssetServer(map[string]string{
+		"/1.0.0": "in a gadda da vida, honey",
+		"/1.1.0": "in a gadda da vida, baby",
+		"/1.2.0": "in a gadda da vida, honey, don't you know",
+		"/1.3.0": "in a gadda da vida, baby, don't you know",
+	})
+	defer srv.Close()
+
+	g := NewReleaseManager("getlantern", "autoupdate-server")
+	dir := t.TempDir()
+	if err := g.SetPatchCacheDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	for _, tag := range []string{"1.0.0", "1.1.0", "1.2.0", "1.3.0"} {
+		asset := &Asset{Name: "autoupdate-binary-linux-amd64", URL: srv.URL + "/" + tag}
+		asset.v, _ = parseVersion(tag)
+		if err := g.pushAsset(OS.Linux, Arch.X64, asset); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assets := g.updateAssetsMap[OS.Linux][Arch.X64]
+	latest := assets["1.3.0"]
+	patched := func(tag string) bool {
+		return fileExists(filepath.Join(dir, patchFileName(assets[tag].Checksum, latest.Checksum)))
+	}
+
+	// 1.1.0 went missing, the other pair is still generated.
+	assets["1.1.0"].URL = srv.URL + "/missing"
+	summary, err := g.PrecomputePatches(context.Background(), 2)
+	if err == nil {
+		t.Fatal("Expecting the missing asset to be reported.")
+	}
+	if summary.Total != 2 || summary.Cached != 1 || len(summary.Failed) != 1 || summary.Failed[0].Old != assets["1.1.0"] {
+		t.Fatalf("Expecting the patches from the 2 most recent versions to be tried, got %+v", summary)
+	}
+	if !patched("1.2.0") || patched("1.0.0") {
+		t.Fatal("Expecting only the patch from 1.2.0 to be precomputed.")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = g.PrecomputePatches(ctx, 3); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expecting a cancellation error, got %v", err)
+	}
+	if patched("1.0.0") {
+		t.Fatal("Expecting nothing to be generated once cancelled.")
+	}
+}
+
+func TestWarmPatchCacheVerify(t *testing.T) {
+	requireBsdiff(t)
+	setTestPrivateKey(t)
+
+	dir, err := ioutil.TempDir("", "patch-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv := newTestAssetServer(map[string]string{
+		"/2.0.0": "in a gadda da vida, honey",
+		"/2.1.0": "in a gadda da vida, baby",
+		"/2.2.0": "in a gadda da vida, honey, don't you know",
+	})
+	defer srv.Close()
+
+	g := NewReleaseManager("getlantern", "autoupdate-server")
+	if err = g.SetPatchCacheDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	g.SetPatchVerifyWorkers(4)
+	// Patches between tiny files are never smaller than the files.
+	g.SetMaxPatchRatio(0)
+	for _, tag := range []string{"2.0.0", "2.1.0", "2.2.0"} {
+		asset := &Asset{Name: "autoupdate-binary-linux-amd64", URL: srv.URL + "/" + tag}
+		asset.v, _ = parseVersion(tag)
+		if err = g.pushAsset(OS.Linux, Arch.X64, asset); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Corrupt the patch from 2.0.0 before warming.
+	broken := g.updateAssetsMap[OS.Linux][Arch.X64]["2.0.0"]
+	latest := g.updateAssetsMap[OS.Linux][Arch.X64]["2.2.0"]
+	brokenfile := filepath.Join(dir, patchFileName(broken.Checksum, latest.Checksum))
+	if err = writeFile(brokenfile, []byte("not a patch")); err != nil {
+		t.Fatal(err)
+	}
+
+	summary, err := g.WarmPatchCache()
+	if err == nil {
+		t.Fatal("Expecting warming to report the broken patch.")
+	}
+	if summary.Total != 2 || summary.Cached != 1 || len(summary.Failed) != 1 {
+		t.Fatalf("Expecting 1 cached and 1 failed patch, got %+v", summary)
+	}
+	if summary.Failed[0].Old != broken || !errors.Is(summary.Failed[0].Err, ErrPatchVerification) {
+		t.Fatalf("Expecting 2.0.0 to fail verification, got %+v", summary.Failed[0])
+	}
+	if fileExists(brokenfile) {
+		t.Fatal("Expecting the broken patch to be removed from the cache.")
+	}
+
+	// Clients on the broken version get the full binary.
+	res, err := g.CheckForUpdate(&Params{
+		AppVersion: "2.0.0",
+		OS:         OS.Linux,
+		Arch:       Arch.X64,
+		Checksum:   broken.Checksum,
+	})
+	if err != nil && !errors.Is(err, ErrPatchUnavailable) {
+		t.Fatal(err)
+	}
+	if res.PatchType != PATCHTYPE_NONE {
+		t.Fatalf("Expecting a full download, got patch type %v", res.PatchType)
+	}
+
+	res, err = g.CheckForUpdate(&Params{
+		AppVersion: "2.1.0",
+		OS:         OS.Linux,
+		Arch:       Arch.X64,
+		Checksum:   g.updateAssetsMap[OS.Linux][Arch.X64]["2.1.0"].Checksum,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.PatchType != PATCHTYPE_BSDIFF {
+		t.Fatalf("Expecting a patch, got patch type %v", res.PatchType)
+	}
+}
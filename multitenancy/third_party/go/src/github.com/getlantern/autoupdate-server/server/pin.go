@@ -0,0 +1,94 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/blang/semver"
+)
+
+// Pin is a platform whose clients are served an earlier version than the
+// latest, see PinVersion.
+type Pin struct {
+	OS      string `json:"os"`
+	Arch    string `json:"arch"`
+	Version string `json:"version"`
+}
+
+// PinVersion serves the given version as the latest to every client of the
+// os/arch platform, whatever their channel, until Unpin. Clients running a
+// newer version are rolled back to it, that update being mandatory. Pins are
+// kept across UpdateAssetsMap, it fails with ErrNoSuchVersion when the
+// platform has no asset of the version.
+func (g *ReleaseManager) PinVersion(os string, arch string, version string) error {
+	v, err := parseVersion(version)
+	if err != nil {
+		return err
+	}
+	if g.assetOfVersion(os, arch, v) == nil {
+		return fmt.Errorf("%w: no %s/%s asset of version %v to pin", ErrNoSuchVersion, os, arch, v)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.pins[os] == nil {
+		g.pins[os] = make(map[string]semver.Version)
+	}
+	g.pins[os][arch] = v
+	return nil
+}
+
+// Unpin serves the latest version to the clients of the os/arch platform
+// again.
+func (g *ReleaseManager) Unpin(os string, arch string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.pins[os], arch)
+}
+
+// Pins returns the platforms pinned to a version, sorted by OS and arch.
+func (g *ReleaseManager) Pins() []Pin {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	var pins []Pin
+	for os := range g.pins {
+		for arch, v := range g.pins[os] {
+			pins = append(pins, Pin{OS: os, Arch: arch, Version: v.String()})
+		}
+	}
+	sort.Slice(pins, func(i, j int) bool {
+		if pins[i].OS != pins[j].OS {
+			return pins[i].OS < pins[j].OS
+		}
+		return pins[i].Arch < pins[j].Arch
+	})
+	return pins
+}
+
+// pinnedVersion returns the version the os/arch platform is pinned to, if any.
+func (g *ReleaseManager) pinnedVersion(os string, arch string) (semver.Version, bool) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	v, ok := g.pins[os][arch]
+	return v, ok
+}
+
+// pinnedAsset returns the asset of the version the os/arch platform is pinned
+// to, nil if it's not pinned or the version is gone since. g.mu must be held.
+func (g *ReleaseManager) pinnedAsset(os string, arch string) *Asset {
+	v, ok := g.pins[os][arch]
+	if !ok {
+		return nil
+	}
+	var found *Asset
+	for _, a := range g.updateAssetsMap[os][arch] {
+		if a.v.EQ(v) && (found == nil || defaultFormat(a, found)) {
+			found = a
+		}
+	}
+	if found == nil {
+		log.Errorf("Version %v pinned for %s/%s is no longer published, serving the latest", v, os, arch)
+	}
+	return found
+}
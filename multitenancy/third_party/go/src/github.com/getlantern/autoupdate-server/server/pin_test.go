@@ -0,0 +1,122 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/blang/semver"
+)
+
+func TestPinVersion(t *testing.T) {
+	requireBsdiff(t)
+	setTestPrivateKey(t)
+
+	random := make([]byte, 4096)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+	versions := []string{"1.0.0", "1.1.0", "1.2.0"}
+	contents := make(map[string]string)
+	var releases []string
+	for i, tag := range versions {
+		contents["/"+tag] = string(random) + "pinned " + tag
+		releases = append(releases, fmt.Sprintf(`{"id": %d, "tag_name": "%s", "zipball_url": "http://example.com/%s.zip", "assets": [
+			{"id": %d, "name": "autoupdate-binary-linux-amd64", "browser_download_url": "%%[1]s/%s"}
+		]}`, i+1, tag, tag, 10+i, tag))
+	}
+	files := newTestAssetServer(contents)
+	defer files.Close()
+	api := newTestReleasesAPI(fmt.Sprintf("["+strings.Join(releases, ",")+"]", files.URL))
+	defer api.Close()
+
+	g := NewReleaseManager("getlantern", "autoupdate-server")
+	useTestGitHub(t, g, api)
+	g.SetMaxPatchRatio(0)
+	if err := g.SetPatchCacheDir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+	checksum := func(version string) string {
+		return g.assetOfVersion(OS.Linux, Arch.X64, semver.MustParse(version)).Checksum
+	}
+
+	check := func(version string, checksum string, channel string) (*Result, error) {
+		return g.CheckForUpdate(&Params{
+			AppVersion: version,
+			OS:         OS.Linux,
+			Arch:       Arch.X64,
+			Checksum:   checksum,
+			Channel:    channel,
+		})
+	}
+
+	// Nothing to pin to.
+	if err := g.PinVersion(OS.Windows, Arch.X64, "1.1.0"); !errors.Is(err, ErrNoSuchVersion) {
+		t.Fatalf("Expecting ErrNoSuchVersion for a platform without the asset, got %v", err)
+	}
+	if err := g.PinVersion(OS.Linux, Arch.X64, "1.5.0"); !errors.Is(err, ErrNoSuchVersion) || !strings.Contains(err.Error(), "linux/amd64") {
+		t.Fatalf("Expecting a descriptive ErrNoSuchVersion for an unknown version, got %v", err)
+	}
+
+	if err := g.PinVersion(OS.Linux, Arch.X64, "1.1.0"); err != nil {
+		t.Fatal(err)
+	}
+	// The pin outlives refreshes.
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Older clients update to the pinned version.
+	res, err := check("1.0.0", checksum("1.0.0"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Version != "1.1.0" || res.Mandatory {
+		t.Fatalf("Expecting an update to the pinned 1.1.0, got %+v", res)
+	}
+
+	// Clients on the bad version are rolled back with a patch, whatever
+	// their channel.
+	for _, channel := range []string{Channel.Stable, Channel.Beta} {
+		if res, err = check("1.2.0", checksum("1.2.0"), channel); err != nil {
+			t.Fatal(err)
+		}
+		if res.Version != "1.1.0" || !res.Mandatory || res.PatchType != PATCHTYPE_BSDIFF {
+			t.Fatalf("Expecting a mandatory downgrade patch to 1.1.0 on %s, got %+v", channel, res)
+		}
+	}
+	if res, err = check("1.2.0", "unknown", ""); err != nil {
+		t.Fatal(err)
+	}
+	if res.Version != "1.1.0" || res.UpdateType != UPDATETYPE_FULL {
+		t.Fatalf("Expecting a full downgrade to 1.1.0, got %+v", res)
+	}
+	if _, err = check("1.1.0", checksum("1.1.0"), ""); err != ErrNoUpdateAvailable {
+		t.Fatalf("Expecting no update on the pinned version, got %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	NewPinsHandler(g).ServeHTTP(rec, httptest.NewRequest("GET", "/admin/pins", nil))
+	var pins []Pin
+	if err = json.NewDecoder(rec.Body).Decode(&pins); err != nil {
+		t.Fatal(err)
+	}
+	if len(pins) != 1 || pins[0] != (Pin{OS: OS.Linux, Arch: Arch.X64, Version: "1.1.0"}) {
+		t.Fatalf("Expecting the linux/amd64 pin to be listed, got %+v", pins)
+	}
+
+	g.Unpin(OS.Linux, Arch.X64)
+	if _, err = check("1.2.0", checksum("1.2.0"), ""); err != ErrNoUpdateAvailable {
+		t.Fatalf("Expecting no update once unpinned, got %v", err)
+	}
+	if pins := g.Pins(); len(pins) != 0 {
+		t.Fatalf("Expecting no pins left, got %+v", pins)
+	}
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	// platformHeader lets clients that can't fill their params tell their
+	// platform, like "windows/amd64".
+	platformHeader = "X-Update-Platform"
+
+	// inferredPlatformHeader carries the os/arch platform the update handler
+	// told from the request headers, when the params had none.
+	inferredPlatformHeader = "X-Update-Inferred-Platform"
+)
+
+// osAliases maps the names clients and their user agents report their OS by to
+// the OS name, along with the arch some of them imply.
+var osAliases = map[string]struct{ os, arch string }{
+	"windows":   {OS.Windows, ""},
+	"win32":     {OS.Windows, Arch.X86},
+	"win64":     {OS.Windows, Arch.X64},
+	"linux":     {OS.Linux, ""},
+	"darwin":    {OS.Darwin, ""},
+	"macos":     {OS.Darwin, ""},
+	"osx":       {OS.Darwin, ""},
+	"macintosh": {OS.Darwin, ""},
+}
+
+// headerArchAliases maps the arch names found in user agents to the Arch name,
+// on top of archAliases.
+var headerArchAliases = map[string]string{
+	"x86_64": Arch.X64,
+	"x64":    Arch.X64,
+	"i386":   Arch.X86,
+	"i686":   Arch.X86,
+	"x86":    Arch.X86,
+	// 32-bit processes on 64-bit Windows.
+	"wow64": Arch.X86,
+}
+
+// parsePlatform returns the OS and arch told by s, a user agent like
+// "autoupdate-client/2.1 (windows; amd64)" or a platform like "linux/arm64".
+// Either is empty when s doesn't tell it.
+func parsePlatform(s string) (os string, arch string) {
+	var implied string
+	words := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '_')
+	})
+	for _, word := range words {
+		if alias, ok := osAliases[word]; ok && os == "" {
+			os, implied = alias.os, alias.arch
+			continue
+		}
+		if arch != "" {
+			continue
+		}
+		if a, ok := headerArchAliases[word]; ok {
+			arch = a
+		} else if a := normalizeArch(word); knownArch(a) {
+			arch = a
+		}
+	}
+	if arch == "" {
+		arch = implied
+	}
+	return os, arch
+}
+
+// knownArch tells whether arch is an Arch name.
+func knownArch(arch string) bool {
+	switch arch {
+	case Arch.X64, Arch.X86, Arch.ARM, Arch.ARMv5, Arch.ARMv6, Arch.ARMv7, Arch.ARM64:
+		return true
+	}
+	return false
+}
+
+// inferPlatform fills the OS and arch missing from p, neither in its fields
+// nor in its tags, with those told by the X-Update-Platform header of r or
+// else its User-Agent. It returns the os/arch platform then checked for, empty
+// if p was complete, and fails with ErrUnknownPlatform if the headers don't
+// tell what's missing.
+func inferPlatform(r *http.Request, p *Params) (string, error) {
+	needOS := p.OS == "" && p.Tags["os"] == ""
+	needArch := p.Arch == "" && p.Tags["arch"] == ""
+	if !needOS && !needArch {
+		return "", nil
+	}
+
+	os, arch := parsePlatform(r.Header.Get(platformHeader))
+	if uaOS, uaArch := parsePlatform(r.UserAgent()); os == "" || arch == "" {
+		if os == "" {
+			os = uaOS
+		}
+		if arch == "" {
+			arch = uaArch
+		}
+	}
+	if needOS && os == "" || needArch && arch == "" {
+		return "", fmt.Errorf("%w from User-Agent %q", ErrUnknownPlatform, r.UserAgent())
+	}
+
+	if needOS {
+		p.OS = os
+	} else if os = p.OS; os == "" {
+		os = p.Tags["os"]
+	}
+	if needArch {
+		p.Arch = arch
+	} else if arch = p.Arch; arch == "" {
+		arch = p.Tags["arch"]
+	}
+	return os + "/" + arch, nil
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParsePlatform(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		os   string
+		arch string
+	}{
+		{"autoupdate-client/2.1 (windows; amd64)", OS.Windows, Arch.X64},
+		{"autoupdate-client/1.0 (win32)", OS.Windows, Arch.X86},
+		{"autoupdate-client/1.0 (win32; x64)", OS.Windows, Arch.X64},
+		{"autoupdate-client/1.0 (macos; x86_64)", OS.Darwin, Arch.X64},
+		{"lantern/7.2.1 (osx; arm64)", OS.Darwin, Arch.ARM64},
+		{"autoupdate-client/2.0 (linux; aarch64)", OS.Linux, Arch.ARM64},
+		{"autoupdate-client/2.0 (linux; armv7l)", OS.Linux, Arch.ARMv7},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko)", OS.Windows, Arch.X64},
+		{"Mozilla/5.0 (Windows NT 6.1; WOW64; rv:52.0) Gecko/20100101 Firefox/52.0", OS.Windows, Arch.X86},
+		{"Mozilla/5.0 (X11; Linux x86_64; rv:109.0) Gecko/20100101 Firefox/115.0", OS.Linux, Arch.X64},
+		{"Mozilla/5.0 (X11; Linux i686)", OS.Linux, Arch.X86},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7)", OS.Darwin, ""},
+		{"linux/arm64", OS.Linux, Arch.ARM64},
+		{"darwin-amd64", OS.Darwin, Arch.X64},
+		{"Go-http-client/1.1", "", ""},
+		{"curl/7.68.0", "", ""},
+		{"", "", ""},
+	} {
+		if os, arch := parsePlatform(tc.in); os != tc.os || arch != tc.arch {
+			t.Errorf("Expecting %q to tell %q/%q, got %q/%q", tc.in, tc.os, tc.arch, os, arch)
+		}
+	}
+}
+
+func TestUpdateHandlerInfersPlatform(t *testing.T) {
+	g, _, update := newTestUpdatePair(t, nil)
+	h := NewUpdateHandler(g, "https://update.example.com/")
+	serve := func(userAgent string, platform string) *httptest.ResponseRecorder {
+		body := `{"app_version": "1.0.0", "checksum": "unknown"}`
+		req := httptest.NewRequest("POST", "/update", strings.NewReader(body))
+		req.Header.Set("User-Agent", userAgent)
+		if platform != "" {
+			req.Header.Set(platformHeader, platform)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, rec := range []*httptest.ResponseRecorder{
+		serve("autoupdate-client/1.0 (linux; x86_64)", ""),
+		serve("Go-http-client/1.1", "linux/amd64"),
+	} {
+		var res Result
+		if rec.Code != http.StatusOK || json.NewDecoder(rec.Body).Decode(&res) != nil || res.URL != update.URL {
+			t.Fatalf("Expecting the update for the inferred platform, got %d", rec.Code)
+		}
+		if p := rec.Header().Get(inferredPlatformHeader); p != "linux/amd64" {
+			t.Fatalf("Expecting the inferred platform to be told, got %q", p)
+		}
+	}
+
+	rec := serve("Go-http-client/1.1", "")
+	var e errorBody
+	if rec.Code != http.StatusBadRequest || json.NewDecoder(rec.Body).Decode(&e) != nil || e.Code != "unknown_platform" {
+		t.Fatalf("Expecting 400 with an unknown_platform code, got %d %+v", rec.Code, e)
+	}
+}
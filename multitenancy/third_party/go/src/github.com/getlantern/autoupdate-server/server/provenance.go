@@ -0,0 +1,152 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+)
+
+// AssetVerifier is a custom provenance policy, given every update asset
+// along with its release by UpdateAssetsMap. Assets it returns an error for
+// are never offered.
+type AssetVerifier func(rel *Release, a *Asset) error
+
+// provenance holds the checks update assets must pass to be offered.
+type provenance struct {
+	verifiedTags bool
+	uploaders    map[string]bool // logins, nil means anyone
+	verifier     AssetVerifier
+}
+
+// enabled tells whether any check applies.
+func (p *provenance) enabled() bool {
+	return p.verifiedTags || p.uploaders != nil || p.verifier != nil
+}
+
+// tagVerifier is a ReleaseProvider that can tell whether a release tag
+// carries a signature github verified.
+type tagVerifier interface {
+	tagVerified(ctx context.Context, tag string) (bool, error)
+}
+
+// WithVerifiedTags only offers the assets of releases whose tag is an
+// annotated tag with a signature github verified. With a provider that can't
+// tell, nothing is offered.
+func WithVerifiedTags() Option {
+	return func(g *ReleaseManager) {
+		g.provenance.verifiedTags = true
+	}
+}
+
+// WithTrustedUploaders only offers assets uploaded by one of the given github
+// logins.
+func WithTrustedUploaders(logins ...string) Option {
+	return func(g *ReleaseManager) {
+		g.provenance.uploaders = make(map[string]bool, len(logins))
+		for _, login := range logins {
+			g.provenance.uploaders[login] = true
+		}
+	}
+}
+
+// WithAssetVerifier only offers the assets v accepts, on top of the other
+// provenance checks.
+func WithAssetVerifier(v AssetVerifier) Option {
+	return func(g *ReleaseManager) {
+		g.provenance.verifier = v
+	}
+}
+
+// releaseTagVerified tells whether the tag of rel is verified, failing when
+// the provider could not be asked.
+func (g *ReleaseManager) releaseTagVerified(ctx context.Context, rel *Release) (bool, error) {
+	tv, ok := g.provider.(tagVerifier)
+	if !ok || rel.Tag == "" {
+		return false, nil
+	}
+	return tv.tagVerified(ctx, rel.Tag)
+}
+
+// verifyProvenance returns an error matching ErrUnverifiedAsset unless a
+// passes the provenance checks, tagVerified telling whether the tag of rel
+// is verified.
+func (g *ReleaseManager) verifyProvenance(rel *Release, a *Asset, tagVerified bool) error {
+	p := g.provenance
+	if p.verifiedTags && !tagVerified {
+		return fmt.Errorf("%w: tag %q of release %v is not verified", ErrUnverifiedAsset, rel.Tag, rel.Version)
+	}
+	if p.uploaders != nil && !p.uploaders[a.Uploader] {
+		return fmt.Errorf("%w: %s was uploaded by untrusted user %q", ErrUnverifiedAsset, a.Name, a.Uploader)
+	}
+	if p.verifier != nil {
+		if err := p.verifier(rel, a); err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrUnverifiedAsset, a.Name, err)
+		}
+	}
+	return nil
+}
+
+// unverifiedPlatform tells whether assets of the os/arch platform were left
+// out by the provenance checks.
+func (g *ReleaseManager) unverifiedPlatform(os string, arch string) bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.unverified[os+"/"+arch]
+}
+
+// tagVerified asks github whether tag is an annotated tag with a verified
+// signature, lightweight tags can't be signed.
+func (p *githubProvider) tagVerified(ctx context.Context, tag string) (bool, error) {
+	req, err := p.client.NewRequest("GET", fmt.Sprintf("repos/%v/%v/git/refs/tags/%v", p.owner, p.repo, url.PathEscape(tag)), nil)
+	if err != nil {
+		return false, err
+	}
+	var ref struct {
+		Object struct {
+			Type string `json:"type"`
+			SHA  string `json:"sha"`
+		} `json:"object"`
+	}
+	res, err := p.client.Do(req.WithContext(ctx), &ref)
+	p.updateRateLimit(res)
+	if err != nil {
+		return false, githubError(err)
+	}
+	if ref.Object.Type != "tag" {
+		return false, nil
+	}
+
+	p.mu.Lock()
+	verified, known := p.verifiedTags[ref.Object.SHA]
+	p.mu.Unlock()
+	if known {
+		return verified, nil
+	}
+
+	if req, err = p.client.NewRequest("GET", fmt.Sprintf("repos/%v/%v/git/tags/%v", p.owner, p.repo, ref.Object.SHA), nil); err != nil {
+		return false, err
+	}
+	var t struct {
+		Verification struct {
+			Verified bool   `json:"verified"`
+			Reason   string `json:"reason"`
+		} `json:"verification"`
+	}
+	res, err = p.client.Do(req.WithContext(ctx), &t)
+	p.updateRateLimit(res)
+	if err != nil {
+		return false, githubError(err)
+	}
+	if !t.Verification.Verified {
+		log.Debugf("Tag %s is not verified: %s", tag, t.Verification.Reason)
+	}
+
+	// Tag objects never change, only refs move.
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.verifiedTags == nil {
+		p.verifiedTags = make(map[string]bool)
+	}
+	p.verifiedTags[ref.Object.SHA] = t.Verification.Verified
+	return t.Verification.Verified, nil
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// newTestProvenanceAPI serves releases 1.0.0, with a verified annotated tag
+// and assets uploaded by release-bot, and 1.1.0, with a lightweight tag and a
+// linux asset uploaded by mallory. Windows only has mallory's 1.1.0 asset.
+func newTestProvenanceAPI(t *testing.T, tagLookups *int32) *httptest.Server {
+	files := newTestAssetServer(map[string]string{
+		"/1.0.0/linux":   "provenance 1.0.0 linux",
+		"/1.1.0/linux":   "provenance 1.1.0 linux",
+		"/1.1.0/windows": "provenance 1.1.0 windows",
+	})
+	t.Cleanup(files.Close)
+
+	releases := fmt.Sprintf(`[
+		{"id": 1, "tag_name": "1.0.0", "zipball_url": "%[1]s/1.0.0.zip", "assets": [
+			{"id": 11, "name": "autoupdate-binary-linux-amd64", "browser_download_url": "%[1]s/1.0.0/linux", "uploader": {"login": "release-bot"}}
+		]},
+		{"id": 2, "tag_name": "1.1.0", "zipball_url": "%[1]s/1.1.0.zip", "assets": [
+			{"id": 21, "name": "autoupdate-binary-linux-amd64", "browser_download_url": "%[1]s/1.1.0/linux", "uploader": {"login": "mallory"}},
+			{"id": 22, "name": "autoupdate-binary-windows-amd64", "browser_download_url": "%[1]s/1.1.0/windows", "uploader": {"login": "mallory"}}
+		]}
+	]`, files.URL)
+
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch strings.TrimPrefix(r.URL.Path, "/repos/getlantern/autoupdate-server/") {
+		case "releases":
+			w.Write([]byte(releases))
+		case "git/refs/tags/1.0.0":
+			w.Write([]byte(`{"ref": "refs/tags/1.0.0", "object": {"type": "tag", "sha": "aaa"}}`))
+		case "git/refs/tags/1.1.0":
+			w.Write([]byte(`{"ref": "refs/tags/1.1.0", "object": {"type": "commit", "sha": "bbb"}}`))
+		case "git/tags/aaa":
+			atomic.AddInt32(tagLookups, 1)
+			w.Write([]byte(`{"sha": "aaa", "verification": {"verified": true, "reason": "valid"}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(api.Close)
+	return api
+}
+
+func TestAssetProvenance(t *testing.T) {
+	setTestPrivateKey(t)
+
+	check := func(g *ReleaseManager, os string) (*Result, error) {
+		return g.CheckForUpdate(&Params{
+			AppVersion: "0.9.0",
+			OS:         os,
+			Arch:       Arch.X64,
+			Checksum:   "unknown",
+		})
+	}
+
+	for _, c := range []struct {
+		name string
+		opt  Option
+	}{
+		{"verified tags", WithVerifiedTags()},
+		{"trusted uploaders", WithTrustedUploaders("release-bot", "ci")},
+		{"asset verifier", WithAssetVerifier(func(rel *Release, a *Asset) error {
+			if rel.Tag != "1.0.0" {
+				return errors.New("not released by the book")
+			}
+			return nil
+		})},
+	} {
+		var tagLookups int32
+		api := newTestProvenanceAPI(t, &tagLookups)
+		m := newTestMetrics()
+		g := NewReleaseManager("getlantern", "autoupdate-server", c.opt, WithMetrics(m))
+		useTestGitHub(t, g, api)
+		for i := 0; i < 2; i++ {
+			if err := g.UpdateAssetsMap(); err != nil {
+				t.Fatalf("%s: %v", c.name, err)
+			}
+		}
+
+		if m.unverified != 4 {
+			t.Fatalf("%s: expecting both 1.1.0 assets to be left out on every refresh, got %d", c.name, m.unverified)
+		}
+		if g.updateAssetsMap[OS.Linux][Arch.X64]["1.1.0"] != nil {
+			t.Fatalf("%s: expecting the unverified asset not to be indexed", c.name)
+		}
+
+		// The latest verified version is offered instead.
+		res, err := check(g, OS.Linux)
+		if err != nil && !errors.Is(err, ErrUnknownVersion) {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if res.Version != "1.0.0" {
+			t.Fatalf("%s: expecting the verified 1.0.0, got %+v", c.name, res)
+		}
+
+		// Nothing verified is left for windows.
+		if _, err = check(g, OS.Windows); err != ErrNoUpdateAvailable {
+			t.Fatalf("%s: expecting ErrNoUpdateAvailable without a verified asset, got %v", c.name, err)
+		}
+
+		if c.name == "verified tags" && atomic.LoadInt32(&tagLookups) != 1 {
+			t.Fatalf("Expecting the verification of a tag to be looked up once, got %d", tagLookups)
+		}
+	}
+
+	// Without checks every asset is offered.
+	var tagLookups int32
+	g := NewReleaseManager("getlantern", "autoupdate-server")
+	useTestGitHub(t, g, newTestProvenanceAPI(t, &tagLookups))
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := check(g, OS.Windows); (err != nil && !errors.Is(err, ErrUnknownVersion)) || res.Version != "1.1.0" {
+		t.Fatalf("Expecting 1.1.0 without provenance checks, got %+v, %v", res, err)
+	}
+	if a := g.updateAssetsMap[OS.Linux][Arch.X64]["1.1.0"]; a == nil || a.Uploader != "mallory" {
+		t.Fatalf("Expecting the uploader to be known, got %+v", a)
+	}
+}
@@ -0,0 +1,534 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+const (
+	// Number of items asked for per page of a github list.
+	githubPageSize = 100
+
+	// github embeds only part of the assets of releases with many of them in
+	// the releases list, cut at its default page size.
+	defaultAssetPageThreshold = 30
+)
+
+// ReleaseProvider is where a ReleaseManager lists the releases of an
+// application from, a github repository by default.
+type ReleaseProvider interface {
+	// Releases returns every release along with its assets.
+	Releases(ctx context.Context) ([]Release, error)
+	// Client returns the HTTP client to download assets with.
+	Client() *http.Client
+}
+
+// conditionalProvider is a ReleaseProvider that can tell the releases did
+// not change since they were last listed, sparing UpdateAssetsMap the work.
+type conditionalProvider interface {
+	// releasesSince is like Releases, returning ErrNotModified if the
+	// releases are still the ones described by since.
+	releasesSince(ctx context.Context, since releasesValidator) ([]Release, releasesValidator, error)
+}
+
+// loggingProvider is a ReleaseProvider that reports to the manager's logger,
+// set when the manager is created.
+type loggingProvider interface {
+	setLogger(logger Logger)
+}
+
+// tagLog tells a manager's logger about the releases a provider skips.
+type tagLog struct {
+	logger Logger
+}
+
+func (l *tagLog) setLogger(logger Logger) {
+	l.logger = logger
+}
+
+// skipTag reports a release left out because its tag is not a semantic
+// version, it could not be ordered against the others.
+func (l *tagLog) skipTag(tag string, err error) {
+	if l.logger != nil {
+		l.logger.Warn("Skipping release, its tag is not a semantic version", "tag", tag, "err", err)
+	}
+}
+
+// releasesValidator holds the cache validators of a releases list response.
+type releasesValidator struct {
+	etag         string
+	lastModified string
+}
+
+// githubProvider lists the releases of a github repository.
+type githubProvider struct {
+	client *github.Client
+	owner  string
+	repo   string
+	// Releases listed with at least this many assets have them listed
+	// page by page, negative never does.
+	assetPageThreshold int
+	// Asset downloads, with the token for Github hosts if there is one.
+	downloads *http.Client
+	// Whether assets are downloaded from the API, nil asks github whether
+	// the repository is private once a token is set.
+	privateAssets *bool
+	// Whether the release github marks as latest is asked for, see
+	// WithGithubLatest.
+	latestMarker bool
+
+	tagLog
+
+	mu           sync.Mutex
+	rate         RateLimit
+	verifiedTags map[string]bool       // tag object sha -> verified
+	pages        map[int]*releasesPage // of the last releases list, by page
+}
+
+// releasesPage is a page of the releases list kept along with its
+// validators, for it to be asked for conditionally next time.
+type releasesPage struct {
+	releasesValidator
+	next     int
+	releases []githubRelease
+}
+
+// setValidator makes req conditional on the given validator, if any.
+func setValidator(req *http.Request, v releasesValidator) {
+	if v.etag != "" {
+		req.Header.Set("If-None-Match", v.etag)
+	} else if v.lastModified != "" {
+		req.Header.Set("If-Modified-Since", v.lastModified)
+	}
+}
+
+// newGithubProvider returns a provider for the given repository. Requests go
+// through httpClient if not nil, authenticated with token if not empty, to the
+// API at baseURL if not empty.
+func newGithubProvider(owner string, repo string, httpClient *http.Client, token string, baseURL string) *githubProvider {
+	if token != "" {
+		var c http.Client
+		if httpClient != nil {
+			c = *httpClient
+		}
+		c.Transport = &tokenTransport{token: token, base: c.Transport}
+		httpClient = &c
+	}
+
+	p := &githubProvider{
+		client:             github.NewClient(httpClient),
+		owner:              owner,
+		repo:               repo,
+		assetPageThreshold: defaultAssetPageThreshold,
+	}
+
+	if baseURL != "" {
+		if !strings.HasSuffix(baseURL, "/") {
+			baseURL += "/"
+		}
+		u, err := url.Parse(baseURL)
+		if err != nil {
+			log.Fatalf("Could not parse API base URL %q: %q", baseURL, err)
+		}
+		p.client.BaseURL = u
+	}
+
+	if token != "" {
+		// Downloads redirect to storage hosts the token must not reach.
+		hosts := map[string]bool{"github.com": true, p.client.BaseURL.Host: true}
+		p.downloads = &http.Client{Transport: &assetAPITransport{
+			host: p.client.BaseURL.Host,
+			base: &tokenTransport{token: token, base: downloadTransport, hosts: hosts},
+		}}
+	}
+
+	return p
+}
+
+// Releases queries github for all product releases.
+func (p *githubProvider) Releases(ctx context.Context) ([]Release, error) {
+	rs, _, err := p.releasesSince(ctx, releasesValidator{})
+	return rs, err
+}
+
+// Client returns the default client, authenticating downloads from Github
+// with the token if there is one.
+func (p *githubProvider) Client() *http.Client {
+	if p.downloads != nil {
+		return p.downloads
+	}
+	return defaultDownloadClient
+}
+
+// rateLimit returns the API rate limit status as of the last request.
+func (p *githubProvider) rateLimit() RateLimit {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.rate
+}
+
+func (p *githubProvider) updateRateLimit(res *github.Response) {
+	if res == nil || res.Rate.Limit == 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rate = RateLimit{
+		Limit:     res.Rate.Limit,
+		Remaining: res.Rate.Remaining,
+		Reset:     res.Rate.Reset.Time,
+	}
+}
+
+// releasesSince queries github for all product releases, sending the given
+// validators along. ErrNotModified is returned if the list did not change.
+//
+// Every page listed last time is asked for conditionally on its own
+// validators, pages that did not change are taken from then: a release
+// edited down the list does not change the first page.
+func (p *githubProvider) releasesSince(ctx context.Context, since releasesValidator) ([]Release, releasesValidator, error) {
+	var validator releasesValidator
+
+	p.mu.Lock()
+	cached := p.pages
+	p.mu.Unlock()
+
+	var rels []githubRelease
+	pages := make(map[int]*releasesPage)
+	changed := false
+	for page := 1; page != 0; {
+		req, err := p.client.NewRequest("GET", fmt.Sprintf("repos/%v/%v/releases?per_page=%d&page=%d", p.owner, p.repo, githubPageSize, page), nil)
+		if err != nil {
+			return nil, validator, err
+		}
+		req = req.WithContext(ctx)
+		last := cached[page]
+		if last != nil {
+			setValidator(req, last.releasesValidator)
+		} else if page == 1 {
+			// Without the page at hand, as when the maps were loaded
+			// from a snapshot, the first page changes along with any
+			// other.
+			setValidator(req, since)
+		}
+
+		var batch []githubRelease
+		res, err := p.client.Do(req, &batch)
+		p.updateRateLimit(res)
+
+		if res != nil && res.StatusCode == http.StatusNotModified {
+			if last == nil {
+				return nil, since, ErrNotModified
+			}
+			pages[page] = last
+			rels = append(rels, last.releases...)
+			page = last.next
+			continue
+		}
+
+		// Any page failing, like when the rate limit runs out halfway, fails
+		// the whole list: a partial one would drop the releases left.
+		if err != nil {
+			return nil, validator, githubError(err)
+		}
+
+		changed = true
+		pages[page] = &releasesPage{
+			releasesValidator: releasesValidator{etag: res.Header.Get("ETag"), lastModified: res.Header.Get("Last-Modified")},
+			next:              nextPage(res, page),
+			releases:          batch,
+		}
+		rels = append(rels, batch...)
+		page = pages[page].next
+	}
+	validator = pages[1].releasesValidator
+
+	p.mu.Lock()
+	p.pages = pages
+	p.mu.Unlock()
+
+	// The maps only reflect the list since was taken from, a caller
+	// without them gets it in full.
+	if !changed && since != (releasesValidator{}) && since == validator {
+		return nil, since, ErrNotModified
+	}
+
+	for i := range rels {
+		if p.assetPageThreshold < 0 || len(rels[i].Assets) < p.assetPageThreshold || rels[i].ID == nil {
+			continue
+		}
+		assets, err := p.releaseAssets(ctx, *rels[i].ID)
+		if err != nil {
+			return nil, validator, err
+		}
+		rels[i].Assets = assets
+	}
+
+	private := p.private(ctx)
+
+	releases := make([]Release, 0, len(rels))
+
+	for i := range rels {
+		version := *rels[i].TagName
+		// Drafts are for maintainers' eyes only, whatever their assets.
+		if rels[i].Draft != nil && *rels[i].Draft {
+			log.Debugf("Release %v is a draft, ignoring", version)
+			continue
+		}
+		v, err := parseVersion(version)
+		if err != nil {
+			p.skipTag(version, err)
+			continue
+		}
+		rel := Release{
+			id:      *rels[i].ID,
+			URL:     *rels[i].ZipballURL,
+			Tag:     version,
+			Version: v,
+		}
+		if rels[i].Prerelease != nil {
+			rel.Prerelease = *rels[i].Prerelease
+		}
+		if rels[i].CreatedAt != nil {
+			rel.created = rels[i].CreatedAt.Time
+		}
+		if rels[i].Body != nil {
+			rel.parseNotes(*rels[i].Body)
+		}
+		rel.Assets = make([]Asset, 0, len(rels[i].Assets))
+		for _, asset := range rels[i].Assets {
+			a := Asset{
+				id:   *asset.ID,
+				Name: *asset.Name,
+				URL:  *asset.BrowserDownloadURL,
+			}
+			if asset.Digest != nil {
+				a.digest = *asset.Digest
+			}
+			if asset.Size != nil {
+				a.Size = int64(*asset.Size)
+			}
+			if asset.UpdatedAt != nil {
+				a.uploaded = asset.UpdatedAt.Time
+			} else if asset.CreatedAt != nil {
+				a.uploaded = asset.CreatedAt.Time
+			}
+			if asset.Uploader != nil && asset.Uploader.Login != nil {
+				a.Uploader = *asset.Uploader.Login
+			}
+			if private && asset.URL != nil {
+				// The browser URL of a private asset is a 404 even with the
+				// token.
+				a.URL, a.Private = *asset.URL, true
+			}
+			rel.Assets = append(rel.Assets, a)
+		}
+		releases = append(releases, rel)
+	}
+
+	if p.latestMarker {
+		id, err := p.latestRelease(ctx)
+		if err != nil {
+			return nil, validator, err
+		}
+		for i := range releases {
+			releases[i].latest = releases[i].id == id
+		}
+	}
+
+	sort.Sort(sort.Reverse(releasesByID(releases)))
+
+	return releases, validator, nil
+}
+
+// latestRelease returns the ID of the release github marks as latest, zero if
+// it marks none, as when every release is a prerelease.
+func (p *githubProvider) latestRelease(ctx context.Context) (int, error) {
+	req, err := p.client.NewRequest("GET", fmt.Sprintf("repos/%v/%v/releases/latest", p.owner, p.repo), nil)
+	if err != nil {
+		return 0, err
+	}
+	var rel github.RepositoryRelease
+	res, err := p.client.Do(req.WithContext(ctx), &rel)
+	p.updateRateLimit(res)
+	if res != nil && res.StatusCode == http.StatusNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, githubError(err)
+	}
+	if rel.ID == nil {
+		return 0, nil
+	}
+	return *rel.ID, nil
+}
+
+// nextPage returns the page to list after page, zero past the last one. A
+// Link header pointing back is taken as the last page rather than looping.
+func nextPage(res *github.Response, page int) int {
+	if res.NextPage <= page {
+		return 0
+	}
+	return res.NextPage
+}
+
+// releaseAssets lists every asset of the given release page by page.
+func (p *githubProvider) releaseAssets(ctx context.Context, id int) ([]githubReleaseAsset, error) {
+	var assets []githubReleaseAsset
+	for page := 1; page != 0; {
+		req, err := p.client.NewRequest("GET", fmt.Sprintf("repos/%v/%v/releases/%d/assets?per_page=%d&page=%d", p.owner, p.repo, id, githubPageSize, page), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var batch []githubReleaseAsset
+		res, err := p.client.Do(req.WithContext(ctx), &batch)
+		p.updateRateLimit(res)
+		if err != nil {
+			return nil, githubError(err)
+		}
+
+		assets = append(assets, batch...)
+		page = nextPage(res, page)
+	}
+	return assets, nil
+}
+
+// githubRelease is a github.RepositoryRelease with assets that carry the
+// digest field the vendored client does not know about.
+type githubRelease struct {
+	github.RepositoryRelease
+	Assets []githubReleaseAsset `json:"assets,omitempty"`
+}
+
+type githubReleaseAsset struct {
+	github.ReleaseAsset
+	Digest *string `json:"digest,omitempty"`
+}
+
+// RateLimit holds the Github API rate limit status.
+type RateLimit struct {
+	Limit     int
+	Remaining int
+	Reset     time.Time
+}
+
+// githubError translates authentication and rate limit failures reported by
+// the Github API into this package's errors. Other failures are left as they
+// are for temporaryError to look at.
+func githubError(err error) error {
+	switch e := err.(type) {
+	case *github.RateLimitError:
+		return &RateLimitError{Reset: e.Rate.Reset.Time, RetryAfter: retryAfter(e.Response.Header)}
+	case *github.ErrorResponse:
+		switch e.Response.StatusCode {
+		case http.StatusUnauthorized:
+			return ErrUnauthorized
+		case http.StatusForbidden, http.StatusTooManyRequests:
+			after := retryAfter(e.Response.Header)
+			if e.Response.Header.Get("X-RateLimit-Remaining") == "0" {
+				reset, _ := strconv.ParseInt(e.Response.Header.Get("X-RateLimit-Reset"), 10, 64)
+				return &RateLimitError{Reset: time.Unix(reset, 0), RetryAfter: after}
+			}
+			// Secondary rate limits only tell how long to wait.
+			if after > 0 {
+				return &RateLimitError{Reset: time.Now().Add(after), RetryAfter: after}
+			}
+		}
+	}
+	return err
+}
+
+// private tells whether assets are to be downloaded from the API, asking
+// github whether the repository is private the first time if not told. Only
+// a token lets a private repository be seen at all. Repositories github
+// can't tell about are taken as public and asked about again next time.
+func (p *githubProvider) private(ctx context.Context) bool {
+	p.mu.Lock()
+	private := p.privateAssets
+	p.mu.Unlock()
+	if private != nil {
+		return *private
+	}
+	if p.downloads == nil {
+		return false
+	}
+
+	var repo github.Repository
+	req, err := p.client.NewRequest("GET", fmt.Sprintf("repos/%v/%v", p.owner, p.repo), nil)
+	if err == nil {
+		var res *github.Response
+		res, err = p.client.Do(req.WithContext(ctx), &repo)
+		p.updateRateLimit(res)
+	}
+	if err != nil {
+		if p.logger != nil {
+			p.logger.Warn("Could not tell whether the repository is private", "err", err)
+		}
+		return false
+	}
+	detected := repo.Private != nil && *repo.Private
+
+	p.mu.Lock()
+	p.privateAssets = &detected
+	p.mu.Unlock()
+	return detected
+}
+
+// assetAPITransport asks the API at host for the content of release assets
+// rather than their description, github answers with a redirect to a short
+// lived URL of the content.
+type assetAPITransport struct {
+	host string
+	base http.RoundTripper
+}
+
+func (t *assetAPITransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != t.host || !strings.Contains(req.URL.Path, "/releases/assets/") {
+		return t.base.RoundTrip(req)
+	}
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	r.Header.Set("Accept", "application/octet-stream")
+	return t.base.RoundTrip(r)
+}
+
+// tokenTransport adds a GitHub access token to every request, or to those
+// going to the given hosts only.
+type tokenTransport struct {
+	token string
+	base  http.RoundTripper
+	hosts map[string]bool
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if t.hosts != nil && !t.hosts[req.URL.Host] {
+		return base.RoundTrip(req)
+	}
+	// A RoundTripper must not modify the original request.
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	r.Header.Set("Authorization", "token "+t.token)
+	return base.RoundTrip(r)
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRefreshInterval = time.Minute * 30
+	defaultRefreshWorkers  = 4
+)
+
+// ReleaseManagerRegistry serves several applications from one process, each
+// one backed by its own ReleaseManager and keyed by an application ID. It is
+// safe to add and remove applications while serving. Applications share
+// nothing: each one downloads assets and caches patches in a directory of its
+// own, so no file of one is ever served to another.
+type ReleaseManagerRegistry struct {
+	mu      sync.RWMutex
+	apps    map[string]*ReleaseManager
+	workers int
+}
+
+// NewReleaseManagerRegistry creates an empty registry refreshing at most the
+// given number of applications at once, zero or less means the default of 4.
+func NewReleaseManagerRegistry(workers int) *ReleaseManagerRegistry {
+	if workers < 1 {
+		workers = defaultRefreshWorkers
+	}
+	return &ReleaseManagerRegistry{
+		apps:    make(map[string]*ReleaseManager),
+		workers: workers,
+	}
+}
+
+// AddApp registers an application whose releases are published on the given
+// Github repository, replacing any application with the same ID. Unless opts
+// say otherwise, its assets are downloaded to assets/<id> and its patches
+// cached in patches/<id>.
+func (r *ReleaseManagerRegistry) AddApp(id string, owner string, repo string, opts ...Option) *ReleaseManager {
+	g := NewReleaseManager(owner, repo, opts...)
+	if g.downloadDir == "" {
+		if err := g.SetDownloadDir(appDir(assetsDirectory, id)); err != nil {
+			log.Errorf("Could not isolate the downloads of %s: %q", id, err)
+		}
+	}
+	if g.patchDir == "" {
+		if err := g.SetPatchCacheDir(appDir(patchesDirectory, id)); err != nil {
+			log.Errorf("Could not isolate the patches of %s: %q", id, err)
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.apps[id] = g
+	return g
+}
+
+// AddTenant registers the application published on the given Github
+// repository under the ID "owner/repo", without disturbing the others.
+func (r *ReleaseManagerRegistry) AddTenant(owner string, repo string, opts ...Option) *ReleaseManager {
+	return r.AddApp(owner+"/"+repo, owner, repo, opts...)
+}
+
+// appDir returns the directory of the given application in dir, its ID
+// escaped so that it always names a single directory.
+func appDir(dir string, id string) string {
+	return filepath.Join(dir, "app-"+url.PathEscape(id))
+}
+
+// RemoveApp unregisters an application.
+func (r *ReleaseManagerRegistry) RemoveApp(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.apps, id)
+}
+
+// App returns the manager of the given application.
+func (r *ReleaseManagerRegistry) App(id string) (*ReleaseManager, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if g := r.apps[id]; g != nil {
+		return g, nil
+	}
+	return nil, &UnknownAppError{AppID: id}
+}
+
+// CheckForUpdate dispatches the update check to the given application's
+// manager, the one named by p.AppID if appID is empty. An *UnknownAppError,
+// matching ErrNoSuchApp, is returned for unknown applications.
+func (r *ReleaseManagerRegistry) CheckForUpdate(appID string, p *Params) (*Result, error) {
+	if appID == "" {
+		appID = p.AppID
+	}
+	g, err := r.App(appID)
+	if err != nil {
+		return nil, err
+	}
+	return g.CheckForUpdate(p)
+}
+
+// Refresh updates the assets of every application whose refresh interval has
+// elapsed, running up to the registry's number of workers at once.
+// Applications whose rate limit has not reset yet wait for it.
+func (r *ReleaseManagerRegistry) Refresh() error {
+	r.mu.RLock()
+	due := make(map[string]*ReleaseManager)
+	for id, g := range r.apps {
+		g.mu.RLock()
+		interval := g.refreshInterval
+		g.mu.RUnlock()
+		if time.Since(g.LastRefresh()) >= interval && time.Now().After(g.RateLimitedUntil()) {
+			due[id] = g
+		}
+	}
+	r.mu.RUnlock()
+	return r.refresh(due)
+}
+
+// UpdateAssetsMap updates the assets of every application right away, however
+// recently they were refreshed, like Refresh does.
+func (r *ReleaseManagerRegistry) UpdateAssetsMap() error {
+	r.mu.RLock()
+	all := make(map[string]*ReleaseManager, len(r.apps))
+	for id, g := range r.apps {
+		all[id] = g
+	}
+	r.mu.RUnlock()
+	return r.refresh(all)
+}
+
+// refresh updates the assets of the given applications with the registry's
+// workers.
+func (r *ReleaseManagerRegistry) refresh(due map[string]*ReleaseManager) error {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	failed := 0
+	work := make(chan string)
+
+	for i := 0; i < r.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range work {
+				if err := due[id].UpdateAssetsMap(); err != nil {
+					log.Errorf("Could not refresh %s: %q", id, err)
+					mu.Lock()
+					failed++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	for id := range due {
+		work <- id
+	}
+	close(work)
+	wg.Wait()
+
+	if failed > 0 {
+		return fmt.Errorf("Could not refresh %d out of %d applications.", failed, len(due))
+	}
+	return nil
+}
+
+// Run refreshes applications as they become due, checking every tick, until
+// stop is closed.
+func (r *ReleaseManagerRegistry) Run(tick time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(tick)
+	defer t.Stop()
+	for {
+		if err := r.Refresh(); err != nil {
+			log.Debugf("Refresh: %s", err)
+		}
+		select {
+		case <-t.C:
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReleaseManagerRegistry(t *testing.T) {
+	setTestPrivateKey(t)
+
+	files := newTestAssetServer(map[string]string{"/autoupdate-binary-linux-amd64": "registry linux binary"})
+	defer files.Close()
+
+	releases := fmt.Sprintf(`[{"id": 1, "tag_name": "1.0.0", "zipball_url": "%s/1.0.0.zip", "assets": [
+		{"id": 10, "name": "autoupdate-binary-linux-amd64", "browser_download_url": "%s/autoupdate-binary-linux-amd64"}
+	]}]`, files.URL, files.URL)
+
+	var running, maxRunning, hits int32
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+				break
+			}
+		}
+		atomic.AddInt32(&hits, 1)
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte(releases))
+	}))
+	defer api.Close()
+
+	r := NewReleaseManagerRegistry(2)
+	for i := 0; i < 5; i++ {
+		r.AddApp(fmt.Sprintf("app-%d", i), "getlantern", fmt.Sprintf("app-%d", i), WithBaseURL(api.URL))
+	}
+
+	if err := r.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&hits) != 5 {
+		t.Fatalf("Expecting every app to be refreshed, got %d", hits)
+	}
+	if atomic.LoadInt32(&maxRunning) > 2 {
+		t.Fatalf("Expecting at most 2 concurrent refreshes, got %d", maxRunning)
+	}
+
+	// Nothing is due right after a refresh.
+	if err := r.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&hits) != 5 {
+		t.Fatalf("Expecting no refresh before the interval elapses, got %d", hits)
+	}
+
+	params := func() *Params {
+		return &Params{AppVersion: "0.1.0", OS: OS.Linux, Arch: Arch.X64, Checksum: "unknown"}
+	}
+
+	res, err := r.CheckForUpdate("app-3", params())
+	if err != nil && !errors.Is(err, ErrUnknownVersion) {
+		t.Fatal(err)
+	}
+	if res.Version != "1.0.0" {
+		t.Fatalf("Expecting version 1.0.0, got %v", res.Version)
+	}
+
+	if _, err = r.CheckForUpdate("unknown", params()); !errors.Is(err, ErrNoSuchApp) {
+		t.Fatalf("Expecting ErrNoSuchApp, got %q", err)
+	}
+
+	// Lookups stay safe while apps come and go.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				id := fmt.Sprintf("extra-%d-%d", i, j)
+				r.AddApp(id, "getlantern", id, WithBaseURL(api.URL))
+				r.CheckForUpdate("app-0", params())
+				r.RemoveApp(id)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	r.RemoveApp("app-3")
+	if _, err = r.CheckForUpdate("app-3", params()); !errors.Is(err, ErrNoSuchApp) {
+		t.Fatalf("Expecting ErrNoSuchApp after removal, got %q", err)
+	}
+}
+
+func TestReleaseManagerRegistryTenants(t *testing.T) {
+	setTestPrivateKey(t)
+
+	files := newTestAssetServer(map[string]string{
+		"/a/autoupdate-binary-linux-amd64": "tenant a linux binary",
+		"/b/autoupdate-binary-linux-amd64": "tenant b linux binary",
+	})
+	defer files.Close()
+
+	var hits int32
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		// Each repository publishes a version of its own.
+		tenant, version := "a", "1.0.0"
+		if strings.Contains(r.URL.Path, "/tenant-b/") {
+			tenant, version = "b", "2.0.0"
+		}
+		fmt.Fprintf(w, `[{"id": 1, "tag_name": "%[2]s", "zipball_url": "%[1]s/%[2]s.zip", "assets": [
+			{"id": 10, "name": "autoupdate-binary-linux-amd64", "browser_download_url": "%[1]s/%[3]s/autoupdate-binary-linux-amd64"}
+		]}]`, files.URL, version, tenant)
+	}))
+	defer api.Close()
+
+	r := NewReleaseManagerRegistry(0)
+	a := r.AddTenant("getlantern", "tenant-a", WithBaseURL(api.URL))
+	if err := r.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tenants come in without a restart, refreshes cover all of them however
+	// recent the last one.
+	b := r.AddTenant("getlantern", "tenant-b", WithBaseURL(api.URL))
+	for _, g := range []*ReleaseManager{a, b} {
+		dirs := []string{g.DownloadDir(), g.PatchCacheDir()}
+		t.Cleanup(func() {
+			for _, dir := range dirs {
+				os.RemoveAll(dir)
+			}
+		})
+	}
+	if err := r.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&hits); n != 3 {
+		t.Fatalf("Expecting every tenant to be refreshed on each call, got %d releases requests", n)
+	}
+
+	if a.PatchCacheDir() == b.PatchCacheDir() || a.DownloadDir() == b.DownloadDir() {
+		t.Fatalf("Expecting tenants to keep their files apart, got %s and %s", a.PatchCacheDir(), b.PatchCacheDir())
+	}
+	if filepath.Dir(a.PatchCacheDir()) != filepath.Clean(patchesDirectory) {
+		t.Fatalf("Expecting the tenant patches in a single directory under %s, got %s", patchesDirectory, a.PatchCacheDir())
+	}
+
+	check := func(appID string) (*Result, error) {
+		return r.CheckForUpdate("", &Params{AppID: appID, AppVersion: "0.1.0", OS: OS.Linux, Arch: Arch.X64, Checksum: "unknown"})
+	}
+	for id, version := range map[string]string{"getlantern/tenant-a": "1.0.0", "getlantern/tenant-b": "2.0.0"} {
+		res, err := check(id)
+		if err != nil && !errors.Is(err, ErrUnknownVersion) {
+			t.Fatal(err)
+		}
+		if res.Version != version {
+			t.Fatalf("Expecting %s to be offered %s, got %s", id, version, res.Version)
+		}
+	}
+
+	_, err := check("getlantern/tenant-c")
+	var unknown *UnknownAppError
+	if !errors.As(err, &unknown) || unknown.AppID != "getlantern/tenant-c" || !errors.Is(err, ErrNoSuchApp) {
+		t.Fatalf("Expecting an unknown app error for tenant-c, got %v", err)
+	}
+
+	// Options still choose where files go.
+	dir := t.TempDir()
+	c := r.AddApp("c", "getlantern", "tenant-c", WithBaseURL(api.URL), func(g *ReleaseManager) { g.patchDir = dir })
+	t.Cleanup(func() { os.RemoveAll(c.DownloadDir()) })
+	if c.PatchCacheDir() != dir {
+		t.Fatalf("Expecting the patch directory given by options, got %s", c.PatchCacheDir())
+	}
+}
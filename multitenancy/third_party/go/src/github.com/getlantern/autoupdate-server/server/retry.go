@@ -0,0 +1,173 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+// Listing releases is retried a few times, a short blip from github must not
+// leave the assets stale until the next refresh.
+var defaultReleasesRetryPolicy = RetryPolicy{
+	Attempts:   3,
+	Backoff:    time.Second,
+	MaxElapsed: 30 * time.Second,
+	Jitter:     0.2,
+}
+
+// backoff returns the wait before the given retry, from 1.
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < retry && d < time.Hour; i++ {
+		d *= 2
+	}
+	if p.Jitter > 0 {
+		d -= time.Duration(rand.Float64() * p.Jitter * float64(d))
+	}
+	return d
+}
+
+// retry calls try until it succeeds, fails for good or policy gives up,
+// returning its last error. try tells whether its error is worth another try
+// and how long the server asked to wait before it, if anything. onRetry is
+// told about each retry before waiting for it.
+func retry(ctx context.Context, policy RetryPolicy, try func() (temporary bool, after time.Duration, err error), onRetry func(attempt int, wait time.Duration, err error)) error {
+	attempts := policy.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	start := time.Now()
+
+	for attempt := 1; ; attempt++ {
+		temporary, after, err := try()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !temporary || attempt >= attempts {
+			return err
+		}
+
+		wait := policy.backoff(attempt)
+		if after > wait {
+			wait = after
+		}
+		if policy.MaxElapsed > 0 && time.Since(start)+wait > policy.MaxElapsed {
+			return err
+		}
+		onRetry(attempt+1, wait, err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// statusError is an unexpected HTTP response status.
+type statusError struct {
+	msg        string
+	code       int
+	retryAfter time.Duration // as asked by the server, zero if it didn't
+}
+
+func newStatusError(res *http.Response, msg string) *statusError {
+	return &statusError{msg: msg, code: res.StatusCode, retryAfter: retryAfter(res.Header)}
+}
+
+func (e *statusError) Error() string {
+	return e.msg
+}
+
+// temporaryStatus tells whether a request answered with code may succeed if
+// tried again later.
+func temporaryStatus(code int) bool {
+	return code >= 500 || code == http.StatusTooManyRequests || code == http.StatusRequestTimeout
+}
+
+// retryAfter returns the wait asked by the Retry-After header, in seconds or
+// as a date, zero if there is none.
+func retryAfter(h http.Header) time.Duration {
+	v := h.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	if s, err := strconv.Atoi(v); err == nil && s > 0 {
+		return time.Duration(s) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil && time.Until(t) > 0 {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// temporaryError tells whether a request that failed with err may succeed if
+// tried again, and how long the server asked to wait before that. Missing
+// resources, bad credentials and exhausted rate limits are not worth it.
+func temporaryError(err error) (bool, time.Duration) {
+	var se *statusError
+	var rl *RateLimitError
+	var ge *github.ErrorResponse
+	var ne net.Error
+
+	// Transports like the registry one fail requests for their own reasons,
+	// only the network is worth another try.
+	var ue *url.Error
+	if errors.As(err, &ue) {
+		err = ue.Err
+	}
+
+	switch {
+	case err == nil:
+		return false, 0
+	case errors.As(err, &se):
+		return temporaryStatus(se.code), se.retryAfter
+	case errors.As(err, &rl):
+		return rl.RetryAfter > 0, rl.RetryAfter
+	case errors.As(err, &ge):
+		return temporaryStatus(ge.Response.StatusCode), retryAfter(ge.Response.Header)
+	case errors.As(err, &ne), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return true, 0
+	}
+	return false, 0
+}
+
+// SetReleasesRetryPolicy sets how listing releases is retried after a
+// transient failure, three tries over at most thirty seconds by default.
+func (g *ReleaseManager) SetReleasesRetryPolicy(policy RetryPolicy) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.listRetry = policy
+}
+
+// listReleases lists the releases from the provider, only if they changed
+// since the given validators when it can tell, retrying transient failures.
+func (g *ReleaseManager) listReleases(ctx context.Context, since releasesValidator) (rs []Release, validator releasesValidator, err error) {
+	g.mu.RLock()
+	policy := g.listRetry
+	g.mu.RUnlock()
+
+	err = retry(ctx, policy, func() (bool, time.Duration, error) {
+		var err error
+		if cp, ok := g.provider.(conditionalProvider); ok {
+			rs, validator, err = cp.releasesSince(ctx, since)
+		} else {
+			rs, err = g.provider.Releases(ctx)
+		}
+		temporary, after := temporaryError(err)
+		return temporary, after, err
+	}, func(attempt int, wait time.Duration, err error) {
+		g.logger.Warn("Retrying releases request", "attempt", attempt, "backoff", wait, "err", err)
+	})
+	return rs, validator, err
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetry(t *testing.T) {
+	// The releases list fails twice and comes through on the third try, the
+	// second failure asking for a wait.
+	var listed int32
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt32(&listed, 1) {
+		case 1:
+			http.Error(w, "unavailable", http.StatusBadGateway)
+		case 2:
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, `{"message": "You have exceeded a secondary rate limit"}`, http.StatusForbidden)
+		default:
+			w.Write([]byte(`[{"id": 1, "tag_name": "1.0.0", "zipball_url": "http://example.com/1.0.0.zip"}]`))
+		}
+	}))
+	defer api.Close()
+
+	logger := &testLogger{}
+	g := NewReleaseManager("getlantern", "autoupdate-server", WithLogger(logger))
+	useTestGitHub(t, g, api)
+
+	start := time.Now()
+	rs, err := g.GetReleases()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rs) != 1 || listed != 3 {
+		t.Fatalf("Expecting the releases on the third try, got %d releases after %d tries", len(rs), listed)
+	}
+	if time.Since(start) < time.Second {
+		t.Fatal("Expecting Retry-After to be honored.")
+	}
+	if n := logger.count("WARN", "Retrying releases request"); n != 2 {
+		t.Fatalf("Expecting two retries to be logged, got %d in %q", n, logger.entries)
+	}
+
+	// Missing repositories and bad credentials fail right away.
+	for status, want := range map[int]error{http.StatusNotFound: nil, http.StatusUnauthorized: ErrUnauthorized} {
+		var tries int32
+		api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&tries, 1)
+			http.Error(w, `{"message": "Nope"}`, status)
+		}))
+		useTestGitHub(t, g, api)
+		err := g.UpdateAssetsMap()
+		api.Close()
+		if err == nil || want != nil && !errors.Is(err, want) {
+			t.Fatalf("Expecting a %d to fail the refresh, got %v", status, err)
+		}
+		if tries != 1 {
+			t.Fatalf("Expecting a %d not to be retried, got %d tries", status, tries)
+		}
+	}
+
+	// Downloads too, past a dropped connection and an overloaded server.
+	var fetched int32
+	files := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt32(&fetched, 1) {
+		case 1:
+			panic(http.ErrAbortHandler)
+		case 2:
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+		default:
+			w.Write([]byte("flaky asset"))
+		}
+	}))
+	defer files.Close()
+
+	policy := RetryPolicy{Attempts: 3, Backoff: time.Millisecond, Jitter: 0.5}
+	if _, err = downloadAssetRetry(context.Background(), http.DefaultClient, files.URL+"/"+t.Name(), "", policy); err != nil {
+		t.Fatal(err)
+	}
+	if fetched != 3 {
+		t.Fatalf("Expecting the asset on the third try, got %d tries", fetched)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	h := http.Header{}
+	if d := retryAfter(h); d != 0 {
+		t.Fatalf("Expecting no wait without the header, got %v", d)
+	}
+	h.Set("Retry-After", "120")
+	if d := retryAfter(h); d != 2*time.Minute {
+		t.Fatalf("Expecting two minutes, got %v", d)
+	}
+	h.Set("Retry-After", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	if d := retryAfter(h); d < 59*time.Minute || d > time.Hour {
+		t.Fatalf("Expecting about an hour, got %v", d)
+	}
+
+	// Jitter only ever shortens the wait.
+	policy := RetryPolicy{Backoff: time.Second, Jitter: 0.5}
+	for i := 0; i < 100; i++ {
+		if d := policy.backoff(3); d <= 2*time.Second || d > 4*time.Second {
+			t.Fatalf("Expecting the third wait within 2s and 4s, got %v", d)
+		}
+	}
+}
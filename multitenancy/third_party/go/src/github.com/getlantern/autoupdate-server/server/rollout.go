@@ -0,0 +1,110 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+
+	"github.com/blang/semver"
+)
+
+// SetRollout stages the rollout of a version: only the given percentage of
+// clients, picked by their instance ID, are offered it and the others keep
+// getting the version they would have before it was released. Raising the
+// percentage keeps the clients already in the rollout there, 100 offers the
+// version to everyone. A negative percentage removes the setting, falling back
+// to the "Rollout: 10%" line of the release notes, if any.
+func (g *ReleaseManager) SetRollout(version string, percent float64) error {
+	v, err := parseVersion(version)
+	if err != nil {
+		return err
+	}
+	if percent > 100 {
+		return fmt.Errorf("Rollout percentage %v is over 100.", percent)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if percent < 0 {
+		delete(g.rollouts, v.String())
+	} else {
+		g.rollouts[v.String()] = percent
+	}
+	return nil
+}
+
+// Rollout returns the percentage of clients the given version is offered to.
+func (g *ReleaseManager) Rollout(version string) (float64, error) {
+	v, err := parseVersion(version)
+	if err != nil {
+		return 0, err
+	}
+
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.rolloutPercent(v), nil
+}
+
+// rolloutPercent returns the percentage of clients v is offered to, g.mu must
+// be held.
+func (g *ReleaseManager) rolloutPercent(v semver.Version) float64 {
+	if percent, ok := g.rollouts[v.String()]; ok {
+		return percent
+	}
+	if percent, ok := g.releaseRollouts[v.String()]; ok {
+		return percent
+	}
+	return 100
+}
+
+// servable tells whether v may be offered to the client with the given
+// instance ID, g.mu must be held. Clients with no instance ID are always in
+// the rollout.
+func (g *ReleaseManager) servable(v semver.Version, instanceID string) bool {
+	if g.yanked[v.String()] {
+		return false
+	}
+	return inRollout(v, instanceID, g.rolloutPercent(v))
+}
+
+// RolloutBucket tells whether the client with the given instance ID would be
+// offered version while it's rolled out to the given percentage of clients,
+// as CheckForUpdate decides. Nothing is changed, so assignments can be
+// checked before setting a rollout.
+func RolloutBucket(version string, instanceID string, percent float64) (bool, error) {
+	v, err := parseVersion(version)
+	if err != nil {
+		return false, err
+	}
+	return inRollout(v, instanceID, percent), nil
+}
+
+// inRollout tells whether the client with the given instance ID is among the
+// given percentage of clients v is rolled out to.
+func inRollout(v semver.Version, instanceID string, percent float64) bool {
+	if instanceID == "" {
+		return true
+	}
+	return percent >= 100 || rolloutBucket(v, instanceID) < percent
+}
+
+// rolloutBucket places a client in [0, 100) for the rollout of v. The same
+// client always lands in the same place for a version, the version is mixed
+// in so the same clients aren't the first to get every release.
+func rolloutBucket(v semver.Version, instanceID string) float64 {
+	sum := sha256.Sum256([]byte(v.String() + "/" + instanceID))
+	return float64(binary.BigEndian.Uint64(sum[:8])) / (1 << 64) * 100
+}
+
+// parseRollout parses a rollout percentage from release notes.
+func parseRollout(s string) (float64, error) {
+	percent, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if percent < 0 || percent > 100 {
+		return 0, fmt.Errorf("Rollout percentage %v is out of range.", percent)
+	}
+	return percent, nil
+}
@@ -0,0 +1,286 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newTestRollout returns a manager offering 1.1.0, staged at 20% by its
+// release notes, to clients running 1.0.0, a func telling whether the given
+// client is offered it and one closing the test servers.
+func newTestRollout(t *testing.T) (*ReleaseManager, func(instanceID string) bool, func()) {
+	setTestPrivateKey(t)
+
+	files := newTestAssetServer(map[string]string{
+		"/1.0.0": "rollout 1.0.0",
+		"/1.1.0": "rollout 1.1.0",
+	})
+
+	api := newTestReleasesAPI(fmt.Sprintf(`[
+		{"id": 2, "tag_name": "1.1.0", "body": "Staged.\r\nRollout: 20%%\r\n", "zipball_url": "%s/1.1.0.zip", "assets": [
+			{"id": 20, "name": "autoupdate-binary-linux-amd64", "browser_download_url": "%s/1.1.0"}
+		]},
+		{"id": 1, "tag_name": "1.0.0", "zipball_url": "%s/1.0.0.zip", "assets": [
+			{"id": 10, "name": "autoupdate-binary-linux-amd64", "browser_download_url": "%s/1.0.0"}
+		]}
+	]`, files.URL, files.URL, files.URL, files.URL))
+
+	g := NewReleaseManager("getlantern", "autoupdate-server")
+	useTestGitHub(t, g, api)
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+
+	offered := func(instanceID string) bool {
+		res, err := g.CheckForUpdate(&Params{
+			AppVersion: "1.0.0",
+			OS:         OS.Linux,
+			Arch:       Arch.X64,
+			Checksum:   "unknown",
+			InstanceID: instanceID,
+		})
+		if err == ErrNoUpdateAvailable {
+			return false
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Version != "1.1.0" {
+			t.Fatalf("Expecting an update to 1.1.0, got %+v", res)
+		}
+		return true
+	}
+
+	return g, offered, func() {
+		api.Close()
+		files.Close()
+	}
+}
+
+func TestRollout(t *testing.T) {
+	g, offered, done := newTestRollout(t)
+	defer done()
+
+	if percent, _ := g.Rollout("1.1.0"); percent != 20 {
+		t.Fatalf("Expecting the release notes to set a 20%% rollout, got %v", percent)
+	}
+
+	const clients = 500
+	cohort := func() map[int]bool {
+		in := make(map[int]bool)
+		for i := 0; i < clients; i++ {
+			if offered(fmt.Sprintf("instance-%d", i)) {
+				in[i] = true
+			}
+		}
+		return in
+	}
+
+	first := cohort()
+	if len(first) < clients/10 || len(first) > clients*3/10 {
+		t.Fatalf("Expecting about 20%% of the clients in the rollout, got %d of %d", len(first), clients)
+	}
+	for i := range cohort() {
+		if !first[i] {
+			t.Fatalf("Expecting instance-%d to stay on the same side of the rollout.", i)
+		}
+	}
+
+	if !offered("") {
+		t.Fatal("Expecting clients with no instance ID to be in the rollout.")
+	}
+
+	// Ramping up keeps the clients already updated.
+	if err := g.SetRollout("1.1.0", 50); err != nil {
+		t.Fatal(err)
+	}
+	second := cohort()
+	if len(second) <= len(first) {
+		t.Fatalf("Expecting more clients at 50%%, got %d", len(second))
+	}
+	for i := range first {
+		if !second[i] {
+			t.Fatalf("Expecting instance-%d to stay in the rollout.", i)
+		}
+	}
+
+	if err := g.SetRollout("1.1.0", 100); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(cohort()); n != clients {
+		t.Fatalf("Expecting every client at 100%%, got %d", n)
+	}
+
+	// On hold, clients running a yanked version still get it.
+	if err := g.SetRollout("1.1.0", 0); err != nil {
+		t.Fatal(err)
+	}
+	if offered("instance-1") {
+		t.Fatal("Expecting no client at 0%.")
+	}
+	if err := g.SetYanked("1.0.0", true); err != nil {
+		t.Fatal(err)
+	}
+	if !offered("instance-1") {
+		t.Fatal("Expecting clients running a yanked version to bypass the rollout.")
+	}
+
+	// Removing the setting brings back the release notes.
+	if err := g.SetRollout("1.1.0", -1); err != nil {
+		t.Fatal(err)
+	}
+	if percent, _ := g.Rollout("1.1.0"); percent != 20 {
+		t.Fatalf("Expecting the release notes rollout back, got %v", percent)
+	}
+	if err := g.SetRollout("1.1.0", 101); err == nil {
+		t.Fatal("Expecting percentages over 100 to be rejected.")
+	}
+}
+
+func TestRolloutBucket(t *testing.T) {
+	g, offered, done := newTestRollout(t)
+	defer done()
+
+	if err := g.SetRollout("1.1.0", 30); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 200; i++ {
+		id := fmt.Sprintf("instance-%d", i)
+		in, err := RolloutBucket("1.1.0", id, 30)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if in != offered(id) {
+			t.Fatalf("Expecting RolloutBucket to agree with CheckForUpdate for %s.", id)
+		}
+	}
+	if _, err := RolloutBucket("not a version", "instance-1", 30); err == nil {
+		t.Fatal("Expecting a bad version to be rejected.")
+	}
+
+	// Simulating another percentage leaves the live rollout alone.
+	h := NewRolloutHandler(g)
+	for i := 0; i < 20; i++ {
+		id := fmt.Sprintf("instance-%d", i)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/admin/rollout?version=1.1.0&percent=60&instance_id="+id, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expecting 200 OK, got %d", rec.Code)
+		}
+		var body rolloutBody
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if in, _ := RolloutBucket("1.1.0", id, 60); body.InRollout != in || body.Percent != 60 {
+			t.Fatalf("Expecting the simulated assignment, got %+v", body)
+		}
+	}
+	if percent, _ := g.Rollout("1.1.0"); percent != 30 {
+		t.Fatalf("Expecting the rollout to stay at 30%%, got %v", percent)
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/admin/rollout?version=1.1.0", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expecting 400 without an instance ID, got %d", rec.Code)
+	}
+}
+
+func TestRolloutPreviousLatest(t *testing.T) {
+	setTestPrivateKey(t)
+
+	files := newTestAssetServer(map[string]string{
+		"/1.0.0": "staged 1.0.0",
+		"/1.1.0": "staged 1.1.0",
+		"/1.2.0": "staged 1.2.0",
+	})
+	defer files.Close()
+
+	api := newTestReleasesAPI(fmt.Sprintf(`[
+		{"id": 3, "tag_name": "1.2.0", "body": "rollout: 25", "zipball_url": "%[1]s/1.2.0.zip", "assets": [
+			{"id": 30, "name": "autoupdate-binary-linux-amd64", "browser_download_url": "%[1]s/1.2.0"}
+		]},
+		{"id": 2, "tag_name": "1.1.0", "zipball_url": "%[1]s/1.1.0.zip", "assets": [
+			{"id": 20, "name": "autoupdate-binary-linux-amd64", "browser_download_url": "%[1]s/1.1.0"}
+		]},
+		{"id": 1, "tag_name": "1.0.0", "zipball_url": "%[1]s/1.0.0.zip", "assets": [
+			{"id": 10, "name": "autoupdate-binary-linux-amd64", "browser_download_url": "%[1]s/1.0.0"}
+		]}
+	]`, files.URL))
+	defer api.Close()
+
+	g := NewReleaseManager("getlantern", "autoupdate-server")
+	useTestGitHub(t, g, api)
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+	if percent, _ := g.Rollout("1.2.0"); percent != 25 {
+		t.Fatalf("Expecting a lowercase rollout line to stage 1.2.0 at 25%%, got %v", percent)
+	}
+
+	offered := func(version string, instanceID string) string {
+		res, err := g.CheckForUpdate(&Params{
+			AppVersion: version,
+			OS:         OS.Linux,
+			Arch:       Arch.X64,
+			Checksum:   "unknown",
+			InstanceID: instanceID,
+		})
+		if err == ErrNoUpdateAvailable {
+			return ""
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.Version
+	}
+
+	// Clients left out of the rollout get the previous latest, or nothing
+	// when they already run it.
+	const clients = 200
+	cohort := func() map[int]bool {
+		in := make(map[int]bool)
+		for i := 0; i < clients; i++ {
+			id := fmt.Sprintf("device-%d", i)
+			switch v := offered("1.0.0", id); v {
+			case "1.2.0":
+				in[i] = true
+				if got := offered("1.1.0", id); got != "1.2.0" {
+					t.Fatalf("Expecting %s to be offered 1.2.0 from 1.1.0 too, got %q", id, got)
+				}
+			case "1.1.0":
+				if got := offered("1.1.0", id); got != "" {
+					t.Fatalf("Expecting %s to get no update on 1.1.0, got %q", id, got)
+				}
+			default:
+				t.Fatalf("Expecting %s to be offered 1.2.0 or 1.1.0, got %q", id, v)
+			}
+		}
+		return in
+	}
+
+	first := cohort()
+	if len(first) == 0 || len(first) == clients {
+		t.Fatalf("Expecting 1.2.0 to be offered to some of the clients, got %d of %d", len(first), clients)
+	}
+
+	for _, percent := range []float64{40, 75, 100} {
+		if err := g.SetRollout("1.2.0", percent); err != nil {
+			t.Fatal(err)
+		}
+		next := cohort()
+		for i := range first {
+			if !next[i] {
+				t.Fatalf("Expecting device-%d to stay in the rollout at %v%%.", i, percent)
+			}
+		}
+		first = next
+	}
+	if len(first) != clients {
+		t.Fatalf("Expecting every client at 100%%, got %d", len(first))
+	}
+}
@@ -0,0 +1,382 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// How long presigned URLs handed to clients stay valid by default.
+	defaultS3PresignExpiry = 24 * time.Hour
+
+	s3Algorithm       = "AWS4-HMAC-SHA256"
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+	s3TimeFormat      = "20060102T150405Z"
+)
+
+// S3Store is a StreamStorage and an AssetLocator keeping values as objects of
+// an S3 compatible bucket, under an optional key prefix. As the storage of
+// several managers it lets them share the patches they generate, as their
+// asset store it has clients download patches from the bucket, at its public
+// URL or through presigned URLs.
+type S3Store struct {
+	endpoint     *url.URL
+	region       string
+	bucket       string
+	prefix       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	pathStyle    bool
+	publicURL    string
+	expiry       time.Duration
+	client       *http.Client
+	now          func() time.Time
+}
+
+// S3Option configures an S3Store when it's created.
+type S3Option func(*S3Store)
+
+// WithS3Credentials signs requests with the given access key, secret key and,
+// for temporary credentials, session token. Requests are anonymous without
+// them.
+func WithS3Credentials(accessKey string, secretKey string, sessionToken string) S3Option {
+	return func(s *S3Store) {
+		s.accessKey = accessKey
+		s.secretKey = secretKey
+		s.sessionToken = sessionToken
+	}
+}
+
+// WithS3Prefix stores every value under the given key prefix, like
+// "autoupdate/".
+func WithS3Prefix(prefix string) S3Option {
+	return func(s *S3Store) {
+		s.prefix = prefix
+	}
+}
+
+// WithS3PathStyle addresses the bucket in the request path rather than in the
+// host name, as most S3 compatible servers like MinIO want.
+func WithS3PathStyle() S3Option {
+	return func(s *S3Store) {
+		s.pathStyle = true
+	}
+}
+
+// WithS3PublicURL has clients download objects from the given base URL, a
+// public bucket or a CDN in front of it, followed by the object key. URLs are
+// presigned otherwise.
+func WithS3PublicURL(baseURL string) S3Option {
+	return func(s *S3Store) {
+		s.publicURL = strings.TrimSuffix(baseURL, "/")
+	}
+}
+
+// WithS3PresignExpiry sets how long presigned URLs stay valid, a day by
+// default. S3 takes at most a week.
+func WithS3PresignExpiry(d time.Duration) S3Option {
+	return func(s *S3Store) {
+		s.expiry = d
+	}
+}
+
+// WithS3HTTPClient sets the HTTP client used to talk to S3.
+func WithS3HTTPClient(c *http.Client) S3Option {
+	return func(s *S3Store) {
+		s.client = c
+	}
+}
+
+// NewS3Store returns a store for the given bucket of the S3 compatible
+// service at endpoint (https://s3.amazonaws.com) in region, e.g. "us-east-1".
+func NewS3Store(endpoint string, region string, bucket string, opts ...S3Option) (*S3Store, error) {
+	u, err := url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("Bad S3 endpoint %q", endpoint)
+	}
+	if bucket == "" {
+		return nil, errors.New("Missing S3 bucket")
+	}
+
+	s := &S3Store{
+		endpoint: u,
+		region:   region,
+		bucket:   bucket,
+		expiry:   defaultS3PresignExpiry,
+		client:   http.DefaultClient,
+		now:      time.Now,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s, nil
+}
+
+// Save puts value in the key's object.
+func (s *S3Store) Save(key string, value []byte) error {
+	return s.put(key, bytes.NewReader(value), int64(len(value)))
+}
+
+// SaveFrom puts what r yields in the key's object. S3 needs to know the size
+// up front, anything but a file is read in memory first.
+func (s *S3Store) SaveFrom(key string, r io.Reader) error {
+	if fp, ok := r.(*os.File); ok {
+		if fi, err := fp.Stat(); err == nil && fi.Mode().IsRegular() {
+			offset, err := fp.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return err
+			}
+			return s.put(key, fp, fi.Size()-offset)
+		}
+	}
+	value, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return s.Save(key, value)
+}
+
+// Load returns the contents of the key's object.
+func (s *S3Store) Load(key string) ([]byte, error) {
+	body, err := s.Open(key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return ioutil.ReadAll(body)
+}
+
+// Open returns the body of the key's object, to be closed by the caller.
+func (s *S3Store) Open(key string) (io.ReadCloser, error) {
+	res, err := s.do("GET", key, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.check(res); err != nil {
+		res.Body.Close()
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// Put stores what r yields under key, see SaveFrom, and returns the URL
+// clients download it from.
+func (s *S3Store) Put(key string, r io.Reader) (string, error) {
+	if err := s.SaveFrom(key, r); err != nil {
+		return "", err
+	}
+	return s.URL(key), nil
+}
+
+// Lookup tells whether the key's object exists and returns its URL.
+func (s *S3Store) Lookup(key string) (string, error) {
+	res, err := s.do("HEAD", key, nil, 0)
+	if err != nil {
+		return "", err
+	}
+	res.Body.Close()
+	if err = s.check(res); err != nil {
+		return "", err
+	}
+	return s.URL(key), nil
+}
+
+// Delete removes the key's object, deleting a missing one is no error.
+func (s *S3Store) Delete(key string) error {
+	res, err := s.do("DELETE", key, nil, 0)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if err = s.check(res); err != nil && err != ErrNotStored {
+		return err
+	}
+	return nil
+}
+
+// URL returns the address clients download the key's object from: under the
+// public URL if there is one, presigned otherwise.
+func (s *S3Store) URL(key string) string {
+	if s.publicURL != "" {
+		return s.publicURL + "/" + s3Escape(s.prefix+key, false)
+	}
+	return s.presign("GET", key, s.expiry)
+}
+
+// put uploads length bytes of body to the key's object.
+func (s *S3Store) put(key string, body io.Reader, length int64) error {
+	res, err := s.do("PUT", key, body, length)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return s.check(res)
+}
+
+// check turns an unsuccessful response into an error, ErrNotStored for a
+// missing object.
+func (s *S3Store) check(res *http.Response) error {
+	switch {
+	case res.StatusCode/100 == 2:
+		return nil
+	case res.StatusCode == http.StatusNotFound:
+		return ErrNotStored
+	case res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden:
+		return newStatusError(res, fmt.Sprintf("S3 rejected the credentials for bucket %s: %s", s.bucket, res.Status))
+	default:
+		return newStatusError(res, fmt.Sprintf("Expecting 2xx from S3 bucket %s, got: %s", s.bucket, res.Status))
+	}
+}
+
+// object returns the URL of the key's object.
+func (s *S3Store) object(key string) *url.URL {
+	u := *s.endpoint
+	path := "/" + s.prefix + key
+	if s.pathStyle {
+		path = "/" + s.bucket + path
+	} else {
+		u.Host = s.bucket + "." + u.Host
+	}
+	u.Path = strings.TrimSuffix(s.endpoint.Path, "/") + path
+	u.RawPath = strings.TrimSuffix(s.endpoint.EscapedPath(), "/") + s3Escape(path, false)
+	return &u
+}
+
+// do sends a signed request for the key's object. The payload is left
+// unsigned, so uploads stream without being hashed first.
+func (s *S3Store) do(method string, key string, body io.Reader, length int64) (*http.Response, error) {
+	u := s.object(key)
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = length
+		req.Header.Set("Content-Length", strconv.FormatInt(length, 10))
+	}
+
+	if s.accessKey != "" {
+		t := s.now().UTC()
+		req.Header.Set("X-Amz-Date", t.Format(s3TimeFormat))
+		req.Header.Set("X-Amz-Content-Sha256", s3UnsignedPayload)
+		if s.sessionToken != "" {
+			req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+		}
+
+		headers := map[string]string{
+			"host":                 u.Host,
+			"x-amz-content-sha256": s3UnsignedPayload,
+			"x-amz-date":           t.Format(s3TimeFormat),
+		}
+		if s.sessionToken != "" {
+			headers["x-amz-security-token"] = s.sessionToken
+		}
+		names := make([]string, 0, len(headers))
+		for name := range headers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		var canonical strings.Builder
+		for _, name := range names {
+			canonical.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+		}
+		signed := strings.Join(names, ";")
+
+		signature := s.signature(t, method, u.EscapedPath(), "", canonical.String(), signed)
+		req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s", s3Algorithm, s.accessKey, s.scope(t), signed, signature))
+	}
+
+	return s.client.Do(req)
+}
+
+// presign returns the URL of the key's object with the signature of a request
+// for it in its query string, valid for the given duration.
+func (s *S3Store) presign(method string, key string, expiry time.Duration) string {
+	u := s.object(key)
+	if s.accessKey == "" {
+		return u.String()
+	}
+
+	t := s.now().UTC()
+	query := map[string]string{
+		"X-Amz-Algorithm":     s3Algorithm,
+		"X-Amz-Credential":    s.accessKey + "/" + s.scope(t),
+		"X-Amz-Date":          t.Format(s3TimeFormat),
+		"X-Amz-Expires":       strconv.Itoa(int(expiry / time.Second)),
+		"X-Amz-SignedHeaders": "host",
+	}
+	if s.sessionToken != "" {
+		query["X-Amz-Security-Token"] = s.sessionToken
+	}
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	params := make([]string, len(keys))
+	for i, k := range keys {
+		params[i] = s3Escape(k, true) + "=" + s3Escape(query[k], true)
+	}
+	canonicalQuery := strings.Join(params, "&")
+
+	signature := s.signature(t, method, u.EscapedPath(), canonicalQuery, "host:"+u.Host+"\n", "host")
+	u.RawQuery = canonicalQuery + "&X-Amz-Signature=" + signature
+	return u.String()
+}
+
+// scope returns the credential scope of requests signed at t.
+func (s *S3Store) scope(t time.Time) string {
+	return t.Format("20060102") + "/" + s.region + "/s3/aws4_request"
+}
+
+// signature returns the AWS signature version 4 of the described request,
+// signed at t with an unsigned payload.
+func (s *S3Store) signature(t time.Time, method string, path string, query string, headers string, signed string) string {
+	request := strings.Join([]string{method, path, query, headers, signed, s3UnsignedPayload}, "\n")
+	sum := sha256.Sum256([]byte(request))
+	toSign := strings.Join([]string{s3Algorithm, t.Format(s3TimeFormat), s.scope(t), hex.EncodeToString(sum[:])}, "\n")
+
+	key := s3HMAC([]byte("AWS4"+s.secretKey), t.Format("20060102"))
+	for _, part := range []string{s.region, "s3", "aws4_request"} {
+		key = s3HMAC(key, part)
+	}
+	return hex.EncodeToString(s3HMAC(key, toSign))
+}
+
+func s3HMAC(key []byte, value string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes s the way AWS signatures want it, every byte but
+// the unreserved characters, slashes too if asked to.
+func s3Escape(s string, slash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '.', c == '_', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !slash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
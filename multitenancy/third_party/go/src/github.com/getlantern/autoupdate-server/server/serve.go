@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	unixScheme        = "unix://"
+	defaultSocketMode = 0660
+)
+
+// Server is an HTTP server for the update endpoints. Addr is either a TCP
+// address like ":6868" or a Unix socket like "unix:///run/autoupdate.sock".
+type Server struct {
+	Addr    string
+	Handler http.Handler
+
+	// SocketMode is the permission set on the socket file when listening on a
+	// Unix socket, 0660 if zero.
+	SocketMode os.FileMode
+
+	mu     sync.Mutex
+	srv    *http.Server
+	socket string
+}
+
+// Listen opens the listener for s.Addr. A stale socket file left behind by a
+// previous run is removed first.
+func (s *Server) Listen() (net.Listener, error) {
+	if !strings.HasPrefix(s.Addr, unixScheme) {
+		return net.Listen("tcp", s.Addr)
+	}
+
+	socket := strings.TrimPrefix(s.Addr, unixScheme)
+	if socket == "" {
+		return nil, fmt.Errorf("Missing socket path in %q", s.Addr)
+	}
+
+	if fi, err := os.Stat(socket); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("File %s exists and is not a socket.", socket)
+		}
+		if err = os.Remove(socket); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+
+	mode := s.SocketMode
+	if mode == 0 {
+		mode = defaultSocketMode
+	}
+	if err = os.Chmod(socket, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.socket = socket
+	s.mu.Unlock()
+
+	return l, nil
+}
+
+// Serve accepts connections on l until the server is closed.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	s.srv = &http.Server{Handler: s.Handler}
+	srv := s.srv
+	s.mu.Unlock()
+
+	err := srv.Serve(l)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// ListenAndServe listens on s.Addr and serves requests until the server is
+// closed.
+func (s *Server) ListenAndServe() error {
+	l, err := s.Listen()
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Shutdown gracefully stops the server and removes the socket file, if any.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	srv, socket := s.srv, s.socket
+	s.socket = ""
+	s.mu.Unlock()
+
+	var err error
+	if srv != nil {
+		err = srv.Shutdown(ctx)
+	}
+	if socket != "" {
+		if rerr := os.Remove(socket); rerr != nil && !os.IsNotExist(rerr) && err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
@@ -1,9 +1,13 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
 
-	"github.com/blang/semver"
 	"github.com/getlantern/golog"
 )
 
@@ -18,67 +22,211 @@ const (
 	INITIATIVE_MANUAL            = "manual"
 )
 
-// PatchType represents the type of a binary patch, if any. Only bsdiff is supported
+// PatchType represents the type of a binary patch, if any, see SetDiffer.
+// PATCHTYPE_NONE means the client should download the full binary from URL,
+// verifying it against Checksum and Signature.
 type PatchType string
 
 const (
-	PATCHTYPE_BSDIFF PatchType = "bsdiff"
-	PATCHTYPE_NONE             = ""
+	PATCHTYPE_BSDIFF  PatchType = "bsdiff"
+	PATCHTYPE_XDELTA3 PatchType = "xdelta3"
+	PATCHTYPE_NONE    PatchType = "none"
 )
 
+// UpdateType tells how a Result delivers the update.
+type UpdateType string
+
+const (
+	// The client downloads the complete binary from URL.
+	UPDATETYPE_FULL UpdateType = "full"
+	// The client applies the patch at PatchURL, or downloads URL.
+	UPDATETYPE_PATCH UpdateType = "patch"
+	// The client applies every patch of Patches in order, or downloads URL.
+	UPDATETYPE_CHAIN UpdateType = "chain"
+)
+
+// ChecksumType lists the digests clients can identify their binary with.
+// Asset checksums have always been SHA-256, the same digest go-update uses.
+// SHA-1 is still matched for older clients until SetAcceptSHA1(false).
+var ChecksumType = struct {
+	SHA256 string
+	SHA1   string
+}{
+	"sha256",
+	"sha1",
+}
+
 // Params represent parameters sent by the go-update client.
 type Params struct {
 	// protocol version
 	Version int `json:"version"`
-	// identifier of the application to update
-	//AppId string `json:"app_id"`
+	// identifier of the application to update, routes the check when served
+	// by a ReleaseManagerRegistry
+	AppID string `json:"app_id,omitempty"`
 
 	// version of the application updating itself
 	AppVersion string `json:"app_version"`
 	// operating system of target platform
 	OS string `json:"-"`
-	// hardware architecture of target platform
+	// hardware architecture of target platform ("aarch64" is taken as arm64,
+	// "armv6l" as armv6 and so on)
 	Arch string `json:"-"`
 	// application-level user identifier
 	//UserId string `json:"user_id"`
 	// checksum of the binary to replace (used for returning diff patches)
 	Checksum string `json:"checksum"`
+	// digest Checksum was computed with (empty string means 'sha256', or
+	// 'sha1' for a 40 digit checksum)
+	ChecksumType string `json:"checksum_type"`
+	// IDs of the signing keys the client can verify (empty means only the
+	// legacy signature)
+	TrustedKeys []string `json:"trusted_keys"`
 	// release channel (empty string means 'stable')
-	//Channel string `json:"-"`
+	Channel string `json:"channel"`
+	// stable identifier of the client installation, used for staged
+	// rollouts (empty string means always in the rollout)
+	InstanceID string `json:"instance_id"`
+	// identifier of the device, for support to serve it a given version
+	// with SetOverride
+	DeviceID string `json:"device_id"`
+	// ask for a chain of patches through every version in between instead of
+	// a single patch
+	PatchChain bool `json:"patch_chain"`
+	// types of patches the client can apply, in order of preference (empty
+	// means bsdiff only)
+	PatchTypes []PatchType `json:"patch_types"`
 	// tags for custom update channels
 	Tags map[string]string `json:"tags"`
+	// formats the client can install, by extension like "msix", in order of
+	// preference (empty means bare binaries, or whatever else is published)
+	Formats []string `json:"formats"`
+	// send the release notes of the new version along with the update
+	WantsReleaseNotes bool `json:"wants_release_notes"`
+	// encodings of the patch the client can decode before applying it, like
+	// "zstd" and "none" or "bzip2" (empty means only the bsdiff output as it
+	// is)
+	AcceptedCompression []string `json:"accepted_compression"`
+	// serve the full binary rather than a patch, as on metered connections
+	// where a resumable download beats a patch that can't resume
+	PreferFull bool `json:"prefer_full"`
+	// largest patch, or total of a chain, the client takes in bytes, larger
+	// ones are replaced by the full binary (zero means any size)
+	MaxPatchBytes int64 `json:"max_patch_bytes"`
+	// free disk space of the client in bytes, the update is delivered the
+	// way that fits in it (zero means unknown)
+	AvailableBytes int64 `json:"available_bytes"`
 }
 
-// Result represents the answer to be sent to the client.
+// Result represents the answer to be sent to the client. Every update sets
+// UpdateType, Initiative, URL, Size, Version, Checksum, SHA256, Signature and
+// Signatures, describing the complete new binary, URL being relative to the
+// server for private assets. Patch updates also set PatchURL, PatchType and
+// PatchSize, chains set Patches and PatchSize, the total of their steps.
+// Clients with PreferFull set, or whose MaxPatchBytes the patch is over, are
+// always served full updates, PatchUnavailable tells those served one because
+// no patch could be made. Clients sending AcceptedCompression are served
+// the smallest encoding of the patch they take, and told it in Compression
+// along with the PatchChecksum and PatchSignature of what they download.
+// Clients sending AvailableBytes are served whichever of the patch and the full
+// binary fits in it, even against PreferFull or a patch not worth it, and
+// fail with an *InsufficientSpaceError when neither does.
+// ReleaseNotes is only set for clients asking for it, when the release has
+// notes, along with the Changelog of every version since the client's, and
+// PublishedAt when the release provider tells it. No update is
+// ErrNoUpdateAvailable rather than a Result.
 type Result struct {
+	// how the update is delivered
+	UpdateType UpdateType `json:"update_type"`
 	// should the update be applied automatically/manually
 	Initiative Initiative `json:"initiative"`
 	// url where to download the updated application
 	URL string `json:"url"`
+	// size in bytes of the updated application, what a full update
+	// downloads, zero if unknown
+	Size int64 `json:"size,omitempty"`
 	// a URL to a patch to apply
 	PatchURL string `json:"patch_url"`
 	// the patch format (only bsdiff supported at the moment)
 	PatchType PatchType `json:"patch_type"`
+	// size in bytes of the patch, or of every patch of a chain
+	PatchSize int64 `json:"patch_size,omitempty"`
+	// how the patch is encoded, to be decoded before applying it
+	Compression string `json:"compression,omitempty"`
+	// SHA-256 of the patch as downloaded
+	PatchChecksum string `json:"patch_checksum,omitempty"`
+	// signature of PatchChecksum
+	PatchSignature string `json:"patch_signature,omitempty"`
 	// version of the new application
 	Version string `json:"version"`
 	// expected checksum of the new application
 	Checksum string `json:"checksum"`
+	// digest Checksum was computed with, always 'sha256'
+	ChecksumType string `json:"checksum_type"`
+	// SHA-256 of the new application
+	SHA256 string `json:"sha256"`
 	// signature for verifying update authenticity
 	Signature string `json:"signature"`
+	// ID of the key Signature and PatchSignature were made with, empty for
+	// the legacy key
+	SignatureKeyID string `json:"signature_key_id,omitempty"`
+	// signatures by the trusted keys of the client, keyed by key ID
+	Signatures map[string]string `json:"signatures,omitempty"`
+	// patches to apply in order, when the client asked for a chain (replaces
+	// PatchURL)
+	Patches []PatchStep `json:"patches,omitempty"`
+	// the client must apply the update, it is running a yanked version or
+	// one below the minimum version
+	Mandatory bool `json:"mandatory"`
+	// no patch could be made for the client, as when the binary it runs was
+	// deleted from the release, it was served the full binary instead
+	PatchUnavailable bool `json:"patch_unavailable,omitempty"`
+	// the new version is older than the client's, as when the release it
+	// runs was taken down, clients may want to confirm before applying it
+	Downgrade bool `json:"downgrade,omitempty"`
+	// release notes of the new version, possibly truncated
+	ReleaseNotes string `json:"release_notes,omitempty"`
+	// notes of every version after the client's up to the new one, oldest
+	// first
+	Changelog []ReleaseNote `json:"changelog,omitempty"`
+	// the oldest versions or notes were left out of Changelog for its size
+	ChangelogTruncated bool `json:"changelog_truncated,omitempty"`
+	// when the new version was released, if known
+	PublishedAt time.Time `json:"published_at,omitzero"`
 }
 
 // CheckForUpdate receives a *Params message and emits a *Result. If both res
-// and err are nil it means no update is available.
+// and err are nil it means no update is available. A non-nil res may come
+// along with an error matching ErrPatchUnavailable, when no patch could be
+// made, or ErrUnknownVersion, when neither the client's checksum nor its
+// version match a known asset: res is then the full update, still to be
+// served.
 func (g *ReleaseManager) CheckForUpdate(p *Params) (res *Result, err error) {
+	return g.CheckForUpdateContext(context.Background(), p)
+}
 
-	// Keep for the future.
-	if p.Version < 1 {
-		p.Version = 1
-	}
+// CheckForUpdateContext is like CheckForUpdate, cancelling ctx aborts preparing
+// the patch. When ctx is done the error wraps ctx.Err(), telling the stage that
+// did not finish in time.
+func (g *ReleaseManager) CheckForUpdateContext(ctx context.Context, p *Params) (res *Result, err error) {
 
 	// p must not be nil.
 	if p == nil {
-		return nil, fmt.Errorf("Expecting params")
+		return nil, &ParamsError{"Expecting params"}
+	}
+
+	defer func() {
+		outcome := checkOutcome(res, err)
+		g.metrics.UpdateCheck(p.OS, p.Arch, outcome)
+		g.logCheck(p, outcome, res, err)
+	}()
+
+	if m := g.inMaintenance(false); m != nil {
+		return nil, m
+	}
+
+	// Keep for the future.
+	if p.Version < 1 {
+		p.Version = 1
 	}
 
 	if p.Tags != nil {
@@ -90,71 +238,381 @@ func (g *ReleaseManager) CheckForUpdate(p *Params) (res *Result, err error) {
 			p.Arch = p.Tags["arch"]
 		}
 	}
+	p.Arch = g.platformArch(p.OS, normalizeArch(p.Arch))
 
-	appVersion, err := semver.Parse(p.AppVersion)
-	if err != nil {
-		return nil, fmt.Errorf("Bad version string: %v", err)
-	}
+	appVersion, versionErr := parseVersion(p.AppVersion)
 
 	if p.Checksum == "" {
-		return nil, fmt.Errorf("Checksum must not be nil")
+		return nil, &ParamsError{"Checksum must not be nil"}
+	}
+
+	switch p.ChecksumType {
+	case "", ChecksumType.SHA256:
+	case ChecksumType.SHA1:
+		if !g.acceptsSHA1() {
+			return nil, &ParamsError{"SHA-1 checksums are no longer accepted"}
+		}
+	default:
+		return nil, &ParamsError{fmt.Sprintf("Unsupported checksum type %q", p.ChecksumType)}
 	}
 
 	if p.OS == "" {
-		return nil, fmt.Errorf("OS is required")
+		return nil, &ParamsError{"OS is required"}
 	}
 
 	if p.Arch == "" {
-		return nil, fmt.Errorf("Arch is required")
+		return nil, &ParamsError{"Arch is required"}
+	}
+
+	if err = g.platformEOL(p.OS, p.Arch); err != nil {
+		return nil, err
 	}
 
-	// Looking if there is a newer version for the os/arch.
+	if g.adoption != nil {
+		if versionErr == nil {
+			g.adoption.record(p.AppVersion, p.OS, p.Arch)
+		} else {
+			g.adoption.record(AdoptionOther, p.OS, p.Arch)
+		}
+	}
+
+	// The checksum may tell another version than the client does.
+	var base *Asset
+	var pinned bool
+	if versionErr == nil {
+		if appVersion, base, pinned, err = g.resolveVersionMismatch(p, appVersion); err != nil {
+			return nil, err
+		}
+	}
+
+	// Clients below the minimum version must update to the full binary,
+	// those whose version can't be told are assumed to be.
+	floor, hasFloor := g.minimumVersion(p.OS, p.Arch)
+	if versionErr != nil && !hasFloor {
+		return nil, &AppVersionError{AppVersion: p.AppVersion, Err: versionErr}
+	}
+	belowFloor := hasFloor && (versionErr != nil || appVersion.LT(floor))
+
+	if p.Channel == "" {
+		p.Channel = Channel.Stable
+	}
+
+	defer func() {
+		if res != nil || errors.Is(err, ErrNoUpdateAvailable) {
+			g.recordCheck(p, appVersion.String(), res)
+		}
+	}()
+
+	// Clients running a yanked version must move to the latest good one, no
+	// matter how it compares to theirs.
+	yanked := versionErr == nil && g.isYanked(appVersion)
+	mandatory := yanked || belowFloor
+
+	// Clients running a release taken down are offered the latest one even
+	// if older, its binary is likely gone to patch from.
+	withdrawn := versionErr == nil && g.isWithdrawn(appVersion, p.Checksum)
+
+	// Clients that must update don't wait for a staged rollout.
+	instanceID := p.InstanceID
+	if mandatory {
+		instanceID = ""
+	}
+
+	lookupStart := time.Now()
+
+	// Along with a full update, why no patch was offered.
+	var degraded error
+
+	// Looking if there is a newer version for the os/arch on the client's
+	// channel.
+	// Devices support holds back or hands a hotfix to get exactly their
+	// version.
 	var update *Asset
-	if update, err = g.getProductUpdate(p.OS, p.Arch); err != nil {
+	overridden := false
+	if update = g.overriddenAsset(p.DeviceID, p.OS, p.Arch, p.Formats); update != nil {
+		overridden = true
+	} else if update, err = g.getProductUpdate(p.Channel, p.OS, p.Arch, instanceID, p.Formats); err != nil {
+		if g.unverifiedPlatform(p.OS, p.Arch) {
+			// Only unverified assets were published for the platform.
+			return nil, ErrNoUpdateAvailable
+		}
+		if g.unknownPlatform(p.OS, p.Arch) {
+			return nil, fmt.Errorf("%w: %s/%s", ErrUnsupportedPlatform, p.OS, p.Arch)
+		}
 		return nil, fmt.Errorf("Could not lookup for updates: %s", err)
 	}
 
+	// Clients past the version their platform or device is pinned to are
+	// rolled back.
+	pin, isPinned := g.pinnedVersion(p.OS, p.Arch)
+	rollback := (overridden || isPinned && update.v.EQ(pin)) && versionErr == nil && update.v.LT(appVersion)
+	mandatory = mandatory || rollback
+
 	// Looking for the asset thay matches the current app checksum.
 	var current *Asset
-	if current, err = g.lookupAssetWithChecksum(p.OS, p.Arch, p.Checksum); err != nil {
-		// No such asset with the given checksum, nothing to compare.
+	current, err = g.lookupAssetWithChecksum(p.OS, p.Arch, p.Checksum, p.ChecksumType)
+	if pinned {
+		if current, err = base, nil; base == nil {
+			err = fmt.Errorf("No asset of version %v to patch from.", appVersion)
+		}
+	}
+	trackTime(ctx, timingLookup, lookupStart)
+	if err != nil {
+		// No such asset with the given checksum, nothing to patch. Clients
+		// running a build newer than ours, like a sideloaded one, must not
+		// be downgraded.
+		if update.v.LTE(appVersion) && !mandatory && !withdrawn {
+			return nil, ErrNoUpdateAvailable
+		}
+		res = fullUpdate(update)
+		if versionErr == nil && g.assetOfVersion(p.OS, p.Arch, appVersion) == nil {
+			degraded = fmt.Errorf("%w: %s with checksum %s", ErrUnknownVersion, p.AppVersion, p.Checksum)
+		}
+	} else if current.Checksum == update.Checksum || (update.v.LTE(appVersion) && !mandatory) {
+		if g.channelPromoted(p.Channel, current, update) {
+			// Same binary, published on another channel now.
+			return nil, &ChannelChangeError{Channel: assetChannel(update)}
+		}
+		// No update available.
+		return nil, ErrNoUpdateAvailable
+	} else if belowFloor {
+		// Patches from that far back are rarely worth it, if the old asset
+		// is still around at all.
+		res = fullUpdate(update)
+	} else if !strings.EqualFold(current.Ext, update.Ext) {
+		// A patch between two packagings, like an installer and a bare
+		// binary, can't be applied in place.
+		res = fullUpdate(update)
+	} else if p.PreferFull && fits(p.AvailableBytes, update.Size) {
+		// Not even generated, the client won't take it.
+		res = fullUpdate(update)
+	} else if g.assetKnownGone(current) {
+		// Pruned, nothing to patch from.
+		res, degraded = patchUnavailable(update, ErrOldAssetGone)
+	} else if t, ok := g.patchTypeFor(p.PatchTypes); !ok {
+		// The client applies none of the patches we generate.
+		res = fullUpdate(update)
+	} else {
+		// A newer version is available!
+		limits := patchLimits{maxBytes: p.MaxPatchBytes, available: p.AvailableBytes}
+		if p.PatchChain {
+			res, err = g.chainUpdate(ctx, t, p.AcceptedCompression, limits, current, update)
+		} else {
+			res, err = g.patchUpdate(ctx, t, p.AcceptedCompression, limits, current, update)
+		}
+		if res == nil {
+			return nil, err
+		}
+		degraded = err
+	}
+	if res, err = fitSpace(res, update, p.AvailableBytes); err != nil {
+		return nil, err
+	}
 
-		r := &Result{
-			Initiative: INITIATIVE_AUTO,
-			URL:        update.URL,
-			PatchType:  PATCHTYPE_NONE,
-			Version:    update.v.String(),
-			Checksum:   update.Checksum,
-			Signature:  update.Signature,
+	res.Mandatory = mandatory
+	res.Downgrade = versionErr == nil && update.v.LT(appVersion)
+	if p.WantsReleaseNotes {
+		res.ReleaseNotes = g.releaseNotesFor(update.v)
+		if versionErr == nil {
+			res.Changelog, res.ChangelogTruncated = g.changelog(p.OS, p.Arch, appVersion, update)
 		}
+	}
+	res.PublishedAt = g.releaseDateFor(update.v)
+
+	signStart := time.Now()
+	res.Signatures = update.signaturesFor(p.TrustedKeys)
+	trackTime(ctx, timingSign, signStart)
+
+	return res, degraded
+}
 
-		return r, nil
+// logCheck tells the logger what was decided for a client's update check.
+func (g *ReleaseManager) logCheck(p *Params, outcome string, res *Result, err error) {
+	switch outcome {
+	case CheckOutcomeNoUpdate:
+		g.logger.Debug("No update available", "os", p.OS, "arch", p.Arch, "old", p.AppVersion)
+	case CheckOutcomeUnsupported:
+		g.logger.Debug("Update check for an unsupported platform", "os", p.OS, "arch", p.Arch, "old", p.AppVersion)
+	case CheckOutcomePending:
+		g.logger.Debug("Update check waiting for a patch", "os", p.OS, "arch", p.Arch, "old", p.AppVersion)
+	case CheckOutcomeError:
+		if turnedDown(err) {
+			g.logger.Debug("Update check turned down", "os", p.OS, "arch", p.Arch, "old", p.AppVersion, "err", err)
+		} else {
+			g.logger.Warn("Update check failed", "os", p.OS, "arch", p.Arch, "old", p.AppVersion, "err", err)
+		}
+	default:
+		g.logger.Info("Offering update", "os", p.OS, "arch", p.Arch, "old", p.AppVersion, "new", res.Version, "type", outcome, "mandatory", res.Mandatory)
 	}
+}
 
-	// No update available.
-	if update.v.LTE(appVersion) {
-		return nil, ErrNoUpdateAvailable
+// turnedDown tells whether an update check failed with err because of the
+// client's params or on purpose, rather than because something went wrong.
+func turnedDown(err error) bool {
+	var (
+		paramsErr      *ParamsError
+		appVersionErr  *AppVersionError
+		eolErr         *PlatformEOLError
+		channelErr     *ChannelChangeError
+		maintenanceErr *MaintenanceError
+		spaceErr       *InsufficientSpaceError
+	)
+	return errors.As(err, &paramsErr) || errors.As(err, &appVersionErr) || errors.As(err, &eolErr) ||
+		errors.As(err, &channelErr) || errors.As(err, &maintenanceErr) || errors.As(err, &spaceErr)
+}
+
+// channelPromoted tells whether a client on the given channel running current
+// should just move to the channel update was published on, because both are
+// the same binary.
+func (g *ReleaseManager) channelPromoted(channel string, current *Asset, update *Asset) bool {
+	g.mu.RLock()
+	enabled := g.channelPromotion
+	g.mu.RUnlock()
+
+	if !enabled || channel == assetChannel(update) {
+		return false
 	}
+	return current.Checksum == update.Checksum
+}
+
+// patchLimits bounds the patches a client is served.
+type patchLimits struct {
+	maxBytes  int64 // largest patch, or total of a chain, zero means any
+	available int64 // disk space of the client, zero if unknown
+}
+
+// fullFits tells whether the full binary of update fits in the disk space of
+// the client, patches are then only served if worth it.
+func (l patchLimits) fullFits(update *Asset) bool {
+	return fits(l.available, update.Size)
+}
+
+// tooLarge tells whether the client takes no patch, or chain, of size bytes.
+func (l patchLimits) tooLarge(size int64) bool {
+	return l.maxBytes > 0 && size > l.maxBytes
+}
+
+// fits tells whether size bytes fit in available ones, anything does when
+// either is unknown.
+func fits(available int64, size int64) bool {
+	return available <= 0 || size <= available
+}
 
-	// A newer version is available!
+// fitSpace returns res if what it downloads fits in the available bytes of
+// the client, the full update to update instead if only that does, or a
+// *InsufficientSpaceError if neither does.
+func fitSpace(res *Result, update *Asset, available int64) (*Result, error) {
+	required := res.Size
+	if res.UpdateType != UPDATETYPE_FULL {
+		required = res.PatchSize
+	}
+	if fits(available, required) {
+		return res, nil
+	}
+	if res.UpdateType != UPDATETYPE_FULL {
+		if fits(available, res.Size) {
+			log.Debugf("Patch to %s does not fit in %d bytes, serving full update", update.v, available)
+			return fullUpdate(update), nil
+		}
+		if res.Size < required {
+			required = res.Size
+		}
+	}
+	return nil, &InsufficientSpaceError{Required: required, Available: available}
+}
 
+// patchUpdate returns a result pointing the client at a patch of type t
+// between the two assets, in the smallest encoding it accepts, or at the
+// complete new asset if no patch is worth serving, unless that doesn't fit in
+// the client's space, or the patch is larger than it takes. The complete new
+// asset comes along with an error matching ErrPatchUnavailable when no patch
+// could be made. It only fails when ctx is done before the patch is ready,
+// with ErrPatchBusy when too many are being generated and overflowing
+// generations fail, or with a *PatchPendingError while it's generated in the
+// background.
+func (g *ReleaseManager) patchUpdate(ctx context.Context, t PatchType, accepted []string, limits patchLimits, current *Asset, update *Asset) (*Result, error) {
 	// Generate a binary diff of the two assets.
-	var patch *Patch
-	log.Debugf("Generating patch")
-	if patch, err = GeneratePatch(current.URL, update.URL); err != nil {
-		return nil, fmt.Errorf("Unable to generate patch: %q", err)
+	g.logger.Debug("Preparing patch", "old", current.URL, "new", update.URL)
+	patch, err := g.asyncPatch(ctx, t, current, update)
+	if err != nil {
+		if ctx.Err() != nil || errors.Is(err, ErrPatchPending) {
+			return nil, err
+		}
+		if g.failsBusy(err) {
+			return nil, ErrPatchBusy
+		}
+		if errors.Is(err, ErrOldAssetGone) {
+			g.markAssetGone(current)
+		}
+		// No usable patch, the client can still download the full binary.
+		g.logger.Warn("No patch available, serving full update", "old", current.URL, "new", update.URL, "err", err)
+		return patchUnavailable(update, err)
+	}
+
+	patch, ok := g.servedPatch(ctx, t, accepted, current, update, patch)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if !ok {
+		g.logger.Debug("Client takes no encoding of patch, serving full update", "old", current.URL, "new", update.URL)
+		return fullUpdate(update), nil
+	}
+
+	if !g.patchWorthwhile(patch, update) && limits.fullFits(update) {
+		g.logger.Debug("Patch is too large, serving full update", "patch", patch.File)
+		return fullUpdate(update), nil
+	}
+
+	size, err := fileSize(patch.File)
+	if err != nil {
+		g.logger.Warn("Patch is gone, serving full update", "patch", patch.File, "err", err)
+		return patchUnavailable(update, err)
+	}
+	if limits.tooLarge(size) {
+		g.logger.Debug("Patch is larger than the client takes, serving full update", "patch", patch.File)
+		return fullUpdate(update), nil
 	}
 
 	// Generate result.
-	r := &Result{
-		Initiative: INITIATIVE_AUTO,
-		URL:        update.URL,
-		PatchURL:   patch.File,
-		PatchType:  PATCHTYPE_BSDIFF,
-		Version:    update.v.String(),
-		Checksum:   update.Checksum,
-		Signature:  update.Signature,
+	res := &Result{
+		UpdateType:     UPDATETYPE_PATCH,
+		Initiative:     INITIATIVE_AUTO,
+		URL:            update.clientURL(),
+		Size:           update.Size,
+		PatchType:      t,
+		PatchSize:      size,
+		Version:        update.v.String(),
+		Checksum:       update.Checksum,
+		ChecksumType:   ChecksumType.SHA256,
+		SHA256:         update.SHA256,
+		Signature:      update.Signature,
+		SignatureKeyID: update.SignatureKeyID,
+	}
+	if len(accepted) > 0 {
+		if res.Compression, res.PatchChecksum, res.PatchSignature, err = g.patchArtifact(patch); err != nil {
+			g.logger.Error("Could not sign patch, serving full update", "patch", patch.File, "err", err)
+			return fullUpdate(update), nil
+		}
 	}
 
-	return r, nil
+	g.markPatchServed(filepath.Base(patch.File))
+	res.PatchURL = g.patchURL(patch)
+	return res, nil
+}
+
+// fullUpdate returns a result pointing the client at the complete new asset.
+func fullUpdate(update *Asset) *Result {
+	return &Result{
+		UpdateType:     UPDATETYPE_FULL,
+		Initiative:     INITIATIVE_AUTO,
+		URL:            update.clientURL(),
+		Size:           update.Size,
+		PatchType:      PATCHTYPE_NONE,
+		Version:        update.v.String(),
+		Checksum:       update.Checksum,
+		ChecksumType:   ChecksumType.SHA256,
+		SHA256:         update.SHA256,
+		Signature:      update.Signature,
+		SignatureKeyID: update.SignatureKeyID,
+	}
 }
@@ -0,0 +1,783 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestUpdatePair returns a manager with 1.0.0 and 1.1.0 linux/amd64 assets,
+// 1.0.0 being served by the given handler once pushed.
+func newTestUpdatePair(t *testing.T, old http.HandlerFunc) (*ReleaseManager, *Asset, *Asset) {
+	setTestPrivateKey(t)
+
+	// Random bytes don't compress, so a patch between the two assets is
+	// about as large as the new one.
+	random := make([]byte, 4096)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := newTestAssetServer(map[string]string{
+		"/1.0.0": "full fallback 1.0.0",
+		"/1.1.0": string(random),
+	})
+	t.Cleanup(srv.Close)
+
+	g := NewReleaseManager("getlantern", "autoupdate-server")
+	g.SetDownloadRetryPolicy(RetryPolicy{Attempts: 2, Backoff: time.Millisecond})
+	for _, tag := range []string{"1.0.0", "1.1.0"} {
+		asset := &Asset{Name: "autoupdate-binary-linux-amd64", URL: srv.URL + "/" + tag}
+		asset.v, _ = parseVersion(tag)
+		if err := g.pushAsset(OS.Linux, Arch.X64, asset); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	current := g.updateAssetsMap[OS.Linux][Arch.X64]["1.0.0"]
+	if old != nil {
+		// Point the old asset somewhere it was never downloaded from.
+		oldsrv := httptest.NewServer(old)
+		t.Cleanup(oldsrv.Close)
+		current.URL = oldsrv.URL + "/" + t.Name() + "/1.0.0"
+	}
+	return g, current, g.updateAssetsMap[OS.Linux][Arch.X64]["1.1.0"]
+}
+
+func checkFullUpdate(t *testing.T, g *ReleaseManager, current *Asset, update *Asset) {
+	res, err := g.CheckForUpdate(&Params{
+		AppVersion: "1.0.0",
+		OS:         OS.Linux,
+		Arch:       Arch.X64,
+		Checksum:   current.Checksum,
+	})
+	if err != nil && !errors.Is(err, ErrPatchUnavailable) {
+		t.Fatal(err)
+	}
+	if res.UpdateType != UPDATETYPE_FULL || res.PatchType != PATCHTYPE_NONE || res.PatchURL != "" || res.PatchSize != 0 {
+		t.Fatalf("Expecting a full update, got %+v", res)
+	}
+	if res.URL != update.URL || res.Checksum != update.Checksum || res.Signature != update.Signature {
+		t.Fatalf("Expecting the full update to describe 1.1.0, got %+v", res)
+	}
+}
+
+func TestCheckForUpdateFallsBackToFullUpdate(t *testing.T) {
+	// The old release was deleted from Github.
+	var requests int32
+	g, current, update := newTestUpdatePair(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.NotFound(w, r)
+	})
+	check := func() *Result {
+		res, err := g.CheckForUpdate(&Params{AppVersion: "1.0.0", OS: OS.Linux, Arch: Arch.X64, Checksum: current.Checksum})
+		if res == nil || !errors.Is(err, ErrPatchUnavailable) {
+			t.Fatalf("Expecting a full update along with ErrPatchUnavailable, got %+v, %v", res, err)
+		}
+		return res
+	}
+	checkFullUpdate(t, g, current, update)
+	if res := check(); !res.PatchUnavailable {
+		t.Fatalf("Expecting the fallback to be told, got %+v", res)
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Fatalf("Expecting the gone asset not to be asked for again, got %d requests", n)
+	}
+
+	g.SetGoneAssetCooldown(0)
+	g.goneAssets = nil
+	check()
+	check()
+	if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Fatalf("Expecting the asset to be asked for every time without a cooldown, got %d requests", n)
+	}
+
+	// An asset without a URL isn't even tried.
+	current.URL = ""
+	if res := check(); !res.PatchUnavailable || res.UpdateType != UPDATETYPE_FULL {
+		t.Fatalf("Expecting a full update without a URL to patch from, got %+v", res)
+	}
+}
+
+func TestCheckForUpdateCorruptDownload(t *testing.T) {
+	g, current, update := newTestUpdatePair(t, func(w http.ResponseWriter, r *http.Request) {
+		// Promise more than we send so the download is truncated.
+		w.Header().Set("Content-Length", "1024")
+		w.Write([]byte("truncated"))
+	})
+	checkFullUpdate(t, g, current, update)
+
+	if _, err := downloadAssetRetry(context.Background(), http.DefaultClient, current.URL, "", RetryPolicy{Attempts: 1}); err == nil {
+		t.Fatal("Expecting the truncated download not to be kept.")
+	}
+}
+
+func TestCheckForUpdateOversizedPatch(t *testing.T) {
+	requireBsdiff(t)
+
+	g, current, update := newTestUpdatePair(t, nil)
+
+	checkFullUpdate(t, g, current, update)
+
+	g.SetMaxPatchRatio(0)
+	res, err := g.CheckForUpdate(&Params{
+		AppVersion: "1.0.0",
+		OS:         OS.Linux,
+		Arch:       Arch.X64,
+		Checksum:   current.Checksum,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.UpdateType != UPDATETYPE_PATCH || res.PatchType != PATCHTYPE_BSDIFF {
+		t.Fatalf("Expecting a patch with the size check disabled, got %+v", res)
+	}
+	if size, err := fileSize(filepath.Join(g.PatchCacheDir(), path.Base(res.PatchURL))); err != nil || res.PatchSize != size {
+		t.Fatalf("Expecting the size of the patch, got %d", res.PatchSize)
+	}
+}
+
+func TestCheckForUpdateBandwidthHints(t *testing.T) {
+	requireBsdiff(t)
+
+	g, current, update := newTestUpdatePair(t, nil)
+	g.SetMaxPatchRatio(0)
+	check := func(p Params) *Result {
+		p.AppVersion, p.OS, p.Arch, p.Checksum = "1.0.0", OS.Linux, Arch.X64, current.Checksum
+		res, err := g.CheckForUpdate(&p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	for _, p := range []Params{{PreferFull: true}, {PreferFull: true, PatchChain: true}} {
+		if res := check(p); res.UpdateType != UPDATETYPE_FULL || res.PatchURL != "" || res.URL != update.URL {
+			t.Fatalf("Expecting a full update for %+v, got %+v", p, res)
+		}
+	}
+	if _, ok := g.patches.get(patchCacheKey(current.URL, update.URL, "")); ok {
+		t.Fatal("Expecting no patch to be generated for clients preferring the full binary.")
+	}
+
+	res := check(Params{})
+	if res.UpdateType != UPDATETYPE_PATCH {
+		t.Fatalf("Expecting a patch without hints, got %+v", res)
+	}
+	if res := check(Params{MaxPatchBytes: res.PatchSize}); res.UpdateType != UPDATETYPE_PATCH {
+		t.Fatalf("Expecting a patch within MaxPatchBytes, got %+v", res)
+	}
+	for _, p := range []Params{{MaxPatchBytes: res.PatchSize - 1}, {MaxPatchBytes: res.PatchSize - 1, PatchChain: true}} {
+		if res := check(p); res.UpdateType != UPDATETYPE_FULL || res.PatchURL != "" || res.Signature != update.Signature {
+			t.Fatalf("Expecting a full update past MaxPatchBytes for %+v, got %+v", p, res)
+		}
+	}
+}
+
+func TestCheckForUpdateAcrossPackagings(t *testing.T) {
+	requireBsdiff(t)
+
+	g, current, update := newTestUpdatePair(t, nil)
+	g.SetMaxPatchRatio(0)
+
+	// The client runs what was published as an installer.
+	current.Ext = ".exe"
+	checkFullUpdate(t, g, current, update)
+
+	current.Ext = ""
+	res, err := g.CheckForUpdate(&Params{
+		AppVersion: "1.0.0",
+		OS:         OS.Linux,
+		Arch:       Arch.X64,
+		Checksum:   current.Checksum,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.UpdateType != UPDATETYPE_PATCH {
+		t.Fatalf("Expecting a patch between bare binaries, got %+v", res)
+	}
+}
+
+func TestCheckForUpdateChecksumType(t *testing.T) {
+	g, _, update := newTestUpdatePair(t, nil)
+
+	params := func(checksum string, checksumType string) *Params {
+		return &Params{
+			AppVersion:   "1.0.0",
+			OS:           OS.Linux,
+			Arch:         Arch.X64,
+			Checksum:     checksum,
+			ChecksumType: checksumType,
+		}
+	}
+
+	// The result always carries the SHA-256 of the target.
+	res, err := g.CheckForUpdate(params("unknown", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum := fileHash(update.LocalFile); res.SHA256 != sum || res.Checksum != sum {
+		t.Fatalf("Expecting SHA-256 %s in the result, got %+v", sum, res)
+	}
+
+	// Running 1.1.0 already, whatever the case of the digest.
+	upper := strings.ToUpper(update.Checksum)
+	p := params(upper, ChecksumType.SHA256)
+	p.AppVersion = "1.1.0"
+	if _, err = g.CheckForUpdate(p); err != ErrNoUpdateAvailable {
+		t.Fatalf("Expecting the SHA-256 digest to identify 1.1.0, got %q", err)
+	}
+
+	if _, err = g.CheckForUpdate(params(update.Checksum, "md5")); !errors.Is(err, ErrInvalidParams) {
+		t.Fatalf("Expecting unsupported checksum types to be rejected, got %q", err)
+	}
+	if res.ChecksumType != ChecksumType.SHA256 {
+		t.Fatalf("Expecting the result to tell its checksum is a SHA-256, got %q", res.ChecksumType)
+	}
+
+	// Older clients identify 1.1.0 with its SHA-1, saying so or not.
+	content, err := ioutil.ReadFile(update.LocalFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := fmt.Sprintf("%x", sha1.Sum(content))
+	if update.SHA1 != legacy {
+		t.Fatalf("Expecting the SHA-1 %s of the asset, got %s", legacy, update.SHA1)
+	}
+	for _, checksumType := range []string{ChecksumType.SHA1, ""} {
+		if _, err = g.CheckForUpdate(params(legacy, checksumType)); err != ErrNoUpdateAvailable {
+			t.Fatalf("Expecting the SHA-1 digest to identify 1.1.0 with checksum type %q, got %q", checksumType, err)
+		}
+	}
+	if _, err = g.CheckForUpdate(params(update.Checksum, ChecksumType.SHA1)); err == ErrNoUpdateAvailable {
+		t.Fatal("Expecting a SHA-256 not to be taken as a SHA-1")
+	}
+
+	// Once SHA-1 is turned off, the same binary is unknown.
+	g.SetAcceptSHA1(false)
+	if _, err = g.CheckForUpdate(params(legacy, ChecksumType.SHA1)); !errors.Is(err, ErrInvalidParams) {
+		t.Fatalf("Expecting SHA-1 checksums to be rejected, got %q", err)
+	}
+	if res, err = g.CheckForUpdate(params(legacy, "")); err != nil || res.UpdateType != UPDATETYPE_FULL {
+		t.Fatalf("Expecting a full update for an unknown binary, got %+v, %q", res, err)
+	}
+	if _, err = g.CheckForUpdate(params(update.Checksum, "")); err != ErrNoUpdateAvailable {
+		t.Fatalf("Expecting SHA-256 checksums to still be matched, got %q", err)
+	}
+}
+
+func TestCheckForUpdateNoDowngrade(t *testing.T) {
+	g, _, update := newTestUpdatePair(t, nil)
+
+	check := func(appVersion string, checksum string) error {
+		_, err := g.CheckForUpdate(&Params{
+			AppVersion: appVersion,
+			OS:         OS.Linux,
+			Arch:       Arch.X64,
+			Checksum:   checksum,
+		})
+		return err
+	}
+
+	tests := []struct {
+		name       string
+		appVersion string
+		checksum   string
+	}{
+		{"same version", "1.1.0", update.Checksum},
+		{"same version, unknown build", "1.1.0", "unknown"},
+		{"newer client", "1.2.0", update.Checksum},
+		{"newer sideloaded client", "1.2.0", "unknown"},
+	}
+	for _, test := range tests {
+		if err := check(test.appVersion, test.checksum); err != ErrNoUpdateAvailable {
+			t.Fatalf("%s: expecting ErrNoUpdateAvailable, got %q", test.name, err)
+		}
+	}
+
+	for _, appVersion := range []string{"", "one", "1.1", "1.1.0.0"} {
+		err := check(appVersion, "unknown")
+		if !errors.Is(err, ErrBadAppVersion) || !errors.Is(err, ErrInvalidParams) || errors.Is(err, ErrUnknownVersion) {
+			t.Fatalf("Expecting ErrBadAppVersion for %q, got %q", appVersion, err)
+		}
+	}
+}
+
+func TestCheckForUpdateUnknownPlatform(t *testing.T) {
+	g, current, _ := newTestUpdatePair(t, nil)
+	stats := NewStats()
+	WithMetrics(stats)(g)
+
+	for _, p := range []*Params{
+		nil,
+		{AppVersion: "1.0.0", Arch: Arch.X64, Checksum: current.Checksum},
+		{AppVersion: "1.0.0", OS: OS.Linux, Checksum: current.Checksum},
+		{AppVersion: "1.0.0", OS: OS.Linux, Arch: Arch.X64},
+		{AppVersion: "1.0.0", OS: OS.Linux, Arch: Arch.X64, Checksum: current.Checksum, ChecksumType: "md5"},
+		{AppVersion: "", OS: OS.Linux, Arch: Arch.X64, Checksum: current.Checksum},
+		{AppVersion: "1.0", OS: OS.Linux, Arch: Arch.X64, Checksum: current.Checksum},
+	} {
+		if _, err := g.CheckForUpdate(p); !errors.Is(err, ErrInvalidParams) {
+			t.Fatalf("Expecting ErrInvalidParams for %+v, got %v", p, err)
+		}
+	}
+
+	// Platforms nothing is published for are told apart from up to date
+	// ones.
+	for _, p := range []*Params{
+		{AppVersion: "1.0.0", OS: "freebsd", Arch: Arch.X64, Checksum: "unknown"},
+		{AppVersion: "1.0.0", OS: OS.Linux, Arch: Arch.ARM64, Checksum: "unknown"},
+	} {
+		_, err := g.CheckForUpdate(p)
+		if !errors.Is(err, ErrUnsupportedPlatform) || !errors.Is(err, ErrNoSuchPlatform) || errors.Is(err, ErrNoUpdateAvailable) {
+			t.Fatalf("Expecting ErrUnsupportedPlatform for %s/%s, got %v", p.OS, p.Arch, err)
+		}
+	}
+	if ps := stats.Snapshot().Platforms["freebsd/amd64"]; ps.Unsupported != 1 || ps.Errors != 0 {
+		t.Fatalf("Expecting an unsupported check from freebsd, got %+v", ps)
+	}
+
+	// Nothing published at all is not the platform's fault.
+	empty := NewReleaseManager("getlantern", "autoupdate-server")
+	if _, err := empty.CheckForUpdate(&Params{AppVersion: "1.0.0", OS: OS.Linux, Arch: Arch.X64, Checksum: "unknown"}); err == nil || errors.Is(err, ErrNoSuchPlatform) {
+		t.Fatalf("Expecting a lookup error, got %v", err)
+	}
+}
+
+func TestCheckForUpdateVersionMismatch(t *testing.T) {
+	requireBsdiff(t)
+
+	g, current, update := newTestUpdatePair(t, nil)
+	g.SetMaxPatchRatio(0)
+
+	check := func(appVersion string, checksum string) (*Result, error) {
+		return g.CheckForUpdate(&Params{
+			AppVersion: appVersion,
+			OS:         OS.Linux,
+			Arch:       Arch.X64,
+			Checksum:   checksum,
+		})
+	}
+
+	// A 1.0.0 binary claiming to be 1.1.0, and a binary that isn't 1.0.0's
+	// claiming to be it.
+	olderBinary := func() (*Result, error) { return check("1.1.0", current.Checksum) }
+	unknownBinary := func() (*Result, error) { return check("1.0.0", "unknown") }
+
+	// By default the version tells whether an update is due.
+	if _, err := olderBinary(); err != ErrNoUpdateAvailable {
+		t.Fatalf("Expecting ErrNoUpdateAvailable going by the version, got %v", err)
+	}
+	if res, err := unknownBinary(); err != nil || res.UpdateType != UPDATETYPE_FULL {
+		t.Fatalf("Expecting a full update for an unknown binary, got %+v, %v", res, err)
+	}
+	// Neither of an unpublished version, which is told.
+	if res, err := check("0.9.0", "unknown"); res == nil || res.UpdateType != UPDATETYPE_FULL || !errors.Is(err, ErrUnknownVersion) {
+		t.Fatalf("Expecting a full update along with ErrUnknownVersion, got %+v, %v", res, err)
+	}
+
+	g.SetVersionMismatchPolicy(VersionMismatchTrustChecksum)
+	res, err := olderBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.UpdateType != UPDATETYPE_PATCH || res.Version != "1.1.0" {
+		t.Fatalf("Expecting a patch from the binary the checksum matches, got %+v", res)
+	}
+	if res, err = unknownBinary(); err != nil || res.UpdateType != UPDATETYPE_FULL {
+		t.Fatalf("Expecting a full update when the checksum matches nothing, got %+v, %v", res, err)
+	}
+
+	g.SetVersionMismatchPolicy(VersionMismatchTrustVersion)
+	if _, err = olderBinary(); err != ErrNoUpdateAvailable {
+		t.Fatalf("Expecting ErrNoUpdateAvailable going by the version, got %v", err)
+	}
+	if res, err = unknownBinary(); err != nil || res.UpdateType != UPDATETYPE_PATCH {
+		t.Fatalf("Expecting a patch from the asset of the version, got %+v, %v", res, err)
+	}
+
+	g.SetVersionMismatchPolicy(VersionMismatchReject)
+	var mismatch *VersionMismatchError
+	if _, err = olderBinary(); !errors.As(err, &mismatch) || mismatch.ChecksumVersion != "1.0.0" || !errors.Is(err, ErrInvalidParams) {
+		t.Fatalf("Expecting a mismatch with version 1.0.0, got %v", err)
+	}
+	if errors.Is(err, ErrChecksumMismatch) || errors.Is(err, ErrUnknownVersion) {
+		t.Fatalf("Expecting a checksum of another version not to be ErrChecksumMismatch, got %v", err)
+	}
+	if _, err = unknownBinary(); !errors.As(err, &mismatch) || mismatch.ChecksumVersion != "" || !errors.Is(err, ErrChecksumMismatch) || !errors.Is(err, ErrUnknownVersion) {
+		t.Fatalf("Expecting a checksum mismatch with no version, got %v", err)
+	}
+
+	g.SetVersionMismatchPolicy(VersionMismatchFullUpdate)
+	if _, err = olderBinary(); err != ErrNoUpdateAvailable {
+		t.Fatalf("Expecting ErrNoUpdateAvailable going by the version, got %v", err)
+	}
+	if res, err = unknownBinary(); err != nil || res.UpdateType != UPDATETYPE_FULL || res.Version != update.v.String() {
+		t.Fatalf("Expecting a full update instead of a patch that won't apply, got %+v, %v", res, err)
+	}
+	if res, err = check("1.0.0", update.Checksum); err != nil || res.UpdateType != UPDATETYPE_FULL {
+		t.Fatalf("Expecting a full update for a 1.1.0 binary claiming 1.0.0, got %+v, %v", res, err)
+	}
+
+	// Clients must tell their checksum.
+	if _, err = check("1.0.0", ""); !errors.Is(err, ErrInvalidParams) {
+		t.Fatalf("Expecting a missing checksum to be rejected, got %v", err)
+	}
+
+	// Consistent clients go through whatever the policy.
+	if res, err = check("1.0.0", current.Checksum); err != nil || res.Version != update.v.String() {
+		t.Fatalf("Expecting an update to 1.1.0, got %+v, %v", res, err)
+	}
+}
+
+func TestCheckForUpdateYankedVersion(t *testing.T) {
+	g, current, update := newTestUpdatePair(t, nil)
+
+	check := func(version string, checksum string) (*Result, error) {
+		return g.CheckForUpdate(&Params{
+			AppVersion: version,
+			OS:         OS.Linux,
+			Arch:       Arch.X64,
+			Checksum:   checksum,
+		})
+	}
+
+	res, err := check("1.0.0", current.Checksum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Mandatory {
+		t.Fatal("Expecting regular updates not to be mandatory.")
+	}
+
+	// Clients on a yanked version are made to update.
+	if err = g.SetYanked("1.0.0", true); err != nil {
+		t.Fatal(err)
+	}
+	if res, err = check("1.0.0", current.Checksum); err != nil {
+		t.Fatal(err)
+	}
+	if !res.Mandatory || res.Version != "1.1.0" {
+		t.Fatalf("Expecting a mandatory update to 1.1.0, got %+v", res)
+	}
+
+	// A yanked latest is never offered, its clients go back to the latest
+	// good version.
+	g.SetYanked("1.0.0", false)
+	g.SetYanked("1.1.0", true)
+	if _, err = check("1.0.0", current.Checksum); err != ErrNoUpdateAvailable {
+		t.Fatalf("Expecting no update past the yanked latest, got %q", err)
+	}
+	if res, err = check("1.1.0", update.Checksum); err != nil {
+		t.Fatal(err)
+	}
+	if !res.Mandatory || !res.Downgrade || res.Version != "1.0.0" {
+		t.Fatalf("Expecting a mandatory downgrade to 1.0.0, got %+v", res)
+	}
+}
+
+func TestWithdrawnReleases(t *testing.T) {
+	setTestPrivateKey(t)
+
+	files := newTestAssetServer(map[string]string{
+		"/1.0.0": "withdrawn test 1.0.0",
+		"/1.1.0": "withdrawn test 1.1.0",
+	})
+	defer files.Close()
+
+	release := func(id int, tag string) string {
+		return fmt.Sprintf(`{"id": %d, "tag_name": "%s", "zipball_url": "%s/%s.zip", "assets": [
+			{"id": %d, "name": "autoupdate-binary-linux-amd64", "browser_download_url": "%s/%s"}
+		]}`, id, tag, files.URL, tag, 10*id, files.URL, tag)
+	}
+	var mu sync.Mutex
+	releases := "[" + release(2, "1.1.0") + "," + release(1, "1.0.0") + "]"
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Write([]byte(releases))
+	}))
+	defer api.Close()
+	list := func(body string) {
+		mu.Lock()
+		releases = body
+		mu.Unlock()
+	}
+
+	g := NewReleaseManager("getlantern", "autoupdate-server")
+	useTestGitHub(t, g, api)
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+	withdrawn := g.updateAssetsMap[OS.Linux][Arch.X64]["1.1.0"]
+
+	check := func(version string, checksum string) (*Result, error) {
+		return g.CheckForUpdate(&Params{AppVersion: version, OS: OS.Linux, Arch: Arch.X64, Checksum: checksum})
+	}
+
+	// Clients on the latest release have nothing to update to.
+	if _, err := check("1.1.0", withdrawn.Checksum); err != ErrNoUpdateAvailable {
+		t.Fatalf("Expecting no update, got %v", err)
+	}
+
+	// 1.1.0 is deleted, its clients are offered 1.0.0 back in full.
+	list("[" + release(1, "1.0.0") + "]")
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+	for _, checksum := range []string{withdrawn.Checksum, "unknown"} {
+		res, err := check("1.1.0", checksum)
+		if err != nil && !errors.Is(err, ErrUnknownVersion) {
+			t.Fatal(err)
+		}
+		if !res.Downgrade || res.Mandatory || res.Version != "1.0.0" || res.UpdateType != UPDATETYPE_FULL {
+			t.Fatalf("Expecting a full downgrade to 1.0.0 for checksum %s, got %+v", checksum, res)
+		}
+	}
+	// Even when the client tells another version.
+	if res, err := check("1.2.0", withdrawn.Checksum); (err != nil && !errors.Is(err, ErrUnknownVersion)) || !res.Downgrade || res.Version != "1.0.0" {
+		t.Fatalf("Expecting a downgrade to 1.0.0, got %+v %v", res, err)
+	}
+	// Builds newer than any release, like sideloaded ones, are left alone.
+	if _, err := check("1.2.0", "unknown"); err != ErrNoUpdateAvailable {
+		t.Fatalf("Expecting no update for a sideloaded build, got %v", err)
+	}
+	// The snapshot remembers what was withdrawn.
+	if snapshot, err := g.encodeAssets(); err != nil || !strings.Contains(string(snapshot), withdrawn.Checksum) {
+		t.Fatalf("Expecting the withdrawn release to be saved, got %s %v", snapshot, err)
+	}
+
+	// Releases published again are no longer withdrawn.
+	list("[" + release(2, "1.1.0") + "," + release(1, "1.0.0") + "]")
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := check("1.1.0", withdrawn.Checksum); err != ErrNoUpdateAvailable {
+		t.Fatalf("Expecting no update once 1.1.0 is back, got %v", err)
+	}
+	if len(g.withdrawn) != 0 {
+		t.Fatalf("Expecting nothing withdrawn, got %v", g.withdrawn)
+	}
+}
+
+func TestChannelPromotion(t *testing.T) {
+	setTestPrivateKey(t)
+
+	files := newTestAssetServer(map[string]string{"/2.0.0": "promoted 2.0.0"})
+	defer files.Close()
+
+	// 2.0.0 was first published as a prerelease and is now stable.
+	api := newTestReleasesAPI(fmt.Sprintf(`[{"id": 1, "tag_name": "2.0.0", "prerelease": false, "zipball_url": "%s/2.0.0.zip", "assets": [
+		{"id": 10, "name": "autoupdate-binary-linux-amd64", "browser_download_url": "%s/2.0.0"}
+	]}]`, files.URL, files.URL))
+	defer api.Close()
+
+	g := NewReleaseManager("getlantern", "autoupdate-server")
+	useTestGitHub(t, g, api)
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+	checksum := g.updateAssetsMap[OS.Linux][Arch.X64]["2.0.0"].Checksum
+
+	check := func(channel string) error {
+		_, err := g.CheckForUpdate(&Params{
+			AppVersion: "2.0.0",
+			OS:         OS.Linux,
+			Arch:       Arch.X64,
+			Checksum:   checksum,
+			Channel:    channel,
+		})
+		return err
+	}
+
+	// Beta clients are told to move to stable, with nothing to download.
+	err := check(Channel.Beta)
+	var promoted *ChannelChangeError
+	if !errors.As(err, &promoted) || promoted.Channel != Channel.Stable {
+		t.Fatalf("Expecting a channel change to stable, got %q", err)
+	}
+	if !errors.Is(err, ErrNoUpdateAvailable) {
+		t.Fatal("Expecting a channel change to mean no update.")
+	}
+
+	// Stable clients are just up to date.
+	if err = check(Channel.Stable); err != ErrNoUpdateAvailable {
+		t.Fatalf("Expecting no update, got %q", err)
+	}
+
+	g.SetChannelPromotion(false)
+	if err = check(Channel.Beta); err != ErrNoUpdateAvailable {
+		t.Fatalf("Expecting no channel change once disabled, got %q", err)
+	}
+
+	// The handler passes the new channel along with no content.
+	g.SetChannelPromotion(true)
+	rec := httptest.NewRecorder()
+	NewUpdateHandler(g, "").ServeHTTP(rec, httptest.NewRequest("GET", "/update?os=linux&arch=amd64&app_version=2.0.0&channel=beta&checksum="+checksum, nil))
+	if rec.Code != http.StatusNoContent || rec.Header().Get(channelHeader) != Channel.Stable {
+		t.Fatalf("Expecting no content with a switch to stable, got %d %q", rec.Code, rec.Header().Get(channelHeader))
+	}
+}
+
+func TestMinimumVersion(t *testing.T) {
+	g, current, _ := newTestUpdatePair(t, nil)
+	g.SetMaxPatchRatio(0)
+
+	check := func(appVersion string, checksum string) *Result {
+		res, err := g.CheckForUpdate(&Params{
+			AppVersion: appVersion,
+			OS:         OS.Linux,
+			Arch:       Arch.X64,
+			Checksum:   checksum,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	if res := check("1.0.0", current.Checksum); res.Mandatory {
+		t.Fatal("Expecting updates to be optional without a minimum version.")
+	}
+	if _, err := g.CheckForUpdate(&Params{AppVersion: "one", OS: OS.Linux, Arch: Arch.X64, Checksum: "unknown"}); !errors.Is(err, ErrInvalidParams) {
+		t.Fatalf("Expecting a bad version to be rejected without a minimum version, got %q", err)
+	}
+
+	// Other platforms are not affected.
+	if err := g.SetMinimumVersion(OS.Darwin, "", "1.1.0"); err != nil {
+		t.Fatal(err)
+	}
+	if res := check("1.0.0", current.Checksum); res.Mandatory {
+		t.Fatal("Expecting the darwin minimum version not to apply to linux.")
+	}
+
+	if err := g.SetMinimumVersion(OS.Linux, "", "1.1.0"); err != nil {
+		t.Fatal(err)
+	}
+	if res := check("1.0.0", current.Checksum); !res.Mandatory || res.Version != "1.1.0" || res.UpdateType != UPDATETYPE_FULL || res.PatchURL != "" {
+		t.Fatalf("Expecting a mandatory full update to 1.1.0, got %+v", res)
+	}
+	if res := check("not a version", "unknown"); !res.Mandatory || res.Version != "1.1.0" {
+		t.Fatalf("Expecting unknown versions to be taken as below the minimum, got %+v", res)
+	}
+
+	// At or above the floor updates are optional again.
+	if err := g.SetMinimumVersion(OS.Linux, "", "1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	if res := check("1.0.0", current.Checksum); res.Mandatory {
+		t.Fatal("Expecting clients at the minimum version to get an optional update.")
+	}
+
+	if err := g.SetMinimumVersion(OS.Linux, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.SetMinimumVersion(OS.Linux, "", "one"); err == nil {
+		t.Fatal("Expecting a bad minimum version to be rejected.")
+	}
+}
+
+func TestMinimumVersionFromReleaseNotes(t *testing.T) {
+	setTestPrivateKey(t)
+
+	files := newTestAssetServer(map[string]string{"/2.0.0": "release notes 2.0.0"})
+	defer files.Close()
+
+	api := newTestReleasesAPI(fmt.Sprintf(`[{"id": 1, "tag_name": "2.0.0", "body": "Protocol change.\r\nMinimum-Version: 2.0.0\r\n", "zipball_url": "%s/2.0.0.zip", "assets": [
+		{"id": 10, "name": "autoupdate-binary-linux-amd64", "browser_download_url": "%s/2.0.0"}
+	]}]`, files.URL, files.URL))
+	defer api.Close()
+
+	g := NewReleaseManager("getlantern", "autoupdate-server")
+	useTestGitHub(t, g, api)
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := g.CheckForUpdate(&Params{
+		AppVersion: "1.9.0",
+		OS:         OS.Linux,
+		Arch:       Arch.X64,
+		Checksum:   "unknown",
+	})
+	if err != nil && !errors.Is(err, ErrUnknownVersion) {
+		t.Fatal(err)
+	}
+	if !res.Mandatory {
+		t.Fatal("Expecting the release notes to make the update mandatory.")
+	}
+}
+
+func TestCheckForUpdateAvailableBytes(t *testing.T) {
+	// Post processing makes patches of the given size.
+	newPair := func(patchSize int) (*ReleaseManager, *Asset, *Asset) {
+		g, current, update := newTestUpdatePair(t, nil)
+		if err := g.SetPatchCacheDir(t.TempDir()); err != nil {
+			t.Fatal(err)
+		}
+		g.SetMaxPatchRatio(0)
+		g.SetPatchPostProcess(func([]byte) ([]byte, error) {
+			return make([]byte, patchSize), nil
+		})
+		return g, current, update
+	}
+	check := func(g *ReleaseManager, current *Asset, available int64, preferFull bool) (*Result, error) {
+		return g.CheckForUpdate(&Params{
+			AppVersion:     "1.0.0",
+			OS:             OS.Linux,
+			Arch:           Arch.X64,
+			Checksum:       current.Checksum,
+			PreferFull:     preferFull,
+			AvailableBytes: available,
+		})
+	}
+
+	g, current, update := newPair(100)
+	res, err := check(g, current, 0, false)
+	if err != nil || res.UpdateType != UPDATETYPE_PATCH || res.PatchSize != 100 || res.Size != update.Size {
+		t.Fatalf("Expecting the patch and full sizes, got %+v, %v", res, err)
+	}
+	if p, err := g.GeneratePatch(current.URL, update.URL); err != nil || p.Size != 100 {
+		t.Fatalf("Expecting the patch to tell its size, got %+v, %v", p, err)
+	}
+
+	// Only the patch fits, the client gets it even preferring the full
+	// binary.
+	if res, err = check(g, current, 100, true); err != nil || res.UpdateType != UPDATETYPE_PATCH {
+		t.Fatalf("Expecting the patch that fits, got %+v, %v", res, err)
+	}
+
+	_, err = check(g, current, 99, false)
+	var space *InsufficientSpaceError
+	if !errors.As(err, &space) || space.Required != 100 || !errors.Is(err, ErrInsufficientSpace) {
+		t.Fatalf("Expecting 100 bytes to be required, got %v", err)
+	}
+
+	// Only the full binary fits.
+	g, current, update = newPair(2 * int(update.Size))
+	if res, err = check(g, current, update.Size, false); err != nil || res.UpdateType != UPDATETYPE_FULL || res.Size != update.Size {
+		t.Fatalf("Expecting the full update that fits, got %+v, %v", res, err)
+	}
+
+	rec := httptest.NewRecorder()
+	body := fmt.Sprintf(`{"app_version": "1.0.0", "checksum": %q, "available_bytes": 1}`, current.Checksum)
+	NewUpdateHandler(g, "https://update.example.com/").ServeHTTP(rec, httptest.NewRequest("POST", "/update?os=linux&arch=amd64", strings.NewReader(body)))
+	var e errorBody
+	if rec.Code != http.StatusInsufficientStorage || json.NewDecoder(rec.Body).Decode(&e) != nil || e.Code != "insufficient_space" || e.RequiredBytes != update.Size {
+		t.Fatalf("Expecting 507 and the size of the full binary, got %d %+v", rec.Code, e)
+	}
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"sort"
+	"time"
+
+	"github.com/blang/semver"
+)
+
+// incompleteRelease is a release held back for missing platforms.
+type incompleteRelease struct {
+	missing []string  // as os/arch, sorted
+	until   time.Time // when it settles
+}
+
+// SetReleaseSettle holds back the releases missing some of the platforms the
+// previous release of their channel was published for, as when their assets
+// are still being uploaded, until they have been out for d. They're indexed
+// all the same, patches are made from them, but clients are offered the
+// previous release meanwhile. Releases are checked on the next
+// UpdateAssetsMap. Zero, the default, offers releases as soon as they're
+// listed.
+func (g *ReleaseManager) SetReleaseSettle(d time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.releaseSettle = d
+}
+
+// incompleteReleases returns the versions of updateAssetsMap the settle period
+// holds back, with the platforms they miss. A release is out since created,
+// by version, or else since it was first listed. g.mu must be held.
+func (g *ReleaseManager) incompleteReleases(updateAssetsMap map[string]map[string]map[string]*Asset, created map[string]time.Time, now time.Time) map[string]incompleteRelease {
+	if g.releaseSettle <= 0 {
+		return nil
+	}
+
+	// Platforms of every version, by channel.
+	platforms := make(map[string]map[string]bool)
+	versions := make(map[string][]semver.Version)
+	for os := range updateAssetsMap {
+		for arch, assets := range updateAssetsMap[os] {
+			for _, a := range assets {
+				v := a.v.String()
+				if platforms[v] == nil {
+					platforms[v] = make(map[string]bool)
+					channel := assetChannel(a)
+					versions[channel] = append(versions[channel], a.v)
+				}
+				platforms[v][os+"/"+arch] = true
+			}
+		}
+	}
+
+	incomplete := make(map[string]incompleteRelease)
+	for _, vs := range versions {
+		sort.Slice(vs, func(i, j int) bool { return vs[i].LT(vs[j]) })
+		for i := 1; i < len(vs); i++ {
+			v := vs[i].String()
+			var missing []string
+			for platform := range platforms[vs[i-1].String()] {
+				if !platforms[v][platform] {
+					missing = append(missing, platform)
+				}
+			}
+			if len(missing) == 0 {
+				continue
+			}
+			out, ok := created[v]
+			if !ok {
+				out = g.firstSeen[v]
+			}
+			until := out.Add(g.releaseSettle)
+			if !now.Before(until) {
+				continue
+			}
+			sort.Strings(missing)
+			incomplete[v] = incompleteRelease{missing: missing, until: until}
+		}
+	}
+	return incomplete
+}
+
+// unsettled tells whether v is held back for missing platforms, g.mu must be
+// held.
+func (g *ReleaseManager) unsettled(v semver.Version) bool {
+	r, held := g.incomplete[v.String()]
+	return held && time.Now().Before(r.until)
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReleaseSettle(t *testing.T) {
+	setTestPrivateKey(t)
+
+	p := NewMemoryProvider()
+	if err := p.AddRelease("1.0.0", "", map[string][]byte{
+		"autoupdate-binary-linux-amd64": []byte("settle linux 1.0.0"),
+		"autoupdate-binary-windows-386": []byte("settle windows 1.0.0"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// Still uploading, windows is missing.
+	if err := p.AddRelease("1.1.0", "", map[string][]byte{
+		"autoupdate-binary-linux-amd64": []byte("settle linux 1.1.0"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	g := NewReleaseManager("getlantern", "autoupdate-server", WithReleaseProvider(p))
+	g.SetReleaseSettle(time.Hour)
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(os string, arch string, version string) (*Result, error) {
+		return g.CheckForUpdate(&Params{
+			AppVersion: "1.0.0",
+			OS:         os,
+			Arch:       arch,
+			Checksum:   g.updateAssetsMap[os][arch][version].Checksum,
+		})
+	}
+	if _, err := check(OS.Linux, Arch.X64, "1.0.0"); !errors.Is(err, ErrNoUpdateAvailable) {
+		t.Fatalf("Expecting the incomplete 1.1.0 to be held back, got %v", err)
+	}
+	if g.updateAssetsMap[OS.Linux][Arch.X64]["1.1.0"] == nil {
+		t.Fatal("Expecting the incomplete release to be indexed all the same.")
+	}
+	if missing := g.Inventory("", "").Incomplete["1.1.0"]; len(missing) != 1 || missing[0] != "windows/386" {
+		t.Fatalf("Expecting the inventory to tell windows/386 is missing, got %v", missing)
+	}
+
+	// Once complete it's offered everywhere.
+	if err := p.AddRelease("1.1.0", "", map[string][]byte{
+		"autoupdate-binary-windows-386": []byte("settle windows 1.1.0"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+	for _, platform := range [][2]string{{OS.Linux, Arch.X64}, {OS.Windows, Arch.X86}} {
+		if res, err := check(platform[0], platform[1], "1.0.0"); err != nil || res.Version != "1.1.0" {
+			t.Fatalf("Expecting %v to be offered 1.1.0, got %+v %v", platform, res, err)
+		}
+	}
+	if inv := g.Inventory("", ""); inv.Incomplete != nil {
+		t.Fatalf("Expecting nothing held back, got %v", inv.Incomplete)
+	}
+
+	// Releases out for longer than the settle period are offered whatever
+	// they miss.
+	if err := p.AddRelease("1.2.0", "", map[string][]byte{
+		"autoupdate-binary-linux-amd64": []byte("settle linux 1.2.0"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	g.SetReleaseSettle(time.Nanosecond)
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := check(OS.Linux, Arch.X64, "1.1.0"); err != nil || res.Version != "1.2.0" {
+		t.Fatalf("Expecting the settled 1.2.0 to be offered, got %+v %v", res, err)
+	}
+}
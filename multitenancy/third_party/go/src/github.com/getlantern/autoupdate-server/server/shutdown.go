@@ -0,0 +1,121 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// drain tracks the patch generations and downloads in flight, so Close can
+// wait for them.
+type drain struct {
+	mu      sync.Mutex
+	closed  bool
+	running sync.WaitGroup
+	abort   context.Context // done once Close gave up waiting
+	cancel  context.CancelFunc
+}
+
+// drainKey marks the contexts of tracked work, whatever it starts on their
+// behalf is part of it.
+type drainKey struct{}
+
+// aborted returns the context done once Close gave up waiting, d.mu must be
+// held.
+func (d *drain) aborted() context.Context {
+	if d.abort == nil {
+		d.abort, d.cancel = context.WithCancel(context.Background())
+	}
+	return d.abort
+}
+
+// begin tracks the work about to be done with ctx until done is called,
+// returning the context to do it with, cancelled should Close give up
+// waiting for it. Once Close was called ErrShuttingDown is returned instead,
+// unless ctx is that of work already tracked.
+func (g *ReleaseManager) begin(ctx context.Context) (context.Context, func(), error) {
+	if ctx.Value(drainKey{}) != nil {
+		return ctx, func() {}, nil
+	}
+
+	d := &g.drain
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return nil, nil, ErrShuttingDown
+	}
+	d.running.Add(1)
+	abort := d.aborted()
+	d.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.WithValue(ctx, drainKey{}, true))
+	stop := context.AfterFunc(abort, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+		d.running.Done()
+	}, nil
+}
+
+// Close shuts the manager down: periodic, webhook and janitor runs are
+// stopped and new patch generations and downloads fail with ErrShuttingDown,
+// while those in flight are waited for until ctx is done. They are then
+// aborted and the cache files they were writing removed, so only complete
+// patches and assets are left in the cache. The error of ctx is returned if
+// it had to give up waiting. Patches already cached are still served.
+func (g *ReleaseManager) Close(ctx context.Context) error {
+	d := &g.drain
+	d.mu.Lock()
+	d.closed = true
+	d.aborted()
+	d.mu.Unlock()
+
+	g.stopWebhookRefresh()
+	g.StopAutoUpdate()
+	g.StopJanitor()
+
+	done := make(chan struct{})
+	go func() {
+		d.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	g.logger.Warn("Aborting patch generations and downloads still running on shutdown")
+	d.cancel()
+	removeIncomplete(g.PatchCacheDir())
+	removeIncomplete(g.DownloadDir())
+	return ctx.Err()
+}
+
+// closing tells whether Close was called.
+func (g *ReleaseManager) closing() bool {
+	g.drain.mu.Lock()
+	defer g.drain.mu.Unlock()
+	return g.drain.closed
+}
+
+// removeIncomplete deletes the temporary files in dir still being written.
+// Aborted writers can't rename them into place after that.
+func removeIncomplete(dir string) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, fi := range files {
+		file := filepath.Join(dir, fi.Name())
+		if strings.HasSuffix(fi.Name(), ".tmp") && writing.has(file) {
+			log.Debugf("Removing incomplete %s", file)
+			if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+				log.Errorf("Could not remove incomplete %s: %q", file, err)
+			}
+		}
+	}
+}
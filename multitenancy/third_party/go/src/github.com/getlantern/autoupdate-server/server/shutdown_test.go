@@ -0,0 +1,140 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/blang/semver"
+)
+
+// slowDiffer is a ContextDiffer whose patches are the new file itself,
+// written half way until release is closed.
+type slowDiffer struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func newSlowDiffer() *slowDiffer {
+	return &slowDiffer{started: make(chan struct{}), release: make(chan struct{})}
+}
+
+func (d *slowDiffer) Diff(oldPath string, newPath string, patchPath string) error {
+	return d.DiffContext(context.Background(), oldPath, newPath, patchPath)
+}
+
+func (d *slowDiffer) DiffContext(ctx context.Context, oldPath string, newPath string, patchPath string) error {
+	content, err := ioutil.ReadFile(newPath)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(patchPath, content[:len(content)/2], 0600); err != nil {
+		return err
+	}
+	close(d.started)
+	select {
+	case <-d.release:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return ioutil.WriteFile(patchPath, content, 0600)
+}
+
+func (d *slowDiffer) Patch(oldPath string, newPath string, patchPath string) error {
+	return copyFile(patchPath, newPath)
+}
+
+func TestClose(t *testing.T) {
+	generate := func(t *testing.T) (*ReleaseManager, *slowDiffer, string, chan error) {
+		g, _ := newTestMemoryManager(t)
+		if err := g.SetPatchCacheDir(t.TempDir()); err != nil {
+			t.Fatal(err)
+		}
+		if err := g.SetDownloadDir(t.TempDir()); err != nil {
+			t.Fatal(err)
+		}
+		if err := g.UpdateAssetsMap(); err != nil {
+			t.Fatal(err)
+		}
+		d := newSlowDiffer()
+		g.SetDiffer(PATCHTYPE_BSDIFF, d)
+
+		oldAsset := g.assetOfVersion(OS.Linux, Arch.X64, semver.MustParse("1.1.0"))
+		newAsset := g.assetOfVersion(OS.Linux, Arch.X64, semver.MustParse("1.2.0"))
+		errs := make(chan error, 1)
+		go func() {
+			_, err := g.GeneratePatch(oldAsset.URL, newAsset.URL)
+			errs <- err
+		}()
+		<-d.started
+		return g, d, newAsset.LocalFile, errs
+	}
+	cached := func(t *testing.T, g *ReleaseManager) [][]byte {
+		files, err := ioutil.ReadDir(g.PatchCacheDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var contents [][]byte
+		for _, fi := range files {
+			content, err := ioutil.ReadFile(filepath.Join(g.PatchCacheDir(), fi.Name()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			contents = append(contents, content)
+		}
+		return contents
+	}
+
+	t.Run("deadline", func(t *testing.T) {
+		g, _, _, errs := generate(t)
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		if err := g.Close(ctx); err != context.DeadlineExceeded {
+			t.Fatalf("Expecting Close to give up on the generation, got %v", err)
+		}
+		if err := <-errs; err == nil {
+			t.Fatal("Expecting the aborted generation to fail.")
+		}
+		if contents := cached(t, g); len(contents) != 0 {
+			t.Fatalf("Expecting nothing left in the patch cache, got %d files", len(contents))
+		}
+
+		newAsset := g.assetOfVersion(OS.Linux, Arch.X64, semver.MustParse("1.2.0"))
+		oldAsset := g.assetOfVersion(OS.Linux, Arch.X64, semver.MustParse("1.0.0"))
+		if _, err := g.GeneratePatch(oldAsset.URL, newAsset.URL); !errors.Is(err, ErrShuttingDown) {
+			t.Fatalf("Expecting ErrShuttingDown for a new generation, got %v", err)
+		}
+	})
+
+	t.Run("drained", func(t *testing.T) {
+		g, d, newFile, errs := generate(t)
+		closed := make(chan error, 1)
+		go func() {
+			closed <- g.Close(context.Background())
+		}()
+		select {
+		case err := <-closed:
+			t.Fatalf("Expecting Close to wait for the generation, got %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+		close(d.release)
+		if err := <-closed; err != nil {
+			t.Fatal(err)
+		}
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+
+		content, err := ioutil.ReadFile(newFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if contents := cached(t, g); len(contents) != 1 || !bytes.Equal(contents[0], content) {
+			t.Fatalf("Expecting the complete patch in the cache, got %d files", len(contents))
+		}
+	})
+}
@@ -1,20 +1,29 @@
 package server
 
 import (
+	"context"
 	"crypto"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha1"
 	"crypto/x509"
 	"encoding/hex"
 	"encoding/pem"
 	"fmt"
 	"github.com/getlantern/go-update"
+	"io"
 	"io/ioutil"
 	"os"
+	"strings"
+	"sync"
 )
 
 const (
 	privateKeyEnv = `PRIVATE_KEY`
+
+	// Suffix of the detached signature published along a release asset.
+	signatureSuffix = ".sig"
 )
 
 var (
@@ -38,12 +47,23 @@ func checksumForFile(file string) (checksumHex string, err error) {
 	return checksumHex, nil
 }
 
-func signatureForFile(file string) (signatureHex string, err error) {
+// sha1ForFile returns the hex encoded SHA-1 of the given file, the legacy
+// checksum of older clients.
+func sha1ForFile(file string) (string, error) {
+	fp, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer fp.Close()
 
-	if privateKeyFile == "" {
-		log.Fatalf("Missing %s environment variable.", privateKeyEnv)
+	h := sha1.New()
+	if _, err = io.Copy(h, fp); err != nil {
+		return "", err
 	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
 
+func signatureForFile(file string) (signatureHex string, err error) {
 	var checksum string
 
 	if checksum, err = checksumForFile(file); err != nil {
@@ -55,6 +75,16 @@ func signatureForFile(file string) (signatureHex string, err error) {
 		return "", err
 	}
 
+	return signLegacy(checksumHex)
+}
+
+// signLegacy returns the hex encoded signature of the given binary checksum
+// by the PRIVATE_KEY file.
+func signLegacy(checksum []byte) (signatureHex string, err error) {
+	if privateKeyFile == "" {
+		return "", fmt.Errorf("Missing %s environment variable.", privateKeyEnv)
+	}
+
 	// Loading private key
 	var pb []byte
 	var fpk *os.File
@@ -68,21 +98,244 @@ func signatureForFile(file string) (signatureHex string, err error) {
 		return "", fmt.Errorf("Could not read private key: %q", err)
 	}
 
-	// Decoding PEM key.
-	pemBlock, _ := pem.Decode(pb)
+	key, err := ParseSigningKey("", pb)
+	if err != nil {
+		return "", err
+	}
+	// Legacy clients only verify RSA signatures.
+	if _, ok := key.signer.Public().(*rsa.PublicKey); !ok {
+		return "", fmt.Errorf("Legacy signatures need an RSA private key.")
+	}
+
+	var signature string
+	if signature, err = key.sign(checksum); err != nil {
+		return "", fmt.Errorf("Could not create signature: %q", err)
+	}
+
+	return signature, nil
+}
+
+// SigningKey is a key assets are signed with, either RSA (PKCS#1 v1.5 over
+// the SHA-256 checksum, like the legacy signature) or Ed25519 (over the
+// SHA-256 checksum).
+type SigningKey struct {
+	ID     string
+	signer crypto.Signer
+}
+
+// NewRSASigningKey wraps an RSA private key.
+func NewRSASigningKey(id string, key *rsa.PrivateKey) *SigningKey {
+	return &SigningKey{ID: id, signer: key}
+}
+
+// NewEd25519SigningKey wraps an Ed25519 private key.
+func NewEd25519SigningKey(id string, key ed25519.PrivateKey) *SigningKey {
+	return &SigningKey{ID: id, signer: key}
+}
+
+// NewSigningKey wraps a signer holding an RSA or Ed25519 key, like one kept in
+// a hardware module. Signers of other keys are refused right away.
+func NewSigningKey(id string, signer crypto.Signer) (*SigningKey, error) {
+	switch signer.Public().(type) {
+	case *rsa.PublicKey, ed25519.PublicKey:
+		return &SigningKey{ID: id, signer: signer}, nil
+	}
+	return nil, fmt.Errorf("Unsupported signing key %T.", signer.Public())
+}
+
+// LoadSigningKey reads a PEM encoded RSA (PKCS#1 or PKCS#8) or Ed25519
+// (PKCS#8) private key.
+func LoadSigningKey(id string, file string) (*SigningKey, error) {
+	pb, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read private key: %q", err)
+	}
+	key, err := ParseSigningKey(id, pb)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return key, nil
+}
+
+// ParseSigningKey is like LoadSigningKey for the PEM encoded key itself.
+func ParseSigningKey(id string, pemBytes []byte) (*SigningKey, error) {
+	pemBlock, _ := pem.Decode(pemBytes)
+	if pemBlock == nil {
+		return nil, fmt.Errorf("Could not decode private key.")
+	}
+
+	if pemBlock.Type == "RSA PRIVATE KEY" {
+		key, err := x509.ParsePKCS1PrivateKey(pemBlock.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse private key: %q", err)
+		}
+		return NewRSASigningKey(id, key), nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(pemBlock.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse private key: %q", err)
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return NewRSASigningKey(id, k), nil
+	case ed25519.PrivateKey:
+		return NewEd25519SigningKey(id, k), nil
+	}
+	return nil, fmt.Errorf("Unsupported private key type %T.", key)
+}
+
+// sign returns the hex encoded signature of the given binary checksum.
+func (k *SigningKey) sign(checksum []byte) (string, error) {
+	// RSA signs the checksum as a SHA-256 digest, Ed25519 as the message.
+	var opts crypto.SignerOpts = crypto.SHA256
+	if _, ok := k.signer.Public().(ed25519.PublicKey); ok {
+		opts = crypto.Hash(0)
+	}
+	signature, err := k.signer.Sign(rand.Reader, checksum, opts)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(signature), nil
+}
+
+// signatureCache keeps the signatures of asset checksums, keyed by checksum
+// and then key ID. The legacy signature has an empty key ID.
+type signatureCache struct {
+	mu         sync.Mutex
+	signatures map[string]map[string]string
+}
+
+func (c *signatureCache) get(checksum string, keyID string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	signature, ok := c.signatures[checksum][keyID]
+	return signature, ok
+}
+
+func (c *signatureCache) put(checksum string, keyID string, signature string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.signatures == nil {
+		c.signatures = make(map[string]map[string]string)
+	}
+	if c.signatures[checksum] == nil {
+		c.signatures[checksum] = make(map[string]string)
+	}
+	c.signatures[checksum][keyID] = signature
+}
+
+// signAsset returns the legacy signature and the signature by each signing
+// key of the given file. Signatures are computed once per checksum.
+func (g *ReleaseManager) signAsset(file string, checksum string) (legacy string, signatures map[string]string, err error) {
+	if len(g.signingKeys) == 0 {
+		if legacy, ok := g.signatures.get(checksum, ""); ok {
+			return legacy, nil, nil
+		}
+		if legacy, err = signatureForFile(file); err != nil {
+			return "", nil, err
+		}
+		g.signatures.put(checksum, "", legacy)
+		return legacy, nil, nil
+	}
+
+	var sum []byte
+	if sum, err = hex.DecodeString(checksum); err != nil {
+		return "", nil, err
+	}
+
+	signatures = make(map[string]string, len(g.signingKeys))
+	for _, key := range g.signingKeys {
+		signature, ok := g.signatures.get(checksum, key.ID)
+		if !ok {
+			if signature, err = key.sign(sum); err != nil {
+				return "", nil, fmt.Errorf("Could not create signature for file %s: %q", file, err)
+			}
+			g.signatures.put(checksum, key.ID, signature)
+		}
+		signatures[key.ID] = signature
+	}
+
+	return signatures[g.signingKeys[0].ID], signatures, nil
+}
 
-	var privateKey *rsa.PrivateKey
-	if privateKey, err = x509.ParsePKCS1PrivateKey(pemBlock.Bytes); err != nil {
-		return "", fmt.Errorf("Could not parse private key: %q", err)
+// signaturesFor returns the asset signatures by the given keys, nil if none
+// were asked for.
+func (a *Asset) signaturesFor(keyIDs []string) map[string]string {
+	if len(keyIDs) == 0 {
+		return nil
+	}
+	signatures := make(map[string]string)
+	for _, id := range keyIDs {
+		if signature, ok := a.Signatures[id]; ok {
+			signatures[id] = signature
+		}
+	}
+	return signatures
+}
+
+// SetVerificationKey makes UpdateAssetsMap check every update asset against
+// the detached signature published along it, as <asset>.sig holding the hex
+// encoded signature of the asset's SHA-256 checksum. The key is either an
+// *rsa.PublicKey (PKCS#1 v1.5) or an ed25519.PublicKey. While rotating keys,
+// signatures by one of the previous keys are valid too, so releases signed
+// before keep being served. Assets without a valid signature are logged and
+// skipped. A nil key disables verification.
+func (g *ReleaseManager) SetVerificationKey(key crypto.PublicKey, previous ...crypto.PublicKey) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if key == nil {
+		g.verifyKeys = nil
+		return
+	}
+	g.verifyKeys = append([]crypto.PublicKey{key}, previous...)
+}
+
+// verifyDetachedSignature downloads the signature at sigURL like any asset
+// and checks it matches the given hex encoded checksum with one of the given
+// keys. The signature is downloaded again every time, a release may replace
+// it under the same URL, and deleted once checked.
+func (g *ReleaseManager) verifyDetachedSignature(ctx context.Context, keys []crypto.PublicKey, sigURL string, checksum string) error {
+	if sigURL == "" {
+		return fmt.Errorf("%w: no detached signature", ErrBadSignature)
+	}
+
+	g.downloads.drop(assetFile(g.DownloadDir(), sigURL))
+	sigfile, release, err := g.downloadKnownAsset(ctx, sigURL)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	b, err := ioutil.ReadFile(sigfile)
+	if err != nil {
+		return err
 	}
 
-	// Checking message signature.
 	var signature []byte
-	if signature, err = rsa.SignPKCS1v15(rand.Reader, privateKey, crypto.SHA256, checksumHex); err != nil {
-		return "", fmt.Errorf("Could not create signature for file %s: %q", file, err)
+	if signature, err = hex.DecodeString(strings.TrimSpace(string(b))); err != nil {
+		return fmt.Errorf("%w: %v", ErrBadSignature, err)
+	}
+
+	var sum []byte
+	if sum, err = hex.DecodeString(checksum); err != nil {
+		return err
 	}
 
-	signatureHex = hex.EncodeToString(signature)
+	for _, key := range keys {
+		switch k := key.(type) {
+		case *rsa.PublicKey:
+			if rsa.VerifyPKCS1v15(k, crypto.SHA256, sum, signature) == nil {
+				return nil
+			}
+		case ed25519.PublicKey:
+			if ed25519.Verify(k, sum, signature) {
+				return nil
+			}
+		default:
+			return fmt.Errorf("Unsupported verification key %T.", key)
+		}
+	}
 
-	return signatureHex, nil
+	return ErrBadSignature
 }
@@ -0,0 +1,309 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSigningKeys(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Ed25519 keys are loaded from PKCS#8 PEM files.
+	der, err := x509.MarshalPKCS8PrivateKey(edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp, err := ioutil.TempFile("", "autoupdate-ed25519")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fp.Name())
+	pem.Encode(fp, &pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	fp.Close()
+
+	ed, err := LoadSigningKey("ed-2024", fp.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Malformed and unsupported keys are refused before anything is signed.
+	if _, err = ParseSigningKey("bad", []byte("not a key")); err == nil {
+		t.Fatal("Expecting a malformed key to be refused.")
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewSigningKey("ec", ecKey); err == nil {
+		t.Fatal("Expecting an ECDSA key to be refused.")
+	}
+
+	// Keys held elsewhere only need to sign.
+	rsaSigner, err := NewSigningKey("rsa-2015", struct{ crypto.Signer }{rsaKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const content = "signed by two keys"
+	srv := newTestAssetServer(map[string]string{"/1.0.0": content})
+	defer srv.Close()
+
+	g := NewReleaseManager("getlantern", "autoupdate-server", WithSigningKeys(rsaSigner, ed))
+	asset := &Asset{Name: "autoupdate-binary-linux-amd64", URL: srv.URL + "/1.0.0"}
+	asset.v, _ = parseVersion("1.0.0")
+	if err = g.pushAsset(OS.Linux, Arch.X64, asset); err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha256.Sum256([]byte(content))
+	verify := func(res *Result) {
+		if sig, ok := res.Signatures["ed-2024"]; ok {
+			b, _ := hex.DecodeString(sig)
+			if !ed25519.Verify(edPub, sum[:], b) {
+				t.Fatal("Expecting a valid Ed25519 signature.")
+			}
+		}
+		b, _ := hex.DecodeString(res.Signature)
+		if err := rsa.VerifyPKCS1v15(&rsaKey.PublicKey, crypto.SHA256, sum[:], b); err != nil {
+			t.Fatalf("Expecting the legacy signature to come from the first key: %q", err)
+		}
+	}
+
+	check := func(trusted ...string) *Result {
+		res, err := g.CheckForUpdate(&Params{
+			AppVersion:  "0.9.0",
+			OS:          OS.Linux,
+			Arch:        Arch.X64,
+			Checksum:    "unknown",
+			TrustedKeys: trusted,
+		})
+		if err != nil && !errors.Is(err, ErrUnknownVersion) {
+			t.Fatal(err)
+		}
+		verify(res)
+		return res
+	}
+
+	if res := check(); res.Signatures != nil || res.SignatureKeyID != "rsa-2015" {
+		t.Fatalf("Expecting only the signature of rsa-2015 without trusted keys, got %+v", res)
+	}
+	if res := check("ed-2024", "unknown-key"); len(res.Signatures) != 1 || res.Signatures["ed-2024"] == "" {
+		t.Fatalf("Expecting the Ed25519 signature only, got %v", res.Signatures)
+	}
+	if res := check("rsa-2015", "ed-2024"); len(res.Signatures) != 2 {
+		t.Fatalf("Expecting both signatures, got %v", res.Signatures)
+	}
+
+	// Signatures are computed once per checksum.
+	checksum := fmt.Sprintf("%x", sum)
+	g.signatures.put(checksum, "ed-2024", "cached")
+	again := &Asset{Name: "autoupdate-binary-linux-amd64", URL: srv.URL + "/1.0.0"}
+	again.v, _ = parseVersion("1.0.0")
+	if err = g.pushAsset(OS.Linux, Arch.X64, again); err != nil {
+		t.Fatal(err)
+	}
+	if again.Signatures["ed-2024"] != "cached" {
+		t.Fatal("Expecting the cached signature to be reused.")
+	}
+}
+
+func TestSignLegacyBadKey(t *testing.T) {
+	defer SetPrivateKey(privateKeyFile)
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checksum := sha256.Sum256([]byte("binary"))
+	for _, content := range [][]byte{
+		[]byte("not a key"),
+		pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: []byte("garbage")}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}),
+	} {
+		file := filepath.Join(t.TempDir(), "key.pem")
+		if err := ioutil.WriteFile(file, content, 0600); err != nil {
+			t.Fatal(err)
+		}
+		SetPrivateKey(file)
+		if _, err := signLegacy(checksum[:]); err == nil {
+			t.Fatalf("Expecting an error signing with %q", content)
+		}
+	}
+
+	// Without a key, signing files fails rather than exiting.
+	file := filepath.Join(t.TempDir(), "binary")
+	if err := ioutil.WriteFile(file, []byte("binary"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	SetPrivateKey("")
+	if _, err := signatureForFile(file); err == nil {
+		t.Fatal("Expecting an error signing without a key")
+	}
+}
+
+func TestVerifyDetachedSignatures(t *testing.T) {
+	setTestPrivateKey(t)
+
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := func(content string) string {
+		sum := sha256.Sum256([]byte(content))
+		return hex.EncodeToString(ed25519.Sign(key, sum[:]))
+	}
+
+	files := map[string]string{
+		"/1.0.0/autoupdate-binary-linux-amd64":  "verified 1.0.0",
+		"/1.1.0/autoupdate-binary-linux-amd64":  "tampered 1.1.0",
+		"/1.1.0/autoupdate-binary-darwin-amd64": "unsigned 1.1.0",
+	}
+	// 1.0.0 was signed before the key was rotated.
+	sum := sha256.Sum256([]byte(files["/1.0.0/autoupdate-binary-linux-amd64"]))
+	oldSig, err := rsa.SignPKCS1v15(rand.Reader, oldKey, crypto.SHA256, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	files["/1.0.0/autoupdate-binary-linux-amd64.sig"] = hex.EncodeToString(oldSig)
+	files["/1.1.0/autoupdate-binary-linux-amd64.sig"] = sign("the original 1.1.0")
+	srv := newTestAssetServer(files)
+	defer srv.Close()
+
+	asset := func(id int, version string, name string) string {
+		return fmt.Sprintf(`{"id": %d, "name": "%s", "browser_download_url": "%s/%s/%s"}`, id, name, srv.URL, version, name)
+	}
+	api := newTestReleasesAPI(fmt.Sprintf(`[
+		{"id": 2, "tag_name": "1.1.0", "zipball_url": "%s/1.1.0.zip", "assets": [%s, %s, %s]},
+		{"id": 1, "tag_name": "1.0.0", "zipball_url": "%s/1.0.0.zip", "assets": [%s, %s]}
+	]`, srv.URL,
+		asset(20, "1.1.0", "autoupdate-binary-linux-amd64"),
+		asset(21, "1.1.0", "autoupdate-binary-linux-amd64.sig"),
+		asset(22, "1.1.0", "autoupdate-binary-darwin-amd64"),
+		srv.URL,
+		asset(10, "1.0.0", "autoupdate-binary-linux-amd64"),
+		asset(11, "1.0.0", "autoupdate-binary-linux-amd64.sig")))
+	defer api.Close()
+
+	g := NewReleaseManager("getlantern", "autoupdate-server")
+	useTestGitHub(t, g, api)
+	g.SetVerificationKey(pub, &oldKey.PublicKey)
+	if err = g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+
+	latest, err := g.getProductUpdate(Channel.Stable, OS.Linux, Arch.X64, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest.v.String() != "1.0.0" {
+		t.Fatalf("Expecting the tampered 1.1.0 to be skipped, got %v", latest.v)
+	}
+	if g.updateAssetsMap[OS.Linux][Arch.X64]["1.1.0"] != nil {
+		t.Fatal("Expecting the tampered asset not to be indexed.")
+	}
+	if g.updateAssetsMap[OS.Darwin] != nil {
+		t.Fatal("Expecting the unsigned asset not to be indexed.")
+	}
+	if len(g.updateAssetsMap[OS.Linux][Arch.X64]) != 1 {
+		t.Fatal("Expecting signatures not to be taken for update assets.")
+	}
+
+	// Once the old key is dropped, what it signed isn't offered anymore.
+	g.SetVerificationKey(pub)
+	g.UpdateAssetsMap()
+	if g.updateAssetsMap[OS.Linux] != nil {
+		t.Fatal("Expecting assets signed by a dropped key not to be indexed.")
+	}
+}
+
+func TestVerifyDetachedSignaturesPrivate(t *testing.T) {
+	setTestPrivateKey(t)
+	const token, content = "s3cr3t", "private linux binary"
+
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte(content))
+	files := map[string]string{
+		"/repos/getlantern/autoupdate-server/releases/assets/11": content,
+		"/repos/getlantern/autoupdate-server/releases/assets/12": hex.EncodeToString(ed25519.Sign(key, sum[:])),
+	}
+
+	var api *httptest.Server
+	api = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "token "+token {
+			http.NotFound(w, r)
+			return
+		}
+		switch r.URL.Path {
+		case "/repos/getlantern/autoupdate-server":
+			w.Write([]byte(`{"id": 1, "name": "autoupdate-server", "private": true}`))
+		case "/repos/getlantern/autoupdate-server/releases":
+			fmt.Fprintf(w, `[{"id": 1, "tag_name": "1.0.0", "zipball_url": "%[1]s/1.0.0.zip", "assets": [
+				{"id": 11, "name": "autoupdate-binary-linux-amd64", "url": "%[1]s/repos/getlantern/autoupdate-server/releases/assets/11", "browser_download_url": "%[1]s/download/11"},
+				{"id": 12, "name": "autoupdate-binary-linux-amd64.sig", "url": "%[1]s/repos/getlantern/autoupdate-server/releases/assets/12", "browser_download_url": "%[1]s/download/12"}
+			]}]`, api.URL)
+		default:
+			if body, ok := files[r.URL.Path]; ok && r.Header.Get("Accept") == "application/octet-stream" {
+				w.Write([]byte(body))
+				return
+			}
+			http.NotFound(w, r)
+		}
+	}))
+	defer api.Close()
+
+	g := NewReleaseManager("getlantern", "autoupdate-server", WithToken(token), WithBaseURL(api.URL))
+	dir := t.TempDir()
+	if err := g.SetDownloadDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	// A stale signature downloaded before must not be taken.
+	sigfile := assetFile(dir, api.URL+"/repos/getlantern/autoupdate-server/releases/assets/12")
+	if err := ioutil.WriteFile(sigfile, []byte("stale"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	g.SetVerificationKey(pub)
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+	if g.updateAssetsMap[OS.Linux][Arch.X64]["1.0.0"] == nil {
+		t.Fatal("Expecting the private asset signed with the key to be indexed.")
+	}
+	if _, err := os.Stat(sigfile); !os.IsNotExist(err) {
+		t.Fatalf("Expecting the signature to be deleted once checked, got %v", err)
+	}
+}
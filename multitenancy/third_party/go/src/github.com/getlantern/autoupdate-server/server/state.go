@@ -0,0 +1,194 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// CheckRecord is a client update check as seen by CheckForUpdate.
+type CheckRecord struct {
+	Time       time.Time
+	OS         string
+	Arch       string
+	Channel    string
+	AppVersion string
+	// Offered is the version the client was told to update to, empty if none.
+	Offered string
+}
+
+// Report is sent by a client after trying to apply an update.
+type Report struct {
+	Time    time.Time
+	OS      string
+	Arch    string
+	Version string // the version the client tried to update to
+	Success bool
+	Error   string
+}
+
+// VersionState holds the counters kept for a version.
+type VersionState struct {
+	Checks    int // checks from clients running the version
+	Offered   int // checks answered with the version
+	Successes int // reports of a successful update to the version
+	Failures  int // reports of a failed update to the version
+}
+
+// StateSnapshot is the state recorded so far, keyed by version.
+type StateSnapshot struct {
+	Versions map[string]VersionState
+}
+
+// StateStore records client telemetry. Deployments can back it with anything
+// from memory to a database, ReleaseManager only goes through this interface.
+type StateStore interface {
+	RecordCheck(r *CheckRecord) error
+	RecordReport(r *Report) error
+	Snapshot() (*StateSnapshot, error)
+}
+
+// MemoryStateStore is a StateStore that keeps everything in memory, it is the
+// default.
+type MemoryStateStore struct {
+	mu       sync.Mutex
+	versions map[string]VersionState
+}
+
+// NewMemoryStateStore returns an empty MemoryStateStore.
+func NewMemoryStateStore() *MemoryStateStore {
+	return &MemoryStateStore{versions: make(map[string]VersionState)}
+}
+
+// RecordCheck counts a check.
+func (s *MemoryStateStore) RecordCheck(r *CheckRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	vs := s.versions[r.AppVersion]
+	vs.Checks++
+	s.versions[r.AppVersion] = vs
+
+	if r.Offered != "" {
+		vs = s.versions[r.Offered]
+		vs.Offered++
+		s.versions[r.Offered] = vs
+	}
+	return nil
+}
+
+// RecordReport counts a report.
+func (s *MemoryStateStore) RecordReport(r *Report) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	vs := s.versions[r.Version]
+	if r.Success {
+		vs.Successes++
+	} else {
+		vs.Failures++
+	}
+	s.versions[r.Version] = vs
+	return nil
+}
+
+// Snapshot returns a copy of the counters.
+func (s *MemoryStateStore) Snapshot() (*StateSnapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snapshot := &StateSnapshot{Versions: make(map[string]VersionState, len(s.versions))}
+	for v, vs := range s.versions {
+		snapshot.Versions[v] = vs
+	}
+	return snapshot, nil
+}
+
+// WithStateStore records client telemetry in the given store instead of
+// memory.
+func WithStateStore(s StateStore) Option {
+	return func(g *ReleaseManager) {
+		g.state = s
+	}
+}
+
+// autoDisable holds the threshold past which a version is pulled from
+// distribution.
+type autoDisable struct {
+	minReports  int
+	maxFailures float64
+}
+
+// SetAutoDisable yanks a version once at least minReports updates to it were
+// reported and the fraction of them that failed exceeds maxFailures. A
+// minReports of zero or less disables the check, which is the default.
+func (g *ReleaseManager) SetAutoDisable(minReports int, maxFailures float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.autoDisable = autoDisable{minReports: minReports, maxFailures: maxFailures}
+}
+
+// recordCheck stores a check, failing to do so never fails the check itself.
+func (g *ReleaseManager) recordCheck(p *Params, appVersion string, res *Result) {
+	r := &CheckRecord{
+		Time:       time.Now(),
+		OS:         p.OS,
+		Arch:       p.Arch,
+		Channel:    p.Channel,
+		AppVersion: appVersion,
+	}
+	if res != nil {
+		r.Offered = res.Version
+	}
+	if err := g.state.RecordCheck(r); err != nil {
+		log.Errorf("Could not record update check: %q", err)
+	}
+}
+
+// RecordReport stores the outcome of a client update and yanks the version it
+// updated to if too many of those failed, see SetAutoDisable.
+func (g *ReleaseManager) RecordReport(r *Report) error {
+	v, err := parseVersion(r.Version)
+	if err != nil {
+		return &ParamsError{fmt.Sprintf("Bad version string: %v", err)}
+	}
+	r.Version = v.String()
+	if r.Time.IsZero() {
+		r.Time = time.Now()
+	}
+
+	if err = g.state.RecordReport(r); err != nil {
+		return err
+	}
+
+	if r.Success {
+		return nil
+	}
+	return g.checkAutoDisable(r.Version)
+}
+
+// checkAutoDisable yanks the given version if its reported failures are past
+// the threshold.
+func (g *ReleaseManager) checkAutoDisable(version string) error {
+	g.mu.RLock()
+	threshold := g.autoDisable
+	g.mu.RUnlock()
+
+	if threshold.minReports <= 0 {
+		return nil
+	}
+
+	snapshot, err := g.state.Snapshot()
+	if err != nil {
+		return err
+	}
+
+	vs := snapshot.Versions[version]
+	reports := vs.Successes + vs.Failures
+	if reports < threshold.minReports || float64(vs.Failures) <= threshold.maxFailures*float64(reports) {
+		return nil
+	}
+
+	log.Errorf("Disabling version %s, %d of %d updates to it failed", version, vs.Failures, reports)
+	return g.SetYanked(version, true)
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestStateStoreAutoDisable(t *testing.T) {
+	store := NewMemoryStateStore()
+
+	g, current, _ := newTestUpdatePair(t, nil)
+	g.state = store
+	g.SetMaxPatchRatio(0)
+	g.SetAutoDisable(3, 0.5)
+
+	check := func() (*Result, error) {
+		return g.CheckForUpdate(&Params{
+			AppVersion: "1.0.0",
+			OS:         OS.Linux,
+			Arch:       Arch.X64,
+			Checksum:   current.Checksum,
+		})
+	}
+
+	if res, err := check(); err != nil || res.Version != "1.1.0" {
+		t.Fatalf("Expecting an update to 1.1.0, got %+v, %q", res, err)
+	}
+
+	snapshot, err := store.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vs := snapshot.Versions["1.0.0"]; vs.Checks != 1 {
+		t.Fatalf("Expecting one check from 1.0.0, got %+v", vs)
+	}
+	if vs := snapshot.Versions["1.1.0"]; vs.Offered != 1 {
+		t.Fatalf("Expecting 1.1.0 to be offered once, got %+v", vs)
+	}
+
+	for _, ok := range []bool{true, false} {
+		if err = g.RecordReport(&Report{OS: OS.Linux, Arch: Arch.X64, Version: "1.1.0", Success: ok}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if g.isYanked(g.updateAssetsMap[OS.Linux][Arch.X64]["1.1.0"].v) {
+		t.Fatal("Expecting too few reports not to disable the version.")
+	}
+
+	// Records live in the store, a manager sharing it picks them up.
+	g2, _, _ := newTestUpdatePair(t, nil)
+	g2.state = store
+	g2.SetAutoDisable(3, 0.5)
+	if err = g2.RecordReport(&Report{OS: OS.Linux, Arch: Arch.X64, Version: "v1.1.0", Error: "bspatch failed"}); err != nil {
+		t.Fatal(err)
+	}
+	if !g2.isYanked(g2.updateAssetsMap[OS.Linux][Arch.X64]["1.1.0"].v) {
+		t.Fatal("Expecting 2 failures out of 3 reports to disable the version.")
+	}
+
+	g2.SetYanked("1.1.0", false)
+	if err = g2.RecordReport(&Report{Version: "one"}); err == nil {
+		t.Fatal("Expecting a bad version to be rejected.")
+	}
+}
@@ -0,0 +1,561 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/blang/semver"
+)
+
+const (
+	// Storage key of the assets maps snapshot.
+	assetsStorageKey = "assets.json"
+
+	// Storage key prefix of generated patches, followed by the patch file
+	// name.
+	patchStoragePrefix = "patches/"
+
+	// Version of the assets maps snapshot layout, snapshots of any other
+	// version are rejected.
+	assetsSchemaVersion = 1
+)
+
+// Storage persists the manager's state across restarts. Values are opaque
+// blobs saved and loaded by key, keys are slash separated relative paths.
+type Storage interface {
+	// Save stores value under key, replacing any previous value.
+	Save(key string, value []byte) error
+	// Load returns the value stored under key, ErrNotStored if there is none.
+	Load(key string) ([]byte, error)
+}
+
+// StreamStorage is a Storage that also saves and loads values as streams,
+// patches then go through without being held in memory whole.
+type StreamStorage interface {
+	Storage
+	// SaveFrom stores what r yields under key, replacing any previous value.
+	SaveFrom(key string, r io.Reader) error
+	// Open returns the value stored under key, ErrNotStored if there is none.
+	Open(key string) (io.ReadCloser, error)
+}
+
+// FileStorage is a StreamStorage keeping every value in a file under Dir.
+type FileStorage struct {
+	Dir string
+}
+
+// NewFileStorage returns a FileStorage in the given directory, it is created
+// if it does not exist.
+func NewFileStorage(dir string) (*FileStorage, error) {
+	if err := os.MkdirAll(dir, os.ModeDir|0700); err != nil {
+		return nil, fmt.Errorf("Could not create storage directory: %q", err)
+	}
+	return &FileStorage{Dir: dir}, nil
+}
+
+func (s *FileStorage) file(key string) (string, error) {
+	name := filepath.FromSlash(key)
+	if key == "" || filepath.IsAbs(name) || strings.HasPrefix(filepath.Clean(name), "..") {
+		return "", fmt.Errorf("Bad storage key %q.", key)
+	}
+	return filepath.Join(s.Dir, name), nil
+}
+
+// Save writes value to the key's file. The value is written to a temporary
+// file first so a crash never leaves a truncated value behind.
+func (s *FileStorage) Save(key string, value []byte) error {
+	file, err := s.file(key)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(file), os.ModeDir|0700); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(file, value)
+}
+
+// SaveFrom is like Save, copying r to the key's file.
+func (s *FileStorage) SaveFrom(key string, r io.Reader) error {
+	file, err := s.file(key)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(file), os.ModeDir|0700); err != nil {
+		return err
+	}
+
+	return writeFileAtomicFrom(file, r)
+}
+
+// Open opens the key's file.
+func (s *FileStorage) Open(key string) (io.ReadCloser, error) {
+	file, err := s.file(key)
+	if err != nil {
+		return nil, err
+	}
+
+	fp, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, ErrNotStored
+	}
+	return fp, err
+}
+
+// Load reads the key's file.
+func (s *FileStorage) Load(key string) ([]byte, error) {
+	file, err := s.file(key)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, ErrNotStored
+	}
+	return value, err
+}
+
+// storedAssets is the snapshot of the assets maps kept in storage, the latest
+// assets are recomputed from the update assets and the releases served as
+// latest when loading.
+type storedAssets struct {
+	Schema int `json:"schema"`
+	// When the assets were last known to be up to date.
+	SavedAt      time.Time     `json:"saved_at"`
+	ETag         string        `json:"etag"`
+	LastModified string        `json:"last_modified"`
+	Assets       []storedAsset `json:"assets"`
+	Aux          []storedAsset `json:"aux"`
+	// Rollout percentages from the release notes, by version.
+	Rollouts map[string]float64 `json:"rollouts"`
+	// Release notes, by version.
+	Notes map[string]string `json:"notes,omitempty"`
+	// Release creation times, by version.
+	Dates map[string]time.Time `json:"dates,omitempty"`
+	// Release git tags, by version.
+	Tags map[string]string `json:"tags,omitempty"`
+	// Versions of the releases taken down, by the checksums of their
+	// assets.
+	Withdrawn map[string]string `json:"withdrawn,omitempty"`
+	// Versions served to devices with SetOverride, by device ID.
+	Overrides map[string]string `json:"overrides,omitempty"`
+	// Tag of the release served as latest with SetLatestOverride.
+	LatestOverride string `json:"latest_override,omitempty"`
+	// Versions of the releases github marks as latest, by channel.
+	MarkedLatest map[string]string `json:"marked_latest,omitempty"`
+}
+
+// storedAsset carries the unexported fields of an Asset along with it.
+type storedAsset struct {
+	Asset
+	ID      int    `json:"id"`
+	Version string `json:"version"`
+	Digest  string `json:"digest"`
+	Channel string `json:"channel"`
+}
+
+func newStoredAsset(a *Asset) storedAsset {
+	return storedAsset{
+		Asset:   *a,
+		ID:      a.id,
+		Version: a.v.String(),
+		Digest:  a.digest,
+		Channel: a.channel,
+	}
+}
+
+func (s *storedAsset) asset() (*Asset, error) {
+	a := s.Asset
+	v, err := parseVersion(s.Version)
+	if err != nil {
+		return nil, err
+	}
+	a.id, a.v, a.digest, a.channel = s.ID, v, s.Digest, s.Channel
+	return &a, nil
+}
+
+// saveAssets writes the current assets maps to storage, if any.
+func (g *ReleaseManager) saveAssets() {
+	if g.storage == nil {
+		return
+	}
+
+	value, err := g.encodeAssets()
+	if err != nil {
+		g.logger.Error("Could not encode assets", "err", err)
+		return
+	}
+	if err = g.storage.Save(assetsStorageKey, value); err != nil {
+		g.logger.Error("Could not save assets", "err", err)
+	}
+}
+
+// SaveSnapshot writes the current assets maps to the given file: versions,
+// URLs, checksums and signatures, not the binaries. A process restarted with
+// LoadSnapshot serves update checks right away.
+func (g *ReleaseManager) SaveSnapshot(path string) error {
+	value, err := g.encodeAssets()
+	if err != nil {
+		return fmt.Errorf("Could not encode assets: %q", err)
+	}
+	return writeFileAtomic(path, value)
+}
+
+// LoadSnapshot fills the assets maps from a file written by SaveSnapshot, like
+// storage does when the manager is created, until UpdateAssetsMap succeeds.
+// Snapshots of another schema version are rejected with ErrSnapshotVersion,
+// and those saved longer than maxAge ago with ErrSnapshotStale. Zero takes
+// snapshots of any age.
+func (g *ReleaseManager) LoadSnapshot(path string, maxAge time.Duration) error {
+	value, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return g.decodeAssets(value, maxAge)
+}
+
+// encodeAssets returns the snapshot of the current assets maps.
+func (g *ReleaseManager) encodeAssets() ([]byte, error) {
+	g.mu.RLock()
+	snapshot := storedAssets{Schema: assetsSchemaVersion, SavedAt: g.lastRefresh, ETag: g.etag, LastModified: g.lastModified, Rollouts: g.releaseRollouts, Notes: g.releaseNotes, Dates: g.releaseDates, Tags: g.releaseTags, Withdrawn: g.withdrawn}
+	for os := range g.updateAssetsMap {
+		for arch := range g.updateAssetsMap[os] {
+			for _, a := range g.updateAssetsMap[os][arch] {
+				snapshot.Assets = append(snapshot.Assets, newStoredAsset(a))
+			}
+		}
+	}
+	for version := range g.auxAssetsMap {
+		for _, a := range g.auxAssetsMap[version] {
+			snapshot.Aux = append(snapshot.Aux, newStoredAsset(a))
+		}
+	}
+	for id, v := range g.overrides {
+		if snapshot.Overrides == nil {
+			snapshot.Overrides = make(map[string]string)
+		}
+		snapshot.Overrides[id] = v.String()
+	}
+	snapshot.LatestOverride = g.latestPin.tag
+	for channel, v := range g.markedLatest {
+		if snapshot.MarkedLatest == nil {
+			snapshot.MarkedLatest = make(map[string]string)
+		}
+		snapshot.MarkedLatest[channel] = v.String()
+	}
+	g.mu.RUnlock()
+
+	return json.Marshal(snapshot)
+}
+
+// loadAssets fills the assets maps from storage, if any, so updates are served
+// before UpdateAssetsMap first succeeds, even while github is down. The
+// manager is stale until then. Assets whose local file no longer matches
+// their checksum are left out, those whose file is gone are kept without one
+// and downloaded again when needed. The releases validators are dropped in
+// both cases so the next UpdateAssetsMap fetches them again.
+func (g *ReleaseManager) loadAssets() error {
+	if g.storage == nil {
+		return nil
+	}
+
+	value, err := g.storage.Load(assetsStorageKey)
+	if err != nil {
+		if err == ErrNotStored {
+			return nil
+		}
+		return err
+	}
+	return g.decodeAssets(value, 0)
+}
+
+// decodeAssets fills the assets maps from the given snapshot, see loadAssets.
+func (g *ReleaseManager) decodeAssets(value []byte, maxAge time.Duration) error {
+	var snapshot storedAssets
+	if err := json.Unmarshal(value, &snapshot); err != nil {
+		return fmt.Errorf("Could not decode stored assets: %q", err)
+	}
+	if snapshot.Schema != assetsSchemaVersion {
+		return fmt.Errorf("%w: got %d, expecting %d", ErrSnapshotVersion, snapshot.Schema, assetsSchemaVersion)
+	}
+	if maxAge > 0 && time.Since(snapshot.SavedAt) > maxAge {
+		return fmt.Errorf("%w: saved at %v", ErrSnapshotStale, snapshot.SavedAt)
+	}
+
+	updateAssetsMap := make(map[string]map[string]map[string]*Asset)
+	latestAssetsMap := make(map[string]map[string]map[string]*Asset)
+	auxAssetsMap := make(map[string]map[string]*Asset)
+
+	stale := false
+	for i := range snapshot.Assets {
+		a, err := snapshot.Assets[i].asset()
+		if err != nil {
+			stale = true
+			continue
+		}
+		if !fileExists(a.LocalFile) {
+			g.logger.Debug("Stored asset has no local file", "asset", a.URL)
+			a.LocalFile = ""
+			stale = true
+		} else if checksum, err := checksumForFile(a.LocalFile); err != nil || checksum != a.Checksum {
+			g.logger.Debug("Skipping stale stored asset", "asset", a.URL)
+			stale = true
+			continue
+		} else {
+			g.downloads.hold(a.LocalFile)
+		}
+		indexAsset(updateAssetsMap, latestAssetsMap, a)
+	}
+	for i := range snapshot.Aux {
+		a, err := snapshot.Aux[i].asset()
+		if err != nil {
+			stale = true
+			continue
+		}
+		version := a.v.String()
+		if auxAssetsMap[version] == nil {
+			auxAssetsMap[version] = make(map[string]*Asset)
+		}
+		auxAssetsMap[version][a.Name] = a
+	}
+	var overrides map[string]semver.Version
+	for id, version := range snapshot.Overrides {
+		v, err := parseVersion(version)
+		if err != nil {
+			continue
+		}
+		if overrides == nil {
+			overrides = make(map[string]semver.Version)
+		}
+		overrides[id] = v
+	}
+	var markedLatest map[string]semver.Version
+	for channel, version := range snapshot.MarkedLatest {
+		v, err := parseVersion(version)
+		if err != nil {
+			continue
+		}
+		if markedLatest == nil {
+			markedLatest = make(map[string]semver.Version)
+		}
+		markedLatest[channel] = v
+	}
+	var latestPin latestOverride
+	if v, err := parseVersion(snapshot.LatestOverride); err == nil {
+		if channel, ok := versionChannel(updateAssetsMap, v); ok {
+			latestPin = latestOverride{tag: snapshot.LatestOverride, v: v, channel: channel}
+		}
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.updateAssetsMap = updateAssetsMap
+	g.latestAssetsMap = latestAssetsMap
+	if markedLatest != nil {
+		g.markedLatest = markedLatest
+	}
+	if latestPin.tag != "" {
+		g.latestPin = latestPin
+	}
+	forceLatest(updateAssetsMap, latestAssetsMap, g.forcedVersions(g.markedLatest))
+	g.auxAssetsMap = auxAssetsMap
+	if snapshot.Rollouts != nil {
+		g.releaseRollouts = snapshot.Rollouts
+	}
+	if snapshot.Notes != nil {
+		g.releaseNotes = snapshot.Notes
+	}
+	if snapshot.Dates != nil {
+		g.releaseDates = snapshot.Dates
+	}
+	if snapshot.Tags != nil {
+		g.releaseTags = snapshot.Tags
+	}
+	if snapshot.Withdrawn != nil {
+		g.withdrawn = snapshot.Withdrawn
+	}
+	if overrides != nil {
+		g.overrides = overrides
+	}
+	g.staleSince = snapshot.SavedAt
+	if g.staleSince.IsZero() {
+		// Saved before the assets were ever refreshed.
+		g.staleSince = time.Now()
+	}
+	if !stale {
+		g.etag = snapshot.ETag
+		g.lastModified = snapshot.LastModified
+	}
+	return nil
+}
+
+// storedAssetFor returns the asset already known for the same github asset as
+// a, so UpdateAssetsMap does not need to download and sign it again. Only
+// used with storage, an asset is reused while github reports the same ID, URL
+// and digest for it and its local file is still around.
+func (g *ReleaseManager) storedAssetFor(os string, arch string, a *Asset) *Asset {
+	if g.storage == nil {
+		return nil
+	}
+
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	prev := g.updateAssetsMap[os][arch][assetKey(a)]
+	if prev == nil || prev.id != a.id || prev.URL != a.URL || prev.digest != a.digest {
+		return nil
+	}
+	if !fileExists(prev.LocalFile) {
+		return nil
+	}
+	return prev
+}
+
+// assetByURL returns the update asset downloaded from the given URL.
+func (g *ReleaseManager) assetByURL(uri string) *Asset {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	for os := range g.updateAssetsMap {
+		for arch := range g.updateAssetsMap[os] {
+			for _, a := range g.updateAssetsMap[os][arch] {
+				if a.URL == uri {
+					return a
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// storedPatchKey returns the storage key of the patch of type t between the
+// assets behind the given URLs. Patches are keyed by the assets checksums, so
+// a patch against an asset that was replaced on github is never loaded.
+func (g *ReleaseManager) storedPatchKey(t PatchType, oldfileURL string, newfileURL string) (string, bool) {
+	if g.storage == nil {
+		return "", false
+	}
+	oldAsset, newAsset := g.assetByURL(oldfileURL), g.assetByURL(newfileURL)
+	if oldAsset == nil || newAsset == nil {
+		return "", false
+	}
+	return patchStoragePrefix + typedPatchFileName(t, oldAsset.Checksum, newAsset.Checksum), true
+}
+
+// loadPatch copies the stored patch of type t between the given URLs into the
+// patch cache directory.
+func (g *ReleaseManager) loadPatch(t PatchType, oldfileURL string, newfileURL string) (*Patch, bool) {
+	key, ok := g.storedPatchKey(t, oldfileURL, newfileURL)
+	if !ok {
+		return nil, false
+	}
+
+	value, err := g.loadStream(key)
+	if err != nil {
+		if err != ErrNotStored {
+			g.logger.Error("Could not load patch", "key", key, "err", err)
+		}
+		return nil, false
+	}
+	defer value.Close()
+
+	patchfile := filepath.Join(g.PatchCacheDir(), strings.TrimPrefix(key, patchStoragePrefix))
+	if err = writeFileAtomicFrom(patchfile, value); err != nil {
+		g.logger.Error("Could not restore patch", "patch", patchfile, "err", err)
+		return nil, false
+	}
+
+	size, _ := fileSize(patchfile)
+	return &Patch{File: patchfile, Size: size}, true
+}
+
+// savePatch writes a generated patch of type t to storage, if any.
+func (g *ReleaseManager) savePatch(t PatchType, oldfileURL string, newfileURL string, p *Patch) {
+	key, ok := g.storedPatchKey(t, oldfileURL, newfileURL)
+	if !ok {
+		return
+	}
+
+	fp, err := os.Open(p.File)
+	if err != nil {
+		g.logger.Error("Could not read patch", "patch", p.File, "err", err)
+		return
+	}
+	defer fp.Close()
+
+	if ss, ok := g.storage.(StreamStorage); ok {
+		err = ss.SaveFrom(key, fp)
+	} else {
+		var value []byte
+		if value, err = ioutil.ReadAll(fp); err == nil {
+			err = g.storage.Save(key, value)
+		}
+	}
+	if err != nil {
+		g.logger.Error("Could not save patch", "key", key, "err", err)
+	}
+}
+
+// loadStream opens the value stored under key, through a stream if the
+// storage has them.
+func (g *ReleaseManager) loadStream(key string) (io.ReadCloser, error) {
+	if ss, ok := g.storage.(StreamStorage); ok {
+		return ss.Open(key)
+	}
+	value, err := g.storage.Load(key)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(value)), nil
+}
+
+// writeFileAtomic writes value to a temporary file next to file and renames
+// it into place.
+func writeFileAtomic(file string, value []byte) error {
+	return writeFileAtomicFrom(file, bytes.NewReader(value))
+}
+
+// writeFileAtomicFrom is like writeFileAtomic, copying r.
+func writeFileAtomicFrom(file string, r io.Reader) error {
+	fp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(fp, r); err != nil {
+		fp.Close()
+		os.Remove(fp.Name())
+		return err
+	}
+
+	if err = fp.Close(); err != nil {
+		os.Remove(fp.Name())
+		return err
+	}
+
+	if err = os.Rename(fp.Name(), file); err != nil {
+		os.Remove(fp.Name())
+		return err
+	}
+
+	return nil
+}
+
+// StaleSince returns when the assets served were last known to be up to date
+// while they come from storage because UpdateAssetsMap did not succeed since
+// the manager was created, the zero time otherwise.
+func (g *ReleaseManager) StaleSince() time.Time {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.staleSince
+}
@@ -0,0 +1,338 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autoupdate-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = s.Load("missing"); err != ErrNotStored {
+		t.Fatalf("Expecting ErrNotStored, got %q", err)
+	}
+	if err = s.Save("patches/abc", []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Save("patches/abc", []byte("second")); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := s.Load("patches/abc"); err != nil || string(value) != "second" {
+		t.Fatalf("Expecting the last saved value, got %q, %q", value, err)
+	}
+	if err = s.Save("../outside", []byte("nope")); err == nil {
+		t.Fatal("Expecting keys outside of the directory to be rejected.")
+	}
+}
+
+func TestStorageRestart(t *testing.T) {
+	setTestPrivateKey(t)
+
+	dir, err := ioutil.TempDir("", "autoupdate-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	storage, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := newTestAssetServer(map[string]string{
+		"/1.0.0/autoupdate-binary-linux-amd64": "storage restart 1.0.0",
+		"/1.1.0/autoupdate-binary-linux-amd64": "storage restart 1.1.0",
+	})
+	defer files.Close()
+
+	releases := fmt.Sprintf(`[
+		{"id": 2, "tag_name": "1.1.0", "zipball_url": "%s/1.1.0.zip", "assets": [
+			{"id": 20, "name": "autoupdate-binary-linux-amd64", "browser_download_url": "%s/1.1.0/autoupdate-binary-linux-amd64"}
+		]},
+		{"id": 1, "tag_name": "1.0.0", "zipball_url": "%s/1.0.0.zip", "assets": [
+			{"id": 10, "name": "autoupdate-binary-linux-amd64", "browser_download_url": "%s/1.0.0/autoupdate-binary-linux-amd64"}
+		]}
+	]`, files.URL, files.URL, files.URL, files.URL)
+
+	var fetched int
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fetched++
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(releases))
+	}))
+	defer api.Close()
+
+	g := NewReleaseManager("getlantern", "autoupdate-server", WithStorage(storage))
+	useTestGitHub(t, g, api)
+	if err = g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+	current := g.updateAssetsMap[OS.Linux][Arch.X64]["1.0.0"]
+	update := g.updateAssetsMap[OS.Linux][Arch.X64]["1.1.0"]
+
+	// Pretend a patch was generated before the restart.
+	key := patchStoragePrefix + patchFileName(current.Checksum, update.Checksum)
+	if err = storage.Save(key, []byte("stored patch")); err != nil {
+		t.Fatal(err)
+	}
+
+	// After a restart updates are served right away.
+	g = NewReleaseManager("getlantern", "autoupdate-server", WithStorage(storage))
+	useTestGitHub(t, g, api)
+	patchDir, err := ioutil.TempDir("", "autoupdate-patches")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(patchDir)
+	if err = g.SetPatchCacheDir(patchDir); err != nil {
+		t.Fatal(err)
+	}
+	g.SetMaxPatchRatio(0)
+
+	res, err := g.CheckForUpdate(&Params{
+		AppVersion: "1.0.0",
+		OS:         OS.Linux,
+		Arch:       Arch.X64,
+		Checksum:   current.Checksum,
+	})
+	if err != nil {
+		t.Fatalf("Expecting an update from stored assets, got %q", err)
+	}
+	if res.Version != "1.1.0" || res.PatchType != PATCHTYPE_BSDIFF {
+		t.Fatalf("Expecting a patch to 1.1.0, got %+v", res)
+	}
+	p, err := g.GeneratePatch(current.URL, update.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := ioutil.ReadFile(p.File); string(content) != "stored patch" {
+		t.Fatalf("Expecting the stored patch to be served, got %q", content)
+	}
+
+	// The releases did not change, nothing is fetched again.
+	if err = g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+	if fetched != 1 {
+		t.Fatalf("Expecting the releases to be fetched once, got %d", fetched)
+	}
+
+	// A stored asset whose file changed is stale, it's fetched again on the
+	// next refresh.
+	if err = ioutil.WriteFile(current.LocalFile, []byte("tampered"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(current.LocalFile)
+	g = NewReleaseManager("getlantern", "autoupdate-server", WithStorage(storage))
+	useTestGitHub(t, g, api)
+	if g.updateAssetsMap[OS.Linux][Arch.X64]["1.0.0"] != nil {
+		t.Fatal("Expecting the stale asset to be left out.")
+	}
+	if g.updateAssetsMap[OS.Linux][Arch.X64]["1.1.0"] == nil {
+		t.Fatal("Expecting the good asset to be loaded.")
+	}
+	os.Remove(current.LocalFile)
+	if err = g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+	if fetched != 2 {
+		t.Fatalf("Expecting the releases to be fetched again, got %d", fetched)
+	}
+	if a := g.updateAssetsMap[OS.Linux][Arch.X64]["1.0.0"]; a == nil || a.Checksum != current.Checksum {
+		t.Fatal("Expecting the stale asset to be regenerated.")
+	}
+}
+
+func TestStaleAssets(t *testing.T) {
+	setTestPrivateKey(t)
+
+	dir, err := ioutil.TempDir("", "autoupdate-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	storage, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := newTestAssetServer(map[string]string{
+		"/1.0.0/autoupdate-binary-linux-amd64": "stale assets 1.0.0",
+		"/1.1.0/autoupdate-binary-linux-amd64": "stale assets 1.1.0",
+	})
+	defer files.Close()
+
+	down := false
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		fmt.Fprintf(w, `[
+			{"id": 2, "tag_name": "1.1.0", "zipball_url": "%s/1.1.0.zip", "assets": [
+				{"id": 20, "name": "autoupdate-binary-linux-amd64", "browser_download_url": "%s/1.1.0/autoupdate-binary-linux-amd64"}
+			]},
+			{"id": 1, "tag_name": "1.0.0", "zipball_url": "%s/1.0.0.zip", "assets": [
+				{"id": 10, "name": "autoupdate-binary-linux-amd64", "browser_download_url": "%s/1.0.0/autoupdate-binary-linux-amd64"}
+			]}
+		]`, files.URL, files.URL, files.URL, files.URL)
+	}))
+	defer api.Close()
+
+	health := func(g *ReleaseManager) (int, healthBody) {
+		rec := httptest.NewRecorder()
+		NewHealthHandler(g).ServeHTTP(rec, httptest.NewRequest("GET", "/health", nil))
+		var body healthBody
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		return rec.Code, body
+	}
+
+	g := NewReleaseManager("getlantern", "autoupdate-server", WithStorage(storage))
+	useTestGitHub(t, g, api)
+	if code, body := health(g); code != http.StatusServiceUnavailable || body.Status != "unavailable" {
+		t.Fatalf("Expecting nothing to serve yet, got %d %+v", code, body)
+	}
+	if err = g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+	refreshed := g.LastRefresh()
+	if !g.StaleSince().IsZero() {
+		t.Fatal("Expecting fresh assets.")
+	}
+	update := g.updateAssetsMap[OS.Linux][Arch.X64]["1.1.0"]
+
+	// Restarting during an outage with the downloads gone still serves
+	// updates.
+	for _, a := range g.updateAssetsMap[OS.Linux][Arch.X64] {
+		os.Remove(a.LocalFile)
+	}
+	down = true
+	g = NewReleaseManager("getlantern", "autoupdate-server", WithStorage(storage))
+	useTestGitHub(t, g, api)
+	if err = g.UpdateAssetsMap(); err == nil {
+		t.Fatal("Expecting the refresh to fail.")
+	}
+	if since := g.StaleSince(); !since.Equal(refreshed) {
+		t.Fatalf("Expecting stale assets since %v, got %v", refreshed, since)
+	}
+	res, err := g.CheckForUpdate(&Params{
+		AppVersion: "1.0.0",
+		OS:         OS.Linux,
+		Arch:       Arch.X64,
+		Checksum:   "unknown",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Version != "1.1.0" || res.URL != update.URL || res.Checksum != update.Checksum || res.Signature != update.Signature {
+		t.Fatalf("Expecting the stored update, got %+v", res)
+	}
+	if code, body := health(g); code != http.StatusOK || body.Status != "stale" || body.StaleSince == nil || !body.StaleSince.Equal(refreshed) {
+		t.Fatalf("Expecting a stale health, got %d %+v", code, body)
+	}
+
+	// Once github is back the assets are fresh again.
+	down = false
+	if err = g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+	if !g.StaleSince().IsZero() {
+		t.Fatal("Expecting a successful refresh to clear the staleness.")
+	}
+	if a := g.updateAssetsMap[OS.Linux][Arch.X64]["1.1.0"]; a == nil || !fileExists(a.LocalFile) {
+		t.Fatal("Expecting the asset to be downloaded again.")
+	}
+	if code, body := health(g); code != http.StatusOK || body.Status != "ok" {
+		t.Fatalf("Expecting a healthy manager, got %d %+v", code, body)
+	}
+
+	// A corrupt snapshot is ignored.
+	if err = storage.Save(assetsStorageKey, []byte("{not json")); err != nil {
+		t.Fatal(err)
+	}
+	g = NewReleaseManager("getlantern", "autoupdate-server", WithStorage(storage))
+	if len(g.updateAssetsMap) != 0 || !g.StaleSince().IsZero() {
+		t.Fatal("Expecting a corrupt snapshot to be ignored.")
+	}
+}
+
+func TestSnapshotFile(t *testing.T) {
+	g, current, update := newTestUpdatePair(t, nil)
+	g.mu.Lock()
+	g.lastRefresh = time.Now()
+	g.mu.Unlock()
+
+	path := filepath.Join(t.TempDir(), "assets.json")
+	if err := g.SaveSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// A restarted process serves checks from the snapshot until it refreshes.
+	restarted := NewReleaseManager("getlantern", "autoupdate-server")
+	if err := restarted.LoadSnapshot(path, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if restarted.StaleSince().IsZero() {
+		t.Fatal("Expecting the restored assets to be stale.")
+	}
+	res, err := restarted.CheckForUpdate(&Params{AppVersion: "1.0.0", OS: OS.Linux, Arch: Arch.X64, Checksum: current.Checksum})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Version != "1.1.0" || res.URL != update.URL || res.Checksum != update.Checksum || res.Signature != update.Signature {
+		t.Fatalf("Expecting the restored assets to describe 1.1.0, got %+v", res)
+	}
+
+	fresh := NewReleaseManager("getlantern", "autoupdate-server")
+	time.Sleep(time.Millisecond)
+	if err = fresh.LoadSnapshot(path, time.Nanosecond); !errors.Is(err, ErrSnapshotStale) {
+		t.Fatalf("Expecting ErrSnapshotStale, got %v", err)
+	}
+
+	// Snapshots of another layout are turned down whole.
+	value, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snapshot map[string]interface{}
+	if err = json.Unmarshal(value, &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	delete(snapshot, "schema")
+	if value, err = json.Marshal(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(path, value, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = fresh.LoadSnapshot(path, 0); !errors.Is(err, ErrSnapshotVersion) {
+		t.Fatalf("Expecting ErrSnapshotVersion, got %v", err)
+	}
+	if len(fresh.updateAssetsMap) != 0 || !fresh.StaleSince().IsZero() {
+		t.Fatal("Expecting a rejected snapshot to leave the assets alone.")
+	}
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Phases reported in Server-Timing headers.
+const (
+	timingLookup   = "lookup"   // finding the client's and latest assets
+	timingCache    = "cache"    // looking for an already generated patch
+	timingGenerate = "generate" // downloading the assets and running bsdiff
+	timingSign     = "sign"     // picking the signatures for the client
+)
+
+// serverTiming accumulates the time spent in each phase of a request.
+type serverTiming struct {
+	mu     sync.Mutex
+	phases []string
+	spent  map[string]time.Duration
+}
+
+type serverTimingKey struct{}
+
+// withServerTiming returns a context that collects phase timings.
+func withServerTiming(ctx context.Context) (context.Context, *serverTiming) {
+	st := &serverTiming{spent: make(map[string]time.Duration)}
+	return context.WithValue(ctx, serverTimingKey{}, st), st
+}
+
+// trackTime adds the time elapsed since start to the given phase, if ctx
+// collects timings. Meant to be deferred: defer trackTime(ctx, phase, time.Now()).
+func trackTime(ctx context.Context, phase string, start time.Time) {
+	st, _ := ctx.Value(serverTimingKey{}).(*serverTiming)
+	if st == nil {
+		return
+	}
+	elapsed := time.Since(start)
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if _, ok := st.spent[phase]; !ok {
+		st.phases = append(st.phases, phase)
+	}
+	st.spent[phase] += elapsed
+}
+
+// header formats the timings as a Server-Timing header value, durations in
+// milliseconds.
+func (st *serverTiming) header() string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	metrics := make([]string, 0, len(st.phases))
+	for _, phase := range st.phases {
+		metrics = append(metrics, fmt.Sprintf("%s;dur=%.3f", phase, float64(st.spent[phase])/float64(time.Millisecond)))
+	}
+	return strings.Join(metrics, ", ")
+}
+
+// NewServerTimingHandler wraps h, adding a Server-Timing header with the given
+// phase name and the time h took to start responding. It is meant for
+// handlers that only serve files, like the patches directory.
+func NewServerTimingHandler(phase string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(&timingWriter{ResponseWriter: w, phase: phase, start: time.Now()}, r)
+	})
+}
+
+type timingWriter struct {
+	http.ResponseWriter
+	phase       string
+	start       time.Time
+	wroteHeader bool
+}
+
+func (w *timingWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		elapsed := float64(time.Since(w.start)) / float64(time.Millisecond)
+		w.Header().Add("Server-Timing", fmt.Sprintf("%s;dur=%.3f", w.phase, elapsed))
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *timingWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
@@ -0,0 +1,278 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// PatchValidation tells the platforms ValidateReleaseContext generates patches
+// for.
+type PatchValidation int
+
+const (
+	// ValidatePatchSample patches a single platform, the first by OS and
+	// arch.
+	ValidatePatchSample PatchValidation = iota
+	// ValidatePatchAll patches every platform of the release.
+	ValidatePatchAll
+)
+
+// ReleaseReport is the outcome of ValidateRelease.
+type ReleaseReport struct {
+	Tag     string `json:"tag"`
+	Version string `json:"version"`
+	// Passed is true when every asset and patch passed and no platform is
+	// missing.
+	Passed bool          `json:"passed"`
+	Assets []AssetReport `json:"assets"`
+	// Missing holds the os/arch platforms served on the channel of the
+	// release it has no update asset for.
+	Missing []string      `json:"missing,omitempty"`
+	Patches []PatchReport `json:"patches"`
+}
+
+// AssetReport tells whether an update asset of a release can be served.
+type AssetReport struct {
+	Name     string `json:"name"`
+	OS       string `json:"os,omitempty"`
+	Arch     string `json:"arch,omitempty"`
+	Checksum string `json:"checksum,omitempty"`
+	Passed   bool   `json:"passed"`
+	Error    string `json:"error,omitempty"`
+}
+
+// PatchReport tells whether a patch from the latest version of a platform to
+// the release applies.
+type PatchReport struct {
+	OS     string `json:"os"`
+	Arch   string `json:"arch"`
+	From   string `json:"from"` // version patched from
+	Size   int64  `json:"size,omitempty"`
+	Passed bool   `json:"passed"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ValidateRelease checks the release of the given tag could be served, see
+// ValidateReleaseContext, patching a single platform.
+func (g *ReleaseManager) ValidateRelease(tag string) (*ReleaseReport, error) {
+	return g.ValidateReleaseContext(context.Background(), tag, ValidatePatchSample)
+}
+
+// ValidateReleaseContext checks the release of the given tag could be served,
+// without serving it: the release is listed from the provider, github drafts
+// aren't, and each of its update assets must have a name telling its platform,
+// be downloaded matching the digest github reports, pass the provenance checks
+// and get signed. Patches from the latest version of the channel are then
+// generated for the platforms told by patches and applied, their result must
+// match the new asset. The assets maps and the patch cache are left alone.
+// Failures are reported in the ReleaseReport, an error is only returned if
+// the release can't be listed, ErrNoSuchVersion if there is no such release.
+func (g *ReleaseManager) ValidateReleaseContext(ctx context.Context, tag string, patches PatchValidation) (*ReleaseReport, error) {
+	v, err := parseVersion(tag)
+	if err != nil {
+		return nil, err
+	}
+	rs, _, err := g.listReleases(ctx, releasesValidator{})
+	if err != nil {
+		return nil, err
+	}
+	var rel *Release
+	for i := range rs {
+		if rs[i].Tag == tag || rs[i].Version.EQ(v) {
+			rel = &rs[i]
+			break
+		}
+	}
+	if rel == nil {
+		return nil, fmt.Errorf("%w: no release %s to validate", ErrNoSuchVersion, tag)
+	}
+
+	report := &ReleaseReport{Tag: tag, Version: rel.Version.String(), Assets: []AssetReport{}, Patches: []PatchReport{}}
+	channel := channelForRelease(rel)
+
+	g.mu.RLock()
+	verifyKeys := g.verifyKeys
+	g.mu.RUnlock()
+
+	detached := make(map[string]string)
+	for _, a := range rel.Assets {
+		if strings.HasSuffix(a.Name, signatureSuffix) {
+			detached[strings.TrimSuffix(a.Name, signatureSuffix)] = a.URL
+		}
+	}
+
+	// Validated assets, by os/arch, their files kept until the patches are
+	// done.
+	valid := make(map[string]*Asset)
+	// Names of the assets by platform and format.
+	seen := make(map[string]string)
+	var tagVerified, tagChecked bool
+	for i := range rel.Assets {
+		asset := rel.Assets[i]
+		// Auxiliary assets are left out, unless named like update assets.
+		if !g.isUpdateAsset(asset.Name) && !g.malformedUpdateAsset(asset.Name) {
+			continue
+		}
+		r := AssetReport{Name: asset.Name}
+		fail := func(err error) {
+			r.Error = err.Error()
+			report.Assets = append(report.Assets, r)
+		}
+
+		info, version, err := g.assetInfo(asset.Name)
+		if err != nil {
+			fail(err)
+			continue
+		}
+		r.OS, r.Arch = info.OS, info.Arch
+		if named, err := parseVersion(version); version != "" && (err != nil || !named.EQ(rel.Version)) {
+			fail(fmt.Errorf("Asset does not belong to release %v", rel.Version))
+			continue
+		}
+		platform := info.OS + "/" + info.Arch
+		if name, ok := seen[platform+info.Ext]; ok {
+			fail(fmt.Errorf("Asset %s is for the same platform", name))
+			continue
+		}
+		seen[platform+info.Ext] = asset.Name
+
+		asset.v, asset.channel, asset.Ext = rel.Version, channel, info.Ext
+		if g.provenance.verifiedTags && !tagChecked {
+			if tagVerified, err = g.releaseTagVerified(ctx, rel); err != nil {
+				return nil, err
+			}
+			tagChecked = true
+		}
+		if err := g.verifyProvenance(rel, &asset, tagVerified); err != nil {
+			fail(err)
+			continue
+		}
+
+		release, err := g.validateAsset(ctx, info.OS, info.Arch, &asset)
+		if err != nil {
+			fail(err)
+			continue
+		}
+		defer release()
+		if len(verifyKeys) > 0 {
+			if err := g.verifyDetachedSignature(ctx, verifyKeys, detached[asset.Name], asset.Checksum); err != nil {
+				fail(err)
+				continue
+			}
+		}
+
+		r.Checksum, r.Passed = asset.Checksum, true
+		report.Assets = append(report.Assets, r)
+		if valid[platform] == nil || defaultFormat(&asset, valid[platform]) {
+			valid[platform] = &asset
+		}
+	}
+
+	g.mu.RLock()
+	var platforms []string
+	latest := make(map[string]*Asset)
+	for os := range g.latestAssetsMap[channel] {
+		for arch, a := range g.latestAssetsMap[channel][os] {
+			platform := os + "/" + arch
+			if valid[platform] == nil {
+				report.Missing = append(report.Missing, platform)
+				continue
+			}
+			if a.v.LT(rel.Version) {
+				platforms = append(platforms, platform)
+				latest[platform] = a
+			}
+		}
+	}
+	g.mu.RUnlock()
+	sort.Strings(report.Missing)
+	sort.Strings(platforms)
+	if patches == ValidatePatchSample && len(platforms) > 1 {
+		platforms = platforms[:1]
+	}
+
+	for _, platform := range platforms {
+		report.Patches = append(report.Patches, g.validatePatch(ctx, latest[platform], valid[platform]))
+	}
+
+	report.Passed = len(report.Missing) == 0
+	for _, r := range report.Assets {
+		report.Passed = report.Passed && r.Passed
+	}
+	for _, r := range report.Patches {
+		report.Passed = report.Passed && r.Passed
+	}
+	return report, nil
+}
+
+// validateAsset downloads asset and fills its checksums and signatures, like
+// prepareAsset does. The file is deleted once release is called, unless it's
+// the local file of an asset.
+func (g *ReleaseManager) validateAsset(ctx context.Context, os string, arch string, asset *Asset) (release func(), err error) {
+	asset.OS, asset.Arch = os, arch
+	var done func()
+	if asset.LocalFile, done, err = g.downloadKnownAsset(ctx, asset.URL); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			done()
+		}
+	}()
+
+	reported := asset.Size
+	if asset.Size, err = fileSize(asset.LocalFile); err != nil {
+		return nil, err
+	}
+	if reported > 0 && reported != asset.Size {
+		return nil, fmt.Errorf("%w: got %d of %d bytes", ErrCorruptDownload, asset.Size, reported)
+	}
+	if asset.Checksum, err = checksumForFile(asset.LocalFile); err != nil {
+		return nil, err
+	}
+	if asset.SHA256, err = digestSHA256(asset.digest); err != nil {
+		return nil, err
+	}
+	if asset.SHA256 != "" && asset.SHA256 != asset.Checksum {
+		return nil, ErrDigestMismatch
+	}
+	if asset.Signature, asset.Signatures, err = g.signAsset(asset.LocalFile, asset.Checksum); err != nil {
+		return nil, err
+	}
+	return done, nil
+}
+
+// validatePatch generates a patch from oldAsset to newAsset off the patch
+// cache and applies it.
+func (g *ReleaseManager) validatePatch(ctx context.Context, oldAsset *Asset, newAsset *Asset) PatchReport {
+	r := PatchReport{OS: newAsset.OS, Arch: newAsset.Arch, From: oldAsset.v.String()}
+	fail := func(err error) PatchReport {
+		r.Error = err.Error()
+		return r
+	}
+
+	dir, err := ioutil.TempDir(g.DownloadDir(), "validate")
+	if err != nil {
+		return fail(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := g.differ(PATCHTYPE_BSDIFF)
+	if d == nil {
+		d = BsdiffDiffer{}
+	}
+	p, err := generatePatch(ctx, dir, g.downloadKnownAsset, g.limiter(), PATCHTYPE_BSDIFF, d, oldAsset.URL, newAsset.URL)
+	if err != nil {
+		return fail(err)
+	}
+	r.Size = p.Size
+	if err = g.verifyPatch(p.File, oldAsset, newAsset); err != nil {
+		return fail(err)
+	}
+	r.Passed = true
+	return r
+}
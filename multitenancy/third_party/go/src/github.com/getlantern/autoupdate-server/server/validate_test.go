@@ -0,0 +1,93 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestValidateRelease(t *testing.T) {
+	requireBsdiff(t)
+
+	g, p := newTestMemoryManager(t)
+	if err := g.SetPatchCacheDir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.AddRelease("1.3.0", "", map[string][]byte{
+		"autoupdate-binary-linux-amd64": []byte("linux-amd64 binary 1.3.0"),
+		"autoupdate-binary-windows-386": []byte("windows-386 binary 1.3.0"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.AddRelease("1.4.0", "", map[string][]byte{
+		"autoupdate-binary-linux-amd64": []byte("linux-amd64 binary 1.4.0"),
+		"autoupdate-binary-osx-386":     []byte("who knows"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := g.ValidateRelease("1.5.0"); !errors.Is(err, ErrNoSuchVersion) {
+		t.Fatalf("Expecting ErrNoSuchVersion for an unknown release, got %v", err)
+	}
+
+	report, err := g.ValidateReleaseContext(context.Background(), "1.3.0", ValidatePatchAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Passed || len(report.Assets) != 2 || len(report.Patches) != 2 {
+		t.Fatalf("Expecting both assets and patches to pass, got %+v", report)
+	}
+	for _, r := range report.Patches {
+		if !r.Passed || r.From != "1.2.0" {
+			t.Fatalf("Expecting a patch from 1.2.0 to apply, got %+v", r)
+		}
+	}
+	if report, err = g.ValidateRelease("1.3.0"); err != nil || !report.Passed || len(report.Patches) != 1 {
+		t.Fatalf("Expecting a single patch by default, got %+v, %v", report, err)
+	}
+
+	// Nothing validated is served.
+	if v := g.latestAssetsMap[Channel.Stable][OS.Linux][Arch.X64].v.String(); v != "1.2.0" {
+		t.Fatalf("Expecting 1.2.0 to stay the latest, got %s", v)
+	}
+	if len(g.updateAssetsMap[OS.Linux][Arch.X64]) != 3 {
+		t.Fatalf("Expecting the assets maps to be left alone, got %v", g.updateAssetsMap[OS.Linux][Arch.X64])
+	}
+	if entries, _ := g.patches.stats(); entries != 0 {
+		t.Fatalf("Expecting the patch cache to be left alone, got %d entries", entries)
+	}
+
+	report, err = g.ValidateReleaseContext(context.Background(), "1.4.0", ValidatePatchAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Passed || !reflect.DeepEqual(report.Missing, []string{OS.Windows + "/" + Arch.X86}) {
+		t.Fatalf("Expecting windows to be missing, got %+v", report)
+	}
+	var failed []string
+	for _, r := range report.Assets {
+		if !r.Passed {
+			failed = append(failed, r.Name)
+		}
+	}
+	if !reflect.DeepEqual(failed, []string{"autoupdate-binary-osx-386"}) {
+		t.Fatalf("Expecting the asset of an unknown platform to fail, got %+v", report.Assets)
+	}
+	if len(report.Patches) != 1 || !report.Patches[0].Passed {
+		t.Fatalf("Expecting the linux patch to pass, got %+v", report.Patches)
+	}
+
+	content, err := json.Marshal(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded ReleaseReport
+	if err := json.Unmarshal(content, &decoded); err != nil || !reflect.DeepEqual(&decoded, report) {
+		t.Fatalf("Expecting the report to survive JSON, got %s", content)
+	}
+}
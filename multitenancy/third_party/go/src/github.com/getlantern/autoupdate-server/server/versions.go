@@ -0,0 +1,130 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// VersionInfo describes an update asset indexed for a platform.
+type VersionInfo struct {
+	Version   string `json:"version"`
+	Channel   string `json:"channel"`
+	Ext       string `json:"ext,omitempty"`
+	URL       string `json:"url"`
+	Checksum  string `json:"checksum"`
+	Signature string `json:"signature"`
+	// PublishedAt is when the release was created, zero if the release
+	// provider doesn't tell.
+	PublishedAt time.Time `json:"published_at,omitzero"`
+}
+
+// Platform is an os/arch pair assets are indexed for.
+type Platform struct {
+	OS   string `json:"os"`
+	Arch string `json:"arch"`
+}
+
+// ListVersions returns every update asset indexed for os/arch, oldest version
+// first, the formats of a version in the order clients not asking for one are
+// offered them. Yanked and held back versions are listed all the same. Arch
+// is normalized like clients' ones, platforms without any asset fail with
+// ErrNoSuchPlatform.
+func (g *ReleaseManager) ListVersions(os string, arch string) ([]VersionInfo, error) {
+	arch = g.platformArch(os, normalizeArch(arch))
+
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	assets := make([]*Asset, 0, len(g.updateAssetsMap[os][arch]))
+	for _, a := range g.updateAssetsMap[os][arch] {
+		assets = append(assets, a)
+	}
+	if len(assets) == 0 {
+		return nil, fmt.Errorf("%w: %s/%s", ErrNoSuchPlatform, os, arch)
+	}
+	sort.Slice(assets, func(i, j int) bool {
+		if !assets[i].v.EQ(assets[j].v) {
+			return assets[i].v.LT(assets[j].v)
+		}
+		return defaultFormat(assets[i], assets[j])
+	})
+
+	versions := make([]VersionInfo, len(assets))
+	for i, a := range assets {
+		versions[i] = VersionInfo{
+			Version:     a.v.String(),
+			Channel:     assetChannel(a),
+			Ext:         a.Ext,
+			URL:         a.URL,
+			Checksum:    a.Checksum,
+			Signature:   a.Signature,
+			PublishedAt: g.releaseDates[a.v.String()],
+		}
+	}
+	return versions, nil
+}
+
+// GetAsset returns a copy of the update asset of version for os/arch, the
+// bare binary if the version was published in several formats. Platforms
+// without any asset fail with ErrNoSuchPlatform, versions not indexed for the
+// platform with ErrNoSuchVersion.
+func (g *ReleaseManager) GetAsset(os string, arch string, version string) (*Asset, error) {
+	v, err := parseVersion(version)
+	if err != nil {
+		return nil, &ParamsError{fmt.Sprintf("Bad version string: %v", err)}
+	}
+	arch = g.platformArch(os, normalizeArch(arch))
+
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	if len(g.updateAssetsMap[os][arch]) == 0 {
+		return nil, fmt.Errorf("%w: %s/%s", ErrNoSuchPlatform, os, arch)
+	}
+	var found *Asset
+	for _, a := range g.updateAssetsMap[os][arch] {
+		if a.v.EQ(v) && (found == nil || defaultFormat(a, found)) {
+			found = a
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("%w: no %s/%s asset of version %v", ErrNoSuchVersion, os, arch, v)
+	}
+	return found.clone(), nil
+}
+
+// Platforms returns every os/arch pair update assets are indexed for, sorted
+// by OS and arch.
+func (g *ReleaseManager) Platforms() []Platform {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	var platforms []Platform
+	for os := range g.updateAssetsMap {
+		for arch, assets := range g.updateAssetsMap[os] {
+			if len(assets) > 0 {
+				platforms = append(platforms, Platform{OS: os, Arch: arch})
+			}
+		}
+	}
+	sort.Slice(platforms, func(i, j int) bool {
+		if platforms[i].OS != platforms[j].OS {
+			return platforms[i].OS < platforms[j].OS
+		}
+		return platforms[i].Arch < platforms[j].Arch
+	})
+	return platforms
+}
+
+// clone returns a copy of a callers can't change the indexed asset through.
+func (a *Asset) clone() *Asset {
+	c := *a
+	if a.Signatures != nil {
+		c.Signatures = make(map[string]string, len(a.Signatures))
+		for id, sig := range a.Signatures {
+			c.Signatures[id] = sig
+		}
+	}
+	return &c
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestVersionLookups(t *testing.T) {
+	setTestPrivateKey(t)
+
+	p := NewMemoryProvider()
+	if err := p.AddRelease("1.0.0", "", map[string][]byte{
+		"autoupdate-binary-linux-amd64":        []byte("lookup linux 1.0.0"),
+		"autoupdate-binary-linux-amd64.tar.gz": []byte("lookup linux tarball 1.0.0"),
+		"autoupdate-binary-windows-386":        []byte("lookup windows 1.0.0"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.AddRelease("1.1.0-beta", "", map[string][]byte{"autoupdate-binary-linux-amd64": []byte("lookup linux 1.1.0-beta")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.AddRelease("1.1.0", "", map[string][]byte{"autoupdate-binary-linux-amd64": []byte("lookup linux 1.1.0")}); err != nil {
+		t.Fatal(err)
+	}
+	g := NewReleaseManager("getlantern", "autoupdate-server", WithReleaseProvider(p))
+	if err := g.UpdateAssetsMap(); err != nil {
+		t.Fatal(err)
+	}
+
+	platforms := g.Platforms()
+	if len(platforms) != 2 || platforms[0] != (Platform{OS.Linux, Arch.X64}) || platforms[1] != (Platform{OS.Windows, Arch.X86}) {
+		t.Fatalf("Expecting linux/amd64 and windows/386, got %v", platforms)
+	}
+
+	versions, err := g.ListVersions(OS.Linux, "x86_64")
+	if !errors.Is(err, ErrNoSuchPlatform) {
+		t.Fatalf("Expecting ErrNoSuchPlatform for an unknown arch, got %v %v", versions, err)
+	}
+	if versions, err = g.ListVersions(OS.Linux, Arch.X64); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, v := range versions {
+		got = append(got, v.Version+v.Ext)
+	}
+	if want := []string{"1.0.0", "1.0.0.tar.gz", "1.1.0-beta", "1.1.0"}; len(got) != len(want) || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] || got[3] != want[3] {
+		t.Fatalf("Expecting %v, oldest first, got %v", want, got)
+	}
+	latest := g.updateAssetsMap[OS.Linux][Arch.X64]["1.1.0"]
+	if v := versions[3]; v.URL != latest.URL || v.Checksum != latest.Checksum || v.Signature != latest.Signature || v.Channel != Channel.Stable || v.PublishedAt.IsZero() {
+		t.Fatalf("Expecting 1.1.0 to be described, got %+v", v)
+	}
+	if versions[2].Channel != Channel.Beta {
+		t.Fatalf("Expecting the beta channel to be told, got %+v", versions[2])
+	}
+
+	// A platform with a single release.
+	if versions, err = g.ListVersions(OS.Windows, Arch.X86); err != nil || len(versions) != 1 || versions[0].Version != "1.0.0" {
+		t.Fatalf("Expecting windows/386 to have 1.0.0 only, got %v %v", versions, err)
+	}
+	a, err := g.GetAsset(OS.Windows, Arch.X86, "1.0.0")
+	if err != nil || a.Version() != "1.0.0" || a.Checksum != versions[0].Checksum {
+		t.Fatalf("Expecting the windows 1.0.0 asset, got %+v %v", a, err)
+	}
+
+	if a, err = g.GetAsset(OS.Linux, Arch.X64, "1.0.0"); err != nil || a.Ext != "" {
+		t.Fatalf("Expecting the bare binary of 1.0.0, got %+v %v", a, err)
+	}
+	a.URL = "changed"
+	if g.updateAssetsMap[OS.Linux][Arch.X64]["1.0.0"].URL == "changed" {
+		t.Fatal("Expecting a copy of the indexed asset.")
+	}
+	if _, err = g.GetAsset(OS.Windows, Arch.X86, "1.1.0"); !errors.Is(err, ErrNoSuchVersion) {
+		t.Fatalf("Expecting ErrNoSuchVersion for a version not published for the platform, got %v", err)
+	}
+	if _, err = g.GetAsset(OS.Darwin, Arch.X64, "1.0.0"); !errors.Is(err, ErrNoSuchPlatform) {
+		t.Fatalf("Expecting ErrNoSuchPlatform for a platform without assets, got %v", err)
+	}
+	if _, err = g.GetAsset(OS.Linux, Arch.X64, "one"); !errors.Is(err, ErrInvalidParams) {
+		t.Fatalf("Expecting ErrInvalidParams for a bad version, got %v", err)
+	}
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Events received within this long of the first one are answered with a
+	// single refresh, publishing a release sends one per uploaded asset.
+	defaultWebhookDebounce = 10 * time.Second
+
+	// Github never sends more than 25MB.
+	maxWebhookPayload = 25 << 20
+)
+
+// Release webhook actions that change what UpdateAssetsMap would find.
+// "released" is also sent when a prerelease is turned into a release.
+var webhookActions = map[string]bool{
+	"published": true,
+	"released":  true,
+	"edited":    true,
+	"deleted":   true,
+}
+
+// webhookRefresh debounces and coalesces the refreshes asked by webhooks.
+type webhookRefresh struct {
+	mu       sync.Mutex
+	secret   []byte
+	debounce time.Duration
+	timer    *time.Timer // pending refresh, if any
+	running  bool
+	again    bool // another refresh was asked while running
+}
+
+// WithWebhookSecret accepts Github webhook deliveries signed with the given
+// secret in RefreshOnWebhook. Without a secret every delivery is refused.
+func WithWebhookSecret(secret string) Option {
+	return func(g *ReleaseManager) {
+		g.webhook.secret = []byte(secret)
+	}
+}
+
+// WithWebhookDebounce sets how long RefreshOnWebhook waits for more events
+// before refreshing, ten seconds by default.
+func WithWebhookDebounce(d time.Duration) Option {
+	return func(g *ReleaseManager) {
+		g.webhook.debounce = d
+	}
+}
+
+// RefreshOnWebhook handles Github webhook deliveries, refreshing the assets
+// soon after a release is published, released, edited or deleted so clients
+// don't wait for the next polling refresh. Deliveries whose
+// X-Hub-Signature-256 doesn't match the secret are refused with 401, other
+// events are ignored with 200. A burst of events triggers a single refresh,
+// and events arriving while one runs trigger at most one more after it.
+func (g *ReleaseManager) RefreshOnWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	payload, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookPayload))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	if !g.validWebhookSignature(r.Header.Get("X-Hub-Signature-256"), payload) {
+		log.Errorf("Refusing webhook delivery %s with a bad signature", r.Header.Get("X-GitHub-Delivery"))
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	if r.Header.Get("X-GitHub-Event") != "release" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var event struct {
+		Action string `json:"action"`
+	}
+	if err = json.Unmarshal(payload, &event); err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if !webhookActions[event.Action] {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if g.closing() {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+
+	log.Debugf("Release %s webhook received, refreshing assets", event.Action)
+	g.scheduleRefresh()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// validWebhookSignature tells whether signature, as "sha256=<hex hmac>", was
+// made with the webhook secret over payload.
+func (g *ReleaseManager) validWebhookSignature(signature string, payload []byte) bool {
+	g.webhook.mu.Lock()
+	secret := g.webhook.secret
+	g.webhook.mu.Unlock()
+
+	if len(secret) == 0 || !strings.HasPrefix(signature, "sha256=") {
+		return false
+	}
+	sum, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	return hmac.Equal(sum, mac.Sum(nil))
+}
+
+// scheduleRefresh refreshes the assets once the debounce delay elapses,
+// unless a refresh is already pending.
+func (g *ReleaseManager) scheduleRefresh() {
+	wr := &g.webhook
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+
+	if wr.timer != nil {
+		return
+	}
+	wr.timer = time.AfterFunc(wr.debounce, g.webhookRefresh)
+}
+
+// stopWebhookRefresh drops the pending refresh, if any.
+func (g *ReleaseManager) stopWebhookRefresh() {
+	wr := &g.webhook
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+
+	if wr.timer != nil {
+		wr.timer.Stop()
+		wr.timer = nil
+	}
+}
+
+// webhookRefresh runs the pending refresh, or has the running one go once
+// more when it's done.
+func (g *ReleaseManager) webhookRefresh() {
+	wr := &g.webhook
+	wr.mu.Lock()
+	wr.timer = nil
+	if wr.running {
+		wr.again = true
+		wr.mu.Unlock()
+		return
+	}
+	wr.running = true
+	wr.mu.Unlock()
+
+	for {
+		// Close waits for the refresh, or aborts it.
+		ctx, done, err := g.begin(context.Background())
+		if err != nil {
+			wr.mu.Lock()
+			wr.running, wr.again = false, false
+			wr.mu.Unlock()
+			return
+		}
+		if err := g.UpdateAssetsMapContext(ctx); err != nil {
+			log.Errorf("Could not refresh assets after a webhook: %q", err)
+		}
+		done()
+
+		wr.mu.Lock()
+		if !wr.again {
+			wr.running = false
+			wr.mu.Unlock()
+			return
+		}
+		wr.again = false
+		wr.mu.Unlock()
+	}
+}
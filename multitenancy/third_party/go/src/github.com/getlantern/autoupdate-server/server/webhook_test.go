@@ -0,0 +1,101 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// sendTestWebhook delivers a Github event to the manager's webhook handler,
+// signed with secret, and returns the response status.
+func sendTestWebhook(g *ReleaseManager, secret string, event string, payload string) int {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+
+	req := httptest.NewRequest("POST", "/webhook", bytes.NewBufferString(payload))
+	req.Header.Set("X-GitHub-Event", event)
+	req.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	rec := httptest.NewRecorder()
+	g.RefreshOnWebhook(rec, req)
+	return rec.Code
+}
+
+func TestRefreshOnWebhook(t *testing.T) {
+	const secret = "webhook-secret"
+	const debounce = 100 * time.Millisecond
+
+	var listed int32
+	unblock := make(chan struct{})
+	blocking := int32(0)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&listed, 1)
+		if atomic.LoadInt32(&blocking) == 1 {
+			<-unblock
+		}
+		w.Write([]byte(`[]`))
+	}))
+	defer api.Close()
+
+	g := NewReleaseManager("getlantern", "autoupdate-server", WithWebhookSecret(secret), WithWebhookDebounce(debounce))
+	useTestGitHub(t, g, api)
+
+	waitListed := func(n int32) {
+		deadline := time.Now().Add(5 * time.Second)
+		for atomic.LoadInt32(&listed) < n {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expecting %d refreshes, got %d", n, atomic.LoadInt32(&listed))
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	if code := sendTestWebhook(g, "wrong", "release", `{"action": "published"}`); code != http.StatusUnauthorized {
+		t.Fatalf("Expecting 401 for a bad signature, got %d", code)
+	}
+	if code := sendTestWebhook(g, secret, "push", `{"ref": "refs/heads/master"}`); code != http.StatusOK {
+		t.Fatalf("Expecting 200 for an unrelated event, got %d", code)
+	}
+	if code := sendTestWebhook(g, secret, "release", `{"action": "created"}`); code != http.StatusOK {
+		t.Fatalf("Expecting 200 for an unrelated action, got %d", code)
+	}
+
+	// A burst of events is a single refresh.
+	for _, action := range []string{"published", "released", "edited", "edited", "deleted"} {
+		if code := sendTestWebhook(g, secret, "release", `{"action": "`+action+`"}`); code != http.StatusAccepted {
+			t.Fatalf("Expecting 202 for a %s release, got %d", action, code)
+		}
+	}
+	waitListed(1)
+	time.Sleep(3 * debounce)
+	if n := atomic.LoadInt32(&listed); n != 1 {
+		t.Fatalf("Expecting a single refresh for a burst of events, got %d", n)
+	}
+
+	// Events arriving during a refresh are one more refresh once it's done.
+	atomic.StoreInt32(&blocking, 1)
+	sendTestWebhook(g, secret, "release", `{"action": "published"}`)
+	waitListed(2)
+	for i := 0; i < 3; i++ {
+		sendTestWebhook(g, secret, "release", `{"action": "edited"}`)
+		time.Sleep(2 * debounce)
+	}
+	atomic.StoreInt32(&blocking, 0)
+	close(unblock)
+	waitListed(3)
+	time.Sleep(3 * debounce)
+	if n := atomic.LoadInt32(&listed); n != 3 {
+		t.Fatalf("Expecting refreshes to coalesce, got %d", n)
+	}
+
+	// Without a secret nothing is trusted.
+	g = NewReleaseManager("getlantern", "autoupdate-server")
+	if code := sendTestWebhook(g, "", "release", `{"action": "published"}`); code != http.StatusUnauthorized {
+		t.Fatalf("Expecting 401 without a secret, got %d", code)
+	}
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// zstdSuffix names the zstd compressed artifact of a patch file next to it.
+const zstdSuffix = ".zst"
+
+// Compression lists the encodings a patch is served in, as clients name them
+// in Params.AcceptedCompression and as Result.Compression tells them.
+var Compression = struct {
+	None string
+	Zstd string
+}{
+	"none",
+	"zstd",
+}
+
+// bzip2Compression names the raw bsdiff output after the compression of its
+// blocks, as some clients do.
+const bzip2Compression = "bzip2"
+
+// acceptedCompression tells which patch encodings the client takes. Clients
+// that don't say only take the raw bsdiff output, unknown encodings are
+// ignored.
+func acceptedCompression(accepted []string) (none bool, zstd bool) {
+	if len(accepted) == 0 {
+		return true, false
+	}
+	for _, c := range accepted {
+		switch c {
+		case Compression.None, bzip2Compression:
+			none = true
+		case Compression.Zstd:
+			zstd = true
+		}
+	}
+	return none, zstd
+}
+
+// zstdPatch returns the zstd compressed artifact of raw, the patch of type t
+// from oldAsset to newAsset, compressing it the first time only. The artifact is
+// cached apart from raw and removed along with it.
+func (g *ReleaseManager) zstdPatch(ctx context.Context, t PatchType, oldAsset *Asset, newAsset *Asset, raw *Patch) (*Patch, error) {
+	key := typedPatchCacheKey(t, oldAsset.URL, newAsset.URL, Compression.Zstd)
+	if p, ok := g.patches.get(key); ok && fileExists(p.File) {
+		return p, nil
+	}
+
+	zfile := raw.File + zstdSuffix
+	p, err := g.patchFlight.do(ctx, zfile, func() (*Patch, error) {
+		if p, ok := cachedPatchFile(zfile); ok {
+			p.Compression = Compression.Zstd
+			return p, nil
+		}
+		ctx, done, err := g.begin(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer done()
+		if err := zstdFile(ctx, raw.File, zfile); err != nil {
+			return nil, err
+		}
+		size, _ := fileSize(zfile)
+		return &Patch{oldfile: raw.oldfile, newfile: raw.newfile, File: zfile, Size: size, Compression: Compression.Zstd}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	g.patches.put(key, p)
+	return p, nil
+}
+
+// zstdFile compresses src into dst with zstd, which is only created once
+// complete. Cancelling ctx kills zstd.
+func zstdFile(ctx context.Context, src string, dst string) error {
+	fp, err := ioutil.TempFile(filepath.Dir(dst), filepath.Base(dst)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	fp.Close()
+	tmpfile := fp.Name()
+
+	cmd := exec.CommandContext(
+		ctx,
+		"zstd",
+		"-q",
+		"-19",
+		"-f",
+		"-o",
+		tmpfile,
+		src,
+	)
+
+	if err := cmd.Run(); err != nil {
+		os.Remove(tmpfile)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("Failed to compress patch with zstd: %q", err)
+	}
+
+	if err := os.Rename(tmpfile, dst); err != nil {
+		os.Remove(tmpfile)
+		return err
+	}
+	return nil
+}
+
+// servedPatch returns the smallest artifact of raw, the patch of type t from
+// oldAsset to newAsset, the client takes. ok is false when it takes none of them, a
+// client only taking zstd is then offered the full binary if compressing
+// fails.
+func (g *ReleaseManager) servedPatch(ctx context.Context, t PatchType, accepted []string, oldAsset *Asset, newAsset *Asset, raw *Patch) (p *Patch, ok bool) {
+	none, zstd := acceptedCompression(accepted)
+	if none {
+		p = raw
+	}
+	if !zstd {
+		return p, p != nil
+	}
+
+	z, err := g.zstdPatch(ctx, t, oldAsset, newAsset, raw)
+	if err != nil {
+		g.logger.Error("Could not compress patch", "patch", raw.File, "compression", Compression.Zstd, "err", err)
+		return p, p != nil
+	}
+	if p == nil || smallerFile(z.File, p.File) {
+		p = z
+	}
+	return p, true
+}
+
+// smallerFile tells whether a is smaller than b, a file that can't be looked
+// at is never smaller.
+func smallerFile(a string, b string) bool {
+	asize, err := fileSize(a)
+	if err != nil {
+		return false
+	}
+	bsize, err := fileSize(b)
+	return err != nil || asize < bsize
+}
+
+// patchArtifact returns how the given patch is encoded and the checksum and
+// signature of the file actually served, for clients to check before
+// decoding it. The signature is empty when the manager has no key.
+func (g *ReleaseManager) patchArtifact(p *Patch) (compression string, checksum string, signature string, err error) {
+	compression = p.Compression
+	if compression == "" {
+		compression = Compression.None
+	}
+	if checksum, err = checksumForFile(p.File); err != nil {
+		return "", "", "", err
+	}
+	if len(g.signingKeys) == 0 && privateKeyFile == "" {
+		return compression, checksum, "", nil
+	}
+	if signature, _, err = g.signAsset(p.File, checksum); err != nil {
+		return "", "", "", err
+	}
+	return compression, checksum, signature, nil
+}
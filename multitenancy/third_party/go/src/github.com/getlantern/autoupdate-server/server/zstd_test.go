@@ -0,0 +1,181 @@
+package server
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/hex"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func requireZstd(t testing.TB) {
+	if _, err := exec.LookPath("zstd"); err != nil {
+		t.Skip("zstd is not installed")
+	}
+}
+
+func TestZstdPatch(t *testing.T) {
+	requireBsdiff(t)
+	requireZstd(t)
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Repetitive binaries leave a lot for zstd to take out of the patch.
+	srv := newTestAssetServer(map[string]string{
+		"/1.0.0": strings.Repeat("lantern 1.0.0 ", 2000),
+		"/1.1.0": strings.Repeat("lantern 1.1.0 ", 2000),
+	})
+	defer srv.Close()
+
+	g := NewReleaseManager("getlantern", "autoupdate-server", WithSigningKeys(NewRSASigningKey("rsa-2015", key)))
+	g.SetMaxPatchRatio(0)
+	if err := g.SetPatchCacheDir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	for _, tag := range []string{"1.0.0", "1.1.0"} {
+		asset := &Asset{Name: "autoupdate-binary-linux-amd64", URL: srv.URL + "/" + tag}
+		asset.v, _ = parseVersion(tag)
+		if err := g.pushAsset(OS.Linux, Arch.X64, asset); err != nil {
+			t.Fatal(err)
+		}
+	}
+	current := g.updateAssetsMap[OS.Linux][Arch.X64]["1.0.0"]
+	update := g.updateAssetsMap[OS.Linux][Arch.X64]["1.1.0"]
+
+	check := func(accepted ...string) *Result {
+		res, err := g.CheckForUpdate(&Params{AppVersion: "1.0.0", OS: OS.Linux, Arch: Arch.X64, Checksum: current.Checksum, AcceptedCompression: accepted})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.UpdateType != UPDATETYPE_PATCH || res.PatchType != PATCHTYPE_BSDIFF {
+			t.Fatalf("Expecting a bsdiff patch, got %+v", res)
+		}
+		return res
+	}
+
+	// apply decodes the patch of res, applies it to the old asset and
+	// checks the result is the new asset.
+	apply := func(res *Result) {
+		patchfile := filepath.Join(g.PatchCacheDir(), filepath.Base(res.PatchURL))
+		if res.Compression != "" {
+			checksum, err := checksumForFile(patchfile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if checksum != res.PatchChecksum {
+				t.Fatalf("Expecting the checksum of the served patch %s, got %s", checksum, res.PatchChecksum)
+			}
+			sum, _ := hex.DecodeString(checksum)
+			sig, _ := hex.DecodeString(res.PatchSignature)
+			if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, sum, sig); err != nil {
+				t.Fatalf("Expecting the served patch to be signed: %q", err)
+			}
+		}
+		if res.Compression == Compression.Zstd {
+			decoded := filepath.Join(t.TempDir(), "patch")
+			if out, err := exec.Command("zstd", "-d", "-q", "-f", "-o", decoded, patchfile).CombinedOutput(); err != nil {
+				t.Fatalf("Could not decompress patch: %q %s", err, out)
+			}
+			patchfile = decoded
+		}
+
+		oldfile, err := downloadAsset(current.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		patched := filepath.Join(t.TempDir(), "patched")
+		if err := bspatch(oldfile, patched, patchfile); err != nil {
+			t.Fatal(err)
+		}
+		if checksum, _ := checksumForFile(patched); checksum != update.Checksum {
+			t.Fatalf("Expecting the patched binary to be 1.1.0, got checksum %s", checksum)
+		}
+	}
+
+	// Clients that don't say get the bsdiff output as they always did.
+	res := check()
+	if res.Compression != "" || res.PatchChecksum != "" || res.PatchSignature != "" || strings.HasSuffix(res.PatchURL, zstdSuffix) {
+		t.Fatalf("Expecting the raw patch, got %+v", res)
+	}
+	apply(res)
+	raw := res.PatchSize
+
+	res = check(Compression.Zstd, Compression.None)
+	if res.Compression != Compression.Zstd || !strings.HasSuffix(res.PatchURL, zstdSuffix) {
+		t.Fatalf("Expecting the smaller zstd patch, got %+v", res)
+	}
+	if res.PatchSize >= raw {
+		t.Fatalf("Expecting the zstd patch to be smaller than %d bytes, got %d", raw, res.PatchSize)
+	}
+	apply(res)
+
+	res = check(Compression.None)
+	if res.Compression != Compression.None || strings.HasSuffix(res.PatchURL, zstdSuffix) || res.PatchSize != raw {
+		t.Fatalf("Expecting the raw patch, got %+v", res)
+	}
+	apply(res)
+
+	// The raw patch goes by the compression of its blocks too.
+	if res = check(bzip2Compression); res.Compression != Compression.None || res.PatchSize != raw {
+		t.Fatalf("Expecting the raw patch for bzip2, got %+v", res)
+	}
+	if res = check(Compression.Zstd, bzip2Compression); res.Compression != Compression.Zstd {
+		t.Fatalf("Expecting the smaller zstd patch, got %+v", res)
+	}
+
+	// Each encoding is cached on its own.
+	none, ok := g.patches.get(patchCacheKey(current.URL, update.URL, Compression.None))
+	if !ok || none.Compression != "" {
+		t.Fatalf("Expecting the raw patch to be cached, got %+v", none)
+	}
+	zstd, ok := g.patches.get(patchCacheKey(current.URL, update.URL, Compression.Zstd))
+	if !ok || zstd.Compression != Compression.Zstd || zstd.File != none.File+zstdSuffix {
+		t.Fatalf("Expecting the zstd patch to be cached apart, got %+v", zstd)
+	}
+
+	// Random bytes don't compress, the raw patch is smaller unless the
+	// client only takes zstd.
+	g, current, update = newTestUpdatePair(t, nil)
+	g.SetMaxPatchRatio(0)
+	if err := g.SetPatchCacheDir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	if res = check(Compression.Zstd, Compression.None); res.Compression != Compression.None {
+		t.Fatalf("Expecting the smaller raw patch, got %+v", res)
+	}
+	if res = check(Compression.Zstd); res.Compression != Compression.Zstd || res.PatchSignature == "" {
+		t.Fatalf("Expecting a signed zstd patch, got %+v", res)
+	}
+
+	// Unknown encodings leave nothing to serve but the full binary.
+	res, err = g.CheckForUpdate(&Params{AppVersion: "1.0.0", OS: OS.Linux, Arch: Arch.X64, Checksum: current.Checksum, AcceptedCompression: []string{"br"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.UpdateType != UPDATETYPE_FULL || res.PatchURL != "" || res.Compression != "" {
+		t.Fatalf("Expecting a full update, got %+v", res)
+	}
+}
+
+func TestAcceptedCompression(t *testing.T) {
+	for _, c := range []struct {
+		accepted   []string
+		none, zstd bool
+	}{
+		{nil, true, false},
+		{[]string{Compression.Zstd}, false, true},
+		{[]string{Compression.Zstd, bzip2Compression}, true, true},
+		{[]string{bzip2Compression}, true, false},
+		{[]string{"br"}, false, false},
+	} {
+		if none, zstd := acceptedCompression(c.accepted); none != c.none || zstd != c.zstd {
+			t.Fatalf("Expecting %v, %v for %q, got %v, %v", c.none, c.zstd, c.accepted, none, zstd)
+		}
+	}
+}